@@ -43,6 +43,8 @@ func initramfs(goos string, arch string) error {
 	if err != nil {
 		return err
 	}
+	// An archive given up on halfway is still one.
+	defer init.Close()
 
 	// Paths contains the paths to put into the initramfs. The index is a
 	// root directory, and the value is the place from which to walk.
@@ -95,7 +97,7 @@ func initramfs(goos string, arch string) error {
 		}
 	}
 
-	if err := init.WriteTrailer(); err != nil {
+	if err := init.Close(); err != nil {
 		return err
 	}
 
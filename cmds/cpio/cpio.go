@@ -14,7 +14,7 @@
 // Options:
 //     o: output an archive to stdout given a pattern
 //     i: output files from a stdin stream
-//     t: print table of contents
+//     t: print table of contents, as cpio -itvn does with -v
 //     -v: debug prints
 //
 // Bugs: in i mode, it can't use non-seekable stdin, i.e. a pipe. Yep, this sucks.
@@ -28,18 +28,18 @@ package main
 import (
 	"bufio"
 	"flag"
-	"fmt"
 	"io"
 	"log"
 	"os"
 
 	"github.com/u-root/u-root/pkg/cpio"
 	_ "github.com/u-root/u-root/pkg/cpio/newc"
+	_ "github.com/u-root/u-root/pkg/cpio/tar"
 )
 
 var (
 	debug  = func(string, ...interface{}) {}
-	d      = flag.Bool("v", false, "Debug prints")
+	d      = flag.Bool("v", false, "Debug prints, and a long table of contents")
 	format = flag.String("H", "newc", "format")
 )
 
@@ -68,6 +68,7 @@ func main() {
 	switch op {
 	case "i":
 		rr := archiver.Reader(os.Stdin)
+		var l cpio.Linker
 		for {
 			rec, err := rr.ReadRecord()
 			if err == io.EOF {
@@ -77,7 +78,7 @@ func main() {
 				log.Fatalf("error reading records: %v", err)
 			}
 			debug("Creating %s\n", rec)
-			if err := cpio.CreateFile(rec); err != nil {
+			if err := l.CreateFile(rec); err != nil {
 				log.Printf("Creating %q failed: %v", rec.Name, err)
 			}
 		}
@@ -88,7 +89,11 @@ func main() {
 
 		for scanner.Scan() {
 			name := scanner.Text()
-			rec, err := cpio.GetRecord(name)
+			rec, err := cpio.NewRecordFromPath(name, name)
+			if _, ok := err.(*cpio.SkipError); ok {
+				log.Printf("Skipping %v", err)
+				continue
+			}
 			if err != nil {
 				log.Fatalf("Getting record of %q failed: %v", name, err)
 			}
@@ -105,16 +110,8 @@ func main() {
 		}
 
 	case "t":
-		rr := archiver.Reader(os.Stdin)
-		for {
-			rec, err := rr.ReadRecord()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				log.Fatalf("error reading records: %v", err)
-			}
-			fmt.Println(rec)
+		if _, _, err := cpio.ListTo(os.Stdout, archiver.Reader(os.Stdin), *d); err != nil {
+			log.Fatalf("error reading records: %v", err)
 		}
 
 	default:
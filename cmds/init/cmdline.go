@@ -0,0 +1,88 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The kernel command line can change what init does at boot, without
+// rebuilding the image, with these arguments:
+//
+//	uroot.initflags="-v -test"   more flags for init, as if it were given them
+//	uroot.uinit=/bin/sh          run this instead of uinit, after any /inito
+//	uroot.uinitargs="-c 'a b'"   the arguments for uinit, in place of /etc/uinit.args
+//	uroot.nomount=/dev,/run      do not mount these; see rootfs
+//	uroot.mount=none:/run:tmpfs  mount this; see rootfs
+//	uroot.modules=a,b            load these kernel modules, after those of /etc/modules
+//	uroot.nonetwork              tell the uinit not to bring up networking
+//	uroot.debug                  print what init is doing
+//	uroot.nobgbuild              do not build the commands in the background
+//
+// The words of uroot.initflags and uroot.uinitargs are split as
+// cmdline.Fields does, so a word in single quotes may have spaces in it. A
+// flag, such as uroot.debug, may also be given a value as strconv.ParseBool
+// takes, e.g. uroot.debug=0. Any other uroot.* argument is warned about.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+
+	"github.com/u-root/u-root/pkg/cmdline"
+)
+
+// noNetworkEnv is set to 1 in the environment of the commands init runs if
+// uroot.nonetwork is given. Init brings up no networking itself; it is for a
+// uinit that does.
+const noNetworkEnv = "UROOT_NONETWORK"
+
+// urootArgs are the uroot.* arguments init knows.
+var urootArgs = map[string]bool{
+	"uroot.initflags": true,
+	"uroot.uinit":     true,
+	"uroot.uinitargs": true,
+	"uroot.nomount":   true,
+	"uroot.mount":     true,
+	"uroot.modules":   true,
+	"uroot.nonetwork": true,
+	"uroot.debug":     true,
+	"uroot.nobgbuild": true,
+}
+
+// bootArgs are the kernel command line; /proc must be mounted before it
+// is read.
+var bootArgs = &cmdline.CmdLine{}
+
+// readCmdline reads the kernel command line into bootArgs, and does as its
+// uroot.initflags and uroot.debug say. It warns of uroot.* arguments it does
+// not know.
+func readCmdline() {
+	c, err := cmdline.Read()
+	if err != nil {
+		log.Printf("Warning: kernel command line: %v", err)
+		return
+	}
+	bootArgs = c
+	for _, a := range c.Prefix("uroot.") {
+		if !urootArgs[a.Key] {
+			log.Printf("Warning: unknown kernel command line argument %q; ignoring it", a.Key)
+		}
+	}
+	if f, ok := c.Get("uroot.initflags"); ok {
+		// flag.CommandLine exits on an error, which init must not.
+		// Nor is init's usage any help on the console; the error is.
+		fs := flag.NewFlagSet("uroot.initflags", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+		if err := fs.Parse(cmdline.Fields(f)); err != nil {
+			log.Printf("Warning: uroot.initflags=%q: %v", f, err)
+		}
+	}
+	if c.Flag("uroot.debug") {
+		debug = log.Printf
+	}
+}
+
+// uinitPath returns the uinit given by uroot.uinit, or "" if there is none.
+func uinitPath() string {
+	u, _ := bootArgs.Get("uroot.uinit")
+	return u
+}
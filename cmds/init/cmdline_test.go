@@ -0,0 +1,135 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cmdline"
+)
+
+func TestReadCmdline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string, a *cmdline.CmdLine, v, tst bool, d func(string, ...interface{})) {
+		cmdline.Path, bootArgs, *verbose, *test, debug = p, a, v, tst, d
+	}(cmdline.Path, bootArgs, *verbose, *test, debug)
+	defer log.SetOutput(os.Stderr)
+	cmdline.Path = filepath.Join(dir, "cmdline")
+
+	for _, tt := range []struct {
+		cmdline       string
+		verbose, test bool
+		debug         bool
+		warnings      []string
+	}{
+		{cmdline: "console=ttyS0 quiet"},
+		{
+			cmdline: `uroot.initflags="-v -test" uroot.debug`,
+			verbose: true, test: true, debug: true,
+		},
+		{cmdline: "uroot.initflags=-test uroot.debug=0", test: true},
+		{
+			cmdline:  "uroot.uinti=/bin/sh uroot.nonetwork uroot.Debug uroot",
+			warnings: []string{`unknown kernel command line argument "uroot.uinti"`, `unknown kernel command line argument "uroot.Debug"`},
+		},
+		{
+			cmdline:  "uroot.initflags=-nosuchflag",
+			warnings: []string{`uroot.initflags="-nosuchflag": flag provided but not defined: -nosuchflag`},
+		},
+		{
+			cmdline:  "uroot.initflags='-v=maybe'",
+			warnings: []string{`uroot.initflags="'-v=maybe'": invalid boolean value "maybe" for -v`},
+		},
+	} {
+		*verbose, *test, debug = false, false, func(string, ...interface{}) {}
+		if err := ioutil.WriteFile(cmdline.Path, []byte(tt.cmdline+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		readCmdline()
+		if bootArgs.Raw != tt.cmdline+"\n" {
+			t.Errorf("%s: bootArgs is %q", tt.cmdline, bootArgs.Raw)
+		}
+		if *verbose != tt.verbose || *test != tt.test {
+			t.Errorf("%s: -v is %v, -test %v, want %v, %v", tt.cmdline, *verbose, *test, tt.verbose, tt.test)
+		}
+		logs.Reset()
+		debug("debugging")
+		if d := logs.Len() > 0; d != tt.debug {
+			t.Errorf("%s: debug logs %v, want %v", tt.cmdline, d, tt.debug)
+		}
+
+		logs.Reset()
+		readCmdline()
+		var warnings []string
+		for _, l := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			if i := strings.Index(l, "Warning: "); i >= 0 {
+				warnings = append(warnings, strings.TrimSuffix(l[i+len("Warning: "):], "; ignoring it"))
+			}
+		}
+		ok := len(warnings) == len(tt.warnings)
+		for i := 0; ok && i < len(warnings); i++ {
+			ok = strings.HasPrefix(warnings[i], tt.warnings[i])
+		}
+		if !ok {
+			t.Errorf("%s: warnings %q, want %q", tt.cmdline, warnings, tt.warnings)
+		}
+	}
+
+	// Without a command line, there is a warning, and nothing else.
+	os.Remove(cmdline.Path)
+	bootArgs = &cmdline.CmdLine{}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	readCmdline()
+	if !strings.Contains(logs.String(), "Warning: kernel command line:") || len(bootArgs.Args) != 0 {
+		t.Errorf("without %s: logged %q, bootArgs %+v", cmdline.Path, logs.String(), bootArgs)
+	}
+}
+
+func TestUinitArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(f string, a *cmdline.CmdLine) { uinitArgsFile, bootArgs = f, a }(uinitArgsFile, bootArgs)
+	uinitArgsFile = filepath.Join(dir, "uinit.args")
+
+	for _, tt := range []struct {
+		cmdline, file string
+		want          []string
+	}{
+		{"", "", nil},
+		{"", "-c 'echo hi'\n", []string{"-c", "echo hi"}},
+		{`uroot.uinitargs="-c 'echo hi' -x"`, "-y\n", []string{"-c", "echo hi", "-x"}},
+		{"uroot.uinitargs=-v", "", []string{"-v"}},
+		// An empty uroot.uinitargs is none, not those of the file.
+		{"uroot.uinitargs=", "-y\n", nil},
+	} {
+		os.Remove(uinitArgsFile)
+		if tt.file != "" {
+			if err := ioutil.WriteFile(uinitArgsFile, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bootArgs = cmdline.New(tt.cmdline)
+		if got := uinitArgs(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("uinitArgs() with %q and a file of %q: got %q, want %q", tt.cmdline, tt.file, got, tt.want)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/u-root/u-root/pkg/cmdline"
 	"github.com/u-root/u-root/uroot"
 )
 
@@ -34,57 +35,26 @@ func main() {
 	a := []string{"build"}
 	flag.Parse()
 	log.Printf("Welcome to u-root")
-	uroot.Rootfs()
+	rootfs()
+	loadModules()
 
 	if *verbose {
 		debug = log.Printf
 		a = append(a, "-x")
 	}
 
-	// populate buildbin
+	// Without a toolchain, the commands were built ahead of time into
+	// /bbin (busybox mode) or /bin, and there is nothing to install.
+	_, err := os.Stat("/go/bin/go")
+	prebuilt := err != nil
 
-	// In earlier versions we just had src/cmds. Due to the Go rules it seems we need to
-	// embed the URL of the repo everywhere. Yuck.
-	c, err := filepath.Glob("/src/github.com/u-root/u-root/cmds/[a-z]*")
-	if err != nil || len(c) == 0 {
-		log.Printf("In a break with tradition, you seem to have NO u-root commands: %v", err)
-	}
-	o, err := filepath.Glob("/src/*/*/*")
-	if err != nil {
-		log.Printf("Your filepath glob for other commands seems busted: %v", err)
-	}
-	c = append(c, o...)
-	for _, v := range c {
-		name := filepath.Base(v)
-		if name == "installcommand" || name == "init" {
-			continue
-		} else {
-			destPath := filepath.Join("/buildbin", name)
-			source := "/buildbin/installcommand"
-			if err := os.Symlink(source, destPath); err != nil {
-				log.Printf("Symlink %v -> %v failed; %v", source, destPath, err)
-			}
-			if *ludicrous {
-				log.Printf("Symlink %v -> %v", source, destPath)
-			}
-		}
-	}
 	envs := uroot.Envs
+	if bootArgs.Flag("uroot.nonetwork") {
+		envs = append(envs, noNetworkEnv+"=1")
+	}
 	debug("envs %v", envs)
-	os.Setenv("GOBIN", "/buildbin")
-	a = append(a, "-o", "/buildbin/installcommand", filepath.Join(uroot.CmdsPath, "installcommand"))
-	cmd := exec.Command("go", a...)
-	installenvs := envs
-	installenvs = append(envs, "GOBIN=/buildbin")
-	cmd.Env = installenvs
-	cmd.Dir = "/"
-
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	debug("Run %v", cmd)
-	if err := cmd.Run(); err != nil {
-		log.Printf("%v\n", err)
+	if !prebuilt {
+		installBuildbin(a, envs)
 	}
 
 	// Before entering an interactive shell, decrease the loglevel because
@@ -123,7 +93,7 @@ func main() {
 	}
 
 	// Start background build.
-	if isBgBuildEnabled() {
+	if !prebuilt && !bootArgs.Flag("uroot.nobgbuild") {
 		go startBgBuild()
 	}
 
@@ -132,12 +102,25 @@ func main() {
 	// run inito and then run our shell
 	// inito is always first and we set default flags for it.
 	cloneFlags := uintptr(syscall.CLONE_NEWPID)
-	cmdList := []string{"/inito", "/buildbin/uinit", "/buildbin/rush"}
+	// A prebuilt /bin/uinit, e.g. from the -uinit of scripts/ramfs.go,
+	// runs in any mode.
+	cmdList := []string{"/inito", "/bin/uinit", "/buildbin/uinit", "/buildbin/rush"}
+	if prebuilt {
+		cmdList = []string{"/inito", "/bbin/uinit", "/bbin/rush", "/bin/uinit", "/bin/rush"}
+	}
+	// uroot.uinit is run in place of the rest.
+	if u := uinitPath(); u != "" {
+		cmdList = []string{"/inito", u}
+	}
 	noCmdFound := true
 	for _, v := range cmdList {
 		if _, err := os.Stat(v); !os.IsNotExist(err) {
 			noCmdFound = false
-			cmd = exec.Command(v)
+			var args []string
+			if v != "/inito" && (filepath.Base(v) == "uinit" || v == uinitPath()) {
+				args = uinitArgs()
+			}
+			cmd := exec.Command(v, args...)
 			cmd.Env = envs
 			cmd.Stdin = os.Stdin
 			cmd.Stderr = os.Stderr
@@ -165,3 +148,77 @@ func main() {
 	syscall.Sync()
 	log.Printf("init: Exiting...")
 }
+
+// uinitArgsFile has the arguments for uinit, if uroot.uinitargs does not.
+var uinitArgsFile = "/etc/uinit.args"
+
+// uinitArgs returns the arguments for uinit, which are the words of
+// uroot.uinitargs, or else of uinitArgsFile if there is one, split as
+// cmdline.Fields does, so that a word in single quotes can have spaces.
+func uinitArgs() []string {
+	if a, ok := bootArgs.Get("uroot.uinitargs"); ok {
+		return cmdline.Fields(a)
+	}
+	b, err := ioutil.ReadFile(uinitArgsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(err)
+		}
+		return nil
+	}
+	return cmdline.Fields(string(b))
+}
+
+// installBuildbin populates /buildbin with symlinks to installcommand, and
+// builds installcommand, so that commands are compiled on first use.
+func installBuildbin(a []string, envs []string) {
+	// populate buildbin
+
+	// In earlier versions we just had src/cmds. Due to the Go rules it seems we need to
+	// embed the URL of the repo everywhere. Yuck.
+	c, err := filepath.Glob("/src/github.com/u-root/u-root/cmds/[a-z]*")
+	if err != nil || len(c) == 0 {
+		log.Printf("In a break with tradition, you seem to have NO u-root commands: %v", err)
+	}
+	o, err := filepath.Glob("/src/*/*/*")
+	if err != nil {
+		log.Printf("Your filepath glob for other commands seems busted: %v", err)
+	}
+	c = append(c, o...)
+	// Commands deeper in /src are listed.
+	if b, err := ioutil.ReadFile(uroot.CmdsList); err == nil {
+		for _, p := range strings.Fields(string(b)) {
+			c = append(c, filepath.Join("/src", p))
+		}
+	}
+	for _, v := range c {
+		name := filepath.Base(v)
+		if name == "installcommand" || name == "init" {
+			continue
+		} else {
+			destPath := filepath.Join("/buildbin", name)
+			source := "/buildbin/installcommand"
+			if err := os.Symlink(source, destPath); err != nil {
+				log.Printf("Symlink %v -> %v failed; %v", source, destPath, err)
+			}
+			if *ludicrous {
+				log.Printf("Symlink %v -> %v", source, destPath)
+			}
+		}
+	}
+	os.Setenv("GOBIN", "/buildbin")
+	a = append(a, "-o", "/buildbin/installcommand", filepath.Join(uroot.CmdsPath, "installcommand"))
+	cmd := exec.Command("go", a...)
+	installenvs := envs
+	installenvs = append(envs, "GOBIN=/buildbin")
+	cmd.Env = installenvs
+	cmd.Dir = "/"
+
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	debug("Run %v", cmd)
+	if err := cmd.Run(); err != nil {
+		log.Printf("%v\n", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/kmodule"
+)
+
+// modulesDryRunEnv, if set, has init log the modules it would load, in the
+// order it would load them, and not load them.
+const modulesDryRunEnv = "UROOT_MODULES_DRYRUN"
+
+var (
+	// modulesFile lists the kernel modules to load at boot, as
+	// /etc/modules does: a name on each line, and any options for the
+	// module after it.
+	modulesFile = "/etc/modules"
+
+	// modulesRoot has the modules of each kernel release, the running
+	// one of which osRelease has.
+	modulesRoot = "/lib/modules"
+	osRelease   = "/proc/sys/kernel/osrelease"
+)
+
+// module is a module to load, with its options.
+type module struct {
+	name string
+	opts string
+}
+
+// bootModules returns the modules of modulesFile, and then those of
+// uroot.modules=name,name,...
+func bootModules() []module {
+	var mods []module
+	f, err := os.Open(modulesFile)
+	if err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			l := strings.Fields(s.Text())
+			if len(l) == 0 || strings.HasPrefix(l[0], "#") {
+				continue
+			}
+			mods = append(mods, module{name: l[0], opts: strings.Join(l[1:], " ")})
+		}
+		if err := s.Err(); err != nil {
+			log.Printf("%s: %v", modulesFile, err)
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		log.Print(err)
+	}
+	if m, ok := bootArgs.Get("uroot.modules"); ok {
+		for _, n := range strings.Split(m, ",") {
+			if n != "" {
+				mods = append(mods, module{name: n})
+			}
+		}
+	}
+	return mods
+}
+
+// loadModules loads the boot modules, from /lib/modules/<release>, if there
+// is one, each after the modules it needs, as modules.dep says. A module
+// that can not be loaded, or needs one that could not, is logged and
+// skipped. A dry run only finds whether the module's file is there.
+func loadModules() {
+	r, err := ioutil.ReadFile(osRelease)
+	if err != nil {
+		log.Printf("Not loading modules: %v", err)
+		return
+	}
+	dir := filepath.Join(modulesRoot, strings.TrimSpace(string(r)))
+	if _, err := os.Stat(dir); err != nil {
+		debug("Not loading modules: %v", err)
+		return
+	}
+	mods := bootModules()
+	if len(mods) == 0 {
+		return
+	}
+	t, err := kmodule.OpenTree(dir)
+	if err != nil {
+		log.Printf("Not loading modules: %v", err)
+		return
+	}
+
+	_, dryRun := os.LookupEnv(modulesDryRunEnv)
+	var (
+		done   = make(map[string]bool)
+		failed = make(map[string]bool)
+	)
+	for _, bm := range mods {
+		c, err := t.Closure([]string{bm.name})
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+	modules:
+		for _, m := range c {
+			if done[m.Name] {
+				continue
+			}
+			done[m.Name] = true
+			for _, d := range m.Deps {
+				if failed[d] {
+					log.Printf("Warning: not loading module %s, which needs %s", m.Name, d)
+					failed[m.Name] = true
+					continue modules
+				}
+			}
+			// Only the module asked for is given the options.
+			var opts string
+			if m.Name == kmodule.ModuleName(bm.name) {
+				opts = bm.opts
+			}
+			if dryRun {
+				if _, err := os.Stat(m.Src); err != nil {
+					log.Printf("Warning: loading module %s: %v", m.Name, err)
+					failed[m.Name] = true
+					continue
+				}
+				log.Printf("Would load module %s %q from %s", m.Name, opts, m.Src)
+				continue
+			}
+			if _, err := os.Stat(filepath.Join("/sys/module", m.Name)); err == nil {
+				debug("Module %s is already loaded", m.Name)
+				continue
+			}
+			debug("Loading module %s %q from %s", m.Name, opts, m.Src)
+			if err := kmodule.Load(m.Src, opts); err != nil {
+				log.Printf("Warning: loading module %s: %v", m.Name, err)
+				failed[m.Name] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cmdline"
+)
+
+func TestLoadModulesDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(f, r, o string, a *cmdline.CmdLine) {
+		modulesFile, modulesRoot, osRelease, bootArgs = f, r, o, a
+	}(modulesFile, modulesRoot, osRelease, bootArgs)
+	modulesFile = filepath.Join(dir, "modules")
+	modulesRoot = filepath.Join(dir, "lib/modules")
+	osRelease = filepath.Join(dir, "osrelease")
+	bootArgs = cmdline.New("uroot.modules=e,nosuch,f")
+
+	tree := filepath.Join(modulesRoot, "4.13.0")
+	// missing.ko is in modules.dep, but not there, so d, which needs
+	// it, and e, which needs d, are not loaded either.
+	files := map[string]string{
+		osRelease: "4.13.0\n",
+		modulesFile: `# Loaded first.
+a debug=1
+`,
+		filepath.Join(tree, "modules.dep"): `kernel/a.ko: kernel/b.ko kernel/c.ko
+kernel/b.ko: kernel/c.ko
+kernel/c.ko:
+kernel/d.ko: kernel/missing.ko
+kernel/missing.ko:
+kernel/e.ko: kernel/d.ko kernel/missing.ko
+kernel/f.ko: kernel/c.ko
+`,
+	}
+	for _, m := range []string{"a", "b", "c", "d", "e", "f"} {
+		files[filepath.Join(tree, "kernel", m+".ko")] = ""
+	}
+	for n, c := range files {
+		if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(n, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer os.Unsetenv(modulesDryRunEnv)
+	os.Setenv(modulesDryRunEnv, "1")
+	var b bytes.Buffer
+	defer log.SetOutput(os.Stderr)
+	log.SetOutput(&b)
+	defer func(f int) { log.SetFlags(f) }(log.Flags())
+	log.SetFlags(0)
+	loadModules()
+
+	var got []string
+	re := regexp.MustCompile(`^Would load module (\w+) "([^"]*)"`)
+	for _, l := range strings.Split(b.String(), "\n") {
+		if m := re.FindStringSubmatch(l); m != nil {
+			got = append(got, strings.TrimSpace(m[1]+" "+m[2]))
+		}
+	}
+	// c is loaded once, and only a is given options.
+	if want := []string{"c", "b", "a debug=1", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %q, want %q; logged:\n%s", got, want, b.String())
+	}
+	for _, w := range []string{
+		"Warning: loading module missing:",
+		"Warning: not loading module d, which needs missing",
+		"Warning: not loading module e, which needs d",
+		"Warning: modules not found in 4.13.0: nosuch",
+	} {
+		if !strings.Contains(b.String(), w) {
+			t.Errorf("no %q in what was logged:\n%s", w, b.String())
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/u-root/u-root/uroot"
+)
+
+// rootfs builds the root file system, with the uroot.Mounts as uroot.Fstab
+// and then the command line change them:
+//
+//	uroot.nomount=/dev,/sys/fs/cgroup     do not mount these
+//	uroot.mount=none:/run:tmpfs:size=64m  mount this, as an fstab line with
+//	                                      colons for spaces; may be repeated
+//
+// /proc is mounted first, so that the command line can be read, whatever
+// it says. If a Required mount fails, init runs an
+// emergency shell, and goes no further.
+func rootfs() {
+	mounts := uroot.Mounts
+	if f, err := os.Open(uroot.Fstab); err == nil {
+		m, err := uroot.ApplyFstab(mounts, f)
+		f.Close()
+		if err != nil {
+			log.Printf("Warning: %s: %v; ignoring it", uroot.Fstab, err)
+		} else {
+			mounts = m
+		}
+	} else if !os.IsNotExist(err) {
+		log.Print(err)
+	}
+
+	for _, m := range mounts {
+		if m.Target != "/proc" {
+			continue
+		}
+		if err := m.Create(); err != nil && m.Required {
+			emergencyShell(fmt.Errorf("could not mount /proc: %v", err))
+		}
+	}
+	readCmdline()
+
+	if n, ok := bootArgs.Get("uroot.nomount"); ok {
+		mounts = uroot.WithoutMounts(mounts, strings.Split(n, ",")...)
+	}
+	for _, a := range bootArgs.Args {
+		if a.Key != "uroot.mount" {
+			continue
+		}
+		m, err := uroot.ApplyFstab(mounts, strings.NewReader(strings.Replace(a.Value, ":", " ", -1)))
+		if err != nil {
+			log.Printf("Warning: uroot.mount=%q: %v; ignoring it", a.Value, err)
+			continue
+		}
+		mounts = m
+	}
+
+	if err := uroot.RootfsMounts(mounts); err != nil {
+		emergencyShell(err)
+	}
+}
+
+// emergencyShell runs a shell, since err leaves the system in no state to
+// boot, and exits once it does.
+func emergencyShell(err error) {
+	log.Printf("init: %v; starting an emergency shell", err)
+	for _, sh := range []string{"/bbin/rush", "/bin/rush", "/bin/sh"} {
+		if _, err := os.Stat(sh); err != nil {
+			continue
+		}
+		cmd := exec.Command(sh)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = os.Stdout
+		if !*test {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setctty: true, Setsid: true}
+		}
+		if err := cmd.Run(); err != nil {
+			log.Print(err)
+		}
+		break
+	}
+	log.Printf("init: Syncing filesystems")
+	syscall.Sync()
+	log.Printf("init: Exiting...")
+	os.Exit(1)
+}
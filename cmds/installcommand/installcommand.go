@@ -29,9 +29,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 	"syscall"
@@ -171,7 +173,16 @@ func main() {
 	// and the glob will find it. If we get to the point that the glob
 	// no longer works we can go with filepath.Walk (which glob uses anyway)
 	// but for now this works.
+	// Commands deeper in /src, which the glob can not find, are listed
+	// in uroot.CmdsList.
 	src := filepath.Join("/src", uroot.CmdsPath, form.cmdName)
+	if b, err := ioutil.ReadFile(uroot.CmdsList); err == nil {
+		for _, p := range strings.Fields(string(b)) {
+			if path.Base(p) == form.cmdName {
+				src = filepath.Join("/src", p)
+			}
+		}
+	}
 	if _, err := os.Stat(src); err != nil {
 		l, err := filepath.Glob(filepath.Join("/src/*/*/", form.cmdName))
 		if err != nil || len(l) == 0 {
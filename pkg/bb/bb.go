@@ -0,0 +1,291 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bb turns a set of Go commands into one busybox-style binary.
+//
+// Each command's main package is rewritten into a library package: main
+// becomes Main, init functions are only run when the command is invoked,
+// and uses of the global flag.CommandLine are redirected to a FlagSet
+// private to the command so flags of different commands do not collide.
+// A generated main package then dispatches on the base name of os.Args[0],
+// so the binary is used through symlinks named after the commands.
+package bb
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"golang.org/x/tools/imports"
+)
+
+// flagSetName is the name of the per-command FlagSet.
+const flagSetName = "bbFlagSet"
+
+var (
+	// flagSetSelectors are the names in package flag that also exist on
+	// a *flag.FlagSet and hence have to be redirected to it.
+	flagSetSelectors = map[string]bool{"Usage": true}
+
+	setupTmpl = template.Must(template.New("setup").Parse(`package {{.Name}}
+
+import "flag"
+
+var {{.FlagSet}} = flag.NewFlagSet("{{.Name}}", flag.ExitOnError)
+
+// Init runs the init functions of the original command.
+func Init() {
+{{range .Inits}}	{{.}}()
+{{end}}}
+`))
+
+	mainTmpl = template.Must(template.New("main").Parse(`package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+{{range .}}
+	cmd_{{.Name}} "{{.Path}}"{{end}}
+)
+
+var cmds = map[string]struct{ init, main func() }{
+{{range .}}	"{{.Name}}": {cmd_{{.Name}}.Init, cmd_{{.Name}}.Main},
+{{end}}}
+
+func main() {
+	name := filepath.Base(os.Args[0])
+	// Allow "bb cmd args" as well as invocation through a symlink.
+	if _, ok := cmds[name]; !ok && len(os.Args) > 1 {
+		os.Args = os.Args[1:]
+		name = filepath.Base(os.Args[0])
+	}
+	c, ok := cmds[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "bb: %q is not a known command\n", name)
+		os.Exit(1)
+	}
+	c.init()
+	c.main()
+}
+`))
+)
+
+func init() {
+	t := reflect.TypeOf(&flag.FlagSet{})
+	for i := 0; i < t.NumMethod(); i++ {
+		flagSetSelectors[t.Method(i).Name] = true
+	}
+	// These are methods, but also types in package flag.
+	delete(flagSetSelectors, "ErrorHandling")
+}
+
+// Command is a main package to be compiled into the busybox binary.
+type Command struct {
+	// Name is the name the command is invoked as.
+	Name string
+
+	// Dir is the directory containing the command's source.
+	Dir string
+}
+
+type genCommand struct {
+	Name string
+	Path string
+}
+
+// Generate writes a busybox main package for cmds, with import path pkg, into
+// the GOPATH-style tree rooted at gopath. The rewritten commands are put
+// at pkg/cmds/<name>. The files of each command are chosen with ctx, so that
+// build constraints are evaluated for the target and not the host.
+func Generate(ctx *build.Context, gopath, pkg string, cmds []Command) error {
+	seen := make(map[string]string)
+	for _, c := range cmds {
+		if prev, ok := seen[c.Name]; ok {
+			return fmt.Errorf("command %q is in both %q and %q", c.Name, prev, c.Dir)
+		}
+		seen[c.Name] = c.Dir
+	}
+
+	var gen []genCommand
+	for _, c := range cmds {
+		p := filepath.ToSlash(filepath.Join(pkg, "cmds", c.Name))
+		if err := rewriteCommand(ctx, c, filepath.Join(gopath, "src", p)); err != nil {
+			return fmt.Errorf("%s: %v", c.Name, err)
+		}
+		gen = append(gen, genCommand{Name: c.Name, Path: p})
+	}
+
+	var b bytes.Buffer
+	if err := mainTmpl.Execute(&b, gen); err != nil {
+		return err
+	}
+	code, err := format.Source(b.Bytes())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(gopath, "src", pkg, "bb.go"), code, 0644)
+}
+
+// rewriteCommand rewrites the main package in c.Dir into a package called
+// c.Name in dir.
+func rewriteCommand(ctx *build.Context, c Command, dir string) error {
+	p, err := ctx.ImportDir(c.Dir, 0)
+	if err != nil {
+		return err
+	}
+	if p.Name != "main" {
+		return fmt.Errorf("%s is package %s, not a command", c.Dir, p.Name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	files := append([]string(nil), p.GoFiles...)
+	sort.Strings(files)
+	var inits []string
+	fset := token.NewFileSet()
+	for _, name := range files {
+		f, err := parser.ParseFile(fset, filepath.Join(c.Dir, name), nil, parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		inits = rewriteFile(fset, f, c.Name, inits)
+
+		var b bytes.Buffer
+		if err := format.Node(&b, fset, f); err != nil {
+			return fmt.Errorf("formatting %s: %v", name, err)
+		}
+		// The rewrite may have made the flag import unused or made
+		// os necessary; let imports sort that out.
+		code, err := imports.Process(name, b.Bytes(), nil)
+		if err != nil {
+			return fmt.Errorf("fixing imports of %s: %v", name, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), code, 0644); err != nil {
+			return err
+		}
+	}
+
+	var b bytes.Buffer
+	if err := setupTmpl.Execute(&b, struct {
+		Name    string
+		FlagSet string
+		Inits   []string
+	}{c.Name, flagSetName, inits}); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "bbsetup.go"), b.Bytes(), 0644)
+}
+
+// rewriteFile turns f into a file of package name, renaming main to Main
+// and init functions to ones Init calls, which are appended to inits.
+func rewriteFile(fset *token.FileSet, f *ast.File, name string, inits []string) []string {
+	f.Name.Name = name
+	f.Comments = dropImportComment(fset, f)
+
+	for _, d := range f.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil {
+			continue
+		}
+		switch fn.Name.Name {
+		case "main":
+			fn.Name.Name = "Main"
+		case "init":
+			fn.Name.Name = fmt.Sprintf("bbInit%d", len(inits))
+			inits = append(inits, fn.Name.Name)
+		}
+	}
+
+	commandLine := make(map[ast.Expr]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.CallExpr:
+			// flag.Parse() parses os.Args[1:] on the FlagSet.
+			if s, ok := x.Fun.(*ast.SelectorExpr); ok && isFlag(s.X) && s.Sel.Name == "Parse" && len(x.Args) == 0 {
+				x.Args = []ast.Expr{&ast.SliceExpr{
+					X:   &ast.SelectorExpr{X: ast.NewIdent("os"), Sel: ast.NewIdent("Args")},
+					Low: &ast.BasicLit{Kind: token.INT, Value: "1"},
+				}}
+			}
+		case *ast.SelectorExpr:
+			if !isFlag(x.X) {
+				break
+			}
+			if x.Sel.Name == "CommandLine" {
+				commandLine[x] = true
+			} else if flagSetSelectors[x.Sel.Name] {
+				x.X.(*ast.Ident).Name = flagSetName
+			}
+		}
+		return true
+	})
+	if len(commandLine) > 0 {
+		replaceExprs(f, commandLine, ast.NewIdent(flagSetName))
+	}
+	return inits
+}
+
+func isFlag(e ast.Expr) bool {
+	i, ok := e.(*ast.Ident)
+	return ok && i.Name == "flag"
+}
+
+// dropImportComment returns f's comments without the import comment on the
+// package clause, which would pin the package to its original path.
+func dropImportComment(fset *token.FileSet, f *ast.File) []*ast.CommentGroup {
+	line := fset.Position(f.Name.Pos()).Line
+	var cgs []*ast.CommentGroup
+	for _, cg := range f.Comments {
+		if fset.Position(cg.Pos()).Line == line && strings.HasPrefix(cg.Text(), "import ") {
+			continue
+		}
+		cgs = append(cgs, cg)
+	}
+	return cgs
+}
+
+// replaceExprs replaces the expressions in old with new wherever they are
+// used as a value.
+func replaceExprs(f *ast.File, old map[ast.Expr]bool, new ast.Expr) {
+	replace := func(es []ast.Expr) {
+		for i, e := range es {
+			if old[e] {
+				es[i] = new
+			}
+		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.CallExpr:
+			replace(x.Args)
+		case *ast.AssignStmt:
+			replace(x.Rhs)
+		case *ast.ValueSpec:
+			replace(x.Values)
+		case *ast.ReturnStmt:
+			replace(x.Results)
+		case *ast.CompositeLit:
+			replace(x.Elts)
+		case *ast.SelectorExpr:
+			if old[x.X] {
+				x.X = new
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping compile in short mode")
+	}
+	tmpDir, err := ioutil.TempDir("", "bb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var cmds []Command
+	for _, n := range []string{"hello", "goodbye"} {
+		d, err := filepath.Abs(filepath.Join("testdata", n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, Command{Name: n, Dir: d})
+	}
+	if err := Generate(&build.Default, tmpDir, "bbtest", cmds); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	bin := filepath.Join(tmpDir, "bb")
+	cmd := exec.Command("go", "build", "-o", bin, "bbtest")
+	cmd.Env = append(os.Environ(), "GOPATH="+tmpDir)
+	if o, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building: %v\n%s", err, o)
+	}
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"hello", nil, "hello world []"},
+		{"hello", []string{"-n", "gopher", "a"}, "hello gopher [a]"},
+		{"goodbye", []string{"-n", "sun", "-x"}, "goodbye sun true"},
+	} {
+		link := filepath.Join(tmpDir, tt.name)
+		if err := os.Symlink("bb", link); err != nil && !os.IsExist(err) {
+			t.Fatal(err)
+		}
+		o, err := exec.Command(link, tt.args...).CombinedOutput()
+		if err != nil {
+			t.Errorf("%s %v: %v\n%s", tt.name, tt.args, err, o)
+			continue
+		}
+		if got := strings.TrimSpace(string(o)); got != tt.want {
+			t.Errorf("%s %v = %q, want %q", tt.name, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestDuplicateName(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "bb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cmds := []Command{{Name: "a", Dir: "testdata/hello"}, {Name: "a", Dir: "testdata/goodbye"}}
+	if err := Generate(&build.Default, tmpDir, "bbtest", cmds); err == nil {
+		t.Errorf("Generate with duplicate names succeeded, want error")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "src")); !os.IsNotExist(err) {
+		t.Errorf("Generate with duplicate names wrote files, want nothing written")
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// The same flag as hello, which would panic if both used flag.CommandLine.
+var name = flag.String("n", "moon", "who to leave")
+
+func init() {
+	flag.Usage = func() {}
+}
+
+func main() {
+	opts := register(flag.CommandLine)
+	flag.Parse()
+	fmt.Printf("goodbye %s %v\n", *name, *opts)
+}
+
+func register(f *flag.FlagSet) *bool {
+	return f.Bool("x", false, "extra")
+}
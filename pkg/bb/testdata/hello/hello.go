@@ -0,0 +1,23 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var name = flag.String("n", "world", "who to greet")
+
+var greeting string
+
+func init() {
+	greeting = "hello"
+}
+
+func main() {
+	flag.Parse()
+	fmt.Printf("%s %s %v\n", greeting, *name, flag.Args())
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cmdline parses the kernel command line, as in /proc/cmdline, for
+// the commands that run at boot.
+//
+// Arguments are separated by spaces, tabs and newlines. A double quote
+// starts or ends a quoted part, in which they are not, and is itself left
+// out, so that
+//
+//	uroot.uinitargs="-c echo hi" quiet
+//
+// is two arguments, the first of which has the value -c echo hi. There is
+// no escaping quotes. Arguments after a "--" are for init, which the kernel
+// gives them to as its own, and are not parsed.
+//
+// A value that is a list of words, such as that of uroot.uinitargs, is split
+// by Fields, in which single quotes do what double quotes do here, so that
+//
+//	uroot.uinitargs="-c 'echo hi'"
+//
+// is the two words -c and echo hi.
+package cmdline
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Path is where Read reads the kernel command line from.
+var Path = "/proc/cmdline"
+
+// Arg is an argument of the kernel command line.
+type Arg struct {
+	// Key is what is before the first "=", or all of the argument if
+	// there is none.
+	Key string
+	// Value is what is after the first "=".
+	Value string
+	// HasValue is whether there was an "=".
+	HasValue bool
+}
+
+// CmdLine is a kernel command line.
+type CmdLine struct {
+	// Raw is the command line as it was given.
+	Raw string
+	// Args are its arguments, in order, up to any "--".
+	Args []Arg
+}
+
+// New parses the kernel command line s.
+func New(s string) *CmdLine {
+	return &CmdLine{Raw: s, Args: Parse(s)}
+}
+
+// Read reads and parses the kernel command line from Path.
+func Read() (*CmdLine, error) {
+	b, err := ioutil.ReadFile(Path)
+	if err != nil {
+		return nil, err
+	}
+	return New(string(b)), nil
+}
+
+// Parse returns the arguments of the kernel command line s, up to any
+// "--".
+func Parse(s string) []Arg {
+	var args []Arg
+	for _, f := range fields(s) {
+		if f == "--" {
+			break
+		}
+		a := Arg{Key: f}
+		if i := strings.Index(f, "="); i >= 0 {
+			a = Arg{Key: f[:i], Value: f[i+1:], HasValue: true}
+		}
+		args = append(args, a)
+	}
+	return args
+}
+
+// Fields splits the value of an argument into words where there are spaces
+// outside single quotes, leaving the quotes out.
+func Fields(s string) []string {
+	return split(s, '\'')
+}
+
+// fields splits s where there are spaces outside double quotes, leaving the
+// quotes out.
+func fields(s string) []string {
+	return split(s, '"')
+}
+
+// split splits s where there are spaces outside quotes, leaving the quotes
+// out.
+func split(s string, quote rune) []string {
+	var (
+		f      []string
+		b      strings.Builder
+		quoted bool
+		in     bool
+	)
+	for _, c := range s {
+		switch {
+		case c == quote:
+			quoted = !quoted
+			in = true
+		case !quoted && (c == ' ' || c == '\t' || c == '\n'):
+			if in {
+				f = append(f, b.String())
+				b.Reset()
+				in = false
+			}
+		default:
+			b.WriteRune(c)
+			in = true
+		}
+	}
+	if in {
+		f = append(f, b.String())
+	}
+	return f
+}
+
+// Get returns the value of the last argument whose key is key, and whether
+// there is one. An argument without an "=" has the value "".
+func (c *CmdLine) Get(key string) (string, bool) {
+	for i := len(c.Args) - 1; i >= 0; i-- {
+		if c.Args[i].Key == key {
+			return c.Args[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// Flag returns whether the last argument whose key is key has no value, or
+// a value that strconv.ParseBool takes as true, as uroot.debug and
+// uroot.debug=1 both are. It is false if there is no such argument.
+func (c *CmdLine) Flag(key string) bool {
+	for i := len(c.Args) - 1; i >= 0; i-- {
+		if a := c.Args[i]; a.Key == key {
+			if !a.HasValue {
+				return true
+			}
+			t, err := strconv.ParseBool(a.Value)
+			return err == nil && t
+		}
+	}
+	return false
+}
+
+// Prefix returns the arguments whose keys start with prefix, in order.
+func (c *CmdLine) Prefix(prefix string) []Arg {
+	var args []Arg
+	for _, a := range c.Args {
+		if strings.HasPrefix(a.Key, prefix) {
+			args = append(args, a)
+		}
+	}
+	return args
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		cmdline string
+		want    []Arg
+	}{
+		{"", nil},
+		{" \n", nil},
+		{"quiet", []Arg{{Key: "quiet"}}},
+		{"console=ttyS0,115200 quiet\n", []Arg{
+			{Key: "console", Value: "ttyS0,115200", HasValue: true},
+			{Key: "quiet"},
+		}},
+		{"uroot.uinit=", []Arg{{Key: "uroot.uinit", HasValue: true}}},
+		{"a=b=c", []Arg{{Key: "a", Value: "b=c", HasValue: true}}},
+		{"  a\t\tb  ", []Arg{{Key: "a"}, {Key: "b"}}},
+		{`uroot.uinitargs="-c echo hi" quiet`, []Arg{
+			{Key: "uroot.uinitargs", Value: "-c echo hi", HasValue: true},
+			{Key: "quiet"},
+		}},
+		{`"uroot.initflags=-v -test"`, []Arg{{Key: "uroot.initflags", Value: "-v -test", HasValue: true}}},
+		{`a="" b`, []Arg{{Key: "a", HasValue: true}, {Key: "b"}}},
+		{`""`, []Arg{{}}},
+		// An unterminated quote runs to the end.
+		{`a="b c`, []Arg{{Key: "a", Value: "b c", HasValue: true}}},
+		{"a -- b=c", []Arg{{Key: "a"}}},
+		{`a "--" b`, []Arg{{Key: "a"}}},
+	} {
+		if got := Parse(tt.cmdline); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q): got %+v, want %+v", tt.cmdline, got, tt.want)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{"-v -test", []string{"-v", "-test"}},
+		{"-c 'echo hi'", []string{"-c", "echo hi"}},
+		{"-c 'echo  hi' ' x'y", []string{"-c", "echo  hi", " xy"}},
+		{"''", []string{""}},
+		{`-c "echo hi"`, []string{"-c", `"echo`, `hi"`}},
+		// An unterminated quote runs to the end.
+		{"-c 'echo hi", []string{"-c", "echo hi"}},
+	} {
+		if got := Fields(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Fields(%q): got %q, want %q", tt.value, got, tt.want)
+		}
+	}
+
+	// A value in double quotes can have words in single quotes.
+	v, _ := New(`uroot.uinitargs="-c 'echo hi'" quiet`).Get("uroot.uinitargs")
+	if got, want := Fields(v), []string{"-c", "echo hi"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fields(%q): got %q, want %q", v, got, want)
+	}
+}
+
+func TestGet(t *testing.T) {
+	c := New("uroot.debug uroot.uinit=/bin/a uroot.nonetwork=0 uroot.uinit=/bin/b uroot.initflags=\"-v\"")
+	for _, tt := range []struct {
+		key   string
+		value string
+		ok    bool
+		flag  bool
+	}{
+		{"uroot.debug", "", true, true},
+		{"uroot.uinit", "/bin/b", true, false},
+		{"uroot.nonetwork", "0", true, false},
+		{"uroot.initflags", "-v", true, false},
+		{"uroot", "", false, false},
+		{"uroot.nobgbuild", "", false, false},
+	} {
+		v, ok := c.Get(tt.key)
+		if v != tt.value || ok != tt.ok {
+			t.Errorf("Get(%q): got %q, %v, want %q, %v", tt.key, v, ok, tt.value, tt.ok)
+		}
+		if f := c.Flag(tt.key); f != tt.flag {
+			t.Errorf("Flag(%q): got %v, want %v", tt.key, f, tt.flag)
+		}
+	}
+	if !New("uroot.nonetwork=1").Flag("uroot.nonetwork") {
+		t.Errorf("Flag(uroot.nonetwork=1): got false, want true")
+	}
+	// The last one wins.
+	if New("uroot.debug uroot.debug=false").Flag("uroot.debug") {
+		t.Errorf("Flag(uroot.debug uroot.debug=false): got true, want false")
+	}
+
+	got := c.Prefix("uroot.u")
+	want := []Arg{
+		{Key: "uroot.uinit", Value: "/bin/a", HasValue: true},
+		{Key: "uroot.uinit", Value: "/bin/b", HasValue: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Prefix(uroot.u): got %+v, want %+v", got, want)
+	}
+}
+
+func TestRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { Path = p }(Path)
+
+	Path = filepath.Join(dir, "cmdline")
+	if _, err := Read(); err == nil {
+		t.Errorf("Read of a missing %s: got nil, want an error", Path)
+	}
+	const raw = "ro uroot.uinit=/bin/sh\n"
+	if err := ioutil.WriteFile(Path, []byte(raw), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Raw != raw {
+		t.Errorf("Raw: got %q, want %q", c.Raw, raw)
+	}
+	if v, _ := c.Get("uroot.uinit"); v != "/bin/sh" {
+		t.Errorf("uroot.uinit: got %q, want /bin/sh", v)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package compress provides the compressors an initramfs can be packed with.
+//
+// Compressors are registered by name, in the same way as cpio formats, so
+// that new codecs only need an Add call.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// A Compressor wraps writers so that what is written comes out compressed.
+type Compressor interface {
+	// Available returns an error if the compressor can not be used on
+	// this host, e.g. because a helper program is missing.
+	Available() error
+
+	// Writer returns a WriteCloser that compresses into w. Close
+	// flushes all compressed data to w, but does not close w.
+	Writer(w io.Writer) (io.WriteCloser, error)
+
+	// Reader returns a ReadCloser that decompresses what is read from
+	// r. Close does not close r.
+	Reader(r io.Reader) (io.ReadCloser, error)
+
+	// Suffix is the conventional file name suffix, e.g. ".gz".
+	Suffix() string
+}
+
+var (
+	compressors = make(map[string]Compressor)
+	names       []string
+)
+
+// Add registers a compressor under name.
+func Add(name string, c Compressor) {
+	if _, ok := compressors[name]; ok {
+		log.Fatalf("compress: two requests for compressor %s", name)
+	}
+	compressors[name] = c
+	names = append(names, name)
+}
+
+// Get returns the compressor called name.
+func Get(name string) (Compressor, error) {
+	c, ok := compressors[name]
+	if !ok {
+		return nil, fmt.Errorf("compressor %v is not one of %v", name, names)
+	}
+	return c, nil
+}
+
+// Names returns the names of all registered compressors.
+func Names() []string {
+	return append([]string(nil), names...)
+}
+
+// magics are the first bytes of what the compressors write, by name.
+var magics = []struct {
+	name  string
+	magic []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// Detect returns the name of the compressor whose output r starts with, or
+// "none", and a reader of all of r. Only the few bytes it looks at are read
+// ahead, so r can be a pipe.
+func Detect(r io.Reader) (string, io.Reader, error) {
+	var max int
+	for _, m := range magics {
+		if len(m.magic) > max {
+			max = len(m.magic)
+		}
+	}
+	prefix := make([]byte, max)
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	prefix = prefix[:n]
+	r = io.MultiReader(bytes.NewReader(prefix), r)
+	for _, m := range magics {
+		if bytes.HasPrefix(prefix, m.magic) {
+			return m.name, r, nil
+		}
+	}
+	return "none", r, nil
+}
+
+// NewReader returns a reader of what r decompresses to, with the
+// compressor Detect finds, and the compressor's name. What is not
+// compressed is read as it is.
+func NewReader(r io.Reader) (io.ReadCloser, string, error) {
+	name, r, err := Detect(r)
+	if err != nil {
+		return nil, "", err
+	}
+	c, err := Get(name)
+	if err != nil {
+		return nil, name, err
+	}
+	if err := c.Available(); err != nil {
+		return nil, name, err
+	}
+	rc, err := c.Reader(r)
+	return rc, name, err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+type none struct{}
+
+func (none) Available() error { return nil }
+
+func (none) Writer(w io.Writer) (io.WriteCloser, error) {
+	return nopCloser{w}, nil
+}
+
+func (none) Reader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+func (none) Suffix() string { return "" }
+
+type gz struct{}
+
+func (gz) Available() error { return nil }
+
+func (gz) Writer(w io.Writer) (io.WriteCloser, error) {
+	z := gzip.NewWriter(w)
+	// A zero ModTime keeps the header reproducible.
+	z.ModTime = time.Time{}
+	return z, nil
+}
+
+func (gz) Reader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gz) Suffix() string { return ".gz" }
+
+// Command is a Compressor that pipes data through an external program,
+// which must read from stdin and write to stdout. It is run with
+// DecompressArgs instead of Args to decompress.
+type Command struct {
+	Path           string
+	Args           []string
+	DecompressArgs []string
+	Ext            string
+}
+
+// Available checks that the program can be found in $PATH.
+func (c Command) Available() error {
+	if _, err := exec.LookPath(c.Path); err != nil {
+		return fmt.Errorf("%s is not available: %v", c.Path, err)
+	}
+	return nil
+}
+
+// Suffix implements Compressor.Suffix.
+func (c Command) Suffix() string {
+	return c.Ext
+}
+
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// Writer starts the program with its stdout connected to w.
+func (c Command) Writer(w io.Writer) (io.WriteCloser, error) {
+	cmd := exec.Command(c.Path, c.Args...)
+	cmd.Stdout = w
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdWriter{WriteCloser: in, cmd: cmd}, nil
+}
+
+// Close closes the program's stdin and waits for it to finish.
+func (c *cmdWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v", c.cmd.Path, err)
+	}
+	return nil
+}
+
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Reader starts the program, with DecompressArgs, with its stdin connected
+// to r.
+func (c Command) Reader(r io.Reader) (io.ReadCloser, error) {
+	cmd := exec.Command(c.Path, c.DecompressArgs...)
+	cmd.Stdin = r
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{ReadCloser: out, cmd: cmd}, nil
+}
+
+// Close closes the program's stdout and waits for it to finish.
+func (c *cmdReader) Close() error {
+	c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v", c.cmd.Path, err)
+	}
+	return nil
+}
+
+func init() {
+	Add("none", none{})
+	Add("gzip", gz{})
+	// The kernel's xz decoder only knows about CRC32 checks and wants a
+	// modest dictionary; see Documentation/xz.txt. -T1 keeps the output
+	// the same no matter how many CPUs the build machine has.
+	Add("xz", Command{Path: "xz", Args: []string{"--check=crc32", "--lzma2=dict=1MiB", "-T1", "-c"}, DecompressArgs: []string{"-d", "-c"}, Ext: ".xz"})
+	Add("zstd", Command{Path: "zstd", Args: []string{"-q", "-19", "-c"}, DecompressArgs: []string{"-q", "-d", "-c"}, Ext: ".zst"})
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	_ "github.com/u-root/u-root/pkg/cpio/newc"
+)
+
+func testArchive(t *testing.T) []byte {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &bytes.Buffer{}
+	w := archiver.Writer(b)
+	for _, r := range []cpio.Record{
+		{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("nameserver 8.8.8.8\n"), cpio.Info{Name: "etc/resolv.conf", Mode: syscall.S_IFREG | 0644}),
+		cpio.NewRecordFromBytes(bytes.Repeat([]byte("u-root"), 10000), cpio.Info{Name: "init", Mode: syscall.S_IFREG | 0755}),
+	} {
+		if err := w.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func decompressor(name string) func(io.Reader) ([]byte, error) {
+	command := func(path string) func(io.Reader) ([]byte, error) {
+		return func(r io.Reader) ([]byte, error) {
+			cmd := exec.Command(path, "-d", "-c")
+			cmd.Stdin = r
+			return cmd.Output()
+		}
+	}
+	switch name {
+	case "none":
+		return ioutil.ReadAll
+	case "gzip":
+		return func(r io.Reader) ([]byte, error) {
+			z, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(z)
+		}
+	case "xz", "zstd":
+		return command(name)
+	}
+	return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	archive := testArchive(t)
+	for _, name := range Names() {
+		c, err := Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Available(); err != nil {
+			t.Logf("Skipping %s: %v", name, err)
+			continue
+		}
+		decompress := decompressor(name)
+		if decompress == nil {
+			t.Errorf("%s: no decompressor to test with", name)
+			continue
+		}
+
+		b := &bytes.Buffer{}
+		w, err := c.Writer(b)
+		if err != nil {
+			t.Fatalf("%s: Writer: %v", name, err)
+		}
+		if _, err := w.Write(archive); err != nil {
+			t.Fatalf("%s: Write: %v", name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", name, err)
+		}
+
+		compressed := b.Bytes()
+		got, err := decompress(b)
+		if err != nil {
+			t.Fatalf("%s: decompressing: %v", name, err)
+		}
+		if !bytes.Equal(got, archive) {
+			t.Errorf("%s: round trip got %d bytes, want %d", name, len(got), len(archive))
+		}
+
+		r, err := c.Reader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("%s: Reader: %v", name, err)
+		}
+		got, err = ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: Read: %v", name, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", name, err)
+		}
+		if !bytes.Equal(got, archive) {
+			t.Errorf("%s: Reader got %d bytes, want %d", name, len(got), len(archive))
+		}
+	}
+}
+
+func TestBadName(t *testing.T) {
+	if _, err := Get("lzop"); err == nil {
+		t.Errorf("Get(lzop) = nil error, want error")
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	archive := testArchive(t)
+	for _, name := range Names() {
+		c, err := Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Available(); err != nil {
+			t.Logf("Skipping %s: %v", name, err)
+			continue
+		}
+		b := &bytes.Buffer{}
+		w, err := c.Writer(b)
+		if err != nil {
+			t.Fatalf("%s: Writer: %v", name, err)
+		}
+		if _, err := w.Write(archive); err != nil {
+			t.Fatalf("%s: Write: %v", name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", name, err)
+		}
+
+		// A pipe can not be seeked back to the start.
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(func() error {
+				_, err := pw.Write(b.Bytes())
+				return err
+			}())
+		}()
+		r, got, err := NewReader(pr)
+		if err != nil || got != name {
+			t.Fatalf("%s: NewReader: got %q, %v", name, got, err)
+		}
+		d, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: Read: %v", name, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", name, err)
+		}
+		if !bytes.Equal(d, archive) {
+			t.Errorf("%s: NewReader got %d bytes, want %d", name, len(d), len(archive))
+		}
+	}
+
+	// What is shorter than any magic is read as it is.
+	for _, in := range []string{"", "\x1f", "abc"} {
+		name, r, err := Detect(bytes.NewReader([]byte(in)))
+		if err != nil || name != "none" {
+			t.Errorf("Detect(%q): got %q, %v, want none", in, name, err)
+			continue
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || string(got) != in {
+			t.Errorf("Detect(%q): read %q, %v", in, got, err)
+		}
+	}
+}
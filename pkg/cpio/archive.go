@@ -0,0 +1,209 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Archive is the records of an archive, by name.
+//
+// The contents of the records are not read into memory if they can be read
+// again where they are, as those of an archive read from an io.ReaderAt
+// can, so that an Archive of a file is no bigger than its headers.
+type Archive struct {
+	// names are the names of the records, sorted.
+	names []string
+	recs  map[string]archived
+}
+
+// archived is a record of an Archive, with its contents, if it has any, in
+// an io.ReaderAt rather than a reader that can only be read once.
+type archived struct {
+	info     Info
+	contents io.ReaderAt
+}
+
+// ReadArchive reads the records of r up to the trailer, or the end of the
+// archive, into an Archive. Of two records of the same name, the later one
+// is kept, as it would be by the kernel.
+func ReadArchive(r RecordReader) (*Archive, error) {
+	a := &Archive{recs: make(map[string]archived)}
+	for {
+		rec, err := r.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rec.Name == Trailer {
+			break
+		}
+		ar := archived{info: rec.Info}
+		if rec.ReadCloser != nil {
+			if ar.contents, err = contents(rec); err != nil {
+				return nil, fmt.Errorf("%s: %v", rec.Name, err)
+			}
+		}
+		name := archiveName(rec.Name)
+		if _, ok := a.recs[name]; !ok {
+			a.names = append(a.names, name)
+		}
+		a.recs[name] = ar
+	}
+	sort.Strings(a.names)
+	return a, nil
+}
+
+// contents returns the contents of r as an io.ReaderAt, reading them into
+// memory only if they are not one already. The contents of a file on disk
+// are read into memory too, as the file is closed here.
+func contents(r Record) (io.ReaderAt, error) {
+	defer r.Close()
+	if _, file := r.ReadCloser.(*LazyOpen); !file {
+		if ra, ok := r.ReadCloser.(io.ReaderAt); ok {
+			return ra, nil
+		}
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+// archiveName is name as an Archive looks it up: relative, and clean, so
+// that "/etc/passwd", "./etc/passwd" and "etc/passwd" are the same record.
+func archiveName(name string) string {
+	if n := strings.TrimLeft(path.Clean(name), "/"); n != "" {
+		return n
+	}
+	return "."
+}
+
+// Len returns the number of records in a.
+func (a *Archive) Len() int {
+	return len(a.names)
+}
+
+// Names returns the names of the records in a, sorted.
+func (a *Archive) Names() []string {
+	return append([]string(nil), a.names...)
+}
+
+// Contains reports whether a has a record of the name.
+func (a *Archive) Contains(name string) bool {
+	_, ok := a.recs[archiveName(name)]
+	return ok
+}
+
+// Get returns the record of the name. Its contents can be read from the
+// start, however often it is gotten.
+func (a *Archive) Get(name string) (Record, bool) {
+	ar, ok := a.recs[archiveName(name)]
+	if !ok {
+		return Record{}, false
+	}
+	return ar.record(), true
+}
+
+func (ar archived) record() Record {
+	r := Record{Info: ar.info}
+	if ar.contents != nil {
+		r.ReadCloser = NewReadCloser(io.NewSectionReader(ar.contents, 0, int64(ar.info.FileSize)))
+	}
+	return r
+}
+
+// Walk calls fn with each record of a, sorted by name, until it returns an
+// error, which Walk returns.
+func (a *Archive) Walk(fn func(Record) error) error {
+	for _, n := range a.names {
+		if err := fn(a.recs[n].record()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTo writes the records of a to w, sorted by name, which has every
+// directory before what is in it. It does not write a trailer.
+func (a *Archive) WriteTo(w RecordWriter) error {
+	return a.Walk(w.WriteRecord)
+}
+
+// FileReader reads files out of an archive in an io.ReaderAt, without
+// reading the rest of it. The first file asked for has the headers of all
+// the records read, to find where their contents are; no contents are read
+// but those of the files asked for.
+type FileReader struct {
+	rr   RecordReader
+	once sync.Once
+	a    *Archive
+	err  error
+}
+
+// FileReader returns a FileReader of the archive in r.
+func (a Archiver) FileReader(r io.ReaderAt) *FileReader {
+	return &FileReader{rr: a.RecordFormat.Reader(r)}
+}
+
+// record returns the record of the name, with op for the error if there is
+// none.
+func (f *FileReader) record(op, name string) (archived, error) {
+	f.once.Do(func() {
+		f.a, f.err = ReadArchive(f.rr)
+	})
+	if f.err != nil {
+		return archived{}, &os.PathError{Op: op, Path: name, Err: f.err}
+	}
+	ar, ok := f.a.recs[archiveName(name)]
+	if !ok {
+		return archived{}, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return ar, nil
+}
+
+// Stat returns the header of the record of the name.
+func (f *FileReader) Stat(name string) (Info, error) {
+	ar, err := f.record("stat", name)
+	return ar.info, err
+}
+
+// Open returns the contents of the record of the name where they are in
+// the archive, without copying them. A record without contents, such as a
+// directory, has none to read.
+func (f *FileReader) Open(name string) (*io.SectionReader, error) {
+	ar, err := f.record("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if ar.contents == nil {
+		return io.NewSectionReader(bytes.NewReader(nil), 0, 0), nil
+	}
+	return io.NewSectionReader(ar.contents, 0, int64(ar.info.FileSize)), nil
+}
+
+// ReadFile returns the contents of the record of the name.
+func (f *FileReader) ReadFile(name string) ([]byte, error) {
+	s, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, s.Size())
+	if _, err := io.ReadFull(s, b); err != nil {
+		return nil, &os.PathError{Op: "read", Path: name, Err: err}
+	}
+	return b, nil
+}
@@ -0,0 +1,316 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	_ "github.com/u-root/u-root/pkg/cpio/newc"
+)
+
+func archive(t *testing.T, recs ...cpio.Record) []byte {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := archiver.Writer(&b)
+	// Duplicates are written as they are, to read them back.
+	for _, r := range recs {
+		if err := w.WriteDuplicate(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func readArchive(t *testing.T, b []byte) *cpio.Archive {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := cpio.ReadArchive(archiver.RecordFormat.Reader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func contents(t *testing.T, r cpio.Record) string {
+	if r.ReadCloser == nil {
+		return ""
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestArchive(t *testing.T) {
+	a := readArchive(t, archive(t,
+		cpio.NewRecordFromBytes([]byte("b"), cpio.Info{Name: "etc/b", Mode: syscall.S_IFREG | 0644}),
+		cpio.Record{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("old"), cpio.Info{Name: "etc/a", Mode: syscall.S_IFREG | 0644}),
+		cpio.Record{Info: cpio.Info{Name: "dev/null", Mode: syscall.S_IFCHR | 0666, Rmajor: 1, Rminor: 3}},
+		// The later record of a name is the one kept.
+		cpio.NewRecordFromBytes([]byte("new"), cpio.Info{Name: "etc/a", Mode: syscall.S_IFREG | 0600}),
+	))
+
+	want := []string{"dev/null", "etc", "etc/a", "etc/b"}
+	if got := a.Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Names: got %q, want %q", got, want)
+	}
+	if a.Len() != len(want) {
+		t.Errorf("Len: got %d, want %d", a.Len(), len(want))
+	}
+	for _, n := range []string{"etc/a", "/etc/a", "./etc/a", "etc//a"} {
+		if !a.Contains(n) {
+			t.Errorf("Contains(%q): got false, want true", n)
+		}
+	}
+	if a.Contains("etc/c") {
+		t.Errorf("Contains(etc/c): got true, want false")
+	}
+	if _, ok := a.Get("etc/c"); ok {
+		t.Errorf("Get(etc/c): got a record, want none")
+	}
+
+	// The contents can be read again every time.
+	for i := 0; i < 2; i++ {
+		r, ok := a.Get("etc/a")
+		if !ok {
+			t.Fatalf("Get(etc/a): got no record")
+		}
+		if got := contents(t, r); got != "new" || r.Mode != syscall.S_IFREG|0600 {
+			t.Errorf("Get(etc/a): got %q mode %#o, want %q mode %#o", got, r.Mode, "new", syscall.S_IFREG|0600)
+		}
+	}
+	if r, _ := a.Get("dev/null"); contents(t, r) != "" || r.Rmajor != 1 || r.Rminor != 3 {
+		t.Errorf("Get(dev/null): got %v, want a device 1, 3 with no contents", r.Info)
+	}
+
+	var walked []string
+	if err := a.Walk(func(r cpio.Record) error {
+		walked = append(walked, r.Name+" "+contents(t, r))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dev/null ", "etc ", "etc/a new", "etc/b b"}; !reflect.DeepEqual(walked, want) {
+		t.Errorf("Walk: got %q, want %q", walked, want)
+	}
+	stop := io.ErrUnexpectedEOF
+	n := 0
+	if err := a.Walk(func(cpio.Record) error { n++; return stop }); err != stop || n != 1 {
+		t.Errorf("Walk: got %v after %d records, want %v after 1", err, n, stop)
+	}
+
+	// Written again, it is sorted, with one record of each name.
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := archiver.Writer(&b)
+	if err := a.WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range recs {
+		got = append(got, r.Name+" "+contents(t, r))
+	}
+	if !reflect.DeepEqual(got, walked) {
+		t.Errorf("WriteTo: got %q, want %q", got, walked)
+	}
+}
+
+func TestArchiveEmpty(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"trailer only", archive(t)},
+	} {
+		a := readArchive(t, tt.b)
+		if a.Len() != 0 || len(a.Names()) != 0 {
+			t.Errorf("%s: got %q, want no records", tt.name, a.Names())
+		}
+		if a.Contains(".") {
+			t.Errorf("%s: Contains(.): got true, want false", tt.name)
+		}
+		var b bytes.Buffer
+		archiver, err := cpio.Format("newc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.WriteTo(archiver.Writer(&b)); err != nil || b.Len() != 0 {
+			t.Errorf("%s: WriteTo: wrote %d bytes, err %v; want none", tt.name, b.Len(), err)
+		}
+	}
+}
+
+// records is a RecordReader of records, then io.EOF.
+type records []cpio.Record
+
+func (r *records) ReadRecord() (cpio.Record, error) {
+	if len(*r) == 0 {
+		return cpio.Record{}, io.EOF
+	}
+	rec := (*r)[0]
+	*r = (*r)[1:]
+	return rec, nil
+}
+
+func TestArchiveReadOnce(t *testing.T) {
+	// Contents that can only be read once are read into memory.
+	once := ioutil.NopCloser(io.LimitReader(strings.NewReader("once"), 4))
+	a, err := cpio.ReadArchive(&records{{ReadCloser: once, Info: cpio.Info{Name: "a", Mode: syscall.S_IFREG | 0644, FileSize: 4}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		r, ok := a.Get("a")
+		if got := contents(t, r); !ok || got != "once" {
+			t.Errorf("Get(a): got %q, %v, want %q, true", got, ok, "once")
+		}
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	// Contents of every length modulo 4 have every padding after them,
+	// and the archive is padded after the trailer, as GNU cpio pads it.
+	var recs []cpio.Record
+	for _, c := range []string{"", "a", "ab", "abc", "abcd", "abcde"} {
+		recs = append(recs, cpio.NewRecordFromBytes([]byte(c), cpio.Info{Name: "f" + c, Mode: syscall.S_IFREG | 0644}))
+	}
+	recs = append(recs, cpio.Record{Info: cpio.Info{Name: "dir", Mode: syscall.S_IFDIR | 0755}})
+	b := append(archive(t, recs...), make([]byte, 512)...)
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := archiver.FileReader(bytes.NewReader(b))
+	for _, r := range recs[:6] {
+		want := r.Name[1:]
+		got, err := f.ReadFile("/" + r.Name)
+		if err != nil || string(got) != want {
+			t.Errorf("ReadFile(%s): got %q, %v, want %q", r.Name, got, err, want)
+		}
+		info, err := f.Stat(r.Name)
+		if err != nil || info.FileSize != uint64(len(want)) || info.Mode != r.Mode {
+			t.Errorf("Stat(%s): got %v, %v, want size %d mode %#o", r.Name, info, err, len(want), r.Mode)
+		}
+	}
+	// The contents are read where they are in the archive.
+	s, err := f.Open("fabcde")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 2)
+	if _, err := s.ReadAt(got, 3); err != nil || string(got) != "de" {
+		t.Errorf("ReadAt(fabcde, 3): got %q, %v, want %q", got, err, "de")
+	}
+	if got, err := f.ReadFile("dir"); err != nil || len(got) != 0 {
+		t.Errorf("ReadFile(dir): got %q, %v, want nothing", got, err)
+	}
+	if _, err := f.Stat("nonexistent"); !os.IsNotExist(err) {
+		t.Errorf("Stat(nonexistent): got %v, want it not to exist", err)
+	}
+	if _, err := archiver.FileReader(bytes.NewReader(bytes.Repeat([]byte("garbage"), 100))).ReadFile("f"); err == nil || os.IsNotExist(err) {
+		t.Errorf("ReadFile of garbage: got %v, want an error reading the archive", err)
+	}
+}
+
+var (
+	bigOnce sync.Once
+	big     []byte
+)
+
+// bigArchive returns a 200MB archive of 200 files of 1MB, f000 to f199.
+func bigArchive(b *testing.B) []byte {
+	bigOnce.Do(func() {
+		archiver, err := cpio.Format("newc")
+		if err != nil {
+			b.Fatal(err)
+		}
+		var buf bytes.Buffer
+		w := archiver.Writer(&buf)
+		c := make([]byte, 1<<20)
+		for i := 0; i < 200; i++ {
+			if err := w.WriteRecord(cpio.NewRecordFromBytes(c, cpio.Info{Name: fmt.Sprintf("f%03d", i), Mode: syscall.S_IFREG | 0644})); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := w.WriteTrailer(); err != nil {
+			b.Fatal(err)
+		}
+		big = buf.Bytes()
+	})
+	return big
+}
+
+// BenchmarkReadFile reads the last file of a big archive by name.
+func BenchmarkReadFile(b *testing.B) {
+	a := bigArchive(b)
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := archiver.FileReader(bytes.NewReader(a)).ReadFile("f199"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadFileSequential reads the last file of a big archive by
+// reading it all up to that file, as without a FileReader.
+func BenchmarkReadFileSequential(b *testing.B) {
+	a := bigArchive(b)
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := archiver.Reader(bytes.NewReader(a))
+		for {
+			rec, err := r.ReadRecord()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(ioutil.Discard, rec); err != nil {
+				b.Fatal(err)
+			}
+			if rec.Name == "f199" {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// bin reads the old binary cpio format, for old archives that are in
+// nothing else. It does not write it.
+//
+// The header fields are 16-bit words, in the byte order of the machine
+// that wrote the archive, which the magic, 070707, tells. The mtime and
+// size are two words each, the high one first. Device numbers are
+// major<<8 | minor. The header and name, and the contents, are padded to
+// an even length.
+package bin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+const (
+	magic     = 070707
+	headerLen = 26
+	// maxNameLength is the longest name, with its NUL, that the kernel
+	// would take: PATH_MAX.
+	maxNameLength = 4096
+)
+
+// ErrReadOnly is what writing a record returns.
+var ErrReadOnly = errors.New("bin: the old binary format can be read, not written; use newc or odc")
+
+type header struct {
+	Magic    uint16
+	Dev      uint16
+	Ino      uint16
+	Mode     uint16
+	UID      uint16
+	GID      uint16
+	NLink    uint16
+	Rdev     uint16
+	MTime    [2]uint16
+	NameSize uint16
+	FileSize [2]uint16
+}
+
+type format struct{}
+
+type writer struct{}
+
+func (format) Writer(w io.Writer) cpio.RecordWriter {
+	return writer{}
+}
+
+// WriteRecord returns ErrReadOnly.
+func (writer) WriteRecord(cpio.Record) error {
+	return ErrReadOnly
+}
+
+type reader struct {
+	r   io.ReaderAt
+	pos int64
+	// links has the contents of the regular files with more than one
+	// link read with them, by inode, device and mode.
+	links map[cpio.Info]*io.SectionReader
+}
+
+func (format) Reader(r io.ReaderAt) cpio.RecordReader {
+	return &reader{r: r, links: make(map[cpio.Info]*io.SectionReader)}
+}
+
+// Offset returns where the next record starts: after the trailer, where
+// the archive ends.
+func (r *reader) Offset() int64 {
+	return r.pos
+}
+
+// read reads len(p) bytes, or returns io.EOF if there are none to read.
+func (r *reader) read(p []byte) error {
+	n, err := r.r.ReadAt(p, r.pos)
+	if err == io.EOF && n == 0 {
+		return io.EOF
+	}
+	if err != nil && err != io.EOF || n != len(p) {
+		return fmt.Errorf("ReadAt(pos = %d): got %d, want %d bytes; error %v", r.pos, n, len(p), err)
+	}
+	r.pos += int64(n)
+	return nil
+}
+
+// pad2 returns n rounded up to an even number.
+func pad2(n int64) int64 {
+	return (n + 1) &^ 1
+}
+
+// ReadRecord returns the next record, or the trailer.
+func (r *reader) ReadRecord() (cpio.Record, error) {
+	start := r.pos
+	b := make([]byte, headerLen)
+	if err := r.read(b); err != nil {
+		return cpio.Record{}, err
+	}
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint16(b) == magic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint16(b) == magic:
+		order = binary.BigEndian
+	default:
+		return cpio.Record{}, fmt.Errorf("reader: header at %d: magic got %#x, want %#o in either byte order", start, b[:2], magic)
+	}
+	var h header
+	if err := binary.Read(bytes.NewReader(b), order, &h); err != nil {
+		return cpio.Record{}, err
+	}
+
+	if h.NameSize == 0 || h.NameSize > maxNameLength {
+		return cpio.Record{}, fmt.Errorf("reader: header at %d: name length %d is not between 1 and %d", start, h.NameSize, maxNameLength)
+	}
+	name := make([]byte, h.NameSize)
+	if err := r.read(name); err != nil {
+		return cpio.Record{}, err
+	}
+	r.pos = start + pad2(headerLen+int64(h.NameSize))
+
+	size := uint64(h.FileSize[0])<<16 | uint64(h.FileSize[1])
+	info := cpio.Info{
+		Ino:      uint64(h.Ino),
+		Mode:     uint64(h.Mode),
+		UID:      uint64(h.UID),
+		GID:      uint64(h.GID),
+		NLink:    uint64(h.NLink),
+		MTime:    uint64(h.MTime[0])<<16 | uint64(h.MTime[1]),
+		FileSize: size,
+		Major:    uint64(h.Dev >> 8),
+		Minor:    uint64(h.Dev & 0xff),
+		Rmajor:   uint64(h.Rdev >> 8),
+		Rminor:   uint64(h.Rdev & 0xff),
+		Name:     string(name[:h.NameSize-1]),
+	}
+	if size > 0 {
+		var last [1]byte
+		if n, _ := r.r.ReadAt(last[:], r.pos+int64(size)-1); n != 1 {
+			return cpio.Record{}, fmt.Errorf("reader: %s: size %d is more than is left of the archive", info.Name, size)
+		}
+	}
+	content := io.NewSectionReader(r.r, r.pos, int64(size))
+	r.pos = pad2(r.pos + int64(size))
+
+	if info.Mode&syscall.S_IFMT == syscall.S_IFREG && info.NLink > 1 {
+		k := cpio.Info{Ino: info.Ino, Mode: info.Mode, Major: info.Major, Minor: info.Minor}
+		if c, ok := r.links[k]; ok && size == 0 {
+			content = io.NewSectionReader(c, 0, c.Size())
+			info.FileSize = uint64(c.Size())
+		} else if size > 0 {
+			r.links[k] = content
+		}
+	}
+	return cpio.Record{ReadCloser: cpio.NewReadCloser(content), Info: info}, nil
+}
+
+func init() {
+	cpio.AddFormat("bin", format{})
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bin
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	_ "github.com/u-root/u-root/pkg/cpio/newc"
+)
+
+// list returns the records of the archive b, in format, as lines of name,
+// mode, links, mtime and contents.
+func list(t *testing.T, format string, b []byte) []string {
+	f, err := cpio.Format(format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := f.Reader(bytes.NewReader(b)).ReadRecords()
+	if err != nil {
+		t.Fatalf("%s: %v", format, err)
+	}
+	var l []string
+	for _, r := range recs {
+		c, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l = append(l, fmt.Sprintf("%s %o %d %d %q", r.Name, r.Mode, r.NLink, r.MTime, c))
+	}
+	return l
+}
+
+// toNewc returns the archive b, in bin, as a newc archive.
+func toNewc(t *testing.T, b []byte) []byte {
+	bin, err := cpio.Format("bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	w := newc.Writer(&out)
+	if err := w.Concat(bin.Reader(bytes.NewReader(b)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// testdata/little.cpio was made by bsdcpio -o -H bin, which, as GNU cpio
+// does, writes the contents with every link, and testdata/big.cpio is it
+// with the header words swapped.
+func TestRead(t *testing.T) {
+	want := []string{
+		`a 100644 2 1485152330 "shared contents\n"`,
+		`d 40755 2 1485152330 ""`,
+		`d/b 100644 2 1485152330 "shared contents\n"`,
+		`s 120777 1 1792134549 "a"`,
+		`x 100644 1 1485152330 "odd\n"`,
+		`y 100644 1 1485152330 "abc"`,
+	}
+	for _, name := range []string{"little.cpio", "big.cpio"} {
+		b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := list(t, "bin", b); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got\n%s\nwant\n%s", name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+		if got := list(t, "newc", toNewc(t, b)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s as newc: got\n%s\nwant\n%s", name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestReadBad(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/little.cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := cpio.Format("bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := func(n int, v uint16) []byte {
+		c := append([]byte(nil), b...)
+		c[2*n], c[2*n+1] = byte(v), byte(v>>8)
+		return c
+	}
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		err  string
+	}{
+		{"magic", field(0, 070701), "magic"},
+		{"name length 0", field(10, 0), "name length 0"},
+		{"name length too big", field(10, maxNameLength+1), "name length 4097"},
+		{"size past the end", field(11, 1), "more than is left"},
+		{"short", b[:20], "want 26 bytes"},
+	} {
+		_, err := f.Reader(bytes.NewReader(tt.b)).ReadRecords()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want an error with %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	f, err := cpio.Format("bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := f.Writer(&b).WriteRecord(cpio.NewRecordFromBytes([]byte("x"), cpio.Info{Name: "x"})); err != ErrReadOnly || b.Len() != 0 {
+		t.Errorf("WriteRecord: got %v with %d bytes written, want %v and none", err, b.Len(), ErrReadOnly)
+	}
+}
+
+// extract returns the names and contents of what GNU cpio extracts of
+// the archive b.
+func extract(t *testing.T, b []byte) []string {
+	dir, err := ioutil.TempDir("", "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := exec.Command("cpio", "-i", "-d", "--quiet")
+	c.Dir = dir
+	c.Stdin = bytes.NewReader(b)
+	if out, err := c.CombinedOutput(); err != nil {
+		t.Fatalf("cpio -i: %v: %s", err, out)
+	}
+	var l []string
+	if err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		line := fmt.Sprintf("%s %v", rel, fi.Mode())
+		switch fi.Mode() & os.ModeType {
+		case 0:
+			c, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			line += fmt.Sprintf(" %q", c)
+		case os.ModeSymlink:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			line += " -> " + target
+		}
+		l = append(l, line)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func TestGNUCpio(t *testing.T) {
+	if _, err := exec.LookPath("cpio"); err != nil {
+		t.Skip("cpio is not installed")
+	}
+	for _, name := range []string{"little.cpio", "big.cpio"} {
+		b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := extract(t, toNewc(t, b)), extract(t, b); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: as newc, cpio -i made\n%s\nwant what it made of the original\n%s", name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
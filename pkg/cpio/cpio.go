@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"path/filepath"
+	"strconv"
 )
 
 var (
@@ -43,7 +45,13 @@ func (a Archiver) Reader(r io.ReaderAt) Reader {
 }
 
 func (a Archiver) Writer(w io.Writer) Writer {
-	return Writer{rw: a.RecordFormat.Writer(w), alreadyWritten: make(map[string]struct{})}
+	return NewWriter(a.RecordFormat.Writer(w))
+}
+
+// NewWriter returns a Writer writing to rw, for a RecordWriter made other
+// than by a RecordFormat, such as one with options.
+func NewWriter(rw RecordWriter) Writer {
+	return Writer{rw: rw, alreadyWritten: make(map[string]struct{}), links: make(map[Info]struct{})}
 }
 
 type Reader struct {
@@ -83,25 +91,66 @@ type Writer struct {
 	// duplicate names when the record is written,
 	// and lots of harm done if we don't do it.
 	alreadyWritten map[string]struct{}
+
+	// links are the regular files with more than one link whose
+	// contents were written, by inode, device and mode.
+	links map[Info]struct{}
 }
 
 func (w Writer) WriteRecord(rec Record) error {
-	// we do NOT write records with absolute paths.
+	rec, err := relative(rec)
+	if err != nil {
+		return err
+	}
+	if _, ok := w.alreadyWritten[rec.Name]; ok {
+		return nil
+	}
+	return w.WriteDuplicate(rec)
+}
+
+// WriteDuplicate is WriteRecord without the stripping of duplicate names,
+// for callers that want the kernel's behavior of the last record of a name
+// winning.
+//
+// Of the links to a regular file, only the first written has the contents;
+// the rest are written without them, and the kernel, which knows them by
+// their inode, device, mode and more than one link, makes them links to it.
+func (w Writer) WriteDuplicate(rec Record) error {
+	rec, err := relative(rec)
+	if err != nil {
+		return err
+	}
+	w.alreadyWritten[rec.Name] = struct{}{}
+	if rec.Mode&modeTypeMask == modeFile && rec.NLink > 1 && rec.ReadCloser != nil {
+		k := Info{Ino: rec.Ino, Mode: rec.Mode, Major: rec.Major, Minor: rec.Minor}
+		switch _, ok := w.links[k]; {
+		case ok:
+			if err := rec.Close(); err != nil {
+				return err
+			}
+			rec.ReadCloser = nil
+		// An archive whose last link has the contents, as GNU
+		// cpio writes it, is written as it is.
+		case rec.FileSize > 0:
+			w.links[k] = struct{}{}
+		}
+	}
+	return w.rw.WriteRecord(rec)
+}
+
+// relative makes rec's name relative, since we do NOT write records with
+// absolute paths.
+func relative(rec Record) (Record, error) {
 	if filepath.IsAbs(rec.Name) {
 		// There's no constant that means "root".
 		// PathSeparator is not really quite right.
 		rel, err := filepath.Rel("/", rec.Name)
 		if err != nil {
-			return fmt.Errorf("Can't make %s relative to /?", rec.Name)
+			return Record{}, fmt.Errorf("Can't make %s relative to /?", rec.Name)
 		}
 		rec.Name = rel
 	}
-
-	if _, ok := w.alreadyWritten[rec.Name]; ok {
-		return nil
-	}
-	w.alreadyWritten[rec.Name] = struct{}{}
-	return w.rw.WriteRecord(rec)
+	return rec, nil
 }
 
 // WriteRecords writes multiple records.
@@ -119,19 +168,24 @@ func (w Writer) WriteTrailer() error {
 	return w.WriteRecord(TrailerRecord)
 }
 
-// Concat reads files from r one at a time, and writes them to w.
-func (w Writer) Concat(r Reader, transform func(Record) Record) error {
+// Copy reads records from r one at a time, up to its trailer, and writes
+// them to w, through transform if it is not nil. Those it leaves out are
+// not written, and neither is the trailer, so that more can be written
+// after them.
+func Copy(w RecordWriter, r RecordReader, transform RecordFunc) error {
 	// Read and write one file at a time. We don't want all that in memory.
 	for {
 		f, err := r.ReadRecord()
-		if err == io.EOF {
+		if err == io.EOF || err == nil && f.Name == Trailer {
 			return nil
 		}
 		if err != nil {
 			return err
 		}
 		if transform != nil {
-			f = transform(f)
+			if f = transform(f); Skipped(f) {
+				continue
+			}
 		}
 		if err := w.WriteRecord(f); err != nil {
 			return err
@@ -139,15 +193,35 @@ func (w Writer) Concat(r Reader, transform func(Record) Record) error {
 	}
 }
 
+// Concat reads files from r one at a time, and writes them to w, through
+// transform if it is not nil. Those it leaves out are not written.
+func (w Writer) Concat(r Reader, transform RecordFunc) error {
+	return Copy(w, r, transform)
+}
+
 // MakeReproducible changes any fields in a Record such that
 // if we run cpio again, with the same files presented to it
 // in the same order, and those files have unchanged contents,
 // the cpio file it produces will be bit-for-bit
 // identical. This is an essential property for firmware-embedded
 // payloads.
+//
+// The mtime is set to $SOURCE_DATE_EPOCH if that is set, see
+// https://reproducible-builds.org/specs/source-date-epoch/, and 0 otherwise.
+// The device the file came from is cleared too. A Normalizer does more.
 func MakeReproducible(file Record) Record {
-	file.MTime = 0
-	return file
+	epoch := int64(SourceDateEpoch())
+	return Normalizer{Epoch: &epoch}.normalize(file)
+}
+
+// SourceDateEpoch returns $SOURCE_DATE_EPOCH, or 0 if it is not set or not
+// a number.
+func SourceDateEpoch() uint64 {
+	t, err := strconv.ParseUint(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return t
 }
 
 func MakeAllReproducible(files []Record) {
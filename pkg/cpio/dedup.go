@@ -0,0 +1,178 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// DedupPolicy is what a DedupWriter does with a record whose name it has
+// already written.
+type DedupPolicy int
+
+const (
+	// SkipDuplicates leaves the record out.
+	SkipDuplicates DedupPolicy = iota
+	// ErrorOnDuplicates returns an error.
+	ErrorOnDuplicates
+	// SkipIdentical leaves the record out if it is the same as the one
+	// written, with the same mode, device numbers and contents, and
+	// returns an error if it is not.
+	SkipIdentical
+)
+
+// DedupWriter is a RecordWriter that writes each name once, and does what
+// its DedupPolicy says with the records of names it has written.
+//
+// It keeps the names it has written in a map, and nothing else unless the
+// policy is SkipIdentical. Even then, contents are only hashed when a name
+// comes again: those of the record written are read again from the file
+// or archive they came from, if they came from one, and only contents that
+// can not be read again are hashed as they are written.
+type DedupWriter struct {
+	w      RecordWriter
+	policy DedupPolicy
+	onSkip func(Record)
+	names  map[string]*dedupRecord
+}
+
+// dedupRecord is what a DedupWriter keeps of a record it wrote.
+type dedupRecord struct {
+	info Info
+	// reopen returns the contents again, if they can be read again.
+	reopen func() io.ReadCloser
+	// sum is the SHA-256 of the contents that can not be read again.
+	sum []byte
+}
+
+// NewDedupWriter returns a DedupWriter writing to w. onSkip, if it is not
+// nil, is called with each record left out, before its contents are
+// closed.
+func NewDedupWriter(w RecordWriter, policy DedupPolicy, onSkip func(Record)) *DedupWriter {
+	return &DedupWriter{w: w, policy: policy, onSkip: onSkip, names: make(map[string]*dedupRecord)}
+}
+
+// WriteRecord writes r, unless a record of its name was written before.
+// Names are compared as an Archive looks them up, so that "/etc/motd" and
+// "etc/motd" are the same. The trailer is always written.
+func (d *DedupWriter) WriteRecord(r Record) error {
+	if r.Name == Trailer {
+		return d.w.WriteRecord(r)
+	}
+	name := archiveName(r.Name)
+	if w, ok := d.names[name]; ok {
+		return d.duplicate(w, r)
+	}
+
+	dr := &dedupRecord{info: r.Info}
+	if r.ReadCloser == nil {
+		dr.info.FileSize = 0
+	}
+	d.names[name] = dr
+	if d.policy != SkipIdentical || r.ReadCloser == nil {
+		return d.w.WriteRecord(r)
+	}
+	var h hash.Hash
+	switch c := r.ReadCloser.(type) {
+	case *LazyOpen:
+		name := c.Name
+		dr.reopen = func() io.ReadCloser { return NewDeferReadCloser(name) }
+	case io.ReaderAt:
+		size := int64(r.FileSize)
+		dr.reopen = func() io.ReadCloser { return NewReadCloser(io.NewSectionReader(c, 0, size)) }
+	default:
+		h = sha256.New()
+		r.ReadCloser = hashReadCloser{r.ReadCloser, h}
+	}
+	if err := d.w.WriteRecord(r); err != nil {
+		return err
+	}
+	if h != nil {
+		dr.sum = h.Sum(nil)
+	}
+	return nil
+}
+
+// duplicate does what d's policy says with r, whose name was written
+// before as w.
+func (d *DedupWriter) duplicate(w *dedupRecord, r Record) error {
+	if r.ReadCloser != nil {
+		defer r.Close()
+	}
+	switch d.policy {
+	case ErrorOnDuplicates:
+		return fmt.Errorf("%s: written before", r.Name)
+	case SkipIdentical:
+		if err := w.identical(r); err != nil {
+			return fmt.Errorf("%s: written before, %v", r.Name, err)
+		}
+	}
+	if d.onSkip != nil {
+		d.onSkip(r)
+	}
+	return nil
+}
+
+// identical returns an error saying how r differs from w, if it does.
+func (w *dedupRecord) identical(r Record) error {
+	switch {
+	case r.Mode != w.info.Mode:
+		return fmt.Errorf("with mode %#o, not %#o", w.info.Mode, r.Mode)
+	case r.Rmajor != w.info.Rmajor || r.Rminor != w.info.Rminor:
+		return fmt.Errorf("as device %d,%d, not %d,%d", w.info.Rmajor, w.info.Rminor, r.Rmajor, r.Rminor)
+	}
+	size := r.FileSize
+	if r.ReadCloser == nil {
+		size = 0
+	}
+	if size != w.info.FileSize {
+		return fmt.Errorf("with %d bytes, not %d", w.info.FileSize, size)
+	}
+	if size == 0 {
+		return nil
+	}
+
+	sum, err := sha256Sum(r.ReadCloser)
+	if err != nil {
+		return err
+	}
+	want := w.sum
+	if want == nil && w.reopen != nil {
+		c := w.reopen()
+		want, err = sha256Sum(c)
+		c.Close()
+		if err != nil {
+			return fmt.Errorf("reading it again: %v", err)
+		}
+	}
+	if !bytes.Equal(sum, want) {
+		return fmt.Errorf("with different contents")
+	}
+	return nil
+}
+
+func sha256Sum(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// hashReadCloser hashes what is read through it.
+type hashReadCloser struct {
+	io.ReadCloser
+	h hash.Hash
+}
+
+func (h hashReadCloser) Read(p []byte) (int, error) {
+	n, err := h.ReadCloser.Read(p)
+	h.h.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// nameWriter is a RecordWriter that notes the names of the records and
+// reads their contents.
+type nameWriter struct {
+	names []string
+}
+
+func (w *nameWriter) WriteRecord(r cpio.Record) error {
+	if r.ReadCloser != nil {
+		if _, err := ioutil.ReadAll(r); err != nil {
+			return err
+		}
+		r.Close()
+	}
+	w.names = append(w.names, r.Name)
+	return nil
+}
+
+func TestDedupWriter(t *testing.T) {
+	file := func(name, contents string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(contents), cpio.Info{Name: name, Mode: syscall.S_IFREG | 0644})
+	}
+	dir := func(name string) cpio.Record {
+		return cpio.Record{Info: cpio.Info{Name: name, Mode: syscall.S_IFDIR | 0755}}
+	}
+	for _, tt := range []struct {
+		name    string
+		policy  cpio.DedupPolicy
+		recs    []cpio.Record
+		written []string
+		skipped []string
+		err     string
+	}{
+		{"skip", cpio.SkipDuplicates, []cpio.Record{dir("etc"), file("etc/motd", "a"), file("/etc/motd", "b"), dir("etc/")},
+			[]string{"etc", "etc/motd"}, []string{"/etc/motd", "etc/"}, ""},
+		{"error", cpio.ErrorOnDuplicates, []cpio.Record{file("a", "a"), file("./a", "a")},
+			[]string{"a"}, nil, "./a: written before"},
+		{"identical", cpio.SkipIdentical, []cpio.Record{dir("etc"), file("etc/motd", "a"), file("etc/motd", "a"), dir("etc")},
+			[]string{"etc", "etc/motd"}, []string{"etc/motd", "etc"}, ""},
+		{"different contents", cpio.SkipIdentical, []cpio.Record{file("a", "a"), file("a", "b")},
+			[]string{"a"}, nil, "a: written before, with different contents"},
+		{"different size", cpio.SkipIdentical, []cpio.Record{file("a", "a"), file("a", "ab")},
+			[]string{"a"}, nil, "with 1 bytes, not 2"},
+		{"different mode", cpio.SkipIdentical, []cpio.Record{file("a", "a"), dir("a")},
+			[]string{"a"}, nil, "with mode 0100644, not 040755"},
+		{"trailer", cpio.ErrorOnDuplicates, []cpio.Record{cpio.TrailerRecord, cpio.TrailerRecord},
+			[]string{cpio.Trailer, cpio.Trailer}, nil, ""},
+	} {
+		var w nameWriter
+		var skipped []string
+		d := cpio.NewDedupWriter(&w, tt.policy, func(r cpio.Record) { skipped = append(skipped, r.Name) })
+		var err error
+		for _, r := range tt.recs {
+			if err = d.WriteRecord(r); err != nil {
+				break
+			}
+		}
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+		if !reflect.DeepEqual(w.names, tt.written) || !reflect.DeepEqual(skipped, tt.skipped) {
+			t.Errorf("%s: wrote %q and skipped %q, want %q and %q", tt.name, w.names, skipped, tt.written, tt.skipped)
+		}
+	}
+}
+
+// TestDedupWriterContents compares contents from files, which are read
+// again, and from streams, which are hashed as they are written.
+func TestDedupWriterContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for n, c := range map[string]string{"a": "same", "b": "same", "c": "else"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, n), []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	onDisk := func(n string) cpio.Record {
+		return cpio.Record{ReadCloser: cpio.NewDeferReadCloser(filepath.Join(dir, n)), Info: cpio.Info{Name: "f", Mode: syscall.S_IFREG | 0644, FileSize: 4}}
+	}
+	stream := func(c string) cpio.Record {
+		return cpio.Record{ReadCloser: ioutil.NopCloser(strings.NewReader(c)), Info: cpio.Info{Name: "f", Mode: syscall.S_IFREG | 0644, FileSize: uint64(len(c))}}
+	}
+	for _, tt := range []struct {
+		name  string
+		first cpio.Record
+		again cpio.Record
+		same  bool
+	}{
+		{"files", onDisk("a"), onDisk("b"), true},
+		{"different files", onDisk("a"), onDisk("c"), false},
+		{"stream, then file", stream("same"), onDisk("b"), true},
+		{"file, then stream", onDisk("a"), stream("else"), false},
+		{"streams", stream("same"), stream("same"), true},
+	} {
+		d := cpio.NewDedupWriter(&nameWriter{}, cpio.SkipIdentical, nil)
+		if err := d.WriteRecord(tt.first); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := d.WriteRecord(tt.again); (err == nil) != tt.same {
+			t.Errorf("%s: got %v, want the same: %v", tt.name, err, tt.same)
+		}
+	}
+}
+
+func BenchmarkDedupWriter(b *testing.B) {
+	recs := make([]cpio.Record, 200000)
+	for i := range recs {
+		recs[i] = cpio.Record{Info: cpio.Info{Name: fmt.Sprintf("usr/lib/%d/%d", i/100, i), Mode: syscall.S_IFREG | 0644}}
+	}
+	for i := 0; i < b.N; i++ {
+		d := cpio.NewDedupWriter(&nameWriter{}, cpio.SkipIdentical, nil)
+		for _, r := range recs {
+			if err := d.WriteRecord(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"os"
+)
+
+// CharDev returns the record of the character device node name, with the
+// permissions and set-ID and sticky bits of mode, and the device numbers
+// major and minor, as dev/console is CharDev("dev/console", 0600, 5, 1).
+func CharDev(name string, mode os.FileMode, major, minor uint64) Record {
+	return Record{Info: Info{Name: name, Mode: modeChar | unixPerm(mode), Rmajor: major, Rminor: minor}}
+}
+
+// BlockDev returns the record of a block device node, as CharDev does of a
+// character one.
+func BlockDev(name string, mode os.FileMode, major, minor uint64) Record {
+	return Record{Info: Info{Name: name, Mode: modeBlock | unixPerm(mode), Rmajor: major, Rminor: minor}}
+}
+
+// DevMajor returns the major number of the device node i is, or 0 if it is
+// not one. It is not the Major field, which is of the device the file was
+// on.
+func (i Info) DevMajor() uint64 {
+	if !i.isDevice() {
+		return 0
+	}
+	return i.Rmajor
+}
+
+// DevMinor returns the minor number of the device node i is, or 0 if it is
+// not one.
+func (i Info) DevMinor() uint64 {
+	if !i.isDevice() {
+		return 0
+	}
+	return i.Rminor
+}
+
+func (i Info) isDevice() bool {
+	t := i.Mode & modeTypeMask
+	return t == modeChar || t == modeBlock
+}
+
+// unixPerm returns the permissions and set-ID and sticky bits of m as
+// mode_t bits.
+func unixPerm(m os.FileMode) uint64 {
+	p := uint64(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		p |= modeSUID
+	}
+	if m&os.ModeSetgid != 0 {
+		p |= modeSGID
+	}
+	if m&os.ModeSticky != 0 {
+		p |= modeSticky
+	}
+	return p
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestDevices(t *testing.T) {
+	for _, tt := range []struct {
+		r            cpio.Record
+		mode         uint64
+		major, minor uint64
+		long         string
+	}{
+		{cpio.CharDev("dev/console", 0600, 5, 1), syscall.S_IFCHR | 0600, 5, 1, "crw------- 0 0 5,1 1970-01-01 dev/console"},
+		{cpio.CharDev("dev/tty", os.ModeSetgid|0620, 4, 64), syscall.S_IFCHR | 02620, 4, 64, "crw--wS--- 0 0 4,64 1970-01-01 dev/tty"},
+		// Device numbers go past 8 bits, up to the 12 of a major number
+		// and 20 of a minor one Linux has.
+		{cpio.BlockDev("dev/nvme0n1p9", 0660, 259, 1048575), syscall.S_IFBLK | 0660, 259, 1048575, "brw-rw---- 0 0 259,1048575 1970-01-01 dev/nvme0n1p9"},
+		{cpio.CharDev("dev/big", 0600, 4095, 256), syscall.S_IFCHR | 0600, 4095, 256, "crw------- 0 0 4095,256 1970-01-01 dev/big"},
+	} {
+		if tt.r.Mode != tt.mode || tt.r.DevMajor() != tt.major || tt.r.DevMinor() != tt.minor {
+			t.Errorf("%s: got mode %#o, %d,%d, want mode %#o, %d,%d", tt.r.Name, tt.r.Mode, tt.r.DevMajor(), tt.r.DevMinor(), tt.mode, tt.major, tt.minor)
+		}
+		if got := cpio.FormatLong(tt.r); got != tt.long {
+			t.Errorf("FormatLong: got %q, want %q", got, tt.long)
+		}
+	}
+
+	// Only device nodes have device numbers.
+	r := cpio.NewRecordFromBytes(nil, cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644, Rmajor: 1, Rminor: 3})
+	if r.DevMajor() != 0 || r.DevMinor() != 0 {
+		t.Errorf("DevMajor and DevMinor of a file: got %d,%d, want 0,0", r.DevMajor(), r.DevMinor())
+	}
+
+	if _, err := os.Stat("/dev/null"); err != nil {
+		t.Skipf("no /dev/null: %v", err)
+	}
+	if r, err := cpio.NewRecordFromPath("/dev/null", "dev/null"); err != nil || r.Mode&syscall.S_IFMT != syscall.S_IFCHR || r.DevMajor() != 1 || r.DevMinor() != 3 {
+		t.Errorf("NewRecordFromPath(/dev/null): got mode %#o, %d,%d, %v, want a character device 1,3", r.Mode, r.DevMajor(), r.DevMinor(), err)
+	}
+}
+
+// TestExtractDevices makes the nodes, which takes being root, and reads
+// them back.
+func TestExtractDevices(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("not root")
+	}
+	dir, err := ioutil.TempDir("", "cpio-devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recs := []cpio.Record{
+		cpio.CharDev("dev/console", 0600, 5, 1),
+		cpio.BlockDev("dev/nvme0n1p9", 0660, 259, 1048575),
+		cpio.CharDev("dev/big", 0600, 4095, 256),
+	}
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.Extract(archiver.Reader(bytes.NewReader(archive(t, recs...))), dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range recs {
+		r, err := cpio.NewRecordFromPath(filepath.Join(dir, want.Name), want.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Mode != want.Mode || r.DevMajor() != want.DevMajor() || r.DevMinor() != want.DevMinor() {
+			t.Errorf("%s: got mode %#o, %d,%d, want mode %#o, %d,%d", want.Name, r.Mode, r.DevMajor(), r.DevMinor(), want.Mode, want.DevMajor(), want.DevMinor())
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// DiffTextSize is the size up to which the contents of text files are kept
+// by Diff, for a line diff of those that differ. Larger files are only
+// compared by hash.
+var DiffTextSize = 8 << 10
+
+// DiffResult is how two archives differ, by name. Names are compared as an
+// Archive looks them up, so that "/etc/motd" and "etc/motd" are the same,
+// and the last record of a name is the one compared, as the kernel keeps
+// the last one it unpacks.
+type DiffResult struct {
+	// OnlyA and OnlyB are the records only in the first archive and only
+	// in the second, sorted by name.
+	OnlyA, OnlyB []Info
+	// Changed are the records in both that differ, sorted by name.
+	Changed []RecordDiff
+}
+
+// RecordDiff is how a record in two archives differs.
+type RecordDiff struct {
+	A, B Info
+	// Fields names what differs: "mode", "uid", "gid", "dev", "size",
+	// "mtime" and "contents", in that order.
+	Fields []string
+	// Lines is a line diff of the contents, if they differ and are text
+	// of up to DiffTextSize bytes on both sides. Each line starts with
+	// ' ' if it is in both, '-' if it is only in A and '+' if it is only
+	// in B.
+	Lines []string
+}
+
+// Empty returns whether the archives are the same.
+func (d *DiffResult) Empty() bool {
+	return len(d.OnlyA) == 0 && len(d.OnlyB) == 0 && len(d.Changed) == 0
+}
+
+// diffRecord is what Diff keeps of a record: its Info, the hash of its
+// contents and, for small text files, the contents themselves.
+type diffRecord struct {
+	info Info
+	sum  []byte
+	text []byte
+}
+
+// Diff returns how the archives read from a and b differ, reading each up
+// to its trailer. Contents are hashed as they are read; only those of
+// small text files are kept.
+func Diff(a, b RecordReader) (*DiffResult, error) {
+	as, err := diffRecords(a)
+	if err != nil {
+		return nil, fmt.Errorf("first archive: %v", err)
+	}
+	bs, err := diffRecords(b)
+	if err != nil {
+		return nil, fmt.Errorf("second archive: %v", err)
+	}
+
+	d := &DiffResult{}
+	for name, ar := range as {
+		br, ok := bs[name]
+		if !ok {
+			d.OnlyA = append(d.OnlyA, ar.info)
+			continue
+		}
+		if rd, ok := diffRecordPair(ar, br); ok {
+			d.Changed = append(d.Changed, rd)
+		}
+	}
+	for name, br := range bs {
+		if _, ok := as[name]; !ok {
+			d.OnlyB = append(d.OnlyB, br.info)
+		}
+	}
+	sort.Slice(d.OnlyA, func(i, j int) bool { return archiveName(d.OnlyA[i].Name) < archiveName(d.OnlyA[j].Name) })
+	sort.Slice(d.OnlyB, func(i, j int) bool { return archiveName(d.OnlyB[i].Name) < archiveName(d.OnlyB[j].Name) })
+	sort.Slice(d.Changed, func(i, j int) bool { return archiveName(d.Changed[i].A.Name) < archiveName(d.Changed[j].A.Name) })
+	return d, nil
+}
+
+// diffRecords reads rr up to its trailer, keeping what Diff compares.
+func diffRecords(rr RecordReader) (map[string]*diffRecord, error) {
+	m := make(map[string]*diffRecord)
+	for {
+		r, err := rr.ReadRecord()
+		if err == io.EOF || err == nil && r.Name == Trailer {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		dr := &diffRecord{info: r.Info}
+		if r.ReadCloser == nil {
+			dr.info.FileSize = 0
+		} else {
+			err := dr.read(r)
+			if cerr := r.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", r.Name, err)
+			}
+		}
+		m[archiveName(r.Name)] = dr
+	}
+}
+
+// read hashes the contents of r, keeping those of a small text file.
+func (dr *diffRecord) read(r Record) error {
+	h := sha256.New()
+	if r.Mode&modeTypeMask != modeFile || r.FileSize > uint64(DiffTextSize) {
+		if _, err := io.Copy(h, r); err != nil {
+			return err
+		}
+		dr.sum = h.Sum(nil)
+		return nil
+	}
+	var b bytes.Buffer
+	if _, err := io.Copy(io.MultiWriter(h, &b), r); err != nil {
+		return err
+	}
+	dr.sum = h.Sum(nil)
+	if isText(b.Bytes()) {
+		dr.text = b.Bytes()
+	}
+	return nil
+}
+
+// isText returns whether b looks like text: UTF-8 with no NULs.
+func isText(b []byte) bool {
+	return utf8.Valid(b) && bytes.IndexByte(b, 0) < 0
+}
+
+// diffRecordPair returns how a and b differ, and whether they do.
+func diffRecordPair(a, b *diffRecord) (RecordDiff, bool) {
+	rd := RecordDiff{A: a.info, B: b.info}
+	for _, f := range []struct {
+		name string
+		diff bool
+	}{
+		{"mode", a.info.Mode != b.info.Mode},
+		{"uid", a.info.UID != b.info.UID},
+		{"gid", a.info.GID != b.info.GID},
+		{"dev", a.info.Rmajor != b.info.Rmajor || a.info.Rminor != b.info.Rminor},
+		{"size", a.info.FileSize != b.info.FileSize},
+		{"mtime", a.info.MTime != b.info.MTime},
+		{"contents", !bytes.Equal(a.sum, b.sum)},
+	} {
+		if f.diff {
+			rd.Fields = append(rd.Fields, f.name)
+		}
+	}
+	if len(rd.Fields) == 0 {
+		return rd, false
+	}
+	if a.text != nil && b.text != nil && !bytes.Equal(a.sum, b.sum) {
+		rd.Lines = lineDiff(splitLines(a.text), splitLines(b.text))
+	}
+	return rd, true
+}
+
+func splitLines(b []byte) []string {
+	return strings.SplitAfter(string(b), "\n")
+}
+
+// lineDiff returns the lines of a and b, marked as RecordDiff.Lines marks
+// them, by their longest common subsequence. It is quadratic, and meant
+// for files of up to DiffTextSize.
+func lineDiff(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var l []string
+	line := func(c byte, s string) {
+		if s != "" {
+			l = append(l, string(c)+strings.TrimSuffix(s, "\n"))
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			line(' ', a[i])
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			line('-', a[i])
+			i++
+		default:
+			line('+', b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		line('-', a[i])
+	}
+	for ; j < len(b); j++ {
+		line('+', b[j])
+	}
+	return l
+}
+
+// diffContext is how many lines in both files Report shows around those
+// that differ.
+const diffContext = 2
+
+// Report writes d to w, a line for each record only in A, marked '-', and
+// only in B, marked '+', as FormatLong lists them, and for each that
+// differs, '~' and what differs, followed by its line diff, if it has
+// one, with a few lines of context, e.g.
+//
+//	~ etc/motd: size 6 -> 7, contents
+//	  -hello
+//	  +hello!
+func (d *DiffResult) Report(w io.Writer) error {
+	var b bytes.Buffer
+	for _, i := range d.OnlyA {
+		fmt.Fprintf(&b, "- %s\n", formatLong(i, ""))
+	}
+	for _, i := range d.OnlyB {
+		fmt.Fprintf(&b, "+ %s\n", formatLong(i, ""))
+	}
+	for _, rd := range d.Changed {
+		var fields []string
+		for _, f := range rd.Fields {
+			switch f {
+			case "mode":
+				fields = append(fields, fmt.Sprintf("mode %s -> %s", modeString(rd.A.Mode), modeString(rd.B.Mode)))
+			case "uid":
+				fields = append(fields, fmt.Sprintf("uid %d -> %d", rd.A.UID, rd.B.UID))
+			case "gid":
+				fields = append(fields, fmt.Sprintf("gid %d -> %d", rd.A.GID, rd.B.GID))
+			case "dev":
+				fields = append(fields, fmt.Sprintf("dev %d,%d -> %d,%d", rd.A.Rmajor, rd.A.Rminor, rd.B.Rmajor, rd.B.Rminor))
+			case "size":
+				fields = append(fields, fmt.Sprintf("size %d -> %d", rd.A.FileSize, rd.B.FileSize))
+			case "mtime":
+				fields = append(fields, fmt.Sprintf("mtime %d -> %d", rd.A.MTime, rd.B.MTime))
+			default:
+				fields = append(fields, f)
+			}
+		}
+		fmt.Fprintf(&b, "~ %s: %s\n", archiveName(rd.A.Name), strings.Join(fields, ", "))
+		writeLines(&b, rd.Lines)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// writeLines writes the lines of a line diff that differ, and those within
+// diffContext of them, with "..." where lines are left out.
+func writeLines(w io.Writer, lines []string) {
+	show := make([]bool, len(lines))
+	for i, l := range lines {
+		if l[0] == ' ' {
+			continue
+		}
+		for j := i - diffContext; j <= i+diffContext; j++ {
+			if j >= 0 && j < len(lines) {
+				show[j] = true
+			}
+		}
+	}
+	skipped := false
+	for i, l := range lines {
+		if !show[i] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			fmt.Fprintln(w, "  ...")
+			skipped = false
+		}
+		fmt.Fprintf(w, "  %s\n", l)
+	}
+	if skipped {
+		fmt.Fprintln(w, "  ...")
+	}
+}
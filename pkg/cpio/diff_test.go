@@ -0,0 +1,108 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestDiff(t *testing.T) {
+	file := func(name, contents string, mode uint64) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(contents), cpio.Info{Name: name, Mode: syscall.S_IFREG | mode, MTime: 1234567890})
+	}
+	motd := "one\ntwo\nthree\nfour\nfive\nsix\nseven\n"
+	a := func() []cpio.Record {
+		return []cpio.Record{
+			{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}},
+			file("etc/motd", motd, 0644),
+			file("etc/old", "old\n", 0644),
+			file("bin/init", "\x7fELF\x00", 0755),
+			file("same", "same\n", 0644),
+			{Info: cpio.Info{Name: "dev/null", Mode: syscall.S_IFCHR | 0666, Rmajor: 1, Rminor: 3}},
+		}
+	}
+	b := []cpio.Record{
+		{Info: cpio.Info{Name: "/etc", Mode: syscall.S_IFDIR | 0755}},
+		file("etc/motd", strings.Replace(motd, "six", "6", 1), 0644),
+		file("etc/new", "new\n", 0644),
+		file("bin/init", "\x7fELF\x01", 0755),
+		file("same", "same\n", 0644),
+		{Info: cpio.Info{Name: "dev/null", Mode: syscall.S_IFCHR | 0666, Rmajor: 1, Rminor: 5}},
+		{Info: cpio.Info{Name: "tmp", Mode: syscall.S_IFDIR | 0777, UID: 1000}},
+		{Info: cpio.Info{Name: "tmp", Mode: syscall.S_IFDIR | 01777}},
+	}
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := cpio.Diff(archiver.Reader(bytes.NewReader(archive(t, a()...))), archiver.Reader(bytes.NewReader(archive(t, b...))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Empty() {
+		t.Fatal("Diff: got no differences")
+	}
+	var fields []string
+	for _, rd := range d.Changed {
+		fields = append(fields, rd.A.Name+": "+strings.Join(rd.Fields, " "))
+	}
+	if want := []string{"bin/init: contents", "dev/null: dev", "etc/motd: size contents"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("Changed: got %q, want %q", fields, want)
+	}
+	if want := []string{" four", " five", "-six", "+6", " seven"}; !reflect.DeepEqual(d.Changed[2].Lines[3:], want) {
+		t.Errorf("Lines: got %q, want %q", d.Changed[2].Lines, want)
+	}
+
+	var r bytes.Buffer
+	if err := d.Report(&r); err != nil {
+		t.Fatal(err)
+	}
+	want := `- -rw-r--r-- 0 0 4 2009-02-13 etc/old
++ -rw-r--r-- 0 0 4 2009-02-13 etc/new
++ drwxrwxrwt 0 0 0 1970-01-01 tmp
+~ bin/init: contents
+~ dev/null: dev 1,3 -> 1,5
+~ etc/motd: size 34 -> 32, contents
+  ...
+   four
+   five
+  -six
+  +6
+   seven
+`
+	if r.String() != want {
+		t.Errorf("Report: got\n%s\nwant\n%s", r.String(), want)
+	}
+
+	// An archive is the same as itself.
+	d, err = cpio.Diff(archiver.Reader(bytes.NewReader(archive(t, a()...))), archiver.Reader(bytes.NewReader(archive(t, a()...))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Empty() {
+		t.Errorf("Diff of an archive with itself: got %+v, want no differences", d)
+	}
+}
+
+func TestDiffTextSize(t *testing.T) {
+	defer func(n int) { cpio.DiffTextSize = n }(cpio.DiffTextSize)
+	cpio.DiffTextSize = 4
+	a := cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "motd", Mode: syscall.S_IFREG | 0644})
+	b := cpio.NewRecordFromBytes([]byte("howdy\n"), cpio.Info{Name: "motd", Mode: syscall.S_IFREG | 0644})
+	d, err := cpio.Diff(&records{a, cpio.TrailerRecord}, &records{b, cpio.TrailerRecord})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Changed) != 1 || d.Changed[0].Lines != nil {
+		t.Errorf("Diff of files larger than DiffTextSize: got %+v, want contents differing with no line diff", d.Changed)
+	}
+}
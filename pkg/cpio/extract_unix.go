@@ -0,0 +1,232 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Extractor is a RecordWriter that creates the records written to it under
+// Root, as the kernel unpacks an initramfs with Root as /. Nothing, not
+// even a name like ../../etc/passwd or one below a symlink to /etc, is
+// created outside Root.
+//
+// Ownership is set where it can be. What is not made, the ownership that
+// could not be set, device nodes unless MakeDevices is set, and sockets,
+// is passed to Deferred, for the caller to apply some other way.
+type Extractor struct {
+	Root string
+	// MakeDevices makes device nodes, which takes being root.
+	MakeDevices bool
+	// Deferred, if it is not nil, is called with the records, or just
+	// the ownership of the records, that were not made.
+	Deferred func(Info)
+
+	// dirs are the directories made, whose modes are set at the end so
+	// that a read-only one can still be filled.
+	dirs  []Record
+	links Linker
+}
+
+// NewExtractor returns an Extractor creating records under root, which
+// makes device nodes if it is run as root.
+func NewExtractor(root string) *Extractor {
+	return &Extractor{Root: root, MakeDevices: os.Geteuid() == 0}
+}
+
+// Extract creates the records of rr under root, up to the trailer, with
+// NewExtractor.
+func Extract(rr RecordReader, root string) error {
+	e := NewExtractor(root)
+	if err := Copy(e, rr, nil); err != nil {
+		return err
+	}
+	return e.Finish()
+}
+
+// Resolve returns the path under Root for name, following the symlinks
+// already made as the kernel would, as if Root were /. The last element
+// of name is not followed, as it is what a record makes.
+func (e *Extractor) Resolve(name string) (string, error) {
+	var (
+		done  string
+		links int
+	)
+	rest := strings.Split(strings.TrimLeft(path.Clean("/"+name), "/"), "/")
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+		if c == "" || c == "." {
+			continue
+		}
+		if c == ".." {
+			done = path.Dir(done)
+			continue
+		}
+		next := path.Join(done, c)
+		if len(rest) == 0 {
+			done = next
+			break
+		}
+		target, err := os.Readlink(filepath.Join(e.Root, next))
+		if err != nil {
+			done = next
+			continue
+		}
+		if links++; links > 40 {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+		if path.IsAbs(target) {
+			done = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return filepath.Join(e.Root, done), nil
+}
+
+// WriteRecord creates r under Root. A later record replaces an earlier one
+// of the same name, as the kernel has it, but a directory only replaces
+// the metadata of one. The trailer calls Finish.
+func (e *Extractor) WriteRecord(r Record) error {
+	if r.Name == Trailer {
+		return e.Finish()
+	}
+	if r.ReadCloser != nil {
+		defer r.Close()
+	}
+	p, err := e.Resolve(r.Name)
+	if err != nil {
+		return err
+	}
+	if p == filepath.Clean(e.Root) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	t := r.Mode & modeTypeMask
+	if fi, err := os.Lstat(p); err == nil && !(fi.IsDir() && t == modeDir) {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+
+	switch t {
+	case modeFile:
+		// A hard link gets what contents its record has written to
+		// the file it shares, as the kernel has it.
+		flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if old, ok := e.links.Link(r, p); ok {
+			if err := os.Link(old, p); err != nil {
+				return err
+			}
+			flag = os.O_WRONLY
+		}
+		f, err := os.OpenFile(p, flag, 0600)
+		if err != nil {
+			return err
+		}
+		if r.ReadCloser != nil {
+			_, err = CopySparse(f, r)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case modeDir:
+		if err := os.MkdirAll(p, 0755); err != nil {
+			return err
+		}
+		d := r
+		d.Name = p
+		d.ReadCloser = nil
+		e.dirs = append(e.dirs, d)
+	case modeSymlink:
+		target, err := r.Linkname()
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, p); err != nil {
+			return err
+		}
+		// Symlinks have no mode, and their mtime is left alone.
+		e.chown(p, r)
+		return nil
+	case modeFIFO:
+		if err := syscall.Mkfifo(p, perm(r)); err != nil {
+			return err
+		}
+	case modeChar, modeBlock:
+		if !e.MakeDevices {
+			e.postpone(r)
+			return nil
+		}
+		if err := syscall.Mknod(p, uint32(t)|perm(r), dev(r)); err != nil {
+			return err
+		}
+	default:
+		e.postpone(r)
+		return nil
+	}
+
+	// Chown clears the set-ID bits, so the mode is set after it.
+	e.chown(p, r)
+	if t == modeDir {
+		return nil
+	}
+	return setMode(p, r)
+}
+
+// chown gives p the ownership of r, or defers it.
+func (e *Extractor) chown(p string, r Record) {
+	if err := os.Lchown(p, int(r.UID), int(r.GID)); err != nil {
+		e.postpone(r)
+	}
+}
+
+func (e *Extractor) postpone(r Record) {
+	if e.Deferred != nil {
+		e.Deferred(r.Info)
+	}
+}
+
+// Finish sets the modes and mtimes of the directories made, deepest
+// first, which is left to the end so that read-only ones can be filled.
+func (e *Extractor) Finish() error {
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		if err := setMode(e.dirs[i].Name, e.dirs[i]); err != nil {
+			return err
+		}
+	}
+	e.dirs = nil
+	return nil
+}
+
+// setMode sets the permissions, set-ID and sticky bits and mtime of r on p.
+func setMode(p string, r Record) error {
+	m := os.FileMode(perm(r))
+	if r.Mode&modeSUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if r.Mode&modeSGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if r.Mode&modeSticky != 0 {
+		m |= os.ModeSticky
+	}
+	if err := os.Chmod(p, m); err != nil {
+		return err
+	}
+	mtime := time.Unix(int64(r.MTime), 0)
+	return os.Chtimes(p, mtime, mtime)
+}
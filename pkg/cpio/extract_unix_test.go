@@ -0,0 +1,176 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// TestExtractorConfined writes records with hostile names, none of which
+// may be made outside of the root.
+func TestExtractorConfined(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "cpio-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "a", "root")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	file := func(name, contents string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(contents), cpio.Info{Name: name, Mode: syscall.S_IFREG | 0644})
+	}
+	link := func(name, target string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(target), cpio.Info{Name: name, Mode: syscall.S_IFLNK | 0777})
+	}
+	e := &cpio.Extractor{Root: root}
+	for _, r := range []cpio.Record{
+		file("../../x", "a"),
+		file("/abs", "b"),
+		link("up", "../../.."),
+		file("up/y", "c"),
+		link("etc", "/usr/etc"),
+		file("etc/passwd", "d"),
+		link("host", tmp),
+		file("host/z", "e"),
+		// A symlink made later replaces the file, and is not
+		// followed when replaced in its turn.
+		link("x", "/outside"),
+		file("x", "f"),
+		link("loop", "loop"),
+		cpio.TrailerRecord,
+	} {
+		if err := e.WriteRecord(r); err != nil {
+			if r.Name == "loop" {
+				continue
+			}
+			t.Fatalf("WriteRecord(%q): %v", r.Name, err)
+		}
+	}
+	if _, err := e.Resolve("loop/w"); err == nil {
+		t.Errorf("Resolve(loop/w): got nil, want a symlink loop error")
+	}
+
+	for name, want := range map[string]string{
+		"x":                         "f",
+		"abs":                       "b",
+		"y":                         "c",
+		"usr/etc/passwd":            "d",
+		filepath.Join(tmp[1:], "z"): "e",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil || string(b) != want {
+			t.Errorf("%s: got %q, %v, want %q", name, b, err, want)
+		}
+	}
+	// Nothing is made next to the root or above it.
+	for _, dir := range []string{tmp, filepath.Dir(root)} {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fis) != 1 {
+			t.Errorf("%s: got %d entries, want 1", dir, len(fis))
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpio-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	recs := []cpio.Record{
+		{Info: cpio.Info{Name: "ro", Mode: syscall.S_IFDIR | 0555, MTime: 1234567890}},
+		cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "ro/motd", Mode: syscall.S_IFREG | 0640, MTime: 1234567890}),
+		cpio.NewRecordFromBytes([]byte("#!/bin/sh\n"), cpio.Info{Name: "bin/su", Mode: syscall.S_IFREG | 04755, Ino: 3, NLink: 2}),
+		{Info: cpio.Info{Name: "bin/sudo", Mode: syscall.S_IFREG | 04755, Ino: 3, NLink: 2}},
+		cpio.NewRecordFromBytes([]byte("su"), cpio.Info{Name: "bin/sh", Mode: syscall.S_IFLNK | 0777}),
+		{Info: cpio.Info{Name: "run/initctl", Mode: syscall.S_IFIFO | 0600}},
+		{Info: cpio.Info{Name: "dev/null", Mode: syscall.S_IFCHR | 0666, Rmajor: 1, Rminor: 3}},
+	}
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.Extract(archiver.Reader(bytes.NewReader(archive(t, recs...))), dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(dir, "ro"), 0755)
+
+	for _, tt := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"ro", os.ModeDir | 0555},
+		{"ro/motd", 0640},
+		{"bin/su", os.ModeSetuid | 0755},
+		{"bin/sh", os.ModeSymlink | 0777},
+		{"run/initctl", os.ModeNamedPipe | 0600},
+	} {
+		fi, err := os.Lstat(filepath.Join(dir, tt.name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fi.Mode() != tt.mode {
+			t.Errorf("%s: got mode %v, want %v", tt.name, fi.Mode(), tt.mode)
+		}
+	}
+	for _, name := range []string{"ro", "ro/motd"} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil || fi.ModTime().Unix() != 1234567890 {
+			t.Errorf("%s: got %v, %v, want mtime 1234567890", name, fi, err)
+		}
+	}
+	checkLinked(t, dir, "bin/su", "bin/sudo", []byte("#!/bin/sh\n"))
+	if target, err := os.Readlink(filepath.Join(dir, "bin/sh")); err != nil || target != "su" {
+		t.Errorf("bin/sh: got %q, %v, want su", target, err)
+	}
+	fi, err := os.Lstat(filepath.Join(dir, "dev/null"))
+	if os.Geteuid() != 0 {
+		if err == nil {
+			t.Errorf("dev/null: made without being root")
+		}
+	} else if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		t.Errorf("dev/null: got %v, %v, want a character device", fi, err)
+	}
+}
+
+func TestExtractorDeferred(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpio-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var deferred []string
+	e := &cpio.Extractor{Root: dir, Deferred: func(i cpio.Info) { deferred = append(deferred, i.Name) }}
+	for _, r := range []cpio.Record{
+		{Info: cpio.Info{Name: "dev/console", Mode: syscall.S_IFCHR | 0600, Rmajor: 5, Rminor: 1}},
+		{Info: cpio.Info{Name: "run/sock", Mode: syscall.S_IFSOCK | 0666}},
+		cpio.TrailerRecord,
+	} {
+		if err := e.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"dev/console", "run/sock"}; len(deferred) != 2 || deferred[0] != want[0] || deferred[1] != want[1] {
+		t.Errorf("Deferred: got %q, want %q", deferred, want)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "dev/console")); err == nil {
+		t.Errorf("dev/console: made without MakeDevices")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"fmt"
+	"path"
+)
+
+// filterReader is a RecordReader that reads past the records keep returns
+// false for.
+type filterReader struct {
+	rr   RecordReader
+	keep func(Record) bool
+}
+
+// FilterReader returns a RecordReader reading the records of rr that keep
+// returns true for, and the trailer. The contents of the others are closed
+// unread: the readers here read records at their offsets, so that what
+// comes after them is read just the same.
+func FilterReader(rr RecordReader, keep func(Record) bool) RecordReader {
+	return &filterReader{rr: rr, keep: keep}
+}
+
+func (f *filterReader) ReadRecord() (Record, error) {
+	for {
+		r, err := f.rr.ReadRecord()
+		if err != nil || r.Name == Trailer || f.keep(r) {
+			return r, err
+		}
+		skip(r)
+	}
+}
+
+// ByGlob returns a predicate true for the records whose names, or the
+// directories they are in, match one of patterns, as path.Match has it,
+// so that lib/modules matches what is below it too. Names and patterns
+// are taken as an Archive looks names up, so that "/etc/motd" and
+// "etc/motd" are the same.
+func ByGlob(patterns ...string) (func(Record) bool, error) {
+	var globs []string
+	for _, p := range patterns {
+		g := archiveName(p)
+		if _, err := path.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("%q: %v", p, err)
+		}
+		globs = append(globs, g)
+	}
+	return func(r Record) bool {
+		_, _, ok := underPrefix(archiveName(r.Name), func(dir string) bool {
+			// The top, which .* would match, is not a name.
+			if dir == "." {
+				return false
+			}
+			for _, g := range globs {
+				if ok, _ := path.Match(g, dir); ok {
+					return true
+				}
+			}
+			return false
+		})
+		return ok
+	}, nil
+}
+
+// ByPrefix returns a predicate true for the records named one of dirs, or
+// below one of them.
+func ByPrefix(dirs ...string) func(Record) bool {
+	m := make(map[string]bool)
+	for _, d := range dirs {
+		m[archiveName(d)] = true
+	}
+	return func(r Record) bool {
+		_, _, ok := underPrefix(archiveName(r.Name), func(dir string) bool { return m[dir] })
+		return ok
+	}
+}
+
+// NotType returns a predicate true for the records that are not of the
+// type of mode, such as syscall.S_IFCHR.
+func NotType(mode uint64) func(Record) bool {
+	return func(r Record) bool {
+		return r.Mode&modeTypeMask != mode&modeTypeMask
+	}
+}
+
+// Not returns a predicate true where f is false, to have FilterReader
+// leave out what f matches.
+func Not(f func(Record) bool) func(Record) bool {
+	return func(r Record) bool {
+		return !f(r)
+	}
+}
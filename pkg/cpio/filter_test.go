@@ -0,0 +1,90 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func filterRecords() []cpio.Record {
+	return []cpio.Record{
+		{Info: cpio.Info{Name: "lib", Mode: syscall.S_IFDIR | 0755}},
+		{Info: cpio.Info{Name: "lib/modules", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes(bytes.Repeat([]byte("k"), 4097), cpio.Info{Name: "lib/modules/e1000.ko", Mode: syscall.S_IFREG | 0644}),
+		cpio.NewRecordFromBytes([]byte("libc"), cpio.Info{Name: "lib/libc.so", Mode: syscall.S_IFREG | 0755}),
+		cpio.NewRecordFromBytes([]byte("modules"), cpio.Info{Name: "lib/modules.txt", Mode: syscall.S_IFREG | 0644}),
+		{Info: cpio.Info{Name: "dev/console", Mode: syscall.S_IFCHR | 0600, Rmajor: 5, Rminor: 1}},
+		cpio.NewRecordFromBytes([]byte("x"), cpio.Info{Name: "/.profile", Mode: syscall.S_IFREG | 0644}),
+	}
+}
+
+func TestFilterReader(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := cpio.FilterReader(archiver.RecordFormat.Reader(bytes.NewReader(archive(t, filterRecords()...))), cpio.Not(cpio.ByPrefix("/lib/modules")))
+	var got []string
+	for {
+		r, err := rr.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// What follows a record left out is read as it would be.
+		got = append(got, r.Name+" "+contents(t, r))
+	}
+	want := []string{"lib ", "lib/libc.so libc", "lib/modules.txt modules", "dev/console ", ".profile x", "TRAILER!!! "}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterReader: got %q, want %q", got, want)
+	}
+}
+
+func TestFilterPredicates(t *testing.T) {
+	glob := func(patterns ...string) func(cpio.Record) bool {
+		f, err := cpio.ByGlob(patterns...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	for _, tt := range []struct {
+		name string
+		f    func(cpio.Record) bool
+		want string
+	}{
+		{"ByGlob", glob("lib/modules"), "lib/modules lib/modules/e1000.ko"},
+		{"ByGlob", glob("/lib/*.so", "lib/*/*.ko"), "lib/modules/e1000.ko lib/libc.so"},
+		{"ByGlob", glob(".*"), ".profile"},
+		{"ByGlob", glob(), ""},
+		{"ByPrefix", cpio.ByPrefix("lib/modules", "dev/"), "lib/modules lib/modules/e1000.ko dev/console"},
+		{"ByPrefix", cpio.ByPrefix("/"), "lib lib/modules lib/modules/e1000.ko lib/libc.so lib/modules.txt dev/console .profile"},
+		{"NotType", cpio.NotType(syscall.S_IFREG), "lib lib/modules dev/console"},
+		{"Not", cpio.Not(cpio.NotType(syscall.S_IFDIR)), "lib lib/modules"},
+	} {
+		var got []string
+		for _, r := range filterRecords() {
+			if tt.f(r) {
+				got = append(got, strings.TrimPrefix(r.Name, "/"))
+			}
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, strings.Join(got, " "), tt.want)
+		}
+	}
+
+	if _, err := cpio.ByGlob("lib/[modules"); err == nil {
+		t.Errorf("ByGlob(lib/[modules): got nil, want an error")
+	}
+}
@@ -6,8 +6,6 @@ package cpio
 
 import (
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"syscall"
@@ -63,7 +61,7 @@ func perm(r Record) uint32 {
 }
 
 func dev(r Record) int {
-	return int(r.Rmajor<<8 | r.Rminor)
+	return int(mkdev(r.Rmajor, r.Rminor))
 }
 
 func linuxModeToMode(m uint64) (os.FileMode, error) {
@@ -106,7 +104,7 @@ func CreateFile(f Record) error {
 			return err
 		}
 		defer nf.Close()
-		if _, err := io.Copy(nf, f); err != nil {
+		if _, err := CopySparse(nf, f); err != nil {
 			return err
 		}
 		return setModes(f)
@@ -130,17 +128,71 @@ func CreateFile(f Record) error {
 		return setModes(f)
 
 	case os.ModeSymlink:
-		content, err := ioutil.ReadAll(f)
+		target, err := f.Linkname()
 		if err != nil {
 			return err
 		}
-		return os.Symlink(string(content), f.Name)
+		return os.Symlink(target, f.Name)
 
 	default:
 		return fmt.Errorf("%v: Unknown type %#o", f.Name, m)
 	}
 }
 
+// Linker finds the hard links among records the way the kernel does when
+// it extracts an archive: a regular file with more than one link is a link
+// to the first one before it with the same inode, device and mode. The zero
+// Linker has seen no records.
+type Linker struct {
+	paths map[Info]string
+}
+
+// Link returns the path that was given with the record r is a hard link
+// to, if it is one. If not, it remembers path as the path of r's inode.
+func (l *Linker) Link(r Record, path string) (string, bool) {
+	if r.Mode&modeTypeMask != modeFile || r.NLink < 2 {
+		return "", false
+	}
+	k := Info{Ino: r.Ino, Mode: r.Mode, Major: r.Major, Minor: r.Minor}
+	if p, ok := l.paths[k]; ok {
+		return p, true
+	}
+	if l.paths == nil {
+		l.paths = make(map[Info]string)
+	}
+	l.paths[k] = path
+	return "", false
+}
+
+// CreateFile is like CreateFile, but makes a record that links to an earlier
+// one a hard link to it. The contents, if the record has any, are written to
+// the file they share, as the kernel writes them.
+func (l *Linker) CreateFile(f Record) error {
+	old, ok := l.Link(f, f.Name)
+	if !ok {
+		return CreateFile(f)
+	}
+	if err := os.Remove(f.Name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(old, f.Name); err != nil {
+		return err
+	}
+	if f.ReadCloser == nil {
+		return nil
+	}
+	defer f.Close()
+	nf, err := os.OpenFile(f.Name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer nf.Close()
+	if _, err := CopySparse(nf, f); err != nil {
+		return err
+	}
+	return setModes(f)
+}
+
 // Inumber and devnumbers are unique to Unix-like
 // operating systems. You can not uniquely disambiguate a file in a
 // Unix system with just an inumber, you need a device number too.
@@ -159,6 +211,9 @@ var (
 	inumber  uint64
 )
 
+// inode returns i with its Dev cleared and an inode number of our own, and
+// whether the file it is of has been seen before.
+//
 // Certain elements of the file can not be set by cpio:
 // the Inode #
 // the Dev
@@ -186,20 +241,52 @@ func inode(i Info) (Info, bool) {
 	return i, false
 }
 
-func GetRecord(path string) (Record, error) {
+// NewInode returns an inode number that neither GetRecord nor NewInode
+// has given out, for a record from elsewhere, such as another archive,
+// whose inode number could be the same as one of theirs.
+func NewInode() uint64 {
+	i := inumber
+	inumber++
+	return i
+}
+
+// SkipError is the error of a file that has no record, such as a socket,
+// which a walker may pass over.
+type SkipError struct {
+	Path string
+	// Type is what the file is, such as "socket".
+	Type string
+}
+
+func (e *SkipError) Error() string {
+	return fmt.Sprintf("%s: a %s can not be archived", e.Path, e.Type)
+}
+
+// NewRecordFromPath returns the record of the file path, named archiveName.
+// A symlink is not followed: the record is of the link, with its target. The
+// contents of a regular file are opened when they are first read, and every
+// link to one has them, in case it is the only one archived; a Writer
+// writes them once. Directories, FIFOs and device nodes have none.
+//
+// The inode number is one given out here, the same for each link to a file,
+// and the device the file was on is cleared, so that archives of the same
+// files are the same.
+//
+// A socket has no record; a *SkipError is returned for it.
+func NewRecordFromPath(path, archiveName string) (Record, error) {
 	fi, err := os.Lstat(path)
 	if err != nil {
 		return Record{}, err
 	}
+	if fi.Mode()&os.ModeSocket != 0 {
+		return Record{}, &SkipError{Path: path, Type: "socket"}
+	}
 
 	sys := fi.Sys().(*syscall.Stat_t)
-	info, done := inode(sysInfo(path, sys))
+	info, _ := inode(sysInfo(archiveName, sys))
 
 	switch fi.Mode() & os.ModeType {
 	case 0: // Regular file.
-		if done {
-			return Record{Info: info}, nil
-		}
 		return Record{Info: info, ReadCloser: NewDeferReadCloser(path)}, nil
 
 	case os.ModeSymlink:
@@ -207,9 +294,15 @@ func GetRecord(path string) (Record, error) {
 		if err != nil {
 			return Record{}, err
 		}
-		return StaticRecord([]byte(linkname), info), nil
+		return NewRecordFromBytes([]byte(linkname), info), nil
 
 	default:
-		return StaticRecord(nil, info), nil
+		return NewRecordFromBytes(nil, info), nil
 	}
 }
+
+// GetRecord returns the record of the file path, named path; see
+// NewRecordFromPath.
+func GetRecord(path string) (Record, error) {
+	return NewRecordFromPath(path, path)
+}
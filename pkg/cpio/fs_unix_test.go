@@ -0,0 +1,351 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// extract creates the records of the archive b in dir with a Linker.
+func extract(t *testing.T, b []byte, dir string) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := archiver.Reader(bytes.NewReader(b)).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l cpio.Linker
+	for _, r := range recs {
+		r.Name = filepath.Join(dir, r.Name)
+		if err := l.CreateFile(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkLinked checks that the files a and b in dir are one with contents c.
+func checkLinked(t *testing.T, dir, a, b string, c []byte) {
+	fa, err := os.Stat(filepath.Join(dir, a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := os.Stat(filepath.Join(dir, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fa, fb) {
+		t.Errorf("%s and %s are not hard links to one file", a, b)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, c) {
+		t.Errorf("%s: got %q, want %q", b, got, c)
+	}
+}
+
+func TestHardLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := []byte("the contents of a file with two links")
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), c, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []cpio.Record
+	for _, n := range []string{"a", "b"} {
+		r, err := cpio.NewRecordFromPath(filepath.Join(dir, n), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.NLink != 2 {
+			t.Errorf("NewRecordFromPath(%s): got %d links, want 2", n, r.NLink)
+		}
+		recs = append(recs, r)
+	}
+	if recs[0].Ino != recs[1].Ino {
+		t.Errorf("NewRecordFromPath: got inodes %d and %d for links to one file", recs[0].Ino, recs[1].Ino)
+	}
+	b := archive(t, recs...)
+	if n := bytes.Count(b, c); n != 1 {
+		t.Errorf("the contents are in the archive %d times, want once", n)
+	}
+
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	extract(t, b, out)
+	checkLinked(t, out, "a", "b", c)
+}
+
+func TestHardLinksLast(t *testing.T) {
+	// GNU cpio has the contents with the last link, and an archive of
+	// it is written as it is.
+	c := []byte("contents")
+	info := cpio.Info{Ino: 7, Mode: syscall.S_IFREG | 0644, NLink: 2}
+	first := info
+	first.Name = "a"
+	last := info
+	last.Name = "b"
+	b := archive(t, cpio.NewRecordFromBytes(nil, first), cpio.NewRecordFromBytes(c, last))
+	if n := bytes.Count(b, c); n != 1 {
+		t.Errorf("the contents are in the archive %d times, want once", n)
+	}
+
+	dir, err := ioutil.TempDir("", "cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	extract(t, b, dir)
+	checkLinked(t, dir, "b", "a", c)
+}
+
+// sparseFile makes a file of size bytes in dir, all holes but for data at
+// each of at, and skips the test if the file system makes no holes.
+func sparseFile(t *testing.T, dir string, size int64, at ...int64) string {
+	name := filepath.Join(dir, "sparse")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range at {
+		if _, err := f.WriteAt([]byte("data"), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if blocks(t, name) > 1<<20 {
+		t.Skipf("%s: the file system makes no holes", dir)
+	}
+	return name
+}
+
+// blocks returns how many bytes of the file name are on disk.
+func blocks(t *testing.T, name string) int64 {
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const size = 1 << 30
+	at := []int64{0, 300000, size / 2, size - 4}
+	name := sparseFile(t, dir, size, at...)
+
+	r, err := cpio.NewRecordFromPath(name, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	r.Name = out
+	if err := cpio.CreateFile(r); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	fi, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != size {
+		t.Errorf("%s: got %d bytes, want %d", out, fi.Size(), size)
+	}
+	if n := blocks(t, out); n > 1<<20 {
+		t.Errorf("%s: got %d bytes on disk, want the holes left holes", out, n)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, off := range append(at, 4096, size-8) {
+		want := "data"
+		if off == 4096 || off == size-8 {
+			want = "\x00\x00\x00\x00"
+		}
+		b := make([]byte, 4)
+		if _, err := f.ReadAt(b, off); err != nil || string(b) != want {
+			t.Errorf("%s at %d: got %q, %v, want %q", out, off, b, err, want)
+		}
+	}
+}
+
+func TestSparseContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Data at the start and end, and a run across two blocks.
+	name := sparseFile(t, dir, 3<<20, 0, 1<<20-2, 3<<20-4)
+	want, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := cpio.NewRecordFromPath(name, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("NewRecordFromPath(%s): the contents read are not those of the file", name)
+	}
+
+	// A file that ends in a hole ends in one when copied.
+	var b bytes.Buffer
+	b.WriteString("data")
+	b.Write(make([]byte, 1<<20))
+	f, err := os.Create(filepath.Join(dir, "copy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := cpio.CopySparse(f, bytes.NewReader(b.Bytes())); err != nil || n != int64(b.Len()) {
+		t.Fatalf("CopySparse: got %d, %v, want %d", n, err, b.Len())
+	}
+	c, err := ioutil.ReadFile(f.Name())
+	if err != nil || !bytes.Equal(c, b.Bytes()) {
+		t.Errorf("CopySparse: the copy is not the same: %v", err)
+	}
+}
+
+func TestNewRecordFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "blob")
+	if err := ioutil.WriteFile(name, []byte("firmware"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := cpio.NewRecordFromFile(name, cpio.Info{Name: "lib/firmware/blob", Mode: syscall.S_IFREG | 0644})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.FileSize != 8 {
+		t.Errorf("FileSize: got %d, want 8", r.FileSize)
+	}
+	a := readArchive(t, archive(t, r))
+	if r, ok := a.Get("lib/firmware/blob"); !ok || contents(t, r) != "firmware" {
+		t.Errorf("lib/firmware/blob: got %v, want firmware", r)
+	}
+
+	if _, err := cpio.NewRecordFromFile(dir, cpio.Info{Name: "d"}); err == nil {
+		t.Errorf("NewRecordFromFile of a directory: got nil, want an error")
+	}
+}
+
+func TestNewRecordFromPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := func(name string) string { return filepath.Join(dir, name) }
+	if err := ioutil.WriteFile(p("file"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(p("file"), os.ModeSetuid|0751); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(p("dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", p("link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(p("fifo"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", p("sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	mtime := time.Unix(1234567890, 0)
+	for _, n := range []string{"file", "dir", "fifo"} {
+		if err := os.Chtimes(p(n), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		path     string
+		mode     uint64
+		size     uint64
+		contents string
+		dev      [2]uint64
+	}{
+		{p("file"), syscall.S_IFREG | 04751, 6, "hello\n", [2]uint64{}},
+		{p("dir"), syscall.S_IFDIR | 0750, 0, "", [2]uint64{}},
+		// The link is archived, not the file.
+		{p("link"), syscall.S_IFLNK | 0777, 4, "file", [2]uint64{}},
+		{p("fifo"), syscall.S_IFIFO | 0640, 0, "", [2]uint64{}},
+		{"/dev/null", syscall.S_IFCHR | 0666, 0, "", [2]uint64{1, 3}},
+	} {
+		r, err := cpio.NewRecordFromPath(tt.path, "x/y")
+		if err != nil {
+			t.Errorf("NewRecordFromPath(%s): %v", tt.path, err)
+			continue
+		}
+		var st syscall.Stat_t
+		if err := syscall.Lstat(tt.path, &st); err != nil {
+			t.Fatal(err)
+		}
+		if r.Name != "x/y" || r.Mode != tt.mode || r.FileSize != tt.size || [2]uint64{r.Rmajor, r.Rminor} != tt.dev {
+			t.Errorf("NewRecordFromPath(%s): got %s, mode %#o, size %d, device %d,%d, want x/y, mode %#o, size %d, device %d,%d", tt.path, r.Name, r.Mode, r.FileSize, r.Rmajor, r.Rminor, tt.mode, tt.size, tt.dev[0], tt.dev[1])
+		}
+		if r.UID != uint64(st.Uid) || r.GID != uint64(st.Gid) || r.MTime != uint64(st.Mtim.Sec) || r.NLink != uint64(st.Nlink) || r.Dev != 0 {
+			t.Errorf("NewRecordFromPath(%s): got %d:%d, mtime %d, %d links, dev %d, want %d:%d, mtime %d, %d links, dev 0", tt.path, r.UID, r.GID, r.MTime, r.NLink, r.Dev, st.Uid, st.Gid, st.Mtim.Sec, st.Nlink)
+		}
+		if got := contents(t, r); got != tt.contents {
+			t.Errorf("NewRecordFromPath(%s): got contents %q, want %q", tt.path, got, tt.contents)
+		}
+	}
+
+	_, err = cpio.NewRecordFromPath(p("sock"), "run/sock")
+	if se, ok := err.(*cpio.SkipError); !ok || se.Path != p("sock") || se.Type != "socket" {
+		t.Errorf("NewRecordFromPath of a socket: got %v, want a SkipError", err)
+	}
+	if _, err := cpio.NewRecordFromPath(p("nothing"), "nothing"); !os.IsNotExist(err) {
+		t.Errorf("NewRecordFromPath of nothing: got %v, want it not to exist", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// modeString returns m as ls -l shows it, e.g. -rwxr-xr-x.
+func modeString(m uint64) string {
+	var b [10]byte
+	switch m & modeTypeMask {
+	case modeFile:
+		b[0] = '-'
+	case modeDir:
+		b[0] = 'd'
+	case modeSymlink:
+		b[0] = 'l'
+	case modeChar:
+		b[0] = 'c'
+	case modeBlock:
+		b[0] = 'b'
+	case modeFIFO:
+		b[0] = 'p'
+	case modeSocket:
+		b[0] = 's'
+	default:
+		b[0] = '?'
+	}
+	for i, c := range "rwxrwxrwx" {
+		b[i+1] = '-'
+		if m&(1<<uint(8-i)) != 0 {
+			b[i+1] = byte(c)
+		}
+	}
+	// The set-ID and sticky bits take the place of the x they go with,
+	// in upper case if that x is not set.
+	for _, s := range []struct {
+		bit uint64
+		i   int
+		c   byte
+	}{
+		{modeSUID, 3, 's'},
+		{modeSGID, 6, 's'},
+		{modeSticky, 9, 't'},
+	} {
+		if m&s.bit == 0 {
+			continue
+		}
+		if b[s.i] == 'x' {
+			b[s.i] = s.c
+		} else {
+			b[s.i] = s.c - 'a' + 'A'
+		}
+	}
+	return string(b[:])
+}
+
+// FormatLong returns r as ls -l lists it: type and permissions, uid, gid,
+// size, or major,minor for a device node, the date of its mtime, in UTC,
+// and name, e.g.
+//
+//	-rwxr-xr-x 0 0 123456 2009-02-13 init
+//	lrwxrwxrwx 0 0 7 2009-02-13 bin/sh -> busybox
+//	crw------- 0 0 5,1 2009-02-13 dev/console
+//
+// The target of a symlink is only shown if its contents are an io.ReaderAt,
+// as those of records read from archives or made by NewRecordFromBytes
+// are, so that they are still there to be read; List shows it anyway.
+func FormatLong(r Record) string {
+	var target string
+	if _, ok := r.ReadCloser.(io.ReaderAt); ok && r.Mode&modeTypeMask == modeSymlink {
+		target, _ = r.Linkname()
+	}
+	return formatLong(r.Info, target)
+}
+
+func formatLong(i Info, target string) string {
+	size := fmt.Sprint(i.FileSize)
+	if i.isDevice() {
+		size = fmt.Sprintf("%d,%d", i.DevMajor(), i.DevMinor())
+	}
+	s := fmt.Sprintf("%s %d %d %s %s %s", modeString(i.Mode), i.UID, i.GID, size, time.Unix(int64(i.MTime), 0).UTC().Format("2006-01-02"), i.Name)
+	if target != "" {
+		s += " -> " + target
+	}
+	return s
+}
+
+// List writes the records of rr to w as FormatLong lists them, one a line,
+// up to the trailer. It reads the targets of symlinks, and closes the
+// contents of every record.
+func List(w io.Writer, rr RecordReader) error {
+	_, _, err := list(w, rr, true, formatLong)
+	return err
+}
+
+// ListTo writes the records of rr to w, up to the trailer, as cpio -it
+// lists them, a name a line, or, if long is set, as cpio -itvn does, e.g.
+//
+//	-rwxr-xr-x   1 0        0            1234 Feb 13  2009 init
+//	lrwxrwxrwx   1 0        0               7 Oct 16 08:17 bin/sh -> busybox
+//	crw-------   1 0        0          5,   1 Feb 13  2009 dev/console
+//
+// with the mtime in local time, and the year in place of the time of day
+// if it is more than six months ago or in the future. It returns the number
+// of records and the size of their contents.
+//
+// Only the targets of symlinks are read, for the long listing; the contents
+// of every record are closed unread, which, as the readers here read at
+// offsets, leaves what follows them to be read as it would be.
+func ListTo(w io.Writer, rr RecordReader, long bool) (records int, size uint64, err error) {
+	if !long {
+		return list(w, rr, false, func(i Info, _ string) string { return i.Name })
+	}
+	now := time.Now()
+	return list(w, rr, true, func(i Info, target string) string { return formatGNU(i, target, now) })
+}
+
+// formatGNU returns i as cpio -itvn lists it at now.
+func formatGNU(i Info, target string, now time.Time) string {
+	size := fmt.Sprintf("%8d", i.FileSize)
+	if i.isDevice() {
+		size = fmt.Sprintf("%3d, %3d", i.DevMajor(), i.DevMinor())
+	}
+	mtime := time.Unix(int64(i.MTime), 0)
+	when := mtime.Format("Jan _2 15:04")
+	if d := now.Sub(mtime); d > 6*30*24*time.Hour || d < 0 {
+		when = mtime.Format("Jan _2  2006")
+	}
+	s := fmt.Sprintf("%s %3d %-8d %-8d %s %s %s", modeString(i.Mode), i.NLink, i.UID, i.GID, size, when, i.Name)
+	if target != "" {
+		s += " -> " + target
+	}
+	return s
+}
+
+// list writes a line for each record of rr, up to the trailer, as format
+// makes it of its Info and, if targets is set, the target of a symlink.
+func list(w io.Writer, rr RecordReader, targets bool, format func(Info, string) string) (records int, size uint64, err error) {
+	for {
+		r, err := rr.ReadRecord()
+		if err == io.EOF || err == nil && r.Name == Trailer {
+			return records, size, nil
+		}
+		if err != nil {
+			return records, size, err
+		}
+		var target string
+		if r.ReadCloser != nil {
+			if targets && r.Mode&modeTypeMask == modeSymlink {
+				if target, err = r.Linkname(); err != nil {
+					r.Close()
+					return records, size, err
+				}
+			}
+			if err := r.Close(); err != nil {
+				return records, size, err
+			}
+		}
+		if _, err := fmt.Fprintln(w, format(r.Info, target)); err != nil {
+			return records, size, err
+		}
+		records++
+		size += r.FileSize
+	}
+}
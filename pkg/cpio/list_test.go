@@ -0,0 +1,134 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// 1234567890 is 2009-02-13 23:31:30 UTC.
+func listRecords() []cpio.Record {
+	return []cpio.Record{
+		cpio.NewRecordFromBytes(bytes.Repeat([]byte("x"), 123456), cpio.Info{Name: "init", Mode: syscall.S_IFREG | 0755, MTime: 1234567890}),
+		{Info: cpio.Info{Name: "tmp", Mode: syscall.S_IFDIR | 01777, MTime: 1234567890}},
+		{Info: cpio.Info{Name: "home/user", Mode: syscall.S_IFDIR | 0750, UID: 1000, GID: 100, MTime: 1234567890}},
+		cpio.NewRecordFromBytes([]byte("busybox"), cpio.Info{Name: "bin/sh", Mode: syscall.S_IFLNK | 0777, MTime: 1234567890}),
+		{Info: cpio.Info{Name: "dev/console", Mode: syscall.S_IFCHR | 0600, Rmajor: 5, Rminor: 1, MTime: 1234567890}},
+		{Info: cpio.Info{Name: "dev/sda", Mode: syscall.S_IFBLK | 0660, GID: 6, Rmajor: 8, MTime: 1234567890}},
+		{Info: cpio.Info{Name: "run/initctl", Mode: syscall.S_IFIFO | 0600, MTime: 1234567890}},
+		{Info: cpio.Info{Name: "run/sock", Mode: syscall.S_IFSOCK | 0666, MTime: 1234567890}},
+		cpio.NewRecordFromBytes(nil, cpio.Info{Name: "bin/su", Mode: syscall.S_IFREG | 04755, MTime: 1234567890}),
+		cpio.NewRecordFromBytes(nil, cpio.Info{Name: "odd", Mode: syscall.S_IFREG | 06644, MTime: 0}),
+	}
+}
+
+const listing = `-rwxr-xr-x 0 0 123456 2009-02-13 init
+drwxrwxrwt 0 0 0 2009-02-13 tmp
+drwxr-x--- 1000 100 0 2009-02-13 home/user
+lrwxrwxrwx 0 0 7 2009-02-13 bin/sh -> busybox
+crw------- 0 0 5,1 2009-02-13 dev/console
+brw-rw---- 0 6 8,0 2009-02-13 dev/sda
+prw------- 0 0 0 2009-02-13 run/initctl
+srw-rw-rw- 0 0 0 2009-02-13 run/sock
+-rwsr-xr-x 0 0 0 2009-02-13 bin/su
+-rwSr-Sr-- 0 0 0 1970-01-01 odd
+`
+
+func TestFormatLong(t *testing.T) {
+	want := strings.Split(strings.TrimSuffix(listing, "\n"), "\n")
+	for i, r := range listRecords() {
+		if got := cpio.FormatLong(r); got != want[i] {
+			t.Errorf("FormatLong(%s): got\n%s\nwant\n%s", r.Name, got, want[i])
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	// Written and read back, the symlink target is read for the listing.
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := cpio.List(&b, archiver.Reader(bytes.NewReader(archive(t, listRecords()...)))); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != listing {
+		t.Errorf("List: got\n%s\nwant\n%s", b.String(), listing)
+	}
+
+	// So is one that can not be read at.
+	r := cpio.Record{ReadCloser: ioutil.NopCloser(strings.NewReader("busybox")), Info: cpio.Info{Name: "bin/sh", Mode: syscall.S_IFLNK | 0777, FileSize: 7}}
+	b.Reset()
+	if err := cpio.List(&b, &records{r, cpio.TrailerRecord}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "lrwxrwxrwx 0 0 7 1970-01-01 bin/sh -> busybox\n"; b.String() != want {
+		t.Errorf("List: got %q, want %q", b.String(), want)
+	}
+}
+
+// testdata/list.cpio was made by bsdcpio -o -H newc, with init dated 2035
+// and the rest 2009-02-03 23:31:30 UTC. gnuListing is how GNU cpio -itvn
+// lists it in UTC, as bsdcpio does but for the device numbers.
+const gnuListing = `-rwxr-xr-x   1 0        0            1234 Jan  2  2035 init
+drwxrwxrwt   2 0        0               0 Feb  3  2009 tmp
+drwxr-x---   2 1000     100             0 Feb  3  2009 home/user
+lrwxrwxrwx   1 0        0               7 Feb  3  2009 bin/sh -> busybox
+crw-------   1 0        0          5,   1 Feb  3  2009 dev/console
+brw-rw----   1 0        6        259, 1048575 Feb  3  2009 dev/nvme0n1p9
+prw-------   1 0        0               0 Feb  3  2009 run/initctl
+-rwsr-xr-x   1 0        0               2 Feb  3  2009 bin/su
+`
+
+func TestListTo(t *testing.T) {
+	defer func(l *time.Location) { time.Local = l }(time.Local)
+	time.Local = time.UTC
+	b, err := ioutil.ReadFile("testdata/list.cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		long bool
+		want string
+	}{
+		{true, gnuListing},
+		{false, "init\ntmp\nhome/user\nbin/sh\ndev/console\ndev/nvme0n1p9\nrun/initctl\nbin/su\n"},
+	} {
+		var out bytes.Buffer
+		n, size, err := cpio.ListTo(&out, archiver.RecordFormat.Reader(bytes.NewReader(b)), tt.long)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tt.want {
+			t.Errorf("ListTo(long %v): got\n%s\nwant\n%s", tt.long, out.String(), tt.want)
+		}
+		if n != 8 || size != 1234+7+2 {
+			t.Errorf("ListTo(long %v): got %d records of %d bytes, want 8 of %d", tt.long, n, size, 1234+7+2)
+		}
+	}
+
+	// What was modified in the last six months has the time of day.
+	recent := time.Now().Add(-time.Hour).Truncate(time.Second)
+	r := cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644, NLink: 1, MTime: uint64(recent.Unix())})
+	var out bytes.Buffer
+	if _, _, err := cpio.ListTo(&out, archiver.Reader(bytes.NewReader(archive(t, r))), true); err != nil {
+		t.Fatal(err)
+	}
+	if want := "-rw-r--r--   1 0        0               6 " + recent.Format("Jan _2 15:04") + " etc/motd\n"; out.String() != want {
+		t.Errorf("ListTo: got %q, want %q", out.String(), want)
+	}
+}
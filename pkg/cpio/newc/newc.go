@@ -2,22 +2,33 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// newc implements the new ASCII cpio file format.
+// newc implements the new ASCII cpio file format, and its crc variant,
+// whose headers have the sum of the bytes of the contents.
 package newc
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"syscall"
 
 	"github.com/u-root/u-root/pkg/cpio"
 )
 
 const (
 	newcMagic = "070701"
+	crcMagic  = "070702"
 	magicLen  = 6
+	// maxNameLength is the longest name, with its NUL, that the kernel
+	// extracts: PATH_MAX.
+	maxNameLength = 4096
 )
 
 type header struct {
@@ -36,21 +47,38 @@ type header struct {
 	CRC        uint32
 }
 
-func headerFromInfo(i cpio.Info) header {
+// headerFromInfo returns the header for i, or an error naming the first
+// field too big for its 8 hex digits, rather than a header of the wrong
+// value.
+func headerFromInfo(i cpio.Info) (header, error) {
 	var h header
-	h.Ino = uint32(i.Ino)
-	h.Mode = uint32(i.Mode)
-	h.UID = uint32(i.UID)
-	h.GID = uint32(i.GID)
-	h.NLink = uint32(i.NLink)
-	h.MTime = uint32(i.MTime)
-	h.FileSize = uint32(i.FileSize)
-	h.Major = uint32(i.Major)
-	h.Minor = uint32(i.Minor)
-	h.Rmajor = uint32(i.Rmajor)
-	h.Rminor = uint32(i.Rminor)
-	h.NameLength = uint32(len(i.Name)) + 1
-	return h
+	for _, f := range []struct {
+		name string
+		v    uint64
+		h    *uint32
+	}{
+		{"inode", i.Ino, &h.Ino},
+		{"mode", i.Mode, &h.Mode},
+		{"uid", i.UID, &h.UID},
+		{"gid", i.GID, &h.GID},
+		{"link count", i.NLink, &h.NLink},
+		{"mtime", i.MTime, &h.MTime},
+		{"size", i.FileSize, &h.FileSize},
+		{"device major", i.Major, &h.Major},
+		{"device minor", i.Minor, &h.Minor},
+		{"rdev major", i.Rmajor, &h.Rmajor},
+		{"rdev minor", i.Rminor, &h.Rminor},
+		{"name length", uint64(len(i.Name)) + 1, &h.NameLength},
+	} {
+		if f.v > math.MaxUint32 {
+			return header{}, fmt.Errorf("%s: %s %d is more than newc can hold, %d", i.Name, f.name, f.v, uint64(math.MaxUint32))
+		}
+		*f.h = uint32(f.v)
+	}
+	if h.NameLength > maxNameLength {
+		return header{}, fmt.Errorf("%s: name length %d is more than the kernel extracts, %d", i.Name, h.NameLength, maxNameLength)
+	}
+	return h, nil
 }
 
 func (h header) Info() cpio.Info {
@@ -71,6 +99,71 @@ func (h header) Info() cpio.Info {
 
 type format struct {
 	magic string
+	// noVerify is ReaderOptions.NoVerify.
+	noVerify bool
+}
+
+// ReaderOptions are the options of the readers of a RecordFormat from
+// WithReaderOptions.
+type ReaderOptions struct {
+	// NoVerify is whether crc readers leave the contents of each record
+	// unchecked against its checksum, which reads what there is of a
+	// damaged archive.
+	NoVerify bool
+}
+
+// WithReaderOptions returns f, if it is the newc or crc RecordFormat, with
+// readers that have the options o, and f as it is otherwise, so that it
+// can be given whatever format an archive is read with.
+func WithReaderOptions(f cpio.RecordFormat, o ReaderOptions) cpio.RecordFormat {
+	nf, ok := f.(format)
+	if !ok {
+		return f
+	}
+	nf.noVerify = o.NoVerify
+	return nf
+}
+
+// crc is whether f's headers have the checksum of the contents.
+func (f format) crc() bool {
+	return f.magic == crcMagic
+}
+
+// checksum returns the crc format's checksum of what r reads: the sum of
+// its bytes.
+func checksum(r io.Reader) (uint32, error) {
+	var sum uint32
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			sum += uint32(b)
+		}
+		if err == io.EOF {
+			return sum, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// contentsChecksum returns the checksum of the contents of rec, and rec
+// with contents that are still to be read. Contents that can not be read
+// at, as those of a file on disk or an archive can, are read into memory.
+func contentsChecksum(rec cpio.Record) (uint32, cpio.Record, error) {
+	if _, ok := rec.ReadCloser.(io.ReaderAt); !ok {
+		b, err := ioutil.ReadAll(rec)
+		if err != nil {
+			return 0, rec, err
+		}
+		if err := rec.Close(); err != nil {
+			return 0, rec, err
+		}
+		rec.ReadCloser = cpio.NewBytesReadCloser(b)
+	}
+	sum, err := checksum(io.NewSectionReader(rec.ReadCloser.(io.ReaderAt), 0, int64(rec.FileSize)))
+	return sum, rec, err
 }
 
 // round4 returns the next multiple of 4 close to n.
@@ -82,17 +175,66 @@ type writer struct {
 	f   format
 	w   io.Writer
 	pos int64
+	// block is what the archive is padded to a multiple of after each
+	// trailer, if it is more than 0.
+	block int64
+	// h, if it is not nil, hashes what is written, and sum is its sum as
+	// of the last trailer.
+	h   hash.Hash
+	sum []byte
 }
 
 func (f format) Writer(w io.Writer) cpio.RecordWriter {
 	return &writer{f: f, w: w}
 }
 
+// WriterOptions are the options of NewWriter.
+type WriterOptions struct {
+	// CRC writes the crc variant, with the checksum of the contents in
+	// each header.
+	CRC bool
+	// TrailerPad, if it is more than 0, pads the archive with zeros after
+	// the trailer to a multiple of TrailerPad bytes, as cpio -B pads it to
+	// 512, for loaders that want it on a block boundary. Readers skip the
+	// zeros.
+	TrailerPad int64
+	// Hash is the hash of Digest. It is SHA256 if it is nil.
+	Hash hash.Hash
+}
+
+// Writer is a RecordWriter of newc archives, or crc archives, with the
+// options NewWriter is given.
+type Writer struct {
+	writer
+}
+
+// NewWriter returns a Writer writing to w with the options o.
+func NewWriter(w io.Writer, o WriterOptions) *Writer {
+	f := format{magic: newcMagic}
+	if o.CRC {
+		f.magic = crcMagic
+	}
+	h := o.Hash
+	if h == nil {
+		h = sha256.New()
+	}
+	return &Writer{writer{f: f, w: w, block: o.TrailerPad, h: h}}
+}
+
+// Digest returns the hash of the bytes written up to the last trailer and
+// the padding after it, or nil if no trailer was written.
+func (w *Writer) Digest() []byte {
+	return w.sum
+}
+
 func (w *writer) Write(b []byte) (int, error) {
 	n, err := w.w.Write(b)
 	if err != nil {
 		return 0, err
 	}
+	if w.h != nil {
+		w.h.Write(b[:n])
+	}
 	w.pos += int64(n)
 	return n, nil
 }
@@ -107,20 +249,52 @@ func (w *writer) pad() error {
 	return nil
 }
 
-// Write writes newc cpio records. It pads the header+name write to
-// 4 byte alignment and pads the data write as well.
+// WriteRecord writes a newc cpio record, and after the trailer, the
+// padding and digest w is to have.
 func (w *writer) WriteRecord(f cpio.Record) error {
+	if err := w.writeRecord(f); err != nil {
+		return err
+	}
+	if f.Name != cpio.Trailer {
+		return nil
+	}
+	if w.block > 0 {
+		if n := w.pos % w.block; n != 0 {
+			if _, err := w.Write(make([]byte, w.block-n)); err != nil {
+				return err
+			}
+		}
+	}
+	if w.h != nil {
+		w.sum = w.h.Sum(nil)
+	}
+	return nil
+}
+
+// writeRecord writes f. It pads the header+name write to 4 byte alignment
+// and pads the data write as well.
+func (w *writer) writeRecord(f cpio.Record) error {
+	// Nothing is written of a record whose header can not be.
+	info := f.Info
+	if f.ReadCloser == nil {
+		info.FileSize = 0
+	}
+	hdr, err := headerFromInfo(info)
+	if err != nil {
+		return err
+	}
+	if w.f.crc() && f.ReadCloser != nil {
+		if hdr.CRC, f, err = contentsChecksum(f); err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+	}
+
 	// Write magic.
 	if _, err := w.Write([]byte(w.f.magic)); err != nil {
 		return err
 	}
 
 	buf := &bytes.Buffer{}
-	hdr := headerFromInfo(f.Info)
-	if f.ReadCloser == nil {
-		hdr.FileSize = 0
-	}
-	hdr.CRC = 0
 	if err := binary.Write(buf, binary.BigEndian, hdr); err != nil {
 		return err
 	}
@@ -170,70 +344,234 @@ type reader struct {
 	f   format
 	r   io.ReaderAt
 	pos int64
+	// links has the contents of the regular files with more than one
+	// link, by inode, device and mode: of those read, and, once a link
+	// without them is read, of those after it.
+	links map[cpio.Info]*io.SectionReader
+	ahead bool
+	// verify is whether the contents are checked against the checksum.
+	verify bool
+	// more is whether anything but zeros follows the trailer, once it
+	// is read.
+	more bool
 }
 
 func (f format) Reader(r io.ReaderAt) cpio.RecordReader {
-	return &reader{f: f, r: r}
+	return &reader{f: f, r: r, links: make(map[cpio.Info]*io.SectionReader), verify: f.crc() && !f.noVerify}
 }
 
+// Offset returns where the next record starts: after the trailer and the
+// zeros after it, where the archive ends.
+func (r *reader) Offset() int64 {
+	return r.pos
+}
+
+// More returns whether anything but zeros follows the trailer, once it is
+// read: another archive, say, or a stray trailer and more records, as
+// archives simply concatenated have, which ReadRecord goes on to read.
+func (r *reader) More() bool {
+	return r.more
+}
+
+// Read reads p at r.pos, returning io.EOF if nothing is left there, and
+// cpio.ErrTruncated if some, but not enough, is.
 func (r *reader) Read(p []byte) error {
 	n, err := r.r.ReadAt(p, r.pos)
-	if err == io.EOF {
+	if err == io.EOF && n == 0 {
 		return io.EOF
 	}
-	if err != nil || n != len(p) {
+	if err == io.EOF || err == nil && n != len(p) {
+		return &cpio.FormatError{Offset: r.pos, Err: cpio.ErrTruncated, Detail: fmt.Sprintf("got %d, want %d bytes", n, len(p))}
+	}
+	if err != nil {
 		return fmt.Errorf("ReadAt(pos = %d): got %d, want %d bytes; error %v", r.pos, n, len(p), err)
 	}
 	r.pos += int64(n)
 	return nil
 }
 
+// skipZeros moves r.pos past the zeros there, padding of the archive such
+// as cpio -B writes to 512 bytes, and sets r.more if something follows.
+func (r *reader) skipZeros() error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.r.ReadAt(buf, r.pos)
+		for i, b := range buf[:n] {
+			if b != 0 {
+				r.pos += int64(i)
+				r.more = true
+				return nil
+			}
+		}
+		r.pos += int64(n)
+		if err == io.EOF {
+			r.more = false
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func (r *reader) ReadAligned(p []byte) error {
 	err := r.Read(p)
 	r.pos = round4(r.pos)
 	return err
 }
 
+// ReadRecord returns the next record. The links to a regular file all have
+// its contents, though GNU cpio writes them with only one of them, the last.
 func (r *reader) ReadRecord() (cpio.Record, error) {
+	rec, c, err := r.readRecord()
+	if err != nil || rec.Mode&syscall.S_IFMT != syscall.S_IFREG || rec.NLink < 2 {
+		return rec, err
+	}
+	k := linkKey(rec.Info)
+	if rec.FileSize > 0 {
+		r.links[k] = c
+		return rec, nil
+	}
+	if _, ok := r.links[k]; !ok && !r.ahead {
+		if err := r.readAhead(); err != nil {
+			return cpio.Record{}, err
+		}
+	}
+	if c, ok := r.links[k]; ok {
+		rec.FileSize = uint64(c.Size())
+		rec.ReadCloser = cpio.NewReadCloser(io.NewSectionReader(c, 0, c.Size()))
+	}
+	return rec, nil
+}
+
+func linkKey(i cpio.Info) cpio.Info {
+	return cpio.Info{Ino: i.Ino, Mode: i.Mode, Major: i.Major, Minor: i.Minor}
+}
+
+// readAhead reads the headers of the records after r's, up to the trailer,
+// for the contents of the links to regular files.
+func (r *reader) readAhead() error {
+	r.ahead = true
+	ahead := &reader{f: r.f, r: r.r, pos: r.pos}
+	for {
+		rec, c, err := ahead.readRecord()
+		if err == io.EOF || rec.Name == cpio.Trailer {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Mode&syscall.S_IFMT == syscall.S_IFREG && rec.NLink > 1 && rec.FileSize > 0 {
+			r.links[linkKey(rec.Info)] = c
+		}
+	}
+}
+
+// readRecord returns the next record as it is in the archive, and where its
+// contents are.
+func (r *reader) readRecord() (cpio.Record, *io.SectionReader, error) {
 	hdr := header{}
 
 	cpio.Debug("Next record: pos is %d\n", r.pos)
 
+	// An archive may end here, between records, with no trailer.
+	start := r.pos
 	buf := make([]byte, hex.EncodedLen(binary.Size(hdr))+magicLen)
 	if err := r.Read(buf); err != nil {
-		return cpio.Record{}, err
+		return cpio.Record{}, nil, err
 	}
 
 	// Check the magic.
 	if magic := string(buf[:magicLen]); magic != r.f.magic {
-		return cpio.Record{}, fmt.Errorf("reader: magic got %q, want %q", magic, r.f.magic)
+		return cpio.Record{}, nil, &cpio.FormatError{Offset: start, Err: cpio.ErrBadMagic, Detail: fmt.Sprintf("got %q, want %q", magic, r.f.magic)}
 	}
 	cpio.Debug("Header is %v\n", buf)
 
-	// Decode hex header fields.
-	dst := make([]byte, binary.Size(hdr))
-	if _, err := hex.Decode(dst, buf[magicLen:]); err != nil {
-		return cpio.Record{}, fmt.Errorf("reader: error decoding hex: %v", err)
+	// Decode the fields one at a time, 8 hex digits each, so that a bad
+	// one is named.
+	bad := func(at int64, format string, v ...interface{}) error {
+		return &cpio.FormatError{Offset: at, Err: cpio.ErrBadHeader, Detail: fmt.Sprintf(format, v...)}
 	}
-	if err := binary.Read(bytes.NewReader(dst), binary.BigEndian, &hdr); err != nil {
-		return cpio.Record{}, err
+	for i, f := range []struct {
+		name string
+		v    *uint32
+	}{
+		{"inode", &hdr.Ino},
+		{"mode", &hdr.Mode},
+		{"uid", &hdr.UID},
+		{"gid", &hdr.GID},
+		{"link count", &hdr.NLink},
+		{"mtime", &hdr.MTime},
+		{"size", &hdr.FileSize},
+		{"device major", &hdr.Major},
+		{"device minor", &hdr.Minor},
+		{"rdev major", &hdr.Rmajor},
+		{"rdev minor", &hdr.Rminor},
+		{"name length", &hdr.NameLength},
+		{"checksum", &hdr.CRC},
+	} {
+		at := magicLen + 8*i
+		v, err := strconv.ParseUint(string(buf[at:at+8]), 16, 32)
+		if err != nil {
+			return cpio.Record{}, nil, bad(start+int64(at), "%s: %q is not 8 hex digits", f.name, buf[at:at+8])
+		}
+		*f.v = uint32(v)
 	}
 	cpio.Debug("Decoded header is %s\n", hdr)
 
-	// Get the name.
+	// Get the name. Its length is checked first, as the kernel checks
+	// it, so that a bad header is not a huge allocation.
+	if hdr.NameLength == 0 || hdr.NameLength > maxNameLength {
+		return cpio.Record{}, nil, bad(start+magicLen+8*11, "name length %d is not between 1 and %d", hdr.NameLength, maxNameLength)
+	}
+	nameStart := r.pos
 	nameBuf := make([]byte, hdr.NameLength)
-	if err := r.ReadAligned(nameBuf); err != nil {
-		return cpio.Record{}, err
+	if err := r.ReadAligned(nameBuf); err == io.EOF {
+		return cpio.Record{}, nil, &cpio.FormatError{Offset: r.pos, Err: cpio.ErrTruncated, Detail: fmt.Sprintf("got 0, want %d bytes", len(nameBuf))}
+	} else if err != nil {
+		return cpio.Record{}, nil, err
+	}
+	name := nameBuf[:hdr.NameLength-1]
+	switch {
+	case nameBuf[hdr.NameLength-1] != 0:
+		return cpio.Record{}, nil, bad(nameStart, "name %q does not end in a NUL", nameBuf)
+	case len(name) == 0:
+		return cpio.Record{}, nil, bad(nameStart, "the name is empty")
+	case bytes.IndexByte(name, 0) >= 0:
+		return cpio.Record{}, nil, bad(nameStart, "name %q has a NUL in it", name)
 	}
 
 	info := hdr.Info()
-	info.Name = string(nameBuf[:hdr.NameLength-1])
+	info.Name = string(name)
+
+	// The contents are not read here, but they must be there.
+	if hdr.FileSize > 0 {
+		var last [1]byte
+		if n, _ := r.r.ReadAt(last[:], r.pos+int64(hdr.FileSize)-1); n != 1 {
+			return cpio.Record{}, nil, &cpio.FormatError{Offset: r.pos, Err: cpio.ErrTruncated, Detail: fmt.Sprintf("%s: size %d is more than is left of the archive", info.Name, hdr.FileSize)}
+		}
+	}
 
 	content := io.NewSectionReader(r.r, r.pos, int64(hdr.FileSize))
+	if r.verify {
+		sum, err := checksum(io.NewSectionReader(content, 0, content.Size()))
+		if err != nil {
+			return cpio.Record{}, nil, fmt.Errorf("reader: %s: %v", info.Name, err)
+		}
+		if sum != hdr.CRC {
+			return cpio.Record{}, nil, fmt.Errorf("reader: %s: checksum of the contents is %#08x, the header has %#08x", info.Name, sum, hdr.CRC)
+		}
+	}
 	r.pos = round4(r.pos + int64(hdr.FileSize))
-	return cpio.Record{cpio.NewReadCloser(content), info}, nil
+	if info.Name == cpio.Trailer {
+		if err := r.skipZeros(); err != nil {
+			return cpio.Record{}, nil, err
+		}
+	}
+	return cpio.Record{ReadCloser: cpio.NewReadCloser(content), Info: info}, content, nil
 }
 
 func init() {
 	cpio.AddFormat("newc", format{magic: newcMagic})
+	cpio.AddFormat("crc", format{magic: crcMagic})
 }
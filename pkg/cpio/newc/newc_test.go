@@ -6,9 +6,17 @@ package newc
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -42,7 +50,7 @@ func TestWriteRead(t *testing.T) {
 	}
 
 	contents := []byte("LANAAAAAAAAAA")
-	rec := cpio.StaticRecord(contents, cpio.Info{
+	rec := cpio.NewRecordFromBytes(contents, cpio.Info{
 		Ino:      1,
 		Mode:     syscall.S_IFREG | 2,
 		UID:      3,
@@ -490,7 +498,7 @@ func TestReproducible(t *testing.T) {
 	}
 
 	contents := []byte("LANAAAAAAAAAA")
-	rec := []cpio.Record{cpio.StaticRecord(contents, cpio.Info{
+	rec := []cpio.Record{cpio.NewRecordFromBytes(contents, cpio.Info{
 		Ino:      1,
 		Mode:     syscall.S_IFREG | 2,
 		UID:      3,
@@ -559,3 +567,645 @@ func TestReproducible(t *testing.T) {
 		}
 	}
 }
+
+// testdata/links.cpio has a, b and d/c, links to one file, and x. It was
+// made by bsdcpio -o -H newc, which, as GNU cpio does, writes the contents
+// of the file with the last link only.
+func TestLinks(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/links.cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := f.Reader(bytes.NewReader(b)).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("shared contents\n")
+	check := func(files []cpio.Record) {
+		var ino []uint64
+		for _, r := range files {
+			if r.Name != "./a" && r.Name != "./b" && r.Name != "./d/c" {
+				continue
+			}
+			ino = append(ino, r.Ino)
+			c, err := ioutil.ReadAll(r)
+			if err != nil || !bytes.Equal(c, want) || r.FileSize != uint64(len(want)) || r.NLink != 3 {
+				t.Errorf("%s: got %q, %v, size %d, %d links, want %q, %d links", r.Name, c, err, r.FileSize, r.NLink, want, 3)
+			}
+		}
+		if len(ino) != 3 || ino[0] != ino[1] || ino[1] != ino[2] {
+			t.Errorf("links: got inodes %v, want three of one", ino)
+		}
+	}
+	check(files)
+	if files, err = f.Reader(bytes.NewReader(b)).ReadRecords(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written again, the contents are in the archive once, with the
+	// first link, and are read with every link.
+	var buf bytes.Buffer
+	w := f.Writer(&buf)
+	if err := w.WriteRecords(files); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(buf.Bytes(), want); n != 1 {
+		t.Errorf("the contents are in the archive written %d times, want once", n)
+	}
+	files, err = f.Reader(bytes.NewReader(buf.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(files)
+}
+
+func TestHeaderLimits(t *testing.T) {
+	fields := map[string]func(*cpio.Info, uint64){
+		"inode":        func(i *cpio.Info, v uint64) { i.Ino = v },
+		"mode":         func(i *cpio.Info, v uint64) { i.Mode = v },
+		"uid":          func(i *cpio.Info, v uint64) { i.UID = v },
+		"gid":          func(i *cpio.Info, v uint64) { i.GID = v },
+		"link count":   func(i *cpio.Info, v uint64) { i.NLink = v },
+		"mtime":        func(i *cpio.Info, v uint64) { i.MTime = v },
+		"size":         func(i *cpio.Info, v uint64) { i.FileSize = v },
+		"device major": func(i *cpio.Info, v uint64) { i.Major = v },
+		"device minor": func(i *cpio.Info, v uint64) { i.Minor = v },
+		"rdev major":   func(i *cpio.Info, v uint64) { i.Rmajor = v },
+		"rdev minor":   func(i *cpio.Info, v uint64) { i.Rminor = v },
+	}
+	for name, set := range fields {
+		i := cpio.Info{Name: "f"}
+		set(&i, math.MaxUint32)
+		if _, err := headerFromInfo(i); err != nil {
+			t.Errorf("%s %d: got %v, want nil", name, uint64(math.MaxUint32), err)
+		}
+		set(&i, math.MaxUint32+1)
+		if _, err := headerFromInfo(i); err == nil || !strings.Contains(err.Error(), "f: "+name+" ") {
+			t.Errorf("%s %d: got %v, want an error naming f and %s", name, uint64(math.MaxUint32)+1, err, name)
+		}
+	}
+	// The name has a NUL after it.
+	if _, err := headerFromInfo(cpio.Info{Name: strings.Repeat("n", maxNameLength-1)}); err != nil {
+		t.Errorf("name of %d: got %v, want nil", maxNameLength-1, err)
+	}
+	if _, err := headerFromInfo(cpio.Info{Name: strings.Repeat("n", maxNameLength)}); err == nil {
+		t.Errorf("name of %d: got nil, want an error", maxNameLength)
+	}
+
+	// Nothing is written of a record that can not be.
+	f, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	r := cpio.NewRecordFromBytes(nil, cpio.Info{Name: "big", Mode: syscall.S_IFREG | 0644})
+	r.FileSize = math.MaxUint32 + 1
+	if err := f.Writer(&b).WriteRecord(r); err == nil || b.Len() != 0 {
+		t.Errorf("WriteRecord of %d bytes: got %v with %d bytes written, want an error and none", r.FileSize, err, b.Len())
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	f, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := f.Writer(&b)
+	if err := w.WriteRecord(cpio.NewRecordFromBytes([]byte("abcd"), cpio.Info{Name: "f", Mode: syscall.S_IFREG | 0644})); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fields of the header are 8 hex digits each, after the magic.
+	field := func(n int, v uint32) []byte {
+		c := append([]byte(nil), b.Bytes()...)
+		copy(c[magicLen+8*n:], fmt.Sprintf("%08X", v))
+		return c
+	}
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		err  string
+	}{
+		{"size past the end", field(6, 0xFFFFFFFF), "more than is left"},
+		{"name length 0", field(11, 0), "name length 0"},
+		{"name length too big", field(11, maxNameLength+1), "name length"},
+		{"name length past the end", field(11, maxNameLength), "want 4096 bytes"},
+	} {
+		_, err := f.Reader(bytes.NewReader(tt.b)).ReadRecords()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want an error with %q", tt.name, err, tt.err)
+		}
+	}
+	// Exactly what is left is fine.
+	recs, err := f.Reader(bytes.NewReader(field(6, uint32(b.Len()-112)))).ReadRecords()
+	if err != nil || len(recs) != 1 || recs[0].FileSize != uint64(b.Len()-112) {
+		t.Errorf("size of what is left: got %v, %v", recs, err)
+	}
+}
+
+func TestWriterOptions(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		o    WriterOptions
+		size int
+	}{
+		{"no padding", WriterOptions{}, 0},
+		{"512", WriterOptions{TrailerPad: 512}, 512},
+		{"4KiB crc", WriterOptions{TrailerPad: 4096, CRC: true}, 4096},
+	} {
+		var b bytes.Buffer
+		nw := NewWriter(&b, tt.o)
+		w := cpio.NewWriter(nw)
+		if err := w.WriteRecord(cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "hello", Mode: syscall.S_IFREG | 0644})); err != nil {
+			t.Fatal(err)
+		}
+		if d := nw.Digest(); d != nil {
+			t.Errorf("%s: Digest before the trailer is %x, want nil", tt.name, d)
+		}
+		if err := w.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+		a := b.Bytes()
+		if tt.size > 0 && len(a)%tt.size != 0 {
+			t.Errorf("%s: archive is %d bytes, want a multiple of %d", tt.name, len(a), tt.size)
+		}
+		if sum := sha256.Sum256(a); !bytes.Equal(nw.Digest(), sum[:]) {
+			t.Errorf("%s: Digest is %x, want %x", tt.name, nw.Digest(), sum)
+		}
+
+		// The padding is zeros, which the reader takes as the end,
+		// whether or not another archive follows.
+		f := format{magic: newcMagic}
+		if tt.o.CRC {
+			f.magic = crcMagic
+		}
+		for _, c := range [][]byte{a, append(append([]byte(nil), a...), segment(t, "next")...)} {
+			rr := f.Reader(bytes.NewReader(c)).(cpio.SegmentReader)
+			var names []string
+			for {
+				r, err := rr.ReadRecord()
+				if err != nil {
+					t.Fatalf("%s: %v", tt.name, err)
+				}
+				names = append(names, r.Name)
+				if r.Name == cpio.Trailer {
+					break
+				}
+			}
+			if want := []string{"hello", cpio.Trailer}; !reflect.DeepEqual(names, want) || rr.Offset() != int64(len(a)) || rr.More() != (len(c) > len(a)) {
+				t.Errorf("%s: read %q up to %d, More %v, want %q up to %d", tt.name, names, rr.Offset(), rr.More(), want, len(a))
+			}
+		}
+	}
+
+	// Another hash can be given.
+	var b bytes.Buffer
+	w := NewWriter(&b, WriterOptions{Hash: md5.New()})
+	if err := w.WriteRecord(cpio.TrailerRecord); err != nil {
+		t.Fatal(err)
+	}
+	if sum := md5.Sum(b.Bytes()); !bytes.Equal(w.Digest(), sum[:]) {
+		t.Errorf("md5 Digest is %x, want %x", w.Digest(), sum)
+	}
+}
+
+func TestCRC(t *testing.T) {
+	f, err := cpio.Format("crc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "crc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A file on disk is checksummed without being read into memory.
+	onDisk := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(onDisk, []byte("on disk\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	recs := []cpio.Record{
+		{Info: cpio.Info{Name: "d", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "d/hello", Mode: syscall.S_IFREG | 0644}),
+		{ReadCloser: ioutil.NopCloser(strings.NewReader("\xff\xff")), Info: cpio.Info{Name: "d/stream", Mode: syscall.S_IFREG | 0644, FileSize: 2}},
+		{ReadCloser: cpio.NewDeferReadCloser(onDisk), Info: cpio.Info{Name: "d/disk", Mode: syscall.S_IFREG | 0644, FileSize: 8}},
+	}
+	var b bytes.Buffer
+	w := f.Writer(&b)
+	if err := w.WriteRecords(recs); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The checksum is the last field of the header.
+	a := b.Bytes()
+	check := func(name string) (int, string) {
+		i := bytes.Index(a, []byte(name+"\x00")) - 110 + magicLen + 8*12
+		return i, string(a[i : i+8])
+	}
+	for _, tt := range []struct {
+		name string
+		want uint32
+	}{
+		{"d", 0},
+		{"d/hello", 'h' + 'e' + 'l' + 'l' + 'o' + '\n'},
+		{"d/stream", 0x1fe},
+		{"d/disk", 'o' + 'n' + ' ' + 'd' + 'i' + 's' + 'k' + '\n'},
+	} {
+		if _, got := check(tt.name); got != fmt.Sprintf("%08X", tt.want) {
+			t.Errorf("%s: checksum is %s, want %08X", tt.name, got, tt.want)
+		}
+	}
+
+	got, err := f.Reader(bytes.NewReader(a)).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"", "hello\n", "\xff\xff", "on disk\n"} {
+		c, err := ioutil.ReadAll(got[i])
+		if err != nil || string(c) != want {
+			t.Errorf("%s: got %q, %v, want %q", got[i].Name, c, err, want)
+		}
+	}
+
+	// A newc reader does not take a crc archive.
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newc.Reader(bytes.NewReader(a)).ReadRecords(); err == nil {
+		t.Errorf("newc reader read a crc archive")
+	}
+
+	// Damaged contents are found, but can be read anyway.
+	i := bytes.Index(a, []byte("hello\n"))
+	a[i] = 'j'
+	if _, err := f.Reader(bytes.NewReader(a)).ReadRecords(); err == nil || !strings.Contains(err.Error(), "d/hello: checksum of the contents is 0x00000220, the header has 0x0000021e") {
+		t.Errorf("damaged contents: got %v, want a checksum error", err)
+	}
+	nv := cpio.Archiver{RecordFormat: WithReaderOptions(f.RecordFormat, ReaderOptions{NoVerify: true})}
+	if got, err := nv.Reader(bytes.NewReader(a)).ReadRecords(); err != nil || len(got) != len(recs) {
+		t.Errorf("damaged contents without verifying: got %d records, %v, want %d", len(got), err, len(recs))
+	}
+	// Other readers of the format still verify.
+	if _, err := f.Reader(bytes.NewReader(a)).ReadRecords(); err == nil {
+		t.Errorf("damaged contents, after a reader without verifying: got nil, want a checksum error")
+	}
+	// Other formats are left as they are.
+	other := struct{ cpio.RecordFormat }{f.RecordFormat}
+	if got := WithReaderOptions(other, ReaderOptions{NoVerify: true}); got != cpio.RecordFormat(other) {
+		t.Errorf("WithReaderOptions(another format): got %v, want it as it is", got)
+	}
+}
+
+func TestGNUCpioCRC(t *testing.T) {
+	if _, err := exec.LookPath("cpio"); err != nil {
+		t.Skip("cpio is not installed")
+	}
+	f, err := cpio.Format("crc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := f.Writer(&b)
+	if err := w.WriteRecords([]cpio.Record{
+		cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "hello", Mode: syscall.S_IFREG | 0644}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "crc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// GNU cpio checks the checksums when it extracts.
+	c := exec.Command("cpio", "-i", "-H", "crc", "--quiet")
+	c.Dir = dir
+	c.Stdin = &b
+	if out, err := c.CombinedOutput(); err != nil || len(out) != 0 {
+		t.Fatalf("cpio -i: %v: %s", err, out)
+	}
+}
+
+// testdata/symlinks.cpio has bin/sh, motd, abs and long, symlinks to
+// busybox, etc/motd, /etc/motd and 101 x's, among a few other files. It was
+// made by bsdcpio -o -H newc, which writes symlinks as GNU cpio does, their
+// targets as their contents, without a NUL.
+func TestSymlinks(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/symlinks.cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"bin/sh": "busybox",
+		"motd":   "etc/motd",
+		"abs":    "/etc/motd",
+		"long":   strings.Repeat("x", 101),
+	}
+	check := func(name string, recs []cpio.Record) {
+		got := make(map[string]string)
+		for _, r := range recs {
+			if r.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+				continue
+			}
+			target, err := r.Linkname()
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			got[r.Name] = target
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got symlinks %q, want %q", name, got, want)
+		}
+	}
+	recs, err := f.Reader(bytes.NewReader(b)).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("bsdcpio", recs)
+
+	// Written again, as they are and as Symlink makes them, they are
+	// read back the same.
+	var buf bytes.Buffer
+	w := f.Writer(&buf)
+	if err := w.WriteRecords(recs); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if recs, err = f.Reader(bytes.NewReader(buf.Bytes())).ReadRecords(); err != nil {
+		t.Fatal(err)
+	}
+	check("written again", recs)
+
+	recs = nil
+	for name, target := range want {
+		recs = append(recs, cpio.Symlink(name, target))
+	}
+	buf.Reset()
+	w = f.Writer(&buf)
+	if err := w.WriteRecords(recs); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if recs, err = f.Reader(bytes.NewReader(buf.Bytes())).ReadRecords(); err != nil {
+		t.Fatal(err)
+	}
+	check("Symlink", recs)
+}
+
+func TestGNUCpioSymlink(t *testing.T) {
+	if _, err := exec.LookPath("cpio"); err != nil {
+		t.Skip("cpio is not installed")
+	}
+	f, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := f.Writer(&b)
+	if err := w.WriteRecords([]cpio.Record{
+		cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "motd", Mode: syscall.S_IFREG | 0644}),
+		cpio.Symlink("issue", "motd"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "symlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := exec.Command("cpio", "-i", "--quiet")
+	c.Dir = dir
+	c.Stdin = bytes.NewReader(b.Bytes())
+	if out, err := c.CombinedOutput(); err != nil || len(out) != 0 {
+		t.Fatalf("cpio -i: %v: %s", err, out)
+	}
+	if got, err := os.Readlink(filepath.Join(dir, "issue")); err != nil || got != "motd" {
+		t.Errorf("cpio -i made %q, %v, want a symlink to motd", got, err)
+	}
+
+	// What GNU cpio writes of it is what was extracted.
+	c = exec.Command("cpio", "-o", "-H", "newc", "--quiet")
+	c.Dir = dir
+	c.Stdin = strings.NewReader("motd\nissue\n")
+	out, err := c.Output()
+	if err != nil {
+		t.Fatalf("cpio -o: %v", err)
+	}
+	recs, err := f.Reader(bytes.NewReader(out)).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("cpio -o: got %d records, want 2", len(recs))
+	}
+	if got, err := recs[1].Linkname(); err != nil || got != "motd" {
+		t.Errorf("cpio -o: got %s -> %q, %v, want issue -> motd", recs[1].Name, got, err)
+	}
+}
+
+// segment returns a newc archive of files with the given names, each with
+// its name as its contents.
+func segment(t *testing.T, names ...string) []byte {
+	f, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := f.Writer(&b)
+	for _, n := range names {
+		if err := w.WriteRecord(cpio.NewRecordFromBytes([]byte(n), cpio.Info{Name: n, Mode: syscall.S_IFREG | 0644})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestPadding(t *testing.T) {
+	a, b := segment(t, "a"), segment(t, "b", "c")
+	// As cpio -B writes it, in blocks of 512 bytes.
+	blocked := append([]byte(nil), a...)
+	blocked = append(blocked, make([]byte, 512-len(a)%512)...)
+	cat := func(segs ...[]byte) []byte {
+		return bytes.Join(segs, nil)
+	}
+	for _, tt := range []struct {
+		name   string
+		b      []byte
+		want   []string
+		more   bool
+		offset int64
+	}{
+		{"none", a, []string{"a"}, false, int64(len(a))},
+		{"NULs", cat(a, make([]byte, 3)), []string{"a"}, false, int64(len(a) + 3)},
+		{"blocks of 512", blocked, []string{"a"}, false, 512},
+		{"concatenated", cat(a, b), []string{"a", cpio.Trailer, "b", "c"}, true, int64(len(a))},
+		{"padded and concatenated", cat(blocked, b), []string{"a", cpio.Trailer, "b", "c"}, true, 512},
+	} {
+		rr := format{magic: newcMagic}.Reader(bytes.NewReader(tt.b)).(cpio.SegmentReader)
+		var got []string
+		for {
+			rec, err := rr.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if rec.Name == cpio.Trailer && len(got) == 1 {
+				// The first trailer.
+				if rr.More() != tt.more || rr.Offset() != tt.offset {
+					t.Errorf("%s: after the trailer, got More %v at %d, want %v at %d", tt.name, rr.More(), rr.Offset(), tt.more, tt.offset)
+				}
+			}
+			got = append(got, rec.Name)
+		}
+		// The last trailer ends the list.
+		if want := append(tt.want, cpio.Trailer); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, want)
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	a := segment(t, "hello")
+	// The first record is a header of 110 bytes, its name, "hello" and a
+	// NUL, padded to 4, and its contents, "hello" padded to 4.
+	const first = 110 + 6 + 8
+	// set returns a with s written over it at i.
+	set := func(i int, s string) []byte {
+		c := append([]byte(nil), a...)
+		copy(c[i:], s)
+		return c
+	}
+	empty := set(magicLen+8*11, "00000001")
+	empty[110] = 0
+	for _, tt := range []struct {
+		name   string
+		b      []byte
+		err    error
+		offset int64
+	}{
+		{"no trailer", a[:first], io.EOF, 0},
+		{"short header", a[:first+50], cpio.ErrTruncated, first},
+		{"short name", a[:112], cpio.ErrTruncated, 110},
+		{"short contents", a[:118], cpio.ErrTruncated, 116},
+		{"bad magic", bytes.Join([][]byte{a[:first], []byte("070707"), a[first+6:]}, nil), cpio.ErrBadMagic, first},
+		{"mode not hex", set(magicLen+8, "0000ZZZZ"), cpio.ErrBadHeader, magicLen + 8},
+		{"signed size", set(magicLen+8*6, "-0000001"), cpio.ErrBadHeader, magicLen + 8*6},
+		{"name length 0", set(magicLen+8*11, "00000000"), cpio.ErrBadHeader, magicLen + 8*11},
+		{"name without its NUL", set(115, "!"), cpio.ErrBadHeader, 110},
+		{"NUL in the name", set(112, "\x00"), cpio.ErrBadHeader, 110},
+		{"empty name", empty, cpio.ErrBadHeader, 110},
+	} {
+		_, err := cpio.Archiver{RecordFormat: format{magic: newcMagic}}.Reader(bytes.NewReader(tt.b)).ReadRecords()
+		if tt.err == io.EOF {
+			if err != nil {
+				t.Errorf("%s: got %v, want the records read", tt.name, err)
+			}
+			continue
+		}
+		fe, ok := err.(*cpio.FormatError)
+		if !ok || fe.Err != tt.err || fe.Offset != tt.offset {
+			t.Errorf("%s: got %v, want %v at %d", tt.name, err, tt.err, tt.offset)
+		}
+	}
+}
+
+// FuzzReader reads archives that may be anything, which must not panic or
+// allocate more than they are, and whose records must have the contents
+// their headers say they have.
+func FuzzReader(f *testing.F) {
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		f.Fatal(err)
+	}
+	var seeds [][]byte
+	for _, name := range []string{"links.cpio", "symlinks.cpio"} {
+		b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, b)
+	}
+	var b bytes.Buffer
+	w := newc.Writer(&b)
+	if err := w.WriteRecord(cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "hello", Mode: syscall.S_IFREG | 0644, NLink: 1})); err != nil {
+		f.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		f.Fatal(err)
+	}
+	a := b.Bytes()
+	seeds = append(seeds, testCPIO, a)
+	// And archives that are broken in each way the reader checks for.
+	set := func(i int, s string) []byte {
+		c := append([]byte(nil), a...)
+		copy(c[i:], s)
+		return c
+	}
+	seeds = append(seeds,
+		a[:50],
+		set(0, "070707"),
+		set(magicLen+8, "ZZZZZZZZ"),
+		set(magicLen+8*6, "FFFFFFFF"),
+		set(magicLen+8*11, "FFFFFFFF"),
+		set(magicLen+8*11, "00000000"),
+		set(115, "!"),
+		set(112, "\x00"),
+	)
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		rr := newc.Reader(bytes.NewReader(b))
+		// Each record is at least a header long.
+		for i := 0; i <= len(b)/110; i++ {
+			r, err := rr.ReadRecord()
+			if err != nil {
+				return
+			}
+			if r.ReadCloser == nil {
+				continue
+			}
+			n, err := io.Copy(ioutil.Discard, r)
+			if err != nil {
+				continue
+			}
+			if uint64(n) != r.FileSize {
+				t.Fatalf("%s: read %d bytes, the header has %d", r.Name, n, r.FileSize)
+			}
+		}
+	})
+}
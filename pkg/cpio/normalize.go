@@ -0,0 +1,69 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+// Normalizer says which fields of records to normalize so that archives
+// are reproducible. MakeReproducible is the Normalizer that sets the mtime
+// to SourceDateEpoch and nothing else.
+//
+// The device a file came from is always cleared, and the inode number is
+// renumbered if RenumberInodes is set, even for the records Except leaves
+// alone: those fields are how the kernel knows hard links, and links must
+// be normalized alike on both sides.
+type Normalizer struct {
+	// Epoch, UID and GID, if they are not nil, are the mtime, uid and gid
+	// records are given.
+	Epoch, UID, GID *int64
+	// RenumberInodes gives records inode numbers counting from 1 in the
+	// order they are seen, the links to a file sharing its number.
+	RenumberInodes bool
+	// Except, if it is not nil, returns true for the records whose mtime
+	// and ownership are left alone.
+	Except func(Record) bool
+}
+
+// Transform returns a RecordFunc that normalizes records as n says. Each
+// RecordFunc numbers inodes on its own, and is meant for one archive.
+func (n Normalizer) Transform() RecordFunc {
+	inodes := make(map[Info]uint64)
+	var next uint64
+	return files(func(r Record) Record {
+		if n.RenumberInodes {
+			// Only the links to regular files share their
+			// inode; other records are given one each, even
+			// those, like NewRecordFromBytes records, that have none.
+			k := Info{Ino: r.Ino, Major: r.Major, Minor: r.Minor}
+			ino, ok := inodes[k]
+			if !ok || r.Mode&modeTypeMask != modeFile || r.NLink <= 1 {
+				next++
+				ino = next
+			}
+			if !ok && r.Mode&modeTypeMask == modeFile && r.NLink > 1 {
+				inodes[k] = ino
+			}
+			r.Ino = ino
+		}
+		if n.Except != nil && n.Except(r) {
+			r.Major, r.Minor = 0, 0
+			return r
+		}
+		return n.normalize(r)
+	})
+}
+
+// normalize sets the fields of r that n says to.
+func (n Normalizer) normalize(r Record) Record {
+	if n.Epoch != nil {
+		r.MTime = uint64(*n.Epoch)
+	}
+	if n.UID != nil {
+		r.UID = uint64(*n.UID)
+	}
+	if n.GID != nil {
+		r.GID = uint64(*n.GID)
+	}
+	r.Major, r.Minor = 0, 0
+	return r
+}
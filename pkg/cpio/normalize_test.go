@@ -0,0 +1,80 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func normalizeRecords() []cpio.Record {
+	link := func(name string, ino uint64, contents string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(contents), cpio.Info{Name: name, Ino: ino, Mode: syscall.S_IFREG | 0755, NLink: 2, Major: 8, Minor: 1, UID: 1000, GID: 1000, MTime: 42})
+	}
+	// The same inode number, but on another device.
+	cat := link("bin/cat", 100, "")
+	cat.Minor = 2
+	return []cpio.Record{
+		{Info: cpio.Info{Name: "bin", Ino: 7, Mode: syscall.S_IFDIR | 0755, Major: 8, Minor: 1, UID: 1000, GID: 1000, MTime: 42}},
+		link("bin/ls", 100, ""),
+		{Info: cpio.Info{Name: "home", Ino: 7, Mode: syscall.S_IFDIR | 0755, Major: 8, Minor: 2, UID: 1000, GID: 1000, MTime: 42}},
+		// A link under /home, which Except leaves alone, to one outside it.
+		link("home/user/ls", 100, "ls"),
+		cpio.NewRecordFromBytes([]byte("x"), cpio.Info{Name: "home/user/x", Mode: syscall.S_IFREG | 0644, UID: 1000, GID: 1000, MTime: 42}),
+		link("bin/dir", 100, "dir"),
+		cat,
+		cpio.TrailerRecord,
+	}
+}
+
+func TestNormalizer(t *testing.T) {
+	epoch, root := int64(1234567890), int64(0)
+	home := func(r cpio.Record) bool { return strings.HasPrefix(r.Name, "home/") }
+	for _, tt := range []struct {
+		name string
+		n    cpio.Normalizer
+		want []string
+	}{
+		{"empty", cpio.Normalizer{}, []string{
+			"bin 7 1000:1000 42", "bin/ls 100 1000:1000 42", "home 7 1000:1000 42", "home/user/ls 100 1000:1000 42",
+			"home/user/x 0 1000:1000 42", "bin/dir 100 1000:1000 42", "bin/cat 100 1000:1000 42", "TRAILER!!! 0 0:0 0",
+		}},
+		{"renumber, keeping mtimes", cpio.Normalizer{RenumberInodes: true}, []string{
+			"bin 1 1000:1000 42", "bin/ls 2 1000:1000 42", "home 3 1000:1000 42", "home/user/ls 2 1000:1000 42",
+			"home/user/x 4 1000:1000 42", "bin/dir 2 1000:1000 42", "bin/cat 5 1000:1000 42", "TRAILER!!! 0 0:0 0",
+		}},
+		{"all but home", cpio.Normalizer{Epoch: &epoch, UID: &root, GID: &root, RenumberInodes: true, Except: home}, []string{
+			"bin 1 0:0 1234567890", "bin/ls 2 0:0 1234567890", "home 3 0:0 1234567890", "home/user/ls 2 1000:1000 42",
+			"home/user/x 4 1000:1000 42", "bin/dir 2 0:0 1234567890", "bin/cat 5 0:0 1234567890", "TRAILER!!! 0 0:0 0",
+		}},
+	} {
+		f := tt.n.Transform()
+		var got []string
+		for _, r := range normalizeRecords() {
+			r = f(r)
+			if r.Name != cpio.Trailer && (r.Major != 0 || r.Minor != 0) {
+				t.Errorf("%s: %s: device %d,%d not cleared", tt.name, r.Name, r.Major, r.Minor)
+			}
+			got = append(got, fmt.Sprintf("%s %d %d:%d %d", r.Name, r.Ino, r.UID, r.GID, r.MTime))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestMakeReproducible(t *testing.T) {
+	defer func() { syscall.Unsetenv("SOURCE_DATE_EPOCH") }()
+	syscall.Setenv("SOURCE_DATE_EPOCH", "1234567890")
+	r := cpio.MakeReproducible(cpio.Record{Info: cpio.Info{Name: "x", Ino: 3, UID: 1000, MTime: 42, Major: 8, Minor: 1}})
+	if want := (cpio.Info{Name: "x", Ino: 3, UID: 1000, MTime: 1234567890}); r.Info != want {
+		t.Errorf("MakeReproducible: got %v, want %v", r.Info, want)
+	}
+}
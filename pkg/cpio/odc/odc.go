@@ -0,0 +1,222 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// odc implements the POSIX portable ASCII cpio format, whose header fields
+// are octal, for tools that take no other.
+//
+// Most fields have 6 octal digits, so that they can not be more than
+// 262143; the size and mtime have 11. Device numbers are major<<8 | minor.
+// Names and contents are not padded. The contents of a file with more than
+// one link are written with the first link written; a link read without
+// them, after one with them, is read with them.
+package odc
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"syscall"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+const (
+	magic     = "070707"
+	headerLen = 76
+	// maxNameLength is the longest name, with its NUL, that the kernel
+	// would take: PATH_MAX.
+	maxNameLength = 4096
+)
+
+// field is a header field: its name and width in octal digits.
+type field struct {
+	name  string
+	width int
+}
+
+// fields are the header fields after the magic, in order.
+var fields = []field{
+	{"device", 6},
+	{"inode", 6},
+	{"mode", 6},
+	{"uid", 6},
+	{"gid", 6},
+	{"link count", 6},
+	{"rdev", 6},
+	{"mtime", 11},
+	{"name length", 6},
+	{"size", 11},
+}
+
+type format struct{}
+
+type writer struct {
+	w io.Writer
+}
+
+func (format) Writer(w io.Writer) cpio.RecordWriter {
+	return &writer{w: w}
+}
+
+// dev returns major and minor as one device number, or an error if minor
+// does not fit in its 8 bits.
+func dev(name, field string, major, minor uint64) (uint64, error) {
+	if minor > 0xff {
+		return 0, fmt.Errorf("%s: %s minor %d is more than odc can hold, 255", name, field, minor)
+	}
+	return major<<8 | minor, nil
+}
+
+// header returns the header of i, or an error naming the first field too
+// big for it.
+func header(i cpio.Info) ([]byte, error) {
+	d, err := dev(i.Name, "device", i.Major, i.Minor)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := dev(i.Name, "rdev", i.Rmajor, i.Rminor)
+	if err != nil {
+		return nil, err
+	}
+	values := []uint64{d, i.Ino, i.Mode, i.UID, i.GID, i.NLink, rd, i.MTime, uint64(len(i.Name)) + 1, i.FileSize}
+	h := make([]byte, 0, headerLen)
+	h = append(h, magic...)
+	for n, f := range fields {
+		if max := uint64(1)<<(3*uint(f.width)) - 1; values[n] > max {
+			return nil, fmt.Errorf("%s: %s %d is more than odc can hold, %d", i.Name, f.name, values[n], max)
+		}
+		h = append(h, fmt.Sprintf("%0*o", f.width, values[n])...)
+	}
+	if values[8] > maxNameLength {
+		return nil, fmt.Errorf("%s: name length %d is more than the kernel takes, %d", i.Name, values[8], maxNameLength)
+	}
+	return h, nil
+}
+
+// WriteRecord writes the header, name and contents of r, unless the header
+// can not hold it, when it writes nothing.
+func (w *writer) WriteRecord(r cpio.Record) error {
+	info := r.Info
+	if r.ReadCloser == nil {
+		info.FileSize = 0
+	}
+	h, err := header(info)
+	if err != nil {
+		return err
+	}
+	if _, err := w.w.Write(append(append(h, info.Name...), 0)); err != nil {
+		return err
+	}
+	if r.ReadCloser == nil {
+		return nil
+	}
+	defer r.Close()
+	n, err := io.Copy(w.w, io.LimitReader(r, int64(info.FileSize)))
+	if err != nil {
+		return err
+	}
+	if uint64(n) != info.FileSize {
+		return fmt.Errorf("%s: has %d bytes, want %d", r.Name, n, info.FileSize)
+	}
+	return nil
+}
+
+type reader struct {
+	r   io.ReaderAt
+	pos int64
+	// links has the contents of the regular files with more than one
+	// link read with them, by inode, device and mode.
+	links map[cpio.Info]*io.SectionReader
+}
+
+func (format) Reader(r io.ReaderAt) cpio.RecordReader {
+	return &reader{r: r, links: make(map[cpio.Info]*io.SectionReader)}
+}
+
+// Offset returns where the next record starts: after the trailer, where
+// the archive ends.
+func (r *reader) Offset() int64 {
+	return r.pos
+}
+
+// read reads len(p) bytes, or returns io.EOF if there are none to read.
+func (r *reader) read(p []byte) error {
+	n, err := r.r.ReadAt(p, r.pos)
+	if err == io.EOF && n == 0 {
+		return io.EOF
+	}
+	if err != nil && err != io.EOF || n != len(p) {
+		return fmt.Errorf("ReadAt(pos = %d): got %d, want %d bytes; error %v", r.pos, n, len(p), err)
+	}
+	r.pos += int64(n)
+	return nil
+}
+
+// ReadRecord returns the next record, or the trailer.
+func (r *reader) ReadRecord() (cpio.Record, error) {
+	start := r.pos
+	h := make([]byte, headerLen)
+	if err := r.read(h); err != nil {
+		return cpio.Record{}, err
+	}
+	if m := string(h[:len(magic)]); m != magic {
+		return cpio.Record{}, fmt.Errorf("reader: header at %d: magic got %q, want %q", start, m, magic)
+	}
+	var values []uint64
+	off := len(magic)
+	for _, f := range fields {
+		v, err := strconv.ParseUint(string(h[off:off+f.width]), 8, 64)
+		if err != nil {
+			return cpio.Record{}, fmt.Errorf("reader: header at %d: %s: %v", start, f.name, err)
+		}
+		values = append(values, v)
+		off += f.width
+	}
+	d, ino, mode, uid, gid, nlink, rd, mtime, nameLen, size := values[0], values[1], values[2], values[3], values[4], values[5], values[6], values[7], values[8], values[9]
+
+	if nameLen == 0 || nameLen > maxNameLength {
+		return cpio.Record{}, fmt.Errorf("reader: header at %d: name length %d is not between 1 and %d", start, nameLen, maxNameLength)
+	}
+	name := make([]byte, nameLen)
+	if err := r.read(name); err != nil {
+		return cpio.Record{}, err
+	}
+	info := cpio.Info{
+		Ino:      ino,
+		Mode:     mode,
+		UID:      uid,
+		GID:      gid,
+		NLink:    nlink,
+		MTime:    mtime,
+		FileSize: size,
+		Major:    d >> 8,
+		Minor:    d & 0xff,
+		Rmajor:   rd >> 8,
+		Rminor:   rd & 0xff,
+		Name:     string(name[:nameLen-1]),
+	}
+	if size > 0 {
+		var last [1]byte
+		if n, _ := r.r.ReadAt(last[:], r.pos+int64(size)-1); n != 1 {
+			return cpio.Record{}, fmt.Errorf("reader: %s: size %d is more than is left of the archive", info.Name, size)
+		}
+	}
+	content := io.NewSectionReader(r.r, r.pos, int64(size))
+	r.pos += int64(size)
+
+	if mode&syscall.S_IFMT == syscall.S_IFREG && nlink > 1 {
+		k := cpio.Info{Ino: ino, Mode: mode, Major: info.Major, Minor: info.Minor}
+		if c, ok := r.links[k]; ok && size == 0 {
+			content = io.NewSectionReader(c, 0, c.Size())
+			info.FileSize = uint64(c.Size())
+		} else if size > 0 {
+			r.links[k] = content
+		}
+	}
+	return cpio.Record{ReadCloser: cpio.NewReadCloser(content), Info: info}, nil
+}
+
+func init() {
+	cpio.AddFormat("odc", format{})
+}
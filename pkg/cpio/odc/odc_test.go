@@ -0,0 +1,182 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package odc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// list returns the records of the archive b as lines of name, mode, links
+// and contents.
+func list(t *testing.T, b []byte) []string {
+	f, err := cpio.Format("odc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := f.Reader(bytes.NewReader(b)).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l []string
+	for _, r := range recs {
+		c, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(len(c)) != r.FileSize {
+			t.Errorf("%s: got %d bytes, want %d", r.Name, len(c), r.FileSize)
+		}
+		l = append(l, fmt.Sprintf("%s %o %d %q", r.Name, r.Mode, r.NLink, c))
+	}
+	return l
+}
+
+// testdata/odc.cpio was made by bsdcpio -o -H odc, which, as GNU cpio
+// does, writes the contents with every link.
+func TestRead(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/odc.cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`./a 100644 2 "shared contents\n"`,
+		`./d 40755 2 ""`,
+		`./d/b 100644 2 "shared contents\n"`,
+		`./s 120777 1 "a"`,
+		`./x 100644 1 "x\n"`,
+	}
+	if got := list(t, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Written again, the contents are there once, and read with both
+	// links.
+	f, err := cpio.Format("odc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := f.Reader(bytes.NewReader(b)).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	w := f.Writer(&out)
+	if err := w.WriteRecords(recs); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(out.Bytes(), []byte("shared contents")); n != 1 {
+		t.Errorf("the contents are in the archive written %d times, want once", n)
+	}
+	if got := list(t, out.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("written again: got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLimits(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		info cpio.Info
+		err  string
+	}{
+		{"inode", cpio.Info{Ino: 262143}, ""},
+		{"inode", cpio.Info{Ino: 262144}, "inode 262144 is more than odc can hold, 262143"},
+		{"uid", cpio.Info{UID: 262144}, "uid 262144"},
+		{"size", cpio.Info{FileSize: 1<<33 - 1}, ""},
+		{"size", cpio.Info{FileSize: 1 << 33}, "size 8589934592 is more than odc can hold, 8589934591"},
+		{"mtime", cpio.Info{MTime: 1 << 33}, "mtime"},
+		{"device", cpio.Info{Major: 1023, Minor: 255}, ""},
+		{"device", cpio.Info{Major: 1024}, "device 262144"},
+		{"device", cpio.Info{Minor: 256}, "device minor 256"},
+		{"rdev", cpio.Info{Rmajor: 4, Rminor: 256}, "rdev minor 256"},
+		{"name", cpio.Info{Name: strings.Repeat("n", maxNameLength-1)}, ""},
+		{"name", cpio.Info{Name: strings.Repeat("n", maxNameLength)}, "name length"},
+	} {
+		_, err := header(tt.info)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	// Nothing is written of a record that can not be.
+	f, err := cpio.Format("odc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := f.Writer(&b).WriteRecord(cpio.NewRecordFromBytes(nil, cpio.Info{Name: "f", Ino: 1 << 18})); err == nil || b.Len() != 0 {
+		t.Errorf("WriteRecord: got %v with %d bytes written, want an error and none", err, b.Len())
+	}
+}
+
+func TestReadBad(t *testing.T) {
+	f, err := cpio.Format("odc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := f.Writer(&b).WriteRecord(cpio.NewRecordFromBytes([]byte("abcd"), cpio.Info{Name: "f", Mode: syscall.S_IFREG | 0644})); err != nil {
+		t.Fatal(err)
+	}
+	h := b.Bytes()
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		err  string
+	}{
+		{"magic", append([]byte("070701"), h[6:]...), "magic"},
+		{"digit", append(append(append([]byte(nil), h[:6]...), '9'), h[7:]...), "device"},
+		{"size", append(append([]byte(nil), h[:65]...), append([]byte("00000000010"), h[76:]...)...), "more than is left"},
+		{"name length", append(append([]byte(nil), h[:59]...), append([]byte("000000"), h[65:]...)...), "name length 0"},
+		{"short", h[:50], "want 76 bytes"},
+	} {
+		_, err := f.Reader(bytes.NewReader(tt.b)).ReadRecords()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want an error with %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestGNUCpio(t *testing.T) {
+	if _, err := exec.LookPath("cpio"); err != nil {
+		t.Skip("cpio is not installed")
+	}
+	f, err := cpio.Format("odc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := f.Writer(&b)
+	if err := w.WriteRecords([]cpio.Record{
+		{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644}),
+		cpio.NewRecordFromBytes([]byte("motd"), cpio.Info{Name: "etc/greeting", Mode: syscall.S_IFLNK | 0777}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	c := exec.Command("cpio", "-t", "--quiet")
+	c.Stdin = &b
+	out, err := c.CombinedOutput()
+	if err != nil {
+		t.Fatalf("cpio -t: %v: %s", err, out)
+	}
+	if got, want := string(out), "etc\netc/motd\netc/greeting\n"; got != want {
+		t.Errorf("cpio -t: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"path"
+)
+
+// ParentWriter is a RecordWriter that writes a record for each directory a
+// record is in, if none was written before it, as GNU cpio and some
+// kernels want: one that makes them itself makes them mode 0700. The
+// directories it makes are mode 0755, owned by root, and have the mtime
+// MakeReproducible gives.
+//
+// A record of a directory that it made, written to it later, is written
+// too; what happens to it is up to the RecordWriter below, such as a
+// DedupWriter.
+type ParentWriter struct {
+	w           RecordWriter
+	dirs        map[string]bool
+	synthesized map[string]bool
+}
+
+// NewParentWriter returns a ParentWriter writing to w.
+func NewParentWriter(w RecordWriter) *ParentWriter {
+	return &ParentWriter{w: w, dirs: make(map[string]bool), synthesized: make(map[string]bool)}
+}
+
+// WriteRecord writes the directories r is in that were not written
+// before, top down, and then r.
+func (p *ParentWriter) WriteRecord(r Record) error {
+	if r.Name == Trailer {
+		return p.w.WriteRecord(r)
+	}
+	name := archiveName(r.Name)
+	var missing []string
+	for dir := path.Dir(name); dir != "." && !p.dirs[dir]; dir = path.Dir(dir) {
+		missing = append(missing, dir)
+	}
+	for j := len(missing) - 1; j >= 0; j-- {
+		dir := missing[j]
+		p.dirs[dir] = true
+		p.synthesized[dir] = true
+		if err := p.w.WriteRecord(MakeReproducible(Record{Info: Info{Name: dir, Mode: modeDir | 0755}})); err != nil {
+			return err
+		}
+	}
+	if r.Mode&modeTypeMask == modeDir {
+		p.dirs[name] = true
+	}
+	return p.w.WriteRecord(r)
+}
+
+// AddDir records that the directory name was written other than through p,
+// so that p does not write it again.
+func (p *ParentWriter) AddDir(name string) {
+	p.dirs[archiveName(name)] = true
+}
+
+// Synthesized returns whether the first record of the directory name was
+// one p made, rather than one written to it, so that reports can tell them
+// apart.
+func (p *ParentWriter) Synthesized(name string) bool {
+	return p.synthesized[archiveName(name)]
+}
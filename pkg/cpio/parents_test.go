@@ -0,0 +1,61 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"fmt"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// recordList is a RecordWriter that lists the records written to it.
+type recordList []string
+
+func (l *recordList) WriteRecord(r cpio.Record) error {
+	*l = append(*l, fmt.Sprintf("%s %o %d:%d", r.Name, r.Mode, r.UID, r.GID))
+	return nil
+}
+
+func TestParentWriter(t *testing.T) {
+	var l recordList
+	// Below it, a DedupWriter leaves out the directories written again.
+	p := cpio.NewParentWriter(cpio.NewDedupWriter(&l, cpio.SkipDuplicates, nil))
+	p.AddDir("/etc")
+	for _, r := range []cpio.Record{
+		cpio.NewRecordFromBytes([]byte("foo"), cpio.Info{Name: "usr/bin/foo", Mode: syscall.S_IFREG | 0755, UID: 1000}),
+		cpio.NewRecordFromBytes([]byte("bar"), cpio.Info{Name: "/usr/bin/bar", Mode: syscall.S_IFREG | 0755}),
+		{Info: cpio.Info{Name: "usr", Mode: syscall.S_IFDIR | 0700, UID: 1000}},
+		{Info: cpio.Info{Name: "var", Mode: syscall.S_IFDIR | 0700, UID: 1000}},
+		{Info: cpio.Info{Name: "var/log/x", Mode: syscall.S_IFIFO | 0600}},
+		cpio.NewRecordFromBytes([]byte("hello"), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644}),
+		cpio.TrailerRecord,
+	} {
+		if err := p.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := recordList{
+		"usr 40755 0:0",
+		"usr/bin 40755 0:0",
+		"usr/bin/foo 100755 1000:0",
+		"/usr/bin/bar 100755 0:0",
+		"var 40700 1000:0",
+		"var/log 40755 0:0",
+		"var/log/x 10600 0:0",
+		"etc/motd 100644 0:0",
+		"TRAILER!!! 0 0:0",
+	}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("got %q, want %q", l, want)
+	}
+	for name, want := range map[string]bool{"usr": true, "/usr/bin": true, "var": false, "var/log": true, "etc": false} {
+		if got := p.Synthesized(name); got != want {
+			t.Errorf("Synthesized(%q): got %v, want %v", name, got, want)
+		}
+	}
+}
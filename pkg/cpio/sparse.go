@@ -0,0 +1,132 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// sparseReader reads a file with holes in it, filling the holes with zeros
+// rather than reading them.
+type sparseReader struct {
+	f    *os.File
+	pos  int64
+	size int64
+	// data and hole are where the run of data at or after pos starts
+	// and ends.
+	data, hole int64
+}
+
+// newSparseReader returns a sparseReader of f, or nil, with f as it was,
+// if f has no holes or the system can not tell where they are.
+func newSparseReader(f *os.File) *sparseReader {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	hole, err := f.Seek(0, seekHole)
+	if _, serr := f.Seek(0, io.SeekStart); err != nil || serr != nil || hole >= fi.Size() {
+		return nil
+	}
+	return &sparseReader{f: f, size: fi.Size()}
+}
+
+func (r *sparseReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.pos >= r.hole {
+		// There is no data after the last run but a hole to the end.
+		data, err := r.f.Seek(r.pos, seekData)
+		if err != nil {
+			data = r.size
+		}
+		hole := r.size
+		if data < r.size {
+			if hole, err = r.f.Seek(data, seekHole); err != nil {
+				return 0, err
+			}
+		}
+		r.data, r.hole = data, hole
+	}
+	if r.pos < r.data {
+		if n := r.data - r.pos; int64(len(p)) > n {
+			p = p[:n]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		r.pos += int64(len(p))
+		return len(p), nil
+	}
+	if n := r.hole - r.pos; int64(len(p)) > n {
+		p = p[:n]
+	}
+	n, err := r.f.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// sparseBlock is the size of the runs of zeros CopySparse leaves holes
+// for: a block of most file systems.
+const sparseBlock = 4096
+
+var zeros [sparseBlock]byte
+
+// CopySparse copies src to dst, from its start, like io.Copy, but leaves a
+// hole in dst for every block of zeros in src instead of writing it, so
+// that a sparse file is extracted sparse. dst is made to end where src
+// ends.
+func CopySparse(dst *os.File, src io.Reader) (int64, error) {
+	buf := make([]byte, 16*sparseBlock)
+	var written int64
+	for {
+		m, err := io.ReadFull(src, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		} else if err != nil {
+			return written, err
+		}
+		// Runs of blocks that are all zeros, or not, are skipped or
+		// written at once.
+		for off := 0; off < m; {
+			zero := isZero(buf[off:m])
+			end := off
+			for end < m && isZero(buf[end:m]) == zero {
+				end += blockLen(m - end)
+			}
+			if zero {
+				if _, err := dst.Seek(int64(end-off), io.SeekCurrent); err != nil {
+					return written, err
+				}
+			} else if _, err := dst.Write(buf[off:end]); err != nil {
+				return written, err
+			}
+			written += int64(end - off)
+			off = end
+		}
+		if err == io.EOF {
+			return written, dst.Truncate(written)
+		}
+	}
+}
+
+func blockLen(n int) int {
+	if n > sparseBlock {
+		return sparseBlock
+	}
+	return n
+}
+
+// isZero reports whether the block at the start of b is all zeros.
+func isZero(b []byte) bool {
+	n := blockLen(len(b))
+	return bytes.Equal(b[:n], zeros[:n])
+}
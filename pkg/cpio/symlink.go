@@ -0,0 +1,51 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Symlink returns the record of a symlink name to target. The target is
+// the contents, without a NUL, as GNU cpio and the kernel have it, and the
+// mode is 0777, as Linux gives every symlink.
+func Symlink(name, target string) Record {
+	return NewRecordFromBytes([]byte(target), Info{Name: name, Mode: modeSymlink | 0777})
+}
+
+// Linkname returns the target of the symlink r, read from its contents,
+// which must be FileSize bytes long, not empty, and without NULs, or the
+// kernel would make some other link. Contents that can be read at, as
+// those of records read from an archive can, are left to be read again;
+// others are read up.
+func (r Record) Linkname() (string, error) {
+	if r.Mode&modeTypeMask != modeSymlink {
+		return "", fmt.Errorf("%s: mode %#o is not a symlink", r.Name, r.Mode)
+	}
+	if r.ReadCloser == nil {
+		return "", fmt.Errorf("%s: symlink has no target", r.Name)
+	}
+	// One byte more than FileSize tells a target that is too long.
+	var rd io.Reader = io.LimitReader(r, int64(r.FileSize)+1)
+	if ra, ok := r.ReadCloser.(io.ReaderAt); ok {
+		rd = io.NewSectionReader(ra, 0, int64(r.FileSize)+1)
+	}
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", r.Name, err)
+	}
+	switch {
+	case uint64(len(b)) != r.FileSize:
+		return "", fmt.Errorf("%s: symlink target is %d bytes, the header has %d", r.Name, len(b), r.FileSize)
+	case len(b) == 0:
+		return "", fmt.Errorf("%s: symlink has no target", r.Name)
+	case bytes.IndexByte(b, 0) >= 0:
+		return "", fmt.Errorf("%s: symlink target %q has a NUL", r.Name, b)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestSymlink(t *testing.T) {
+	r := cpio.Symlink("bin/sh", "busybox")
+	if r.Name != "bin/sh" || r.Mode != syscall.S_IFLNK|0777 || r.FileSize != 7 {
+		t.Errorf("Symlink: got %v, want bin/sh, mode %#o, size 7", r.Info, syscall.S_IFLNK|0777)
+	}
+	// The target is there to be read again, as it is written.
+	for i := 0; i < 2; i++ {
+		if got, err := r.Linkname(); err != nil || got != "busybox" {
+			t.Errorf("Linkname: got %q, %v, want busybox", got, err)
+		}
+	}
+	if got := contents(t, r); got != "busybox" {
+		t.Errorf("contents: got %q, want busybox", got)
+	}
+
+	// Contents that can not be read at are read up.
+	r = cpio.Record{ReadCloser: ioutil.NopCloser(strings.NewReader("busybox")), Info: r.Info}
+	if got, err := r.Linkname(); err != nil || got != "busybox" {
+		t.Errorf("Linkname of a stream: got %q, %v, want busybox", got, err)
+	}
+
+	link := func(target string, size uint64) cpio.Record {
+		r := cpio.Symlink("l", target)
+		r.FileSize = size
+		return r
+	}
+	for _, tt := range []struct {
+		name string
+		r    cpio.Record
+		want string
+	}{
+		{"not a symlink", cpio.NewRecordFromBytes([]byte("x"), cpio.Info{Name: "l", Mode: syscall.S_IFREG | 0644}), "l: mode 0100644 is not a symlink"},
+		{"no contents", cpio.Record{Info: cpio.Info{Name: "l", Mode: syscall.S_IFLNK | 0777}}, "l: symlink has no target"},
+		{"empty", link("", 0), "l: symlink has no target"},
+		{"longer than its size", link("busybox", 4), "l: symlink target is 5 bytes, the header has 4"},
+		{"shorter than its size", link("busybox", 8), "l: symlink target is 7 bytes, the header has 8"},
+		{"NUL", link("busybox\x00", 8), `l: symlink target "busybox\x00" has a NUL`},
+	} {
+		if _, err := tt.r.Linkname(); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestSymlinkFiles checks that symlinks are archived and created as
+// symlinks, not followed.
+func TestSymlinkFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "symlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "motd"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("motd", filepath.Join(dir, "issue")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := cpio.NewRecordFromPath(filepath.Join(dir, "issue"), "etc/issue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.Linkname(); err != nil || r.Mode&syscall.S_IFMT != syscall.S_IFLNK || got != "motd" {
+		t.Fatalf("NewRecordFromPath of a symlink: got mode %#o, target %q, %v, want a symlink to motd", r.Mode, got, err)
+	}
+
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	b := archive(t, r)
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.Extract(archiver.Reader(bytes.NewReader(b)), out); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.Readlink(filepath.Join(out, "etc/issue")); err != nil || got != "motd" {
+		t.Errorf("Extract: got %q, %v, want a symlink to motd", got, err)
+	}
+	extract(t, b, filepath.Join(out, "linker"))
+	if got, err := os.Readlink(filepath.Join(out, "linker/etc/issue")); err != nil || got != "motd" {
+		t.Errorf("CreateFile: got %q, %v, want a symlink to motd", got, err)
+	}
+}
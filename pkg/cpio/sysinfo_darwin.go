@@ -8,6 +8,12 @@ import (
 	"syscall"
 )
 
+// whence values for Seek to find the data and holes in a sparse file.
+const (
+	seekData = 4
+	seekHole = 3
+)
+
 func sysInfo(n string, sys *syscall.Stat_t) Info {
 	return Info{
 		Ino:      sys.Ino,
@@ -18,10 +24,24 @@ func sysInfo(n string, sys *syscall.Stat_t) Info {
 		MTime:    uint64(sys.Mtimespec.Sec),
 		FileSize: uint64(sys.Size),
 		Dev:      uint64(sys.Dev),
-		Major:    uint64(sys.Dev >> 8),
-		Minor:    uint64(sys.Dev & 0xff),
-		Rmajor:   uint64(sys.Rdev >> 8),
-		Rminor:   uint64(sys.Rdev & 0xff),
+		Major:    devMajor(uint64(sys.Dev)),
+		Minor:    devMinor(uint64(sys.Dev)),
+		Rmajor:   devMajor(uint64(sys.Rdev)),
+		Rminor:   devMinor(uint64(sys.Rdev)),
 		Name:     n,
 	}
 }
+
+// devMajor, devMinor and mkdev take dev_t apart and put it together as
+// Darwin does: 8 bits of major number and 24 of minor.
+func devMajor(dev uint64) uint64 {
+	return dev >> 24 & 0xff
+}
+
+func devMinor(dev uint64) uint64 {
+	return dev & 0xffffff
+}
+
+func mkdev(major, minor uint64) uint64 {
+	return major<<24 | minor&0xffffff
+}
@@ -8,6 +8,12 @@ import (
 	"syscall"
 )
 
+// whence values for Seek to find the data and holes in a sparse file.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
 func sysInfo(n string, sys *syscall.Stat_t) Info {
 	return Info{
 		Ino:      sys.Ino,
@@ -18,10 +24,26 @@ func sysInfo(n string, sys *syscall.Stat_t) Info {
 		MTime:    uint64(sys.Mtim.Sec),
 		FileSize: uint64(sys.Size),
 		Dev:      sys.Dev,
-		Major:    sys.Dev >> 8,
-		Minor:    sys.Dev & 0xff,
-		Rmajor:   sys.Rdev >> 8,
-		Rminor:   sys.Rdev & 0xff,
+		Major:    devMajor(sys.Dev),
+		Minor:    devMinor(sys.Dev),
+		Rmajor:   devMajor(sys.Rdev),
+		Rminor:   devMinor(sys.Rdev),
 		Name:     n,
 	}
 }
+
+// devMajor, devMinor and mkdev take dev_t apart and put it together as
+// glibc does: the low 8 bits of the minor number, then 12 bits of the
+// major, then the rest of the minor and then the rest of the major, so
+// that the numbers of old, 16 bit, dev_t's are the same.
+func devMajor(dev uint64) uint64 {
+	return dev>>8&0xfff | dev>>32&^0xfff
+}
+
+func devMinor(dev uint64) uint64 {
+	return dev&0xff | dev>>12&^0xff
+}
+
+func mkdev(major, minor uint64) uint64 {
+	return minor&0xff | major&0xfff<<8 | minor&^0xff<<12 | major&^0xfff<<32
+}
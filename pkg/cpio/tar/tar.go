@@ -0,0 +1,197 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// tar implements the POSIX tar format as a cpio record format, so that
+// anything that writes cpio records can write a tar archive instead.
+//
+// A regular file whose inode was already written, which is how the cpio
+// package hands out hard links, becomes a hard link to the name it was
+// first written under. Reading goes the other way only so far: a hard link
+// is read as a copy of the file it links to.
+package tar
+
+import (
+	archivetar "archive/tar"
+	"fmt"
+	"io"
+	"math"
+	"syscall"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+type format struct{}
+
+type inode struct {
+	major, minor, ino uint64
+}
+
+type writer struct {
+	tw *archivetar.Writer
+	// links maps the inodes of the regular files with more than one
+	// link to the name they were first written under.
+	links map[inode]string
+}
+
+func (format) Writer(w io.Writer) cpio.RecordWriter {
+	return &writer{tw: archivetar.NewWriter(w), links: make(map[inode]string)}
+}
+
+// WriteRecord writes r as a tar header and its contents. The trailer ends
+// the archive.
+func (w *writer) WriteRecord(r cpio.Record) error {
+	if r.Name == cpio.Trailer {
+		return w.tw.Close()
+	}
+	if r.ReadCloser != nil {
+		defer r.Close()
+	}
+
+	hdr := &archivetar.Header{
+		Name:     r.Name,
+		Mode:     int64(r.Mode & 07777),
+		Uid:      int(r.UID),
+		Gid:      int(r.GID),
+		ModTime:  time.Unix(int64(r.MTime), 0),
+		Devmajor: int64(r.Rmajor),
+		Devminor: int64(r.Rminor),
+	}
+	switch r.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		hdr.Typeflag = archivetar.TypeReg
+		i := inode{r.Major, r.Minor, r.Ino}
+		if name, ok := w.links[i]; ok {
+			hdr.Typeflag = archivetar.TypeLink
+			hdr.Linkname = name
+			return w.tw.WriteHeader(hdr)
+		}
+		if r.NLink > 1 {
+			w.links[i] = r.Name
+		}
+		if r.ReadCloser != nil {
+			hdr.Size = int64(r.FileSize)
+		}
+	case syscall.S_IFDIR:
+		hdr.Typeflag = archivetar.TypeDir
+		hdr.Name += "/"
+	case syscall.S_IFLNK:
+		hdr.Typeflag = archivetar.TypeSymlink
+		target, err := r.Linkname()
+		if err != nil {
+			return err
+		}
+		hdr.Linkname = target
+		return w.tw.WriteHeader(hdr)
+	case syscall.S_IFCHR:
+		hdr.Typeflag = archivetar.TypeChar
+	case syscall.S_IFBLK:
+		hdr.Typeflag = archivetar.TypeBlock
+	case syscall.S_IFIFO:
+		hdr.Typeflag = archivetar.TypeFifo
+	default:
+		return fmt.Errorf("%s: mode %#o can not be written to a tar archive", r.Name, r.Mode)
+	}
+
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Size == 0 {
+		return nil
+	}
+	_, err := io.Copy(w.tw, r)
+	return err
+}
+
+// countReader counts the bytes read through it. It is deliberately not an
+// io.Seeker, so that the tar reader reads, rather than seeks, past
+// contents, and the count is where the next contents start.
+type countReader struct {
+	r   io.Reader
+	pos int64
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.pos += int64(n)
+	return n, err
+}
+
+type reader struct {
+	r  io.ReaderAt
+	cr *countReader
+	tr *archivetar.Reader
+	// contents maps the names of regular files to where their contents
+	// are, for the hard links to them.
+	contents map[string]*io.SectionReader
+	ino      uint64
+}
+
+func (format) Reader(r io.ReaderAt) cpio.RecordReader {
+	cr := &countReader{r: io.NewSectionReader(r, 0, math.MaxInt64)}
+	return &reader{r: r, cr: cr, tr: archivetar.NewReader(cr), contents: make(map[string]*io.SectionReader)}
+}
+
+// ReadRecord returns the next record, or the trailer at the end of the
+// archive. The contents of the record are read from the underlying
+// io.ReaderAt, so they stay readable after later records are read.
+func (r *reader) ReadRecord() (cpio.Record, error) {
+	hdr, err := r.tr.Next()
+	if err == io.EOF {
+		return cpio.TrailerRecord, nil
+	}
+	if err != nil {
+		return cpio.Record{}, err
+	}
+
+	r.ino++
+	info := cpio.Info{
+		Ino:    r.ino,
+		Mode:   uint64(hdr.Mode & 07777),
+		UID:    uint64(hdr.Uid),
+		GID:    uint64(hdr.Gid),
+		NLink:  1,
+		MTime:  uint64(hdr.ModTime.Unix()),
+		Rmajor: uint64(hdr.Devmajor),
+		Rminor: uint64(hdr.Devminor),
+		Name:   hdr.Name,
+	}
+	switch hdr.Typeflag {
+	case archivetar.TypeReg:
+		info.Mode |= syscall.S_IFREG
+		info.FileSize = uint64(hdr.Size)
+		content := io.NewSectionReader(r.r, r.cr.pos, hdr.Size)
+		r.contents[hdr.Name] = content
+		return cpio.Record{ReadCloser: cpio.NewReadCloser(content), Info: info}, nil
+	case archivetar.TypeLink:
+		content, ok := r.contents[hdr.Linkname]
+		if !ok {
+			return cpio.Record{}, fmt.Errorf("%s: hard link to %s, which is not a regular file before it", hdr.Name, hdr.Linkname)
+		}
+		info.Mode |= syscall.S_IFREG
+		info.FileSize = uint64(content.Size())
+		return cpio.Record{ReadCloser: cpio.NewReadCloser(io.NewSectionReader(content, 0, content.Size())), Info: info}, nil
+	case archivetar.TypeSymlink:
+		info.Mode |= syscall.S_IFLNK
+		return cpio.NewRecordFromBytes([]byte(hdr.Linkname), info), nil
+	case archivetar.TypeDir:
+		info.Mode |= syscall.S_IFDIR
+		if len(info.Name) > 1 && info.Name[len(info.Name)-1] == '/' {
+			info.Name = info.Name[:len(info.Name)-1]
+		}
+	case archivetar.TypeChar:
+		info.Mode |= syscall.S_IFCHR
+	case archivetar.TypeBlock:
+		info.Mode |= syscall.S_IFBLK
+	case archivetar.TypeFifo:
+		info.Mode |= syscall.S_IFIFO
+	default:
+		return cpio.Record{}, fmt.Errorf("%s: tar type %q is not supported", hdr.Name, hdr.Typeflag)
+	}
+	return cpio.Record{Info: info}, nil
+}
+
+func init() {
+	cpio.AddFormat("tar", format{})
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	_ "github.com/u-root/u-root/pkg/cpio/newc"
+)
+
+// testRecords returns records of every type, with a hard link, and device
+// nodes if they can be made.
+func testRecords() []cpio.Record {
+	recs := []cpio.Record{
+		{Info: cpio.Info{Ino: 1, Name: "etc", Mode: syscall.S_IFDIR | 0755, NLink: 2}},
+		cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Ino: 2, Name: "etc/motd", Mode: syscall.S_IFREG | 0640, UID: 12, GID: 34, NLink: 2}),
+		{Info: cpio.Info{Ino: 2, Name: "etc/issue", Mode: syscall.S_IFREG | 0640, UID: 12, GID: 34, NLink: 2}},
+		cpio.NewRecordFromBytes([]byte("motd"), cpio.Info{Ino: 3, Name: "etc/greeting", Mode: syscall.S_IFLNK | 0777, NLink: 1}),
+		{Info: cpio.Info{Ino: 4, Name: "bin", Mode: syscall.S_IFDIR | 01777, NLink: 2}},
+		cpio.NewRecordFromBytes([]byte("#!/bin/sh\n"), cpio.Info{Ino: 5, Name: "bin/sh", Mode: syscall.S_IFREG | 04755, NLink: 1}),
+		{Info: cpio.Info{Ino: 6, Name: "fifo", Mode: syscall.S_IFIFO | 0600, NLink: 1}},
+	}
+	if os.Geteuid() == 0 {
+		recs = append(recs,
+			cpio.Record{Info: cpio.Info{Ino: 7, Name: "console", Mode: syscall.S_IFCHR | 0600, Rmajor: 5, Rminor: 1, NLink: 1}},
+			cpio.Record{Info: cpio.Info{Ino: 8, Name: "sda", Mode: syscall.S_IFBLK | 0660, GID: 6, Rmajor: 8, NLink: 1}},
+		)
+	}
+	return recs
+}
+
+func write(t *testing.T, format string, recs []cpio.Record) []byte {
+	a, err := cpio.Format(format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := a.Writer(&b)
+	if err := w.WriteRecords(recs); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// tree describes each file under dir as a line, with the names of the
+// files sharing an inode in it, for comparing extracted archives.
+func tree(t *testing.T, dir string) []string {
+	names := make(map[uint64][]string)
+	var paths []string
+	if err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		rel, _ := filepath.Rel(dir, p)
+		names[st.Ino] = append(names[st.Ino], rel)
+		paths = append(paths, p)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, p := range paths {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		l := fmt.Sprintf("%v %d:%d links=%q", fi.Mode(), st.Uid, st.Gid, names[st.Ino])
+		switch fi.Mode() & os.ModeType {
+		case 0:
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l += fmt.Sprintf(" %q", b)
+		case os.ModeSymlink:
+			target, err := os.Readlink(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l += " -> " + target
+		case os.ModeDevice, os.ModeDevice | os.ModeCharDevice:
+			l += fmt.Sprintf(" %d,%d", st.Rdev>>8, st.Rdev&0xff)
+		}
+		lines = append(lines, l)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func extract(t *testing.T, archive []byte, name string, arg ...string) []string {
+	if _, err := exec.LookPath(name); err != nil {
+		t.Skipf("%s is not installed", name)
+	}
+	dir, err := ioutil.TempDir("", "tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := exec.Command(name, arg...)
+	c.Dir = dir
+	c.Stdin = bytes.NewReader(archive)
+	if out, err := c.CombinedOutput(); err != nil {
+		t.Fatalf("%s %s: %v: %s", name, strings.Join(arg, " "), err, out)
+	}
+	return tree(t, dir)
+}
+
+func TestGNUTar(t *testing.T) {
+	oldMask := syscall.Umask(0)
+	defer syscall.Umask(oldMask)
+
+	fromTar := extract(t, write(t, "tar", testRecords()), "tar", "-x", "-p", "--numeric-owner", "-f", "-")
+	if len(fromTar) != len(testRecords()) {
+		t.Errorf("tar -x made %d files, want %d:\n%s", len(fromTar), len(testRecords()), strings.Join(fromTar, "\n"))
+	}
+	fromCpio := extract(t, write(t, "newc", testRecords()), "cpio", "-i", "-d", "--quiet")
+	if !reflect.DeepEqual(fromTar, fromCpio) {
+		t.Errorf("tar -x made\n%s\nwant what cpio -i made\n%s", strings.Join(fromTar, "\n"), strings.Join(fromCpio, "\n"))
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	a, err := cpio.Format("tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := a.Reader(bytes.NewReader(write(t, "tar", testRecords()))).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := testRecords()
+	if len(recs) != len(want) {
+		t.Fatalf("got %d records, want %d", len(recs), len(want))
+	}
+	for i, r := range recs {
+		w := want[i]
+		if r.Name != w.Name || r.Mode != w.Mode || r.UID != w.UID || r.GID != w.GID || r.Rmajor != w.Rmajor || r.Rminor != w.Rminor {
+			t.Errorf("record %d: got %v, want %v", i, r.Info, w.Info)
+		}
+	}
+	// Contents are read after all the records are, and the hard link
+	// reads as a copy.
+	for i, want := range []string{"", "hello\n", "hello\n", "motd", "", "#!/bin/sh\n"} {
+		var got []byte
+		if recs[i].ReadCloser != nil {
+			if got, err = ioutil.ReadAll(recs[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", recs[i].Name, got, want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio
+
+import (
+	"path"
+	"strings"
+)
+
+// A RecordFunc transforms a record on its way from a reader to a writer,
+// as Concat's transform does. One that returns a record with no name
+// leaves the record out; see FilterOut.
+//
+// The trailer is not a file, and the RecordFuncs here leave it alone.
+type RecordFunc func(Record) Record
+
+// Skipped returns whether a RecordFunc left r out.
+func Skipped(r Record) bool {
+	return r.Name == ""
+}
+
+// Chain returns a RecordFunc applying fs in order, each to what the one
+// before it returned, until one leaves the record out. Nil fs are passed
+// over.
+//
+// The order matters to those that go by name. Chained after Rename(a: b),
+// a RecordFunc that goes by name, such as the Transform of a ramfs.Manifest
+// that chowns a, sees b and leaves it alone; chained before it, it chowns
+// a, which is then renamed.
+func Chain(fs ...RecordFunc) RecordFunc {
+	return func(r Record) Record {
+		for _, f := range fs {
+			if f == nil {
+				continue
+			}
+			if r = f(r); Skipped(r) {
+				return r
+			}
+		}
+		return r
+	}
+}
+
+// files returns f, applied only to records that are not the trailer.
+func files(f RecordFunc) RecordFunc {
+	return func(r Record) Record {
+		if r.Name == Trailer {
+			return r
+		}
+		return f(r)
+	}
+}
+
+// Rename returns a RecordFunc that renames the records named by the keys of
+// names to their values. Names are matched as an Archive looks them up, so
+// that "/etc/motd" and "etc/motd" are the same.
+func Rename(names map[string]string) RecordFunc {
+	m := make(map[string]string, len(names))
+	for from, to := range names {
+		m[archiveName(from)] = to
+	}
+	return files(func(r Record) Record {
+		if to, ok := m[archiveName(r.Name)]; ok {
+			r.Name = to
+		}
+		return r
+	})
+}
+
+// RenameMap returns a RecordFunc that renames records as Rename does, but
+// a key that ends in "/", with its value, is a prefix rewrite: with
+// "bin/": "bbin/", bin becomes bbin, and bin/ls bbin/ls, so that a
+// directory and what is below it stay together. A name matched exactly
+// comes before a prefix, and a longer prefix before a shorter one. A
+// prefix rewritten to "/" moves what is below it to the top, and leaves
+// out the directory itself.
+func RenameMap(names map[string]string) RecordFunc {
+	exact := make(map[string]string)
+	prefixes := make(map[string]string)
+	for from, to := range names {
+		if strings.HasSuffix(from, "/") {
+			prefixes[archiveName(from)] = archiveName(to)
+		} else {
+			exact[archiveName(from)] = to
+		}
+	}
+	return files(func(r Record) Record {
+		name := archiveName(r.Name)
+		if to, ok := exact[name]; ok {
+			r.Name = to
+			return r
+		}
+		dir, rest, ok := underPrefix(name, func(dir string) bool {
+			_, ok := prefixes[dir]
+			return ok
+		})
+		if !ok {
+			return r
+		}
+		switch to := prefixes[dir]; {
+		case rest == "" && to == ".":
+			// As with StripPrefix, the directory moved to the
+			// top is left out, rather than replacing it.
+			return skip(r)
+		case rest == "":
+			r.Name = to
+		case to == ".":
+			r.Name = rest
+		default:
+			r.Name = to + "/" + rest
+		}
+		return r
+	})
+}
+
+// Drop returns a RecordFunc that leaves out the records named in names,
+// closing their contents. A name that ends in "/" leaves out the directory
+// and everything below it.
+func Drop(names map[string]bool) RecordFunc {
+	exact := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	for name, drop := range names {
+		switch {
+		case !drop:
+		case strings.HasSuffix(name, "/"):
+			prefixes[archiveName(name)] = true
+		default:
+			exact[archiveName(name)] = true
+		}
+	}
+	return FilterOut(func(r Record) bool {
+		name := archiveName(r.Name)
+		if exact[name] {
+			return true
+		}
+		_, _, ok := underPrefix(name, func(dir string) bool { return prefixes[dir] })
+		return ok
+	})
+}
+
+// underPrefix returns the longest directory has returns true for that is
+// name or has name below it, and the rest of name below it. The directory
+// "." has every name below it.
+func underPrefix(name string, has func(dir string) bool) (dir, rest string, ok bool) {
+	for dir = name; ; dir = path.Dir(dir) {
+		if has(dir) {
+			switch dir {
+			case name:
+				return dir, "", true
+			case ".":
+				return dir, name, true
+			}
+			return dir, name[len(dir)+1:], true
+		}
+		if dir == "." {
+			return "", "", false
+		}
+	}
+}
+
+// Chown returns a RecordFunc that gives every record uid and gid.
+func Chown(uid, gid uint64) RecordFunc {
+	return files(func(r Record) Record {
+		r.UID, r.GID = uid, gid
+		return r
+	})
+}
+
+// Chmod returns a RecordFunc that clears the permission bits that are not
+// in mask, as 0755 takes away group and other write. The type of the file
+// is left alone.
+func Chmod(mask uint64) RecordFunc {
+	return files(func(r Record) Record {
+		r.Mode &= modeTypeMask | mask
+		return r
+	})
+}
+
+// StripPrefix returns a RecordFunc that takes dir off the start of the
+// names of the records below it, and leaves out the record of dir itself.
+// Other records are left alone.
+func StripPrefix(dir string) RecordFunc {
+	dir = archiveName(dir)
+	return files(func(r Record) Record {
+		name := archiveName(r.Name)
+		switch {
+		case dir == ".":
+		case name == dir:
+			return skip(r)
+		case strings.HasPrefix(name, dir+"/"):
+			r.Name = strings.TrimPrefix(name, dir+"/")
+		}
+		return r
+	})
+}
+
+// FilterOut returns a RecordFunc that leaves out the records drop returns
+// true for, closing their contents.
+func FilterOut(drop func(Record) bool) RecordFunc {
+	return files(func(r Record) Record {
+		if drop(r) {
+			return skip(r)
+		}
+		return r
+	})
+}
+
+// skip closes the contents of r and returns the record that leaves it out.
+func skip(r Record) Record {
+	if r.ReadCloser != nil {
+		r.Close()
+	}
+	return Record{}
+}
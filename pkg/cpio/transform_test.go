@@ -0,0 +1,158 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpio_test
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// closeCounter counts the Closes of the contents of records.
+type closeCounter struct {
+	*strings.Reader
+	closes *int
+}
+
+func (c closeCounter) Close() error {
+	*c.closes++
+	return nil
+}
+
+func transformRecords() []cpio.Record {
+	return []cpio.Record{
+		{Info: cpio.Info{Name: "rootfs", Mode: syscall.S_IFDIR | 0777, UID: 1000, GID: 1000}},
+		{Info: cpio.Info{Name: "rootfs/etc", Mode: syscall.S_IFDIR | 0775, UID: 1000, GID: 1000}},
+		cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "rootfs/etc/motd", Mode: syscall.S_IFREG | 0666, UID: 1000, GID: 1000}),
+		cpio.NewRecordFromBytes([]byte("x"), cpio.Info{Name: "rootfs/tmp.swp", Mode: syscall.S_IFREG | 04777, UID: 1000, GID: 1000}),
+		cpio.TrailerRecord,
+	}
+}
+
+// describe returns r as its name, mode and owner, or "-" if it was left
+// out.
+func describe(r cpio.Record) string {
+	if cpio.Skipped(r) {
+		return "-"
+	}
+	return fmt.Sprintf("%s %o %d:%d", r.Name, r.Mode, r.UID, r.GID)
+}
+
+func TestTransforms(t *testing.T) {
+	swp := func(r cpio.Record) bool { return strings.HasSuffix(r.Name, ".swp") }
+	for _, tt := range []struct {
+		name string
+		f    cpio.RecordFunc
+		want []string
+	}{
+		{"Chown", cpio.Chown(0, 0), []string{"rootfs 40777 0:0", "rootfs/etc 40775 0:0", "rootfs/etc/motd 100666 0:0", "rootfs/tmp.swp 104777 0:0", "TRAILER!!! 0 0:0"}},
+		{"Chmod", cpio.Chmod(0755), []string{"rootfs 40755 1000:1000", "rootfs/etc 40755 1000:1000", "rootfs/etc/motd 100644 1000:1000", "rootfs/tmp.swp 100755 1000:1000", "TRAILER!!! 0 0:0"}},
+		{"StripPrefix", cpio.StripPrefix("/rootfs/"), []string{"-", "etc 40775 1000:1000", "etc/motd 100666 1000:1000", "tmp.swp 104777 1000:1000", "TRAILER!!! 0 0:0"}},
+		{"FilterOut", cpio.FilterOut(swp), []string{"rootfs 40777 1000:1000", "rootfs/etc 40775 1000:1000", "rootfs/etc/motd 100666 1000:1000", "-", "TRAILER!!! 0 0:0"}},
+		{"Rename", cpio.Rename(map[string]string{"/rootfs/etc/motd": "rootfs/etc/issue"}), []string{"rootfs 40777 1000:1000", "rootfs/etc 40775 1000:1000", "rootfs/etc/issue 100666 1000:1000", "rootfs/tmp.swp 104777 1000:1000", "TRAILER!!! 0 0:0"}},
+		{"RenameMap", cpio.RenameMap(map[string]string{"rootfs/": "root/", "rootfs/etc/": "/", "/rootfs/tmp.swp": "tmp.swp"}), []string{"root 40777 1000:1000", "-", "motd 100666 1000:1000", "tmp.swp 104777 1000:1000", "TRAILER!!! 0 0:0"}},
+		{"Drop", cpio.Drop(map[string]bool{"/rootfs/etc/": true, "rootfs/tmp.swp": true, "root/": true, "rootfs": false}), []string{"rootfs 40777 1000:1000", "-", "-", "-", "TRAILER!!! 0 0:0"}},
+		{"Chain", cpio.Chain(cpio.StripPrefix("rootfs"), nil, cpio.FilterOut(swp), cpio.Chown(0, 0), cpio.Chmod(0755)), []string{"-", "etc 40755 0:0", "etc/motd 100644 0:0", "-", "TRAILER!!! 0 0:0"}},
+	} {
+		var got []string
+		for _, r := range transformRecords() {
+			got = append(got, describe(tt.f(r)))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestChainOrder shows the order mattering to a RecordFunc that goes by
+// name, here one for the records named etc/motd.
+func TestChainOrder(t *testing.T) {
+	rename := cpio.Rename(map[string]string{"etc/motd": "etc/issue"})
+	chownMotd := func(r cpio.Record) cpio.Record {
+		if r.Name == "etc/motd" {
+			r.UID, r.GID = 0, 0
+		}
+		return r
+	}
+	r := cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644, UID: 1000, GID: 1000})
+	for _, tt := range []struct {
+		name string
+		f    cpio.RecordFunc
+		want string
+	}{
+		{"chown, then rename", cpio.Chain(chownMotd, rename), "etc/issue 100644 0:0"},
+		{"rename, then chown", cpio.Chain(rename, chownMotd), "etc/issue 100644 1000:1000"},
+		{"left out, then renamed", cpio.Chain(cpio.FilterOut(func(cpio.Record) bool { return true }), rename), "-"},
+	} {
+		if got := describe(tt.f(r)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConcatTransform(t *testing.T) {
+	var closes int
+	recs := []cpio.Record{
+		{ReadCloser: closeCounter{strings.NewReader("x"), &closes}, Info: cpio.Info{Name: "a.swp", Mode: syscall.S_IFREG | 0644, FileSize: 1}},
+		cpio.NewRecordFromBytes([]byte("b"), cpio.Info{Name: "b", Mode: syscall.S_IFREG | 0644}),
+	}
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := archiver.Writer(&b)
+	if err := w.Concat(archiver.Reader(bytes.NewReader(archive(t, recs...))), cpio.FilterOut(func(r cpio.Record) bool { return r.Name == "a.swp" })); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	a := readArchive(t, b.Bytes())
+	if got, want := a.Names(), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Concat: got %q, want %q", got, want)
+	}
+
+	// What is left out has its contents closed.
+	closes = 0
+	cpio.FilterOut(func(cpio.Record) bool { return true })(cpio.Record{ReadCloser: closeCounter{strings.NewReader("x"), &closes}})
+	if closes != 1 {
+		t.Errorf("FilterOut closed the contents %d times, want 1", closes)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	recs := []cpio.Record{
+		{Info: cpio.Info{Name: "bin", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("ls"), cpio.Info{Name: "bin/ls", Mode: syscall.S_IFREG | 0755}),
+		cpio.NewRecordFromBytes([]byte("sh"), cpio.Info{Name: "bin/sh", Mode: syscall.S_IFREG | 0755}),
+		{Info: cpio.Info{Name: "binaries", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("init"), cpio.Info{Name: "init", Mode: syscall.S_IFREG | 0755}),
+		cpio.NewRecordFromBytes([]byte("x"), cpio.Info{Name: "tmp/x", Mode: syscall.S_IFREG | 0644}),
+	}
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l recordList
+	rr := archiver.RecordFormat.Reader(bytes.NewReader(archive(t, recs...)))
+	transform := cpio.Chain(
+		cpio.Drop(map[string]bool{"tmp/": true, "bin/sh": true}),
+		cpio.RenameMap(map[string]string{"bin/": "bbin/", "init": "inito"}),
+	)
+	if err := cpio.Copy(&l, rr, transform); err != nil {
+		t.Fatal(err)
+	}
+	// The trailer is not written, and binaries is not below bin.
+	want := recordList{"bbin 40755 0:0", "bbin/ls 100755 0:0", "binaries 40755 0:0", "inito 100755 0:0"}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("Copy: got %q, want %q", l, want)
+	}
+}
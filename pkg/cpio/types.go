@@ -6,6 +6,7 @@ package cpio
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -20,12 +21,58 @@ type Record struct {
 	Info
 }
 
-var TrailerRecord = StaticRecord(nil, Info{Name: Trailer})
+var TrailerRecord = NewRecordFromBytes(nil, Info{Name: Trailer})
 
 type RecordReader interface {
 	ReadRecord() (Record, error)
 }
 
+// An OffsetReader is a RecordReader that tells where in the archive it is
+// reading. After the trailer, that is where the archive ends, so that what
+// comes after it, such as another archive, can be read.
+type OffsetReader interface {
+	RecordReader
+	Offset() int64
+}
+
+// A SegmentReader is an OffsetReader that, once it has read the trailer and
+// the zeros padding the archive after it, says whether anything else, such
+// as another archive, follows.
+type SegmentReader interface {
+	OffsetReader
+	More() bool
+}
+
+var (
+	// ErrTruncated is the Err of a FormatError for an archive that ends
+	// part way through a record. One that ends between records, with no
+	// trailer, ends with io.EOF.
+	ErrTruncated = errors.New("the archive ends part way through a record")
+	// ErrBadMagic is the Err of a FormatError for a record that does not
+	// start with the magic number of its format.
+	ErrBadMagic = errors.New("bad magic")
+	// ErrBadHeader is the Err of a FormatError for a header that can not
+	// be right, such as one with a field that is not a number or a name
+	// without the NUL that ends it.
+	ErrBadHeader = errors.New("bad header")
+)
+
+// A FormatError is an error in the archive at Offset.
+type FormatError struct {
+	Offset int64
+	Err    error
+	// Detail says more, such as what the magic was.
+	Detail string
+}
+
+func (e *FormatError) Error() string {
+	s := fmt.Sprintf("reader: at %d: %v", e.Offset, e.Err)
+	if e.Detail != "" {
+		s += ": " + e.Detail
+	}
+	return s
+}
+
 type RecordWriter interface {
 	WriteRecord(Record) error
 }
@@ -35,39 +82,91 @@ type RecordFormat interface {
 	Writer(w io.Writer) RecordWriter
 }
 
-func StaticRecord(contents []byte, info Info) Record {
+// NewRecordFromBytes returns a record of info with contents, which are an
+// io.ReaderAt, as those of records read from archives are. Its FileSize is
+// the length of contents.
+func NewRecordFromBytes(contents []byte, info Info) Record {
 	info.FileSize = uint64(len(contents))
 	return Record{
-		ReadCloser: ioutil.NopCloser(bytes.NewReader(contents)),
+		ReadCloser: NewBytesReadCloser(contents),
 		Info:       info,
 	}
 }
 
 func NewBytesReadCloser(contents []byte) io.ReadCloser {
-	return ioutil.NopCloser(bytes.NewReader(contents))
+	return NewReadCloser(bytes.NewReader(contents))
 }
 
+// NewReadCloser returns r with a Close that does nothing. If r is an
+// io.ReaderAt too, as the contents of records read from an archive are, so
+// is what it returns, so that the contents can be read more than once.
 func NewReadCloser(r io.Reader) io.ReadCloser {
+	if ra, ok := r.(readerAt); ok {
+		return nopReaderAtCloser{ra}
+	}
 	return ioutil.NopCloser(r)
 }
 
+type readerAt interface {
+	io.Reader
+	io.ReaderAt
+}
+
+type nopReaderAtCloser struct {
+	readerAt
+}
+
+func (nopReaderAtCloser) Close() error {
+	return nil
+}
+
+// LazyOpen reads the file Name, which it opens when it is first read. The
+// holes of a sparse file are not read, but filled with zeros.
 type LazyOpen struct {
 	Name string
 	File *os.File
+
+	sparse *sparseReader
+}
+
+func (r *LazyOpen) open() error {
+	if r.File != nil {
+		return nil
+	}
+	f, err := os.Open(r.Name)
+	if err != nil {
+		return err
+	}
+	r.File = f
+	r.sparse = newSparseReader(f)
+	return nil
 }
 
 func (r *LazyOpen) Read(p []byte) (int, error) {
-	if r.File == nil {
-		f, err := os.Open(r.Name)
-		if err != nil {
-			return -1, err
-		}
-		r.File = f
+	if err := r.open(); err != nil {
+		return -1, err
+	}
+	if r.sparse != nil {
+		return r.sparse.Read(p)
 	}
 	return r.File.Read(p)
 }
 
+// ReadAt reads the file at off, without moving where Read reads from, so
+// that the contents can be read, e.g. to checksum them, before they are
+// written.
+func (r *LazyOpen) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.open(); err != nil {
+		return 0, err
+	}
+	return r.File.ReadAt(p, off)
+}
+
 func (r *LazyOpen) Close() error {
+	// A file that was never read was never opened.
+	if r.File == nil {
+		return nil
+	}
 	return r.File.Close()
 }
 
@@ -75,6 +174,22 @@ func NewDeferReadCloser(name string) io.ReadCloser {
 	return &LazyOpen{Name: name}
 }
 
+// NewRecordFromFile returns a record of info with the contents of the file
+// name, whose size is its FileSize. The file is opened when the contents
+// are first read, and they are read from it as they are written, a buffer
+// at a time, however large it is.
+func NewRecordFromFile(name string, info Info) (Record, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return Record{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return Record{}, fmt.Errorf("%s is not a regular file", name)
+	}
+	info.FileSize = uint64(fi.Size())
+	return Record{ReadCloser: NewDeferReadCloser(name), Info: info}, nil
+}
+
 // Info holds metadata about files.
 type Info struct {
 	Ino      uint64
@@ -0,0 +1,315 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kmodule
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Module is a kernel module in a Tree.
+type Module struct {
+	// Name is the name of the module, as in lsmod.
+	Name string
+
+	// Path is where the module goes relative to
+	// /lib/modules/<version>, e.g. kernel/drivers/nvme/host/nvme.ko.xz.
+	Path string
+
+	// Src is the module's file on the host.
+	Src string
+
+	// Deps are the names of all modules this one needs, directly or
+	// not, in the order modules.dep lists them.
+	Deps []string
+
+	// Aliases are the patterns of modules.alias that name this module.
+	Aliases []string
+
+	order int
+}
+
+// Tree is the modules of one kernel, either installed in
+// /lib/modules/<version> or in a kernel build directory.
+type Tree struct {
+	Version string
+	modules map[string]*Module
+}
+
+// ModuleName returns the name of the module in file, which is its base
+// name without any .ko and compression suffixes and with - as _.
+func ModuleName(file string) string {
+	n := filepath.Base(file)
+	if i := strings.Index(n, ".ko"); i != -1 {
+		n = n[:i]
+	}
+	return strings.Replace(n, "-", "_", -1)
+}
+
+// OpenTree reads the modules in dir. If dir has a modules.dep, it is an
+// installed /lib/modules/<version> directory. Otherwise it has to be a
+// kernel build directory, whose modules are found through modules.order
+// and whose dependencies and aliases are read from the modules themselves.
+func OpenTree(dir string) (*Tree, error) {
+	if _, err := os.Stat(filepath.Join(dir, "modules.dep")); err == nil {
+		return openInstalled(dir)
+	}
+	return openBuild(dir)
+}
+
+func openInstalled(dir string) (*Tree, error) {
+	t := &Tree{Version: filepath.Base(dir), modules: make(map[string]*Module)}
+
+	if err := readLines(filepath.Join(dir, "modules.dep"), func(l string) error {
+		i := strings.Index(l, ":")
+		if i == -1 {
+			return fmt.Errorf("modules.dep: no colon in %q", l)
+		}
+		m := &Module{Name: ModuleName(l[:i]), Path: l[:i], Src: filepath.Join(dir, l[:i]), order: math.MaxInt32}
+		for _, d := range strings.Fields(l[i+1:]) {
+			m.Deps = append(m.Deps, ModuleName(d))
+		}
+		t.modules[m.Name] = m
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// The alias and order files are optional.
+	if err := readLines(filepath.Join(dir, "modules.alias"), func(l string) error {
+		f := strings.Fields(l)
+		if len(f) != 3 || f[0] != "alias" {
+			return nil
+		}
+		if m, ok := t.modules[ModuleName(f[2])]; ok {
+			m.Aliases = append(m.Aliases, f[1])
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	n := 0
+	if err := readLines(filepath.Join(dir, "modules.order"), func(l string) error {
+		if m, ok := t.modules[ModuleName(l)]; ok {
+			m.order = n
+			n++
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return t, nil
+}
+
+func openBuild(dir string) (*Tree, error) {
+	v, err := ioutil.ReadFile(filepath.Join(dir, "include/config/kernel.release"))
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither /lib/modules/<version> nor a kernel build directory: %v", dir, err)
+	}
+	t := &Tree{Version: strings.TrimSpace(string(v)), modules: make(map[string]*Module)}
+
+	direct := make(map[string][]string)
+	n := 0
+	if err := readLines(filepath.Join(dir, "modules.order"), func(l string) error {
+		// Older kernels list kernel/<path>, newer ones the .o.
+		rel := strings.TrimPrefix(l, "kernel/")
+		if strings.HasSuffix(rel, ".o") {
+			rel = strings.TrimSuffix(rel, ".o") + ".ko"
+		}
+		src := filepath.Join(dir, rel)
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		info, err := Modinfo(b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+		m := &Module{Name: ModuleName(rel), Path: filepath.Join("kernel", rel), Src: src, order: n}
+		n++
+		for _, kv := range info {
+			switch {
+			case strings.HasPrefix(kv, "depends="):
+				for _, d := range strings.Split(strings.TrimPrefix(kv, "depends="), ",") {
+					if d != "" {
+						direct[m.Name] = append(direct[m.Name], ModuleName(d))
+					}
+				}
+			case strings.HasPrefix(kv, "alias="):
+				m.Aliases = append(m.Aliases, strings.TrimPrefix(kv, "alias="))
+			}
+		}
+		t.modules[m.Name] = m
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// modules.dep lists everything a module needs, not just what it
+	// names itself.
+	for _, m := range t.modules {
+		seen := make(map[string]bool)
+		var walk func(name string)
+		walk = func(name string) {
+			for _, d := range direct[name] {
+				if !seen[d] {
+					seen[d] = true
+					m.Deps = append(m.Deps, d)
+					walk(d)
+				}
+			}
+		}
+		walk(m.Name)
+	}
+	return t, nil
+}
+
+// Modinfo returns the key=value strings in the .modinfo section of the
+// uncompressed module b.
+func Modinfo(b []byte) ([]string, error) {
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	s := f.Section(".modinfo")
+	if s == nil {
+		return nil, fmt.Errorf("no .modinfo section")
+	}
+	d, err := s.Data()
+	if err != nil {
+		return nil, err
+	}
+	var info []string
+	for _, kv := range bytes.Split(d, []byte{0}) {
+		if len(kv) > 0 {
+			info = append(info, string(kv))
+		}
+	}
+	return info, nil
+}
+
+func readLines(name string, fn func(string) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if l := strings.TrimSpace(s.Text()); l != "" && l[0] != '#' {
+			if err := fn(l); err != nil {
+				return err
+			}
+		}
+	}
+	return s.Err()
+}
+
+// Closure returns the named modules and all the modules they need, each
+// after the ones it needs, so in an order they can be loaded in. It is an
+// error if any of the modules is not in t.
+func (t *Tree) Closure(names []string) ([]*Module, error) {
+	var (
+		mods    []*Module
+		missing []string
+		seen    = make(map[string]bool)
+	)
+	var add func(name, neededBy string)
+	add = func(name, neededBy string) {
+		name = ModuleName(name)
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		m, ok := t.modules[name]
+		if !ok {
+			if neededBy != "" {
+				name += " (needed by " + neededBy + ")"
+			}
+			missing = append(missing, name)
+			return
+		}
+		// modules.dep lists a module's deps so that the last one
+		// has to be loaded first.
+		for i := len(m.Deps) - 1; i >= 0; i-- {
+			add(m.Deps[i], m.Name)
+		}
+		mods = append(mods, m)
+	}
+	for _, n := range names {
+		add(n, "")
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("modules not found in %s: %s", t.Version, strings.Join(missing, ", "))
+	}
+	return mods, nil
+}
+
+// WriteDep writes a modules.dep for mods, which has to include all the
+// modules they need.
+func WriteDep(w io.Writer, mods []*Module) error {
+	paths := make(map[string]string)
+	for _, m := range mods {
+		paths[m.Name] = m.Path
+	}
+	for _, m := range mods {
+		var deps []string
+		for _, d := range m.Deps {
+			p, ok := paths[d]
+			if !ok {
+				return fmt.Errorf("%s needs %s, which is not included", m.Name, d)
+			}
+			deps = append(deps, " "+p)
+		}
+		if _, err := fmt.Fprintf(w, "%s:%s\n", m.Path, strings.Join(deps, "")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteAlias writes a modules.alias for mods.
+func WriteAlias(w io.Writer, mods []*Module) error {
+	if _, err := fmt.Fprintf(w, "# Aliases extracted from modules themselves.\n"); err != nil {
+		return err
+	}
+	for _, m := range mods {
+		for _, a := range m.Aliases {
+			if _, err := fmt.Fprintf(w, "alias %s %s\n", a, m.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteOrder writes a modules.order for mods, in the order of the kernel's
+// own modules.order if there was one.
+func WriteOrder(w io.Writer, mods []*Module) error {
+	sorted := append([]*Module(nil), mods...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].order < sorted[j].order
+	})
+	for _, m := range sorted {
+		p := m.Path
+		// modules.order names modules before they are compressed.
+		if i := strings.Index(p, ".ko"); i != -1 {
+			p = p[:i+len(".ko")]
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
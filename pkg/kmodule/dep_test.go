@@ -0,0 +1,123 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kmodule
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kmodule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir = filepath.Join(dir, "4.13.0")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for n, c := range map[string]string{
+		"modules.dep": `kernel/drivers/nvme/host/nvme.ko.xz: kernel/drivers/nvme/host/nvme-core.ko.xz
+kernel/drivers/nvme/host/nvme-core.ko.xz:
+kernel/drivers/net/e1000e.ko: kernel/drivers/ptp/ptp.ko kernel/drivers/pps/pps_core.ko
+kernel/drivers/ptp/ptp.ko: kernel/drivers/pps/pps_core.ko
+kernel/drivers/pps/pps_core.ko:
+kernel/fs/unused.ko:
+`,
+		"modules.alias": `# Aliases extracted from modules themselves.
+alias pci:v00008086d000015B7sv*sd*bc*sc*i* e1000e
+alias fs-unused unused
+alias pci:v*d*sv*sd*bc01sc08i02* nvme
+`,
+		"modules.order": `kernel/fs/unused.ko
+kernel/drivers/pps/pps_core.ko
+kernel/drivers/ptp/ptp.ko
+kernel/drivers/net/e1000e.ko
+kernel/drivers/nvme/host/nvme-core.ko
+kernel/drivers/nvme/host/nvme.ko
+`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, n), []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree, err := OpenTree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Version != "4.13.0" {
+		t.Errorf("Version = %q, want 4.13.0", tree.Version)
+	}
+
+	mods, err := tree.Closure([]string{"nvme", "e1000e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range mods {
+		names = append(names, m.Name)
+	}
+	if want := []string{"nvme_core", "nvme", "pps_core", "ptp", "e1000e"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Closure = %v, want %v", names, want)
+	}
+	if got, want := mods[1].Src, filepath.Join(dir, "kernel/drivers/nvme/host/nvme.ko.xz"); got != want {
+		t.Errorf("nvme Src = %q, want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		write func(*bytes.Buffer) error
+		want  string
+	}{
+		{"modules.dep", func(b *bytes.Buffer) error { return WriteDep(b, mods) }, `kernel/drivers/nvme/host/nvme-core.ko.xz:
+kernel/drivers/nvme/host/nvme.ko.xz: kernel/drivers/nvme/host/nvme-core.ko.xz
+kernel/drivers/pps/pps_core.ko:
+kernel/drivers/ptp/ptp.ko: kernel/drivers/pps/pps_core.ko
+kernel/drivers/net/e1000e.ko: kernel/drivers/ptp/ptp.ko kernel/drivers/pps/pps_core.ko
+`},
+		{"modules.alias", func(b *bytes.Buffer) error { return WriteAlias(b, mods) }, `# Aliases extracted from modules themselves.
+alias pci:v*d*sv*sd*bc01sc08i02* nvme
+alias pci:v00008086d000015B7sv*sd*bc*sc*i* e1000e
+`},
+		{"modules.order", func(b *bytes.Buffer) error { return WriteOrder(b, mods) }, `kernel/drivers/pps/pps_core.ko
+kernel/drivers/ptp/ptp.ko
+kernel/drivers/net/e1000e.ko
+kernel/drivers/nvme/host/nvme-core.ko
+kernel/drivers/nvme/host/nvme.ko
+`},
+	} {
+		var b bytes.Buffer
+		if err := tt.write(&b); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if b.String() != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, b.String(), tt.want)
+		}
+	}
+
+	if _, err := tree.Closure([]string{"e1000e", "nope", "nope2"}); err == nil || !strings.Contains(err.Error(), "nope, nope2") {
+		t.Errorf("Closure of missing modules: got %v, want an error naming nope and nope2", err)
+	}
+}
+
+func TestModuleName(t *testing.T) {
+	for in, want := range map[string]string{
+		"kernel/drivers/nvme/host/nvme-core.ko.xz": "nvme_core",
+		"e1000e.ko":       "e1000e",
+		"pps_core.ko.zst": "pps_core",
+		"nvme-core":       "nvme_core",
+	} {
+		if got := ModuleName(in); got != want {
+			t.Errorf("ModuleName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -2,10 +2,13 @@ package kmodule
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"syscall"
 	"unsafe"
+
+	"github.com/u-root/u-root/pkg/compress"
 )
 
 // Flags to finit_module(2) / FileInit.
@@ -25,7 +28,7 @@ func Init(image []byte, opts string) error {
 	}
 
 	if _, _, e := syscall.Syscall(syscall.SYS_INIT_MODULE, uintptr(unsafe.Pointer(&image[0])), uintptr(len(image)), uintptr(unsafe.Pointer(optsNull))); e != 0 {
-		return fmt.Errorf("init_module(%v, %q) failed with %v", image, opts, e)
+		return fmt.Errorf("init_module(%d bytes, %q) failed with %v", len(image), opts, e)
 	}
 
 	return nil
@@ -59,6 +62,48 @@ func FileInit(f *os.File, opts string, flags uintptr) error {
 	return nil
 }
 
+// Load loads the kernel module in the file name with the given opts. A module
+// compressed with xz, zstd or gzip is decompressed, with package compress,
+// and loaded with Init, since finit_module(2) takes only what the kernel can
+// read as it is. Decompressing xz and zstd needs their programs in $PATH.
+func Load(name, opts string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, err := readImage(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if img == nil {
+		return FileInit(f, opts, 0)
+	}
+	return Init(img, opts)
+}
+
+// readImage returns what the compressed module f decompresses to, or nil,
+// with f back at its start, if it is not compressed.
+func readImage(f *os.File) ([]byte, error) {
+	r, c, err := compress.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing with %s: %v", c, err)
+	}
+	defer r.Close()
+	if c == "none" {
+		_, err := f.Seek(0, io.SeekStart)
+		return nil, err
+	}
+	img, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing with %s: %v", c, err)
+	}
+	if err := r.Close(); err != nil {
+		return nil, fmt.Errorf("decompressing with %s: %v", c, err)
+	}
+	return img, nil
+}
+
 // Delete removes a kernel module.
 func Delete(name string, flags uintptr) error {
 	modnameptr, err := syscall.BytePtrFromString(name)
@@ -2,5 +2,5 @@ package kmodule
 
 const (
 	// arm64 syscall number for finit_module(2).
-	_SYS_FINIT_MODULE = 379
+	_SYS_FINIT_MODULE = 273
 )
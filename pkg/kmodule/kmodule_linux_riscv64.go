@@ -0,0 +1,10 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kmodule
+
+const (
+	// riscv64 syscall number for finit_module(2).
+	_SYS_FINIT_MODULE = 273
+)
@@ -0,0 +1,61 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kmodule
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kmodule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := []byte("\x7fELF module")
+	var gz bytes.Buffer
+	z := gzip.NewWriter(&gz)
+	if _, err := z.Write(img); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name     string
+		contents []byte
+		want     []byte
+	}{
+		{"e1000e.ko", img, nil},
+		{"e1000e.ko.gz", gz.Bytes(), img},
+	} {
+		name := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(name, tt.contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readImage(f)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		// What is not decompressed is loaded from f, from its start.
+		if rest, err := ioutil.ReadAll(f); tt.want == nil && (err != nil || !bytes.Equal(rest, img)) {
+			t.Errorf("%s: f reads %q, %v after, want %q", tt.name, rest, err, img)
+		}
+		f.Close()
+	}
+}
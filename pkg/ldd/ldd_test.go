@@ -1,9 +1,11 @@
 package ldd
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -90,3 +92,61 @@ func testLddBadSo(t *testing.T) {
 	t.Logf("Err on bad dir is %v", err)
 
 }
+
+// TestNeeded tests that Needed finds the interpreter and libraries of
+// /bin/date that its interpreter does.
+func TestNeeded(t *testing.T) {
+	l, err := List([]string{"/bin/date"})
+	if err != nil {
+		t.Fatalf("LddList on /bin/date: want nil, got %v", err)
+	}
+	n, err := Needed([]string{"/bin/date"})
+	if err != nil {
+		t.Fatalf("Needed on /bin/date: want nil, got %v", err)
+	}
+	// The loader and Needed may find a library in different
+	// directories, so only compare what the files are called.
+	names := make(map[string]bool)
+	for _, f := range n {
+		names[filepath.Base(f.FullName)] = true
+	}
+	for _, f := range l {
+		if !names[filepath.Base(f)] {
+			t.Errorf("Needed on /bin/date: %v is missing from %v", f, n)
+		}
+	}
+}
+
+func TestNeededNotFound(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ldd")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// A shell script is not ELF, and is ignored.
+	script := filepath.Join(tempDir, "script")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Needed([]string{script}); err != nil || len(n) != 0 {
+		t.Errorf("Needed on a script: want nothing, got %v, %v", n, err)
+	}
+
+	// A copy of /bin/date that needs a libc nobody has.
+	b, err := ioutil.ReadFile("/bin/date")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("libc.so.6\x00")) {
+		t.Skip("/bin/date does not need libc.so.6")
+	}
+	b = bytes.Replace(b, []byte("libc.so.6\x00"), []byte("libx.so.6\x00"), -1)
+	date := filepath.Join(tempDir, "date")
+	if err := ioutil.WriteFile(date, b, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Needed([]string{date}); err == nil || !strings.Contains(err.Error(), "libx.so.6") {
+		t.Errorf("Needed on %v: want an error about libx.so.6, got %v", date, err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ldd
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultLibDirs are searched after the directories in /etc/ld.so.conf, as
+// the dynamic loader does after ld.so.cache.
+var defaultLibDirs = []string{"/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+
+// Needed returns the interpreters and shared libraries that the ELF files
+// in names need, directly or not. Unlike Ldd, it runs nothing: it reads
+// PT_INTERP and DT_NEEDED and searches DT_RPATH, DT_RUNPATH, the
+// directories in /etc/ld.so.conf and the default directories the way the
+// dynamic loader does, so it also works for files built for another
+// machine. Symlinks on the way to a library, e.g. libfoo.so.1 pointing at
+// libfoo.so.1.2.3, are included as well, since the loader looks for the
+// name the file was linked against. Files that are not ELF or not
+// dynamically linked are ignored. A library that can not be found is an
+// error.
+func Needed(names []string) ([]*FileInfo, error) {
+	conf, err := ldSoConf("/etc/ld.so.conf")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	n := &needed{
+		dirs:  append(conf, defaultLibDirs...),
+		seen:  make(map[string]bool),
+		files: make(map[string]*FileInfo),
+	}
+	for _, name := range names {
+		f, err := elf.Open(name)
+		if err != nil {
+			// Not an ELF file, which is fine.
+			continue
+		}
+		err = n.add(name, f, nil)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var libs []*FileInfo
+	for _, fi := range n.files {
+		libs = append(libs, fi)
+	}
+	sort.Slice(libs, func(i, j int) bool {
+		return libs[i].FullName < libs[j].FullName
+	})
+	return libs, nil
+}
+
+type needed struct {
+	dirs  []string
+	seen  map[string]bool
+	files map[string]*FileInfo
+}
+
+// add adds what the ELF file f, opened as name, needs. rpath is the
+// DT_RPATH of the objects that loaded it, which is searched too.
+func (n *needed) add(name string, f *elf.File, rpath []string) error {
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		b := make([]byte, p.Filesz)
+		if _, err := p.ReadAt(b, 0); err != nil {
+			return fmt.Errorf("%s: reading PT_INTERP: %v", name, err)
+		}
+		if err := follow(strings.TrimRight(string(b), "\x00"), n.files); err != nil {
+			return fmt.Errorf("%s: interpreter: %v", name, err)
+		}
+	}
+
+	libs, err := f.DynString(elf.DT_NEEDED)
+	if err != nil || len(libs) == 0 {
+		// Statically linked.
+		return nil
+	}
+	origin := filepath.Dir(name)
+	if p, err := filepath.EvalSymlinks(name); err == nil {
+		origin = filepath.Dir(p)
+	}
+	runpath, err := dynPath(f, elf.DT_RUNPATH, origin)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	// DT_RPATH is ignored if there is a DT_RUNPATH, and unlike it is
+	// also searched for the libraries of the libraries.
+	if len(runpath) == 0 {
+		r, err := dynPath(f, elf.DT_RPATH, origin)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		rpath = append(r, rpath...)
+	}
+
+	var search []string
+	if len(runpath) == 0 {
+		search = append(search, rpath...)
+	}
+	search = append(append(search, runpath...), n.dirs...)
+
+	for _, lib := range libs {
+		dirs := search
+		if strings.Contains(lib, "/") {
+			dirs = []string{""}
+		}
+		p, lf, err := find(lib, dirs, f)
+		if err != nil {
+			return fmt.Errorf("%s, needed by %s: %v", lib, name, err)
+		}
+		if n.seen[p] {
+			lf.Close()
+			continue
+		}
+		n.seen[p] = true
+		err = follow(p, n.files)
+		if err == nil {
+			err = n.add(p, lf, rpath)
+		}
+		lf.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find returns the first lib in dirs that is built for the same machine
+// as f, opened.
+func find(lib string, dirs []string, f *elf.File) (string, *elf.File, error) {
+	for _, d := range dirs {
+		p := filepath.Join(d, lib)
+		lf, err := elf.Open(p)
+		if err != nil {
+			continue
+		}
+		if lf.Class == f.Class && lf.Machine == f.Machine {
+			return p, lf, nil
+		}
+		lf.Close()
+	}
+	return "", nil, fmt.Errorf("not found in %s", strings.Join(dirs, ":"))
+}
+
+// dynPath returns the directories in the DT_RPATH or DT_RUNPATH tag of f,
+// with $ORIGIN replaced by origin.
+func dynPath(f *elf.File, tag elf.DynTag, origin string) ([]string, error) {
+	v, err := f.DynString(tag)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, s := range v {
+		for _, d := range strings.Split(s, ":") {
+			if d == "" {
+				continue
+			}
+			d = strings.Replace(d, "${ORIGIN}", origin, -1)
+			dirs = append(dirs, strings.Replace(d, "$ORIGIN", origin, -1))
+		}
+	}
+	return dirs, nil
+}
+
+// ldSoConf returns the directories listed in the ld.so.conf file name and
+// the files it includes.
+func ldSoConf(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var dirs []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := s.Text()
+		if i := strings.Index(l, "#"); i != -1 {
+			l = l[:i]
+		}
+		fields := strings.Fields(l)
+		switch {
+		case len(fields) == 0 || fields[0] == "hwcap":
+		case fields[0] == "include":
+			for _, pat := range fields[1:] {
+				if !filepath.IsAbs(pat) {
+					pat = filepath.Join(filepath.Dir(name), pat)
+				}
+				// Glob sorts its matches, as ldconfig does.
+				inc, err := filepath.Glob(pat)
+				if err != nil {
+					return nil, err
+				}
+				for _, i := range inc {
+					d, err := ldSoConf(i)
+					if err != nil {
+						return nil, err
+					}
+					dirs = append(dirs, d...)
+				}
+			}
+		default:
+			for _, d := range fields {
+				dirs = append(dirs, strings.Split(d, ",")...)
+			}
+		}
+	}
+	return dirs, s.Err()
+}
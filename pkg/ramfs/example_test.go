@@ -0,0 +1,49 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs_test
+
+import (
+	"bytes"
+	"log"
+	"os"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/ramfs"
+)
+
+// An image with a console, a few device nodes and an init that is a link
+// to the real one. The directories they are in are made for them.
+func ExampleInitramfs_Symlink() {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var b bytes.Buffer
+	init, err := ramfs.NewInitramfsRecords(archiver.Writer(&b), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := init.CharDev("dev/console", 0600, 5, 1); err != nil {
+		log.Fatal(err)
+	}
+	if err := init.BlockDev("dev/vda", 0660, 253, 0); err != nil {
+		log.Fatal(err)
+	}
+	if err := init.Symlink("bbin/init", "init"); err != nil {
+		log.Fatal(err)
+	}
+	if err := init.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := cpio.List(os.Stdout, archiver.Reader(bytes.NewReader(b.Bytes()))); err != nil {
+		log.Fatal(err)
+	}
+	// Output:
+	// drwxr-xr-x 0 0 0 1970-01-01 dev
+	// crw------- 0 0 5,1 1970-01-01 dev/console
+	// brw-rw---- 0 0 253,0 1970-01-01 dev/vda
+	// lrwxrwxrwx 0 0 9 1970-01-01 init -> bbin/init
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"io/fs"
+	"path"
+	"syscall"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// WriteFS writes what is in fsys, such as an embed.FS, under prefix, with
+// WriteRecord: a record of each directory, regular file and, if fsys is an
+// fs.ReadLinkFS, symlink, and nothing of the rest. A symlink in an fsys
+// that can not read it is written as what it leads to.
+//
+// The permissions and mtime are those fsys gives, and the permissions are
+// 0644 for a file and 0755 for a directory if it gives none. An embed.FS
+// gives every file 0444.
+func (i *Initramfs) WriteFS(fsys fs.FS, prefix string) error {
+	if prefix != "" {
+		if err := checkName(prefix); err != nil {
+			return err
+		}
+	}
+	rl, links := fsys.(fs.ReadLinkFS)
+	return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "." {
+			return nil
+		}
+		name := path.Join(prefix, p)
+		if d.Type()&fs.ModeSymlink != 0 && links {
+			target, err := rl.ReadLink(p)
+			if err != nil {
+				return err
+			}
+			return i.WriteRecord(cpio.Symlink(name, target))
+		}
+		fi, err := fs.Stat(fsys, p)
+		if err != nil {
+			return err
+		}
+		info := cpio.Info{Name: name, Mode: fsPerm(fi.Mode())}
+		if t := fi.ModTime(); t.Unix() > 0 {
+			info.MTime = uint64(t.Unix())
+		}
+		switch {
+		case fi.Mode().IsRegular():
+			info.Mode |= syscall.S_IFREG
+			info.FileSize = uint64(fi.Size())
+			return i.WriteRecord(cpio.Record{Info: info, ReadCloser: &fsReader{fsys: fsys, name: p}})
+		case fi.IsDir():
+			info.Mode |= syscall.S_IFDIR
+			return i.WriteRecord(cpio.Record{Info: info})
+		}
+		Debug("%s: a %v can not be written from an fs.FS; skipping it", p, fi.Mode().Type())
+		return nil
+	})
+}
+
+// fsPerm returns the permissions and set-ID and sticky bits of m as mode_t
+// bits, or those of a file or directory of mode 0644 or 0755 if m has no
+// permissions.
+func fsPerm(m fs.FileMode) uint64 {
+	p := uint64(m.Perm())
+	if p == 0 {
+		p = 0644
+		if m.IsDir() {
+			p = 0755
+		}
+	}
+	if m&fs.ModeSetuid != 0 {
+		p |= syscall.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		p |= syscall.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		p |= syscall.S_ISVTX
+	}
+	return p
+}
+
+// fsReader reads the file name of fsys, which it opens when it is first
+// read.
+type fsReader struct {
+	fsys fs.FS
+	name string
+	f    fs.File
+}
+
+func (r *fsReader) Read(b []byte) (int, error) {
+	if r.f == nil {
+		f, err := r.fsys.Open(r.name)
+		if err != nil {
+			return 0, err
+		}
+		r.f = f
+	}
+	return r.f.Read(b)
+}
+
+func (r *fsReader) Close() error {
+	// A file that was never read was never opened.
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestWriteFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"bin/uinit": {Data: []byte("uinit"), Mode: 0755},
+		"etc/empty": {Mode: fs.ModeDir | 0700},
+		"etc/motd":  {Data: []byte("hello"), Mode: 0644},
+		// No permissions are 0644.
+		"etc/zero":  {},
+		"lib":       {Data: []byte("usr/lib"), Mode: fs.ModeSymlink | 0777},
+		"usr/lib/x": {Data: []byte("x"), Mode: 0644},
+	}
+	head := []string{
+		"drwxr-xr-x 0 0 0 1970-01-01 p",
+		"dr-xr-xr-x 0 0 0 1970-01-01 p/bin",
+		"-rwxr-xr-x 0 0 5 1970-01-01 p/bin/uinit",
+		"dr-xr-xr-x 0 0 0 1970-01-01 p/etc",
+		"drwx------ 0 0 0 1970-01-01 p/etc/empty",
+		"-rw-r--r-- 0 0 5 1970-01-01 p/etc/motd",
+		"-rw-r--r-- 0 0 0 1970-01-01 p/etc/zero",
+	}
+	tail := []string{
+		"dr-xr-xr-x 0 0 0 1970-01-01 p/usr",
+		"dr-xr-xr-x 0 0 0 1970-01-01 p/usr/lib",
+		"-rw-r--r-- 0 0 1 1970-01-01 p/usr/lib/x",
+	}
+
+	for _, tt := range []struct {
+		name string
+		fsys fs.FS
+		lib  string
+	}{
+		{"ReadLinkFS", fsys, "lrwxrwxrwx 0 0 7 1970-01-01 p/lib -> usr/lib"},
+		// Without ReadLink, what lib leads to is written.
+		{"FS", struct{ fs.FS }{fsys}, "dr-xr-xr-x 0 0 0 1970-01-01 p/lib"},
+	} {
+		archiver, err := cpio.Format("newc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := i.WriteFS(tt.fsys, "p"); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := i.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+
+		recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range recs {
+			got = append(got, cpio.FormatLong(r))
+			if r.Name == "p/bin/uinit" {
+				c, err := ioutil.ReadAll(r)
+				if err != nil || string(c) != "uinit" {
+					t.Errorf("%s: p/bin/uinit: got %q, %v, want uinit", tt.name, c, err)
+				}
+			}
+		}
+		want := append(append(append([]string(nil), head...), tt.lib), tail...)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", tt.name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+		if n := i.Names(); len(n) != len(want) {
+			t.Errorf("%s: Names: got %q, want %d names", tt.name, n, len(want))
+		}
+	}
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := NewInitramfsRecords(archiver.Writer(ioutil.Discard), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{"/p", "../p", "p/../../q"} {
+		if err := i.WriteFS(fsys, prefix); err == nil {
+			t.Errorf("WriteFS under %q: got nil, want an error", prefix)
+		}
+	}
+}
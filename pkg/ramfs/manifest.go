@@ -0,0 +1,154 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// ManifestEntry overrides the metadata of one archive path. Nil fields are
+// left alone.
+type ManifestEntry struct {
+	Path   string
+	Mode   *uint64 `json:",omitempty"`
+	UID    *uint64 `json:",omitempty"`
+	GID    *uint64 `json:",omitempty"`
+	Rename string  `json:",omitempty"`
+}
+
+// Manifest is a set of per-path overrides applied to records as they are
+// written, e.g. to make /etc/shadow 0600 root:root whatever it is on the
+// host.
+type Manifest struct {
+	entries map[string]ManifestEntry
+	used    map[string]bool
+}
+
+// ParseManifest reads a manifest. It is either a JSON array of
+// ManifestEntry, or lines of the form
+//
+//	path mode uid gid [rename]
+//
+// where mode is octal permission bits and "-" leaves a field alone. Blank
+// lines and lines starting with # are ignored.
+func ParseManifest(r io.Reader) (*Manifest, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ManifestEntry
+	if t := bytes.TrimSpace(b); len(t) > 0 && t[0] == '[' {
+		if err := json.Unmarshal(t, &entries); err != nil {
+			return nil, err
+		}
+	} else if entries, err = parseManifestLines(b); err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{
+		entries: make(map[string]ManifestEntry),
+		used:    make(map[string]bool),
+	}
+	for _, e := range entries {
+		e.Path = cleanName(e.Path)
+		if e.Path == "" {
+			return nil, fmt.Errorf("manifest entry %+v has no path", e)
+		}
+		if _, ok := m.entries[e.Path]; ok {
+			return nil, fmt.Errorf("manifest has two entries for %q", e.Path)
+		}
+		if e.Rename != "" {
+			e.Rename = cleanName(e.Rename)
+		}
+		m.entries[e.Path] = e
+	}
+	return m, nil
+}
+
+func parseManifestLines(b []byte) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		f := strings.Fields(l)
+		if len(f) != 4 && len(f) != 5 {
+			return nil, fmt.Errorf("manifest line %d: got %d fields, want path mode uid gid [rename]", n, len(f))
+		}
+		e := ManifestEntry{Path: f[0]}
+		for i, v := range []struct {
+			p    **uint64
+			base int
+		}{{&e.Mode, 8}, {&e.UID, 10}, {&e.GID, 10}} {
+			if f[i+1] == "-" {
+				continue
+			}
+			u, err := strconv.ParseUint(f[i+1], v.base, 32)
+			if err != nil {
+				return nil, fmt.Errorf("manifest line %d: %v", n, err)
+			}
+			*v.p = &u
+		}
+		if len(f) == 5 {
+			e.Rename = f[4]
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+func cleanName(n string) string {
+	return strings.TrimLeft(filepath.Clean("/"+n), "/")
+}
+
+// Transform applies the manifest entry for r's name, if any, to r.
+func (m *Manifest) Transform(r cpio.Record) cpio.Record {
+	e, ok := m.entries[cleanName(r.Name)]
+	if !ok {
+		return r
+	}
+	m.used[e.Path] = true
+
+	if e.Mode != nil {
+		r.Mode = r.Mode&^07777 | *e.Mode&07777
+	}
+	if e.UID != nil {
+		r.UID = *e.UID
+	}
+	if e.GID != nil {
+		r.GID = *e.GID
+	}
+	if e.Rename != "" {
+		r.Name = e.Rename
+	}
+	return r
+}
+
+// Unused returns the sorted paths of entries that never matched a record,
+// which usually means the manifest is stale.
+func (m *Manifest) Unused() []string {
+	var u []string
+	for p := range m.entries {
+		if !m.used[p] {
+			u = append(u, p)
+		}
+	}
+	sort.Strings(u)
+	return u
+}
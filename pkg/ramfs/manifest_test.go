@@ -0,0 +1,87 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestManifest(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		manifest string
+	}{
+		{"lines", `
+# path mode uid gid [rename]
+/etc/shadow 0600 0 0
+bin/helper 4755 - -
+etc/motd - 1000 1000 etc/issue
+usr/stale 0644 0 0
+`},
+		{"json", `[
+	{"Path": "/etc/shadow", "Mode": 384, "UID": 0, "GID": 0},
+	{"Path": "bin/helper", "Mode": 2541},
+	{"Path": "etc/motd", "UID": 1000, "GID": 1000, "Rename": "etc/issue"},
+	{"Path": "usr/stale", "Mode": 420, "UID": 0, "GID": 0}
+]`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseManifest(strings.NewReader(tt.manifest))
+			if err != nil {
+				t.Fatalf("ParseManifest: %v", err)
+			}
+
+			for _, r := range []struct {
+				in, want cpio.Info
+			}{
+				{
+					cpio.Info{Name: "etc/shadow", Mode: syscall.S_IFREG | 0644, UID: 1000, GID: 1000},
+					cpio.Info{Name: "etc/shadow", Mode: syscall.S_IFREG | 0600},
+				},
+				{
+					cpio.Info{Name: "bin/helper", Mode: syscall.S_IFREG | 0755, UID: 5, GID: 6},
+					cpio.Info{Name: "bin/helper", Mode: syscall.S_IFREG | 04755, UID: 5, GID: 6},
+				},
+				{
+					cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644},
+					cpio.Info{Name: "etc/issue", Mode: syscall.S_IFREG | 0644, UID: 1000, GID: 1000},
+				},
+				{
+					cpio.Info{Name: "etc/passwd", Mode: syscall.S_IFREG | 0644, UID: 7},
+					cpio.Info{Name: "etc/passwd", Mode: syscall.S_IFREG | 0644, UID: 7},
+				},
+			} {
+				got := m.Transform(cpio.Record{Info: r.in})
+				if got.Info != r.want {
+					t.Errorf("Transform(%v) = %v, want %v", r.in, got.Info, r.want)
+				}
+			}
+
+			if got, want := m.Unused(), []string{"usr/stale"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("Unused() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestManifestBad(t *testing.T) {
+	for _, m := range []string{
+		"etc/shadow 0600 0",
+		"etc/shadow 0999 0 0",
+		"etc/shadow 0600 root 0",
+		"etc/a 0600 0 0\n/etc/a 0644 0 0",
+		`[{"Mode": 384}]`,
+		`[{"Path": "a", "Bogus": 1]`,
+	} {
+		if _, err := ParseManifest(strings.NewReader(m)); err == nil {
+			t.Errorf("ParseManifest(%q) succeeded, want error", m)
+		}
+	}
+}
@@ -2,11 +2,44 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Package ramfs writes initramfs archives: files from disk, other archives
+// and records made up on the spot, with the directories they are in, and
+// nothing written twice by accident.
+//
+// An image builder makes its device nodes and symlinks with the methods of
+// Initramfs, rather than by hand, e.g.
+//
+//	archiver, err := cpio.Format("newc")
+//	...
+//	init, err := ramfs.NewInitramfsRecords(archiver.Writer(f), nil)
+//	...
+//	// An archive given up on halfway is still one.
+//	defer init.Close()
+//	if err := init.CharDev("dev/console", 0600, 5, 1); err != nil {
+//		...
+//	}
+//	if err := init.Symlink("bbin/init", "init"); err != nil {
+//		...
+//	}
+//	if err := init.WriteFile("/etc/hosts", "etc/hosts"); err != nil {
+//		...
+//	}
+//	return init.Close()
 package ramfs
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 
 	"github.com/u-root/u-root/pkg/cpio"
@@ -38,72 +71,786 @@ var DevCPIO = []cpio.Record{
 	{Info: cpio.Info{Name: "usr/lib", Mode: d | 0755}},
 	{Info: cpio.Info{Name: "lib64", Mode: d | 0755}},
 	{Info: cpio.Info{Name: "bin", Mode: d | 0755}},
-	{Info: cpio.Info{Name: "dev/console", Mode: c | 0600, Rmajor: 5, Rminor: 1}},
-	{Info: cpio.Info{Name: "dev/tty", Mode: c | 0666, Rmajor: 5, Rminor: 0}},
-	{Info: cpio.Info{Name: "dev/null", Mode: c | 0666, Rmajor: 1, Rminor: 3}},
-	{Info: cpio.Info{Name: "dev/port", Mode: c | 0640, Rmajor: 1, Rminor: 4}},
-	{Info: cpio.Info{Name: "dev/urandom", Mode: c | 0666, Rmajor: 1, Rminor: 9}},
+	cpio.CharDev("dev/console", 0600, 5, 1),
+	cpio.CharDev("dev/tty", 0666, 5, 0),
+	cpio.CharDev("dev/null", 0666, 1, 3),
+	cpio.CharDev("dev/port", 0640, 1, 4),
+	cpio.CharDev("dev/urandom", 0666, 1, 9),
 	{Info: cpio.Info{Name: "etc/resolv.conf", Mode: f | 0644, FileSize: uint64(len(nameserver))}, ReadCloser: cpio.NewBytesReadCloser([]byte(nameserver))},
 	{Info: cpio.Info{Name: "etc/localtime", Mode: f | 0644, FileSize: uint64(len(gmt0))}, ReadCloser: cpio.NewBytesReadCloser([]byte(gmt0))},
 }
 
+// ErrClosed is the error of a write to an Initramfs after Close.
+var ErrClosed = errors.New("the Initramfs is closed")
+
+// Debug logs the records an Initramfs skips as identical to ones it wrote.
+var Debug = func(string, ...interface{}) {}
+
+// Warn logs the records an Initramfs with DedupWarn leaves out.
+var Warn = log.Printf
+
+// DedupPolicy is what an Initramfs does with a record whose name it has
+// already written, when neither record is from an Override or Default
+// Source and they are not both directories. A record identical to the one
+// written, with the same mode and contents, or with no contents and the
+// same inode or device, is skipped whatever the policy.
+type DedupPolicy int
+
+const (
+	// DedupFirst keeps the first record of a name.
+	DedupFirst DedupPolicy = iota
+	// DedupLast writes the later records too. The kernel extracts them
+	// in order, so the last one wins.
+	DedupLast
+	// DedupError keeps the first record, and has Conflicts and
+	// WriteTrailer return an error listing every name written twice.
+	DedupError
+	// DedupRefuse has the write of a later record return an error
+	// naming its source and that of the record written.
+	DedupRefuse
+	// DedupWarn keeps the first record, and logs the later ones with
+	// Warn.
+	DedupWarn
+)
+
+// Source says where the records written to an Initramfs come from.
+type Source struct {
+	// Name is used when reporting conflicts, e.g. "-files /etc/passwd".
+	Name string
+	// Override has the records win over later records of the same name,
+	// which are dropped rather than conflict.
+	Override bool
+	// Default has the records give way to earlier records of the same
+	// name, rather than conflict.
+	Default bool
+	// Replace has the records written even if a record of the same name
+	// was, for the kernel to replace it, or for a Writer that leaves the
+	// earlier ones out of the archive.
+	Replace bool
+	// Exclusive has a record of the same name as one of the records,
+	// before or after it, be an error rather than a conflict, unless the
+	// two are identical.
+	Exclusive bool
+}
+
+// ConflictPolicy is what ConcatWithPolicy does with the records of an
+// archive whose names are written before or after them.
+type ConflictPolicy int
+
+const (
+	// ConflictSource does what the Source and the Policy say, as for
+	// any record.
+	ConflictSource ConflictPolicy = iota
+	// ConflictError has a name written before or after an error.
+	ConflictError
+	// ConflictSkip leaves out the records of names already written.
+	ConflictSkip
+	// ConflictOverwrite writes the records even if their names were
+	// written, for the kernel to replace them, and leaves out those of
+	// their names written after them.
+	ConflictOverwrite
+)
+
 type Initramfs struct {
 	cpio.Writer
 
-	files map[string]struct{}
+	// Policy decides what happens to conflicting records.
+	Policy DedupPolicy
+	// NoParents leaves writing the directories records are in to the
+	// caller.
+	NoParents bool
+	// FollowSymlinks has the files written from disk that are symlinks
+	// written as what they lead to, under their own names, and the
+	// directories they lead to written as directories. A symlink to
+	// nothing is written as it is.
+	FollowSymlinks bool
+
+	source    Source
+	parents   *cpio.ParentWriter
+	files     map[string]written
+	conflicts map[string][]string
+	dups      int
+	dupBytes  uint64
+	// closed is whether Close was called, after which nothing more is
+	// written, and closeErr what it returned.
+	closed   bool
+	closeErr error
+	// names are those of files, in the order they were first written.
+	names []string
+	// stage, if it is not nil, holds the records until the trailer.
+	stage *stage
+	// transform is the Transform of the Options.
+	transform cpio.RecordFunc
+	// noEpoch is the NoEpoch of the Options.
+	noEpoch bool
+}
+
+// written is what an Initramfs remembers about a name it wrote.
+type written struct {
+	source Source
+	dir    bool
+	info   cpio.Info
+	// sum is the SHA-256 of the contents, if there were any.
+	sum []byte
+}
+
+// hashReader hashes and counts what is read through it.
+type hashReader struct {
+	io.ReadCloser
+	h hash.Hash
+	n uint64
+}
+
+func (r *hashReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		r.h.Write(b[:n])
+		r.n += uint64(n)
+	}
+	return n, err
+}
+
+// Options are how NewInitramfsOptions makes an Initramfs.
+type Options struct {
+	// Records are written first, and override records of the same name
+	// written later.
+	Records []cpio.Record
+	// Policy is the Policy of the Initramfs, from its first record on.
+	// It is DedupFirst, which writes what it can, if it is not set.
+	Policy DedupPolicy
+	// Staged holds the records, the last of each name, until the
+	// trailer, and then writes them sorted by name, each directory
+	// before what is in it, whatever order they came in. Contents
+	// larger than StageMemory are spooled to a file in SpoolDir, or
+	// the default directory for temporary files if it is "", which
+	// WriteTrailer or Close removes. Without it, records are written
+	// as they come, and nothing is held.
+	Staged   bool
+	SpoolDir string
+	// Transform, if it is not nil, is applied to every record written,
+	// the Records and the directories made for records included, before
+	// it is looked up among those written, so that what it renames is
+	// known by its new name. It comes after the MakeReproducible of
+	// WriteRecord, or what is left of it with NoEpoch, and after the
+	// transform of Concat. A record it
+	// leaves out, by returning one with no name, as cpio.FilterOut does,
+	// is not written, nor counted as written. A record it renames into
+	// a directory that was not written is not given one.
+	Transform cpio.RecordFunc
+	// NoEpoch has the Records and WriteRecord keep the mtimes records
+	// have, rather than set them to cpio.SourceDateEpoch, for a
+	// Transform that sets them itself, such as a cpio.Normalizer that
+	// leaves some alone. The device files came from is still cleared.
+	NoEpoch bool
 }
 
 func NewInitramfs(w cpio.Writer) (*Initramfs, error) {
-	// Write devtmpfs records.
-	dcpio := DevCPIO[:]
-	cpio.MakeAllReproducible(dcpio)
-	if err := w.WriteRecords(dcpio); err != nil {
+	return NewInitramfsRecords(w, DevCPIO)
+}
+
+// NewInitramfsRecords is NewInitramfs with recs written first instead of
+// DevCPIO, e.g. to add device nodes or leave them to devtmpfs. They
+// override records of the same name written later.
+func NewInitramfsRecords(w cpio.Writer, recs []cpio.Record) (*Initramfs, error) {
+	return NewInitramfsOptions(w, Options{Records: recs})
+}
+
+// NewInitramfsOptions returns an Initramfs writing to w as o says.
+func NewInitramfsOptions(w cpio.Writer, o Options) (*Initramfs, error) {
+	i := &Initramfs{
+		Writer:    w,
+		Policy:    o.Policy,
+		transform: o.Transform,
+		noEpoch:   o.NoEpoch,
+		files:     make(map[string]written),
+		conflicts: make(map[string][]string),
+	}
+	i.parents = cpio.NewParentWriter(writeFunc(i.write))
+	if o.Staged {
+		i.stage = newStage(o.SpoolDir)
+	}
+	dcpio := append([]cpio.Record(nil), o.Records...)
+	for j := range dcpio {
+		dcpio[j] = i.reproducible(dcpio[j])
+	}
+	i.SetSource(Source{Name: "ramfs", Override: true})
+	if err := i.WriteRecords(dcpio); err != nil {
 		return nil, err
 	}
+	i.SetSource(Source{})
+	return i, nil
+}
 
-	return &Initramfs{
-		Writer: w,
-		files:  make(map[string]struct{}),
-	}, nil
+// SetSource sets where the records written from now on come from.
+func (i *Initramfs) SetSource(s Source) {
+	i.source = s
 }
 
+// reproducible returns r made reproducible, with its mtime left alone if
+// the Options say NoEpoch.
+func (i *Initramfs) reproducible(r cpio.Record) cpio.Record {
+	if i.noEpoch {
+		r.Major, r.Minor = 0, 0
+		return r
+	}
+	return cpio.MakeReproducible(r)
+}
+
+// WriteRecord writes r, made reproducible, and, unless NoParents is set,
+// the directories it is in that were not written before it, which a
+// cpio.ParentWriter makes. A parent that is not a directory conflicts with
+// the one made.
+//
+// It is how records that are not on disk or in an archive, such as
+// generated files, symlinks and device nodes, are added.
 func (i *Initramfs) WriteRecord(r cpio.Record) error {
 	if r.Name == "." || r.Name == "/" {
 		return nil
 	}
+	r = i.reproducible(r)
+	if i.NoParents {
+		return i.write(r)
+	}
+	return i.parents.WriteRecord(r)
+}
+
+// Symlink writes a symlink at linkpath pointing at target, with WriteRecord.
+// The link path is relative to the root of the archive, and the target is
+// as it is in the image, relative to the link or absolute.
+func (i *Initramfs) Symlink(target, linkpath string) error {
+	if err := checkName(linkpath); err != nil {
+		return err
+	}
+	return i.WriteRecord(cpio.Symlink(linkpath, target))
+}
+
+// CharDev writes the character device node name, with the permissions and
+// set-ID and sticky bits of mode and the device numbers major and minor,
+// with WriteRecord.
+func (i *Initramfs) CharDev(name string, mode os.FileMode, major, minor uint64) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	return i.WriteRecord(cpio.CharDev(name, mode, major, minor))
+}
+
+// BlockDev writes a block device node as CharDev does a character one.
+func (i *Initramfs) BlockDev(name string, mode os.FileMode, major, minor uint64) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	return i.WriteRecord(cpio.BlockDev(name, mode, major, minor))
+}
+
+// checkName returns an error if name, of a record made up, is empty,
+// absolute, or has a ".." in it.
+func checkName(name string) error {
+	if !Below(name) {
+		return fmt.Errorf("%q is not a path below the archive's root", name)
+	}
+	for _, e := range strings.Split(name, "/") {
+		if e == ".." {
+			return fmt.Errorf("%q has a .. in it", name)
+		}
+	}
+	return nil
+}
+
+// Synthesized returns whether the directory name was made by WriteRecord
+// for the records in it, rather than written.
+func (i *Initramfs) Synthesized(name string) bool {
+	return i.parents.Synthesized(name)
+}
+
+// writeFunc is a RecordWriter that calls itself.
+type writeFunc func(cpio.Record) error
+
+func (f writeFunc) WriteRecord(r cpio.Record) error {
+	return f(r)
+}
+
+// write writes r, transformed, or not, according to the sources of r and
+// of any record of the same name written before, and the Policy.
+func (i *Initramfs) write(r cpio.Record) error {
+	if i.closed {
+		if r.ReadCloser != nil {
+			r.Close()
+		}
+		return ErrClosed
+	}
+	if i.transform != nil {
+		rc := r.ReadCloser
+		if r = i.transform(r); cpio.Skipped(r) {
+			if rc != nil {
+				return rc.Close()
+			}
+			return nil
+		}
+	}
+	name := strings.TrimLeft(filepath.Clean(r.Name), "/")
+	dir := r.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	w, ok := i.files[name]
+	conflict := ok && !(w.dir && dir)
+	exclusive := conflict && (w.source.Exclusive || i.source.Exclusive)
+	if conflict && i.source.Replace && !exclusive {
+		return i.record(name, dir, r, i.Writer.WriteDuplicate)
+	}
+	if conflict && (exclusive || !w.source.Override && !i.source.Default) {
+		same, err := i.identical(w, &r)
+		if err != nil {
+			return err
+		}
+		if same {
+			Debug("%s from %s is identical to the one from %s; skipping it", name, i.source.Name, w.source.Name)
+			i.dups++
+			if r.ReadCloser != nil {
+				i.dupBytes += r.FileSize
+				return r.Close()
+			}
+			return nil
+		}
+	}
+	switch {
+	case !ok:
+		return i.record(name, dir, r, i.Writer.WriteRecord)
+	case exclusive:
+		if r.ReadCloser != nil {
+			r.Close()
+		}
+		return duplicate(name, i.source, w.source)
+	case w.dir && dir, w.source.Override, i.source.Default:
+	case i.Policy == DedupLast:
+		return i.record(name, dir, r, i.Writer.WriteDuplicate)
+	case i.Policy == DedupRefuse:
+		if r.ReadCloser != nil {
+			r.Close()
+		}
+		return duplicate(name, i.source, w.source)
+	case i.Policy == DedupWarn:
+		Warn("%v; keeping the first", duplicate(name, i.source, w.source))
+	case i.Policy == DedupError:
+		c := i.conflicts[name]
+		if len(c) == 0 {
+			c = []string{w.source.Name}
+		}
+		if c[len(c)-1] != i.source.Name {
+			c = append(c, i.source.Name)
+		}
+		i.conflicts[name] = c
+	}
+	if r.ReadCloser != nil {
+		return r.Close()
+	}
+	return nil
+}
+
+// duplicate returns the error of a record of name from s, written after one
+// from was, saying where each came from if its Source was named.
+func duplicate(name string, s, from Source) error {
+	switch {
+	case s.Name != "" && from.Name != "":
+		return fmt.Errorf("%s from %s is also from %s", name, s.Name, from.Name)
+	case s.Name != "":
+		return fmt.Errorf("%s from %s was already written", name, s.Name)
+	case from.Name != "":
+		return fmt.Errorf("%s is also from %s", name, from.Name)
+	}
+	return fmt.Errorf("%s was already written", name)
+}
+
+// record writes r with write, remembering it and the hash of its contents
+// as the record of name.
+func (i *Initramfs) record(name string, dir bool, r cpio.Record, write func(cpio.Record) error) error {
+	var h *hashReader
+	if r.ReadCloser != nil {
+		h = &hashReader{ReadCloser: r.ReadCloser, h: sha256.New()}
+		r.ReadCloser = h
+	}
+	if i.stage != nil {
+		write = i.stage.put
+	}
+	if err := write(r); err != nil {
+		return err
+	}
+	if dir {
+		i.parents.AddDir(name)
+	}
+	if _, ok := i.files[name]; !ok {
+		i.names = append(i.names, name)
+	}
+	w := written{source: i.source, dir: dir, info: r.Info}
+	if h == nil {
+		w.info.FileSize = 0
+	}
+	// A writer that did not read it all has no sum to compare.
+	if h != nil && h.n == r.FileSize {
+		w.sum = h.h.Sum(nil)
+	}
+	i.files[name] = w
+	return nil
+}
+
+// identical reports whether r is the same as the record w remembers. It
+// reads r's contents to compare them, if it has to, and leaves r with a
+// reader of them. Contents that are an io.ReaderAt, as those of files and
+// archives are, are read through a SectionReader and left as they were;
+// only others are read into memory.
+func (i *Initramfs) identical(w written, r *cpio.Record) (bool, error) {
+	if w.info.Mode != r.Mode || w.info.Rmajor != r.Rmajor || w.info.Rminor != r.Rminor {
+		return false, nil
+	}
+	// No contents is a device, or a hard link to the inode written.
+	if r.ReadCloser == nil {
+		return w.info.Ino == r.Ino, nil
+	}
+	if w.sum == nil || w.info.FileSize != r.FileSize {
+		return false, nil
+	}
+	h := sha256.New()
+	if ra, ok := r.ReadCloser.(io.ReaderAt); ok {
+		if _, err := io.Copy(h, io.NewSectionReader(ra, 0, int64(r.FileSize))); err != nil {
+			return false, fmt.Errorf("%s: %v", r.Name, err)
+		}
+		return bytes.Equal(h.Sum(nil), w.sum), nil
+	}
+	b, err := ioutil.ReadAll(r.ReadCloser)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", r.Name, err)
+	}
+	if err := r.Close(); err != nil {
+		return false, fmt.Errorf("%s: %v", r.Name, err)
+	}
+	r.ReadCloser = cpio.NewBytesReadCloser(b)
+	h.Write(b)
+	return bytes.Equal(h.Sum(nil), w.sum), nil
+}
+
+// RecordInfo is what an Initramfs keeps of a record it wrote.
+type RecordInfo struct {
+	// Name is the name of the record, relative to the root.
+	Name string
+	Mode uint64
+	// Size is the size of the contents.
+	Size uint64
+	// SHA256 is the hash of the contents, or nil if there were none, or
+	// they were not all read.
+	SHA256 []byte
+	// Source is the name of the Source the record came from.
+	Source string
+}
+
+// Names returns the names of the records written, directories made for
+// them included, in the order they were first written.
+func (i *Initramfs) Names() []string {
+	return append([]string(nil), i.names...)
+}
+
+// Records returns what i keeps of the records written, in the order of
+// Names. Of a name written more than once, it is of the last record.
+func (i *Initramfs) Records() []RecordInfo {
+	recs := make([]RecordInfo, len(i.names))
+	for n, name := range i.names {
+		w := i.files[name]
+		recs[n] = RecordInfo{Name: name, Mode: w.info.Mode, Size: w.info.FileSize, SHA256: append([]byte(nil), w.sum...), Source: w.source.Name}
+	}
+	return recs
+}
+
+// Has returns whether a record of name was written to i.
+func (i *Initramfs) Has(name string) bool {
+	_, ok := i.files[strings.TrimLeft(filepath.Clean(name), "/")]
+	return ok
+}
+
+// Deduplicated returns the number of records skipped as identical to
+// records already written, and the size of their contents.
+func (i *Initramfs) Deduplicated() (int, uint64) {
+	return i.dups, i.dupBytes
+}
 
-	// Create record for parent directory if needed.
-	dir := filepath.Dir(r.Name)
-	if _, ok := i.files[dir]; dir != "/" && dir != "." && !ok {
-		if err := i.WriteRecord(cpio.Record{
-			Info: cpio.Info{
-				Name: dir,
-				Mode: syscall.S_IFDIR | 0755,
-			},
-		}); err != nil {
+// WriteRecords writes recs as they are, without the directories they are
+// in, but with the same handling of names written before as WriteRecord.
+func (i *Initramfs) WriteRecords(recs []cpio.Record) error {
+	for _, r := range recs {
+		if err := i.write(r); err == ErrClosed {
 			return err
+		} else if err != nil {
+			return fmt.Errorf("WriteRecords: writing %q got %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+// Concat writes the records of r, transformed by transform if it is not
+// nil, like WriteRecords, leaving out those it leaves out. They are given
+// new inode numbers first, so that the hard links among them, which the
+// transform may rename, stay links to each other and not to files written
+// from elsewhere.
+func (i *Initramfs) Concat(r cpio.Reader, transform cpio.RecordFunc) error {
+	return i.ConcatWithPolicy(r, transform, ConflictSource)
+}
+
+// ConcatWithPolicy is Concat with the records of names written before or
+// after them handled as policy says, for the rest of the Initramfs.
+func (i *Initramfs) ConcatWithPolicy(r cpio.Reader, transform cpio.RecordFunc, policy ConflictPolicy) error {
+	defer i.SetSource(i.source)
+	switch policy {
+	case ConflictError:
+		i.source.Exclusive = true
+	case ConflictSkip:
+		i.source.Default = true
+	case ConflictOverwrite:
+		i.source.Override, i.source.Replace = true, true
+	}
+
+	inodes := make(map[cpio.Info]uint64)
+	renumber := func(rec cpio.Record) cpio.Record {
+		k := cpio.Info{Ino: rec.Ino, Major: rec.Major, Minor: rec.Minor}
+		ino, ok := inodes[k]
+		if !ok {
+			ino = cpio.NewInode()
+			inodes[k] = ino
 		}
+		rec.Ino = ino
+		return rec
+	}
+	return cpio.Copy(writeFunc(i.write), r, cpio.Chain(renumber, transform))
+}
+
+// Conflicts returns an error listing the names written more than once and
+// where each record came from, if the Policy is DedupError.
+func (i *Initramfs) Conflicts() error {
+	if len(i.conflicts) == 0 {
+		return nil
+	}
+	var names []string
+	for n := range i.conflicts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var c []string
+	for _, n := range names {
+		c = append(c, fmt.Sprintf("%s (from %s)", n, strings.Join(i.conflicts[n], ", ")))
 	}
+	return fmt.Errorf("records written more than once: %s", strings.Join(c, "; "))
+}
 
-	i.files[r.Name] = struct{}{}
-	return i.Writer.WriteRecord(r)
+// WriteTrailer is Close, for an Initramfs that was not closed. It returns
+// ErrClosed for one that was.
+func (i *Initramfs) WriteTrailer() error {
+	if i.closed {
+		return ErrClosed
+	}
+	return i.Close()
+}
+
+// Close writes the records a staged Initramfs holds and the trailer,
+// unless there were conflicts, and removes the spool. After it, writes
+// return ErrClosed. Only the first call does this; the others return what
+// it returned, so that a deferred Close can back up the one that is
+// checked.
+func (i *Initramfs) Close() error {
+	if i.closed {
+		return i.closeErr
+	}
+	i.closed = true
+	i.closeErr = i.finish()
+	return i.closeErr
+}
+
+// finish is what Close does.
+func (i *Initramfs) finish() error {
+	if i.stage != nil {
+		defer i.stage.close()
+	}
+	if err := i.Conflicts(); err != nil {
+		return err
+	}
+	if i.stage != nil {
+		if err := i.stage.flush(i.Writer.WriteDuplicate); err != nil {
+			return err
+		}
+	}
+	if err := i.Writer.WriteTrailer(); err != nil {
+		return err
+	}
+	if i.stage != nil {
+		return i.stage.close()
+	}
+	return nil
 }
 
 func (i *Initramfs) WriteFile(src string, dest string) error {
-	record, err := cpio.GetRecord(src)
+	return i.writeFile(src, "", func(rel string) (string, bool) {
+		return filepath.Join(dest, rel), false
+	}, nil, &walk{})
+}
+
+// WriteDir writes what is in the directory root, as WriteFile does, under
+// prefix, leaving out the files for which skip returns true, and, for a
+// directory, everything in it. Skip is given the path of each file
+// relative to root, and its os.FileInfo, which is of the file itself, not
+// of what it links to.
+func (i *Initramfs) WriteDir(root, prefix string, skip func(path string, info os.FileInfo) bool) error {
+	return i.writeFile(root, "", func(rel string) (string, bool) {
+		return filepath.Join(prefix, rel), false
+	}, skip, &walk{})
+}
+
+// writeFile writes the file rel below root, or what is in it, if it is a
+// directory, to where dst says, leaving out what dst or skip, if it is not
+// nil, say to, as part of the walk w.
+func (i *Initramfs) writeFile(root, rel string, dst func(rel string) (string, bool), skip func(string, os.FileInfo) bool, w *walk) error {
+	dest, drop := dst(rel)
+	if drop {
+		return nil
+	}
+	src := filepath.Join(root, rel)
+	if skip != nil && rel != "" {
+		fi, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		if skip(rel, fi) {
+			return nil
+		}
+	}
+	from := src
+	if i.FollowSymlinks {
+		var err error
+		if from, err = follow(src); err != nil {
+			return err
+		}
+	}
+	record, err := cpio.NewRecordFromPath(from, dest)
+	if _, ok := err.(*cpio.SkipError); ok {
+		Debug("%v", err)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
 	if record.Info.Mode&^0777 == syscall.S_IFDIR {
+		if i.FollowSymlinks {
+			fi, err := os.Stat(from)
+			if err != nil {
+				return err
+			}
+			id := idOf(fi)
+			if w.dirs == nil {
+				w.dirs = make(map[fileID]bool)
+			}
+			if w.dirs[id] {
+				return fmt.Errorf("%s: a symlink loop leads back to %s", src, from)
+			}
+			w.dirs[id] = true
+			defer delete(w.dirs, id)
+		}
 		return children(src, func(name string) error {
-			return i.WriteFile(filepath.Join(src, name), filepath.Join(dest, name))
+			return i.writeFile(root, filepath.Join(rel, name), dst, skip, w)
 		})
-	} else {
-		// Fix the name.
-		record.Name = dest
-		return i.WriteRecord(cpio.MakeReproducible(record))
 	}
+	if record.Mode&syscall.S_IFMT == syscall.S_IFREG && record.NLink > 1 {
+		if err := w.link(from, &record); err != nil {
+			return err
+		}
+	}
+	return i.WriteRecord(record)
+}
+
+// walk is what writeFile keeps of one walk of the files on disk, by the
+// device and inode numbers of the files. They are kept for the walk only,
+// since an inode number can be given to another file once one is deleted.
+type walk struct {
+	// dirs are the directories the file written is in, with
+	// FollowSymlinks, which it must not lead back to.
+	dirs map[fileID]bool
+	// links are the files of more than one link written, by the name
+	// they were first written under.
+	links map[fileID]hardLink
+}
+
+// hardLink is a file of more than one link that a walk wrote.
+type hardLink struct {
+	name string
+	ino  uint64
+}
+
+// link gives r, of the file path, which has more than one link, an inode
+// number of its own, or that of the links to the same file written in the
+// walk before it. The cpio.Writer writes the contents of the first, and
+// the rest as links to it.
+func (w *walk) link(path string, r *cpio.Record) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	id := idOf(fi)
+	if l, ok := w.links[id]; ok {
+		Debug("%s is a hard link to %s; writing it as one", r.Name, l.name)
+		r.Ino = l.ino
+		return nil
+	}
+	if w.links == nil {
+		w.links = make(map[fileID]hardLink)
+	}
+	r.Ino = cpio.NewInode()
+	w.links[id] = hardLink{name: r.Name, ino: r.Ino}
+	return nil
+}
+
+// fileID is the device and inode numbers of a file.
+type fileID struct {
+	dev, ino uint64
+}
+
+func idOf(fi os.FileInfo) fileID {
+	st := fi.Sys().(*syscall.Stat_t)
+	return fileID{uint64(st.Dev), uint64(st.Ino)}
+}
+
+// maxSymlinks is how many symlinks follow follows from one path, as Linux
+// does.
+const maxSymlinks = 40
+
+// follow returns the path of what the symlink path, if it is one, leads
+// to, through any symlinks on the way, or path itself if the last one
+// leads to nothing.
+func follow(path string) (string, error) {
+	p := path
+	for n := 0; ; n++ {
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) && p != path {
+			Debug("%s: a symlink to nothing; writing it as it is", path)
+			return path, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return p, nil
+		}
+		if n == maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		p = target
+	}
+}
+
+// Below reports whether name is a relative path naming something below the
+// directory it is relative to. An empty name, ".", and "/" all name the
+// directory itself, so that copying them would copy all of it.
+func Below(name string) bool {
+	c := filepath.Clean(name)
+	return name != "" && c != "." && !filepath.IsAbs(c) && c != ".." && !strings.HasPrefix(c, "../")
 }
 
 func children(dir string, fn func(name string) error) error {
@@ -116,6 +863,8 @@ func children(dir string, fn func(name string) error) error {
 	if err != nil {
 		return err
 	}
+	// Directory order differs between file systems and runs.
+	sort.Strings(names)
 
 	for _, name := range names {
 		if err := fn(name); os.IsNotExist(err) {
@@ -129,11 +878,30 @@ func children(dir string, fn func(name string) error) error {
 }
 
 // Copy all files relative to `srcDir` to `destDir` in the cpio archive.
+// They are written sorted, whatever the order of files, so that the same
+// files always make the same archive; their directories come first. Each
+// must be a path below srcDir, or nothing is written.
 func (i *Initramfs) WriteFiles(srcDir string, destDir string, files []string) error {
+	return i.WriteFilesFunc(srcDir, files, func(rel string) (string, bool) {
+		return filepath.Join(destDir, rel), false
+	})
+}
+
+// WriteFilesFunc is WriteFiles with each file, and each file in those that
+// are directories, written where dst says, given its path relative to
+// srcDir, or left out, with what is in it, if dst says to skip it. The
+// directories the files are in are made where the files are written.
+func (i *Initramfs) WriteFilesFunc(srcDir string, files []string, dst func(rel string) (dest string, skip bool)) error {
+	for _, file := range files {
+		if !Below(file) {
+			return fmt.Errorf("WriteFiles: %q is not a path below %s", file, srcDir)
+		}
+	}
+	files = append([]string(nil), files...)
+	sort.Strings(files)
+	w := &walk{}
 	for _, file := range files {
-		srcPath := filepath.Join(srcDir, file)
-		destPath := filepath.Join(destDir, file)
-		if err := i.WriteFile(srcPath, destPath); err != nil {
+		if err := i.writeFile(srcDir, filepath.Clean(file), dst, nil, w); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,1398 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestDedup(t *testing.T) {
+	file := func(name, contents string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(contents), cpio.Info{Name: name, Mode: syscall.S_IFREG | 0644})
+	}
+	dir := func(name string) cpio.Record {
+		return cpio.Record{Info: cpio.Info{Name: name, Mode: syscall.S_IFDIR | 0755}}
+	}
+
+	for _, tt := range []struct {
+		policy DedupPolicy
+		want   []string
+		err    string
+	}{
+		{DedupFirst, []string{"etc", "etc/motd a", "bin", "etc/passwd files", "etc/hosts", "bin/sh"}, ""},
+		{DedupLast, []string{"etc", "etc/motd a", "bin", "etc/passwd files", "etc/hosts", "etc/motd b", "bin", "bin/sh"}, ""},
+		{DedupError, nil, "bin (from a, b); etc/motd (from a, b)"},
+	} {
+		archiver, err := cpio.Format("newc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		i, err := NewInitramfsRecords(archiver.Writer(&b), []cpio.Record{dir("etc")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		i.Policy = tt.policy
+
+		for _, w := range []struct {
+			source Source
+			recs   []cpio.Record
+		}{
+			{Source{Name: "a"}, []cpio.Record{dir("etc"), file("etc/motd", "a"), file("bin", "")}},
+			{Source{Name: "files", Override: true}, []cpio.Record{file("etc/passwd", "files")}},
+			{Source{Name: "skeleton", Default: true}, []cpio.Record{file("etc/passwd", "skeleton"), file("etc/hosts", "")}},
+			// bin/sh needs bin to be a directory.
+			{Source{Name: "b"}, []cpio.Record{file("etc/motd", "b"), file("bin/sh", ""), file("etc/passwd", "b")}},
+		} {
+			i.SetSource(w.source)
+			for _, r := range w.recs {
+				if err := i.WriteRecord(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		err = i.WriteTrailer()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v: WriteTrailer: got %v, want an error with %q", tt.policy, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: WriteTrailer: %v", tt.policy, err)
+		}
+
+		recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range recs {
+			s := r.Name
+			if r.FileSize > 0 {
+				c := make([]byte, r.FileSize)
+				if _, err := r.Read(c); err != nil {
+					t.Fatal(err)
+				}
+				s += " " + string(c)
+			}
+			got = append(got, s)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %q, want %q", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestWriteFilesOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []string{"src/b/y.go", "src/a-b/x.go", "src/a/sub/z.go", "src/a/x.go", "go/src/os/file.go"}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// It is the names, in order, that are compared.
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names [2][]string
+	for n, order := range [][]string{files, {files[4], files[3], files[1], files[2], files[0]}} {
+		var b bytes.Buffer
+		i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := i.WriteFiles(dir, "", order); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+		recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := map[string]bool{".": true}
+		for _, r := range recs {
+			if !seen[filepath.Dir(r.Name)] {
+				t.Errorf("%s comes before its directory", r.Name)
+			}
+			seen[r.Name] = true
+			names[n] = append(names[n], r.Name)
+		}
+	}
+	want := []string{
+		"go", "go/src", "go/src/os", "go/src/os/file.go",
+		"src", "src/a-b", "src/a-b/x.go", "src/a", "src/a/sub", "src/a/sub/z.go", "src/a/x.go", "src/b", "src/b/y.go",
+	}
+	for _, got := range names {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("WriteFiles: got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestWriteFilesFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"src/a/x.go", "src/a/sub/y.go", "src/b/z.go", "vendor/v/w.go"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// src goes to go/src, but for src/b, and vendor/v to src/v.
+	dst := func(rel string) (string, bool) {
+		switch {
+		case rel == "src/b":
+			return "", true
+		case strings.HasPrefix(rel, "vendor/"):
+			return filepath.Join("src", strings.TrimPrefix(rel, "vendor/")), false
+		}
+		return filepath.Join("go", rel), false
+	}
+	if err := i.WriteFilesFunc(dir, []string{"vendor/v", "src"}, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteFilesFunc(dir, []string{"../x"}, dst); err == nil {
+		t.Errorf("WriteFilesFunc of ../x: got nil, want an error")
+	}
+	if err := i.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range recs {
+		s := r.Name
+		if r.FileSize > 0 {
+			c, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s += " " + string(c)
+		}
+		got = append(got, s)
+	}
+	want := []string{
+		"go", "go/src", "go/src/a", "go/src/a/sub", "go/src/a/sub/y.go src/a/sub/y.go", "go/src/a/x.go src/a/x.go",
+		"src", "src/v", "src/v/w.go vendor/v/w.go",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWriteDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"a/x", "a/.git/config", "a/.git/objects/1", "b/skip.tmp", "b/keep"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a/x", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(dir, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []string
+	skip := func(path string, info os.FileInfo) bool {
+		seen = append(seen, path)
+		return info.IsDir() && info.Name() == ".git" || strings.HasSuffix(path, ".tmp")
+	}
+	if err := i.WriteDir(dir, "p", skip); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing in a directory skipped is looked at.
+	if want := []string{"a", "a/.git", "a/x", "b", "b/keep", "b/skip.tmp", "fifo", "link"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("skip was called with %q, want %q", seen, want)
+	}
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range recs {
+		got = append(got, cpio.FormatLong(r))
+	}
+	want := []string{
+		"drwxr-xr-x 0 0 0 1970-01-01 p",
+		"drwxr-xr-x 0 0 0 1970-01-01 p/a",
+		"-rw-r--r-- 0 0 3 1970-01-01 p/a/x",
+		"drwxr-xr-x 0 0 0 1970-01-01 p/b",
+		"-rw-r--r-- 0 0 6 1970-01-01 p/b/keep",
+		"prw------- 0 0 0 1970-01-01 p/fifo",
+		"lrwxrwxrwx 0 0 3 1970-01-01 p/link -> a/x",
+	}
+	for n, r := range recs {
+		if r.UID != 0 || r.GID != 0 {
+			// The owner is whoever runs the test.
+			got[n] = strings.Replace(got[n], fmt.Sprintf(" %d %d ", r.UID, r.GID), " 0 0 ", 1)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for f, contents := range map[string]string{
+		"usr/lib/go/VERSION":          "go1",
+		"usr/lib/go/src/fmt/print.go": "package fmt",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, l := range []struct{ target, name string }{
+		{filepath.Join(dir, "usr/lib/go/VERSION"), "goroot/VERSION"},
+		{"../usr/lib/go/src", "goroot/src"},
+		{"go2", "goroot/bin/go"},
+		{"../VERSION", "goroot/bin/go2"},
+		{"nowhere", "goroot/dangling"},
+		{".", "loop/dot"},
+		{"self", "self/self"},
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(l.name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(l.target, filepath.Join(dir, l.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(root string, follow bool) ([]cpio.Record, error) {
+		var b bytes.Buffer
+		i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i.FollowSymlinks = follow
+		if err := i.WriteDir(filepath.Join(dir, root), "go", nil); err != nil {
+			return nil, err
+		}
+		if err := i.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+		return archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	}
+
+	recs, err := write("goroot", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range recs {
+		l := cpio.FormatLong(r)
+		if r.UID != 0 || r.GID != 0 {
+			// The owner is whoever runs the test.
+			l = strings.Replace(l, fmt.Sprintf(" %d %d ", r.UID, r.GID), " 0 0 ", 1)
+		}
+		got = append(got, l)
+	}
+	want := []string{
+		"drwxr-xr-x 0 0 0 1970-01-01 go",
+		"-rw-r--r-- 0 0 3 1970-01-01 go/VERSION",
+		"drwxr-xr-x 0 0 0 1970-01-01 go/bin",
+		"-rw-r--r-- 0 0 3 1970-01-01 go/bin/go",
+		"-rw-r--r-- 0 0 3 1970-01-01 go/bin/go2",
+		"lrwxrwxrwx 0 0 7 1970-01-01 go/dangling -> nowhere",
+		"drwxr-xr-x 0 0 0 1970-01-01 go/src",
+		"drwxr-xr-x 0 0 0 1970-01-01 go/src/fmt",
+		"-rw-r--r-- 0 0 11 1970-01-01 go/src/fmt/print.go",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// By default, symlinks are written as they are.
+	recs, err = write("goroot", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var links []string
+	for _, r := range recs {
+		if r.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+			links = append(links, r.Name)
+		}
+	}
+	if want := []string{"go/VERSION", "go/bin/go", "go/bin/go2", "go/dangling", "go/src"}; !reflect.DeepEqual(links, want) {
+		t.Errorf("without FollowSymlinks: got symlinks %q, want %q", links, want)
+	}
+
+	for _, tt := range []struct {
+		root, err string
+	}{
+		{"loop", "a symlink loop"},
+		{"self", "too many levels of symbolic links"},
+	} {
+		if _, err := write(tt.root, true); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want an error with %q", tt.root, err, tt.err)
+		}
+	}
+}
+
+func TestWriteFilesLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("shared"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "a"), filepath.Join(src, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "c"), []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(d func(string, ...interface{})) { Debug = d }(Debug)
+	var logs []string
+	Debug = func(format string, v ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, v...))
+	}
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteDir(src, "p", nil); err != nil {
+		t.Fatal(err)
+	}
+	// Links in walks of their own are written as files of their own,
+	// as they would be if one were deleted and its inode number reused.
+	if err := i.WriteFile(filepath.Join(src, "a"), "one/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteFile(filepath.Join(src, "b"), "two/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"p/b is a hard link to p/a; writing it as one"}; !reflect.DeepEqual(logs, want) {
+		t.Errorf("Debug: got %q, want %q", logs, want)
+	}
+
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]uint64)
+	for _, r := range recs {
+		m[r.Name] = r.Ino
+	}
+	if m["p/b"] != m["p/a"] {
+		t.Errorf("p/b: got inode %d, want that of p/a, %d", m["p/b"], m["p/a"])
+	}
+	if m["one/a"] == m["p/a"] || m["two/b"] == m["one/a"] {
+		t.Errorf("links written in different walks share an inode number: %v", m)
+	}
+	// The contents of p/a and p/b are written once.
+	if n := bytes.Count(b.Bytes(), []byte("shared")); n != 3 {
+		t.Errorf("the contents are in the archive %d times, want 3", n)
+	}
+
+	// Extracted, p/b is a link to p/a, with its contents.
+	root := filepath.Join(dir, "root")
+	if err := cpio.Extract(archiver.Reader(bytes.NewReader(b.Bytes())), root); err != nil {
+		t.Fatal(err)
+	}
+	fa, err := os.Stat(filepath.Join(root, "p/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := os.Stat(filepath.Join(root, "p/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fa, fb) {
+		t.Errorf("p/a and p/b are not the same file")
+	}
+	if c, err := ioutil.ReadFile(filepath.Join(root, "p/b")); err != nil || string(c) != "shared" {
+		t.Errorf("p/b: got %q, %v, want shared", c, err)
+	}
+}
+
+func TestParents(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		noParents bool
+		want      []string
+	}{
+		{false, []string{"etc", "usr", "usr/bin", "usr/bin/foo", "etc/motd"}},
+		// Without them, usr is written only when it comes.
+		{true, []string{"etc", "usr/bin/foo", "usr", "etc/motd"}},
+	} {
+		var b bytes.Buffer
+		i, err := NewInitramfsRecords(archiver.Writer(&b), []cpio.Record{{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		i.NoParents = tt.noParents
+		for _, r := range []cpio.Record{
+			cpio.NewRecordFromBytes([]byte("foo"), cpio.Info{Name: "usr/bin/foo", Mode: syscall.S_IFREG | 0755}),
+			// Made for usr/bin/foo already, it is left out.
+			{Info: cpio.Info{Name: "usr", Mode: syscall.S_IFDIR | 0700}},
+			cpio.NewRecordFromBytes([]byte("hello"), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644}),
+		} {
+			if err := i.WriteRecord(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := i.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+		recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, r := range recs {
+			names = append(names, r.Name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("NoParents %v: got %q, want %q", tt.noParents, names, tt.want)
+		}
+		if got := i.Synthesized("usr/bin"); got == tt.noParents {
+			t.Errorf("NoParents %v: Synthesized(usr/bin): got %v", tt.noParents, got)
+		}
+		if i.Synthesized("etc") {
+			t.Errorf("NoParents %v: Synthesized(etc): got true, want false", tt.noParents)
+		}
+	}
+}
+
+func TestWriteFilesBelow(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The directory does not exist, so walking it would fail otherwise.
+	for _, f := range []string{"", ".", "/", "/etc/passwd", "..", "../x", "a/../../x"} {
+		var b bytes.Buffer
+		i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := i.WriteFiles("/nonexistent", "", []string{"a", f}); err == nil || !strings.Contains(err.Error(), "not a path below") {
+			t.Errorf("WriteFiles(%q): got %v, want it rejected", f, err)
+		}
+		if b.Len() != 0 {
+			t.Errorf("WriteFiles(%q): wrote %d bytes before failing", f, b.Len())
+		}
+	}
+	for _, f := range []string{"a", "a/b", "a/../b", "./a", "..a"} {
+		if !Below(f) {
+			t.Errorf("Below(%q) = false, want true", f)
+		}
+	}
+}
+
+func TestIdentical(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "x.go"), []byte("package x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.Policy = DedupError
+	motd := func(contents string, mode uint64) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(contents), cpio.Info{Name: "etc/motd", Mode: mode})
+	}
+	for _, w := range []struct {
+		source string
+		write  func() error
+	}{
+		{"a", func() error { return i.WriteRecord(motd("hello", syscall.S_IFREG|0644)) }},
+		{"a", func() error { return i.WriteFiles(dir, "src", []string{"x.go"}) }},
+		{"b", func() error { return i.WriteRecord(motd("hello", syscall.S_IFREG|0644)) }},
+		{"b", func() error { return i.WriteFiles(dir, "src", []string{"x.go"}) }},
+	} {
+		i.SetSource(Source{Name: w.source})
+		if err := w.write(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, size := i.Deduplicated(); n != 2 || size != 15 {
+		t.Errorf("Deduplicated: got %d records of %d bytes, want 2 of 15", n, size)
+	}
+	if err := i.Conflicts(); err != nil {
+		t.Errorf("Conflicts: got %v, want nil", err)
+	}
+
+	// The same name with other contents, or another mode, still conflicts.
+	i.SetSource(Source{Name: "c"})
+	for _, r := range []cpio.Record{motd("world", syscall.S_IFREG|0644), motd("hello", syscall.S_IFREG|0755)} {
+		if err := i.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := i.Conflicts(); err == nil || !strings.Contains(err.Error(), "etc/motd (from a, c)") {
+		t.Errorf("Conflicts: got %v, want etc/motd from a and c", err)
+	}
+	if n, _ := i.Deduplicated(); n != 2 {
+		t.Errorf("Deduplicated: got %d records, want 2", n)
+	}
+}
+
+func TestConcatLinks(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two archives whose links, with the contents on the last, as GNU
+	// cpio writes them, have the same inode.
+	links := func(a, b, contents string) []byte {
+		info := cpio.Info{Ino: 7, Mode: syscall.S_IFREG | 0644, NLink: 2}
+		first, last := info, info
+		first.Name, last.Name = a, b
+		var buf bytes.Buffer
+		w := archiver.Writer(&buf)
+		if err := w.WriteRecords([]cpio.Record{cpio.NewRecordFromBytes(nil, first), cpio.NewRecordFromBytes([]byte(contents), last)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	var b bytes.Buffer
+	i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rename := func(r cpio.Record) cpio.Record {
+		if r.Name == "a" {
+			r.Name = "renamed"
+		}
+		return r
+	}
+	if err := i.Concat(archiver.Reader(bytes.NewReader(links("a", "b", "one"))), rename); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Concat(archiver.Reader(bytes.NewReader(links("c", "d", "two"))), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, r := range recs {
+		c, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[r.Name] = string(c)
+	}
+	want := map[string]string{"renamed": "one", "b": "one", "c": "two", "d": "two"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Concat: got %q, want %q", got, want)
+	}
+	if n := bytes.Count(b.Bytes(), []byte("one")); n != 1 {
+		t.Errorf("Concat: the contents are in the archive %d times, want once", n)
+	}
+}
+
+func TestConcatWithPolicy(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := func(name, contents string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(contents), cpio.Info{Name: name, Mode: syscall.S_IFREG | 0644})
+	}
+	dir := func(name string) cpio.Record {
+		return cpio.Record{Info: cpio.Info{Name: name, Mode: syscall.S_IFDIR | 0755}}
+	}
+	archive := func(recs ...cpio.Record) []byte {
+		var b bytes.Buffer
+		w := archiver.Writer(&b)
+		if err := w.WriteRecords(recs); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	a := archive(dir("etc"), file("etc/motd", "a"), file("etc/hosts", "a"), dir("bin"), file("bin/sh", "a"))
+	b := archive(dir("etc"), file("etc/motd", "b"), file("etc/passwd", "b"), dir("bin"), file("bin/sh", "a"))
+
+	for _, tt := range []struct {
+		name   string
+		policy ConflictPolicy
+		want   []string
+		err    string
+	}{
+		{"source", ConflictSource, []string{"etc", "etc/motd a", "etc/hosts a", "bin", "bin/sh a", "etc/motd b", "etc/passwd b", "etc/passwd later"}, ""},
+		{"skip", ConflictSkip, []string{"etc", "etc/motd a", "etc/hosts a", "bin", "bin/sh a", "etc/passwd b", "etc/passwd later"}, ""},
+		// The later etc/passwd is left out.
+		{"overwrite", ConflictOverwrite, []string{"etc", "etc/motd a", "etc/hosts a", "bin", "bin/sh a", "etc/motd b", "etc/passwd b", "bin/sh a"}, ""},
+		{"error", ConflictError, nil, "etc/motd from b is also from a"},
+	} {
+		var out bytes.Buffer
+		i, err := NewInitramfsRecords(archiver.Writer(&out), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Later records of a name are written too, unless the policy
+		// says otherwise.
+		i.Policy = DedupLast
+		i.SetSource(Source{Name: "a"})
+		if err := i.Concat(archiver.Reader(bytes.NewReader(a)), nil); err != nil {
+			t.Fatal(err)
+		}
+		i.SetSource(Source{Name: "b"})
+		err = i.ConcatWithPolicy(archiver.Reader(bytes.NewReader(b)), nil, tt.policy)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got %v, want an error with %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		i.SetSource(Source{Name: "later"})
+		if err := i.WriteRecord(file("etc/passwd", "later")); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+
+		recs, err := archiver.Reader(bytes.NewReader(out.Bytes())).ReadRecords()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range recs {
+			s := r.Name
+			if r.FileSize > 0 {
+				c, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s += " " + string(c)
+			}
+			got = append(got, s)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// The names of an archive with ConflictError can not be written
+	// after it either, unless the records are identical.
+	var out bytes.Buffer
+	i, err := NewInitramfsRecords(archiver.Writer(&out), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.SetSource(Source{Name: "a"})
+	if err := i.ConcatWithPolicy(archiver.Reader(bytes.NewReader(a)), nil, ConflictError); err != nil {
+		t.Fatal(err)
+	}
+	i.SetSource(Source{Name: "later"})
+	if err := i.WriteRecord(file("bin/sh", "a")); err != nil {
+		t.Errorf("identical bin/sh: %v", err)
+	}
+	if err := i.WriteRecord(file("etc/motd", "later")); err == nil || !strings.Contains(err.Error(), "etc/motd from later is also from a") {
+		t.Errorf("etc/motd after ConflictError: got %v, want an error", err)
+	}
+}
+
+func TestWriteRecord(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []struct {
+		source Source
+		r      cpio.Record
+	}{
+		{Source{Name: "generated"}, cpio.NewRecordFromBytes([]byte("ID=u-root\n"), cpio.Info{Name: "etc/os-release", Mode: syscall.S_IFREG | 0644, MTime: 12345})},
+		{Source{Name: "generated"}, cpio.Record{Info: cpio.Info{Name: "var/run", Mode: syscall.S_IFDIR | 0755}}},
+		{Source{Name: "generated"}, cpio.Symlink("bin/sh", "../bbin/bb")},
+		{Source{Name: "generated"}, cpio.CharDev("dev/ttyS0", 0620, 4, 64)},
+		// Left out as a conflict, or written as a replacement.
+		{Source{Name: "again"}, cpio.Symlink("bin/sh", "elvish")},
+		{Source{Name: "links", Replace: true}, cpio.Symlink("bin/sh", "rush")},
+	} {
+		i.SetSource(w.source)
+		if err := i.WriteRecord(w.r); err != nil {
+			t.Fatalf("%s: %v", w.r.Name, err)
+		}
+	}
+	if err := i.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteRecord(cpio.Symlink("late", "x")); err == nil {
+		t.Errorf("WriteRecord after the trailer: got nil, want an error")
+	}
+	if err := i.WriteTrailer(); err == nil {
+		t.Errorf("WriteTrailer twice: got nil, want an error")
+	}
+
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range recs {
+		if r.MTime != cpio.SourceDateEpoch() {
+			t.Errorf("%s: mtime is %d, want %d", r.Name, r.MTime, cpio.SourceDateEpoch())
+		}
+		s := r.Name
+		if r.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+			target, err := r.Linkname()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s += " -> " + target
+		}
+		got = append(got, s)
+	}
+	want := []string{"etc", "etc/os-release", "var", "var/run", "bin", "bin/sh -> ../bbin/bb", "dev", "dev/ttyS0", "bin/sh -> rush"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNoEpoch(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The transform sets the mtime of all but etc/keep, which
+	// WriteRecord leaves as it is with NoEpoch.
+	epoch := int64(42)
+	n := cpio.Normalizer{Epoch: &epoch, Except: func(r cpio.Record) bool { return r.Name == "etc/keep" }}
+	var b bytes.Buffer
+	i, err := NewInitramfsOptions(archiver.Writer(&b), Options{
+		Records:   []cpio.Record{{Info: cpio.Info{Name: "dev", Mode: syscall.S_IFDIR | 0755, MTime: 7}}},
+		Transform: n.Transform(),
+		NoEpoch:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []cpio.Record{
+		cpio.NewRecordFromBytes([]byte("keep"), cpio.Info{Name: "etc/keep", Mode: syscall.S_IFREG | 0644, MTime: 1234567, Major: 8, Minor: 1}),
+		cpio.NewRecordFromBytes([]byte("set"), cpio.Info{Name: "etc/set", Mode: syscall.S_IFREG | 0644, MTime: 1234567, Major: 8, Minor: 1}),
+	} {
+		if err := i.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := i.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]uint64)
+	for _, r := range recs {
+		got[r.Name] = r.MTime
+		if r.Major != 0 || r.Minor != 0 {
+			t.Errorf("%s: device is %d:%d, want 0:0", r.Name, r.Major, r.Minor)
+		}
+	}
+	want := map[string]uint64{"dev": 42, "etc": 42, "etc/keep": 1234567, "etc/set": 42}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mtimes: got %v, want %v", got, want)
+	}
+}
+
+func TestNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"motd", "a/b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lib bytes.Buffer
+	w := archiver.Writer(&lib)
+	if err := w.WriteRecords([]cpio.Record{
+		{Info: cpio.Info{Name: "lib", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("c"), cpio.Info{Name: "lib/c", Mode: syscall.S_IFREG | 0644}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	i, err := NewInitramfsRecords(archiver.Writer(&b), []cpio.Record{{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.SetSource(Source{Name: "record"})
+	if err := i.WriteRecord(cpio.Symlink("usr/bin/sh", "rush")); err != nil {
+		t.Fatal(err)
+	}
+	i.SetSource(Source{Name: "file"})
+	if err := i.WriteFile(filepath.Join(dir, "motd"), "etc/motd"); err != nil {
+		t.Fatal(err)
+	}
+	i.SetSource(Source{Name: "files"})
+	if err := i.WriteFiles(dir, "d", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	i.SetSource(Source{Name: "concat"})
+	if err := i.Concat(archiver.Reader(bytes.NewReader(lib.Bytes())), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Written again, it is not named again.
+	i.SetSource(Source{Name: "again"})
+	if err := i.WriteFile(filepath.Join(dir, "motd"), "etc/motd"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"etc", "usr", "usr/bin", "usr/bin/sh", "etc/motd", "d", "d/a", "d/a/b", "lib", "lib/c"}
+	if got := i.Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Names: got %q, want %q", got, want)
+	}
+	recs := i.Records()
+	if len(recs) != len(want) {
+		t.Fatalf("Records: got %d, want %d", len(recs), len(want))
+	}
+	sum := sha256.Sum256([]byte("motd"))
+	for n, tt := range []RecordInfo{
+		{"etc", syscall.S_IFDIR | 0755, 0, nil, "ramfs"},
+		{"usr", syscall.S_IFDIR | 0755, 0, nil, "record"},
+		{"usr/bin", syscall.S_IFDIR | 0755, 0, nil, "record"},
+		{"usr/bin/sh", syscall.S_IFLNK | 0777, 4, recs[3].SHA256, "record"},
+		{"etc/motd", syscall.S_IFREG | 0644, 4, sum[:], "file"},
+	} {
+		if !reflect.DeepEqual(recs[n], tt) {
+			t.Errorf("Records()[%d]: got %+v, want %+v", n, recs[n], tt)
+		}
+	}
+	if recs[3].SHA256 == nil {
+		t.Errorf("usr/bin/sh has no SHA256")
+	}
+	if recs[9].Source != "concat" || recs[9].Size != 1 {
+		t.Errorf("lib/c: got %+v, from concat with 1 byte", recs[9])
+	}
+}
+
+func TestSymlinkDevices(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", ".", "/dev/x", "../x", "dev/../../x", "dev/../x"} {
+		if err := i.Symlink("x", name); err == nil {
+			t.Errorf("Symlink at %q: got nil, want an error", name)
+		}
+		if err := i.CharDev(name, 0600, 1, 3); err == nil {
+			t.Errorf("CharDev %q: got nil, want an error", name)
+		}
+		if err := i.BlockDev(name, 0600, 8, 0); err == nil {
+			t.Errorf("BlockDev %q: got nil, want an error", name)
+		}
+	}
+
+	// They are written as any record, once.
+	i.Policy = DedupError
+	i.SetSource(Source{Name: "a"})
+	if err := i.CharDev("dev/null", 0666, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Symlink("/proc/self/fd", "dev/fd"); err != nil {
+		t.Fatal(err)
+	}
+	i.SetSource(Source{Name: "b"})
+	if err := i.CharDev("dev/null", 0666, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.BlockDev("dev/fd", 0600, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteTrailer(); err == nil || !strings.Contains(err.Error(), "dev/fd (from a, b)") || strings.Contains(err.Error(), "dev/null") {
+		t.Errorf("WriteTrailer: got %v, want a conflict of dev/fd only", err)
+	}
+}
+
+func TestDedupRefuse(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	file := func(name, contents string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(contents), cpio.Info{Name: name, Mode: syscall.S_IFREG | 0644})
+	}
+
+	// Each writes etc/motd, with its name in it, through an entry point
+	// of its own.
+	writers := []struct {
+		name  string
+		write func(i *Initramfs) error
+	}{
+		{"record", func(i *Initramfs) error { return i.WriteRecord(file("etc/motd", "record")) }},
+		{"records", func(i *Initramfs) error { return i.WriteRecords([]cpio.Record{file("etc/motd", "records")}) }},
+		{"file", func(i *Initramfs) error { return i.WriteFile(filepath.Join(root, "file", "etc", "motd"), "etc/motd") }},
+		{"files", func(i *Initramfs) error { return i.WriteFiles(filepath.Join(root, "files"), "", []string{"etc/motd"}) }},
+		{"dir", func(i *Initramfs) error { return i.WriteDir(filepath.Join(root, "dir"), "", nil) }},
+		{"concat", func(i *Initramfs) error {
+			var b bytes.Buffer
+			w := archiver.Writer(&b)
+			if err := w.WriteRecords([]cpio.Record{
+				{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}},
+				file("etc/motd", "concat"),
+			}); err != nil {
+				return err
+			}
+			if err := w.WriteTrailer(); err != nil {
+				return err
+			}
+			return i.Concat(archiver.Reader(bytes.NewReader(b.Bytes())), nil)
+		}},
+	}
+	for _, w := range []string{"file", "files", "dir"} {
+		if err := os.MkdirAll(filepath.Join(root, w, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, w, "etc", "motd"), []byte(w), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, first := range writers {
+		for _, second := range writers {
+			var b bytes.Buffer
+			i, err := NewInitramfsOptions(archiver.Writer(&b), Options{Policy: DedupRefuse})
+			if err != nil {
+				t.Fatal(err)
+			}
+			i.SetSource(Source{Name: first.name})
+			if err := first.write(i); err != nil {
+				t.Fatalf("%s: %v", first.name, err)
+			}
+			i.SetSource(Source{Name: second.name})
+			err = second.write(i)
+			if first.name == second.name {
+				// The same file twice is skipped.
+				if err != nil {
+					t.Errorf("%s twice: got %v, want nil", first.name, err)
+				}
+				continue
+			}
+			want := fmt.Sprintf("etc/motd from %s is also from %s", second.name, first.name)
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("%s after %s: got %v, want an error with %q", second.name, first.name, err, want)
+			}
+		}
+	}
+
+	// Records from a Source with no name are named as well as they can be.
+	var b bytes.Buffer
+	i, err := NewInitramfsOptions(archiver.Writer(&b), Options{Policy: DedupRefuse})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteRecord(file("etc/motd", "a")); err != nil {
+		t.Fatal(err)
+	}
+	i.SetSource(Source{Name: "b"})
+	if err := i.WriteRecord(file("etc/motd", "b")); err == nil || err.Error() != "etc/motd from b was already written" {
+		t.Errorf("after no name: got %v, want etc/motd from b was already written", err)
+	}
+	i.SetSource(Source{})
+	if err := i.WriteRecord(file("etc/motd", "c")); err == nil || err.Error() != "etc/motd was already written" {
+		t.Errorf("no names: got %v, want etc/motd was already written", err)
+	}
+}
+
+func TestDedupWarn(t *testing.T) {
+	defer func(w func(string, ...interface{})) { Warn = w }(Warn)
+	var warnings []string
+	Warn = func(format string, v ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, v...))
+	}
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		o    Options
+		warn []string
+	}{
+		// The default writes what it can, without a word.
+		{Options{}, nil},
+		{Options{Policy: DedupWarn}, []string{"etc/motd from b is also from a; keeping the first"}},
+	} {
+		warnings = nil
+		var b bytes.Buffer
+		i, err := NewInitramfsOptions(archiver.Writer(&b), tt.o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{"a", "b"} {
+			i.SetSource(Source{Name: s})
+			if err := i.WriteRecord(cpio.NewRecordFromBytes([]byte(s), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644})); err != nil {
+				t.Fatalf("%v: %v", tt.o.Policy, err)
+			}
+		}
+		if err := i.WriteTrailer(); err != nil {
+			t.Fatalf("%v: %v", tt.o.Policy, err)
+		}
+		if !reflect.DeepEqual(warnings, tt.warn) {
+			t.Errorf("%v: got warnings %q, want %q", tt.o.Policy, warnings, tt.warn)
+		}
+		if r := i.Records(); len(r) != 2 || r[1].Source != "a" {
+			t.Errorf("%v: got %+v, want etc/motd from a", tt.o.Policy, r)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"secret", "lib/y"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lib bytes.Buffer
+	w := archiver.Writer(&lib)
+	if err := w.WriteRecords([]cpio.Record{
+		cpio.NewRecordFromBytes([]byte("x"), cpio.Info{Name: "lib/x", Mode: syscall.S_IFREG | 0644}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	uid := int64(1000)
+	transform := cpio.Chain(
+		cpio.Rename(map[string]string{"etc/motd": "etc/issue"}),
+		cpio.FilterOut(func(r cpio.Record) bool { return r.Name == "secret" }),
+		cpio.Normalizer{UID: &uid}.Transform(),
+	)
+	var b bytes.Buffer
+	i, err := NewInitramfsOptions(archiver.Writer(&b), Options{
+		Records:   []cpio.Record{{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}}},
+		Policy:    DedupRefuse,
+		Transform: transform,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.SetSource(Source{Name: "record"})
+	if err := i.WriteRecord(cpio.NewRecordFromBytes([]byte("a"), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644})); err != nil {
+		t.Fatal(err)
+	}
+	i.SetSource(Source{Name: "file"})
+	if err := i.WriteFile(filepath.Join(dir, "secret"), "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteFiles(dir, "", []string{"lib"}); err != nil {
+		t.Fatal(err)
+	}
+	// Concat's transform comes first, so that lib/x, renamed to
+	// etc/motd, is then renamed to etc/issue, which was written.
+	i.SetSource(Source{Name: "concat"})
+	err = i.Concat(archiver.Reader(bytes.NewReader(lib.Bytes())), cpio.Rename(map[string]string{"lib/x": "etc/motd"}))
+	if want := "etc/issue from concat is also from record"; err == nil || err.Error() != want {
+		t.Errorf("Concat: got %v, want %q", err, want)
+	}
+	if err := i.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"etc", "etc/issue", "lib", "lib/y"}
+	if got := i.Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Names: got %q, want %q", got, want)
+	}
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range recs {
+		got = append(got, r.Name)
+		if r.UID != 1000 {
+			t.Errorf("%s: uid %d, want 1000", r.Name, r.UID)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestClose(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := func(name, contents string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(contents), cpio.Info{Name: name, Mode: syscall.S_IFREG | 0644})
+	}
+	var b bytes.Buffer
+	i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteRecord(file("etc/motd", "hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Close(); err != nil {
+		t.Errorf("Close twice: got %v, want nil", err)
+	}
+	if err := i.WriteTrailer(); err != ErrClosed {
+		t.Errorf("WriteTrailer after Close: got %v, want ErrClosed", err)
+	}
+
+	// Every way in is closed.
+	for _, tt := range []struct {
+		name  string
+		write func() error
+	}{
+		{"WriteRecord", func() error { return i.WriteRecord(file("etc/hosts", "")) }},
+		{"WriteRecords", func() error { return i.WriteRecords([]cpio.Record{file("etc/hosts", "")}) }},
+		{"WriteFile", func() error { return i.WriteFile("ramfs.go", "ramfs.go") }},
+		{"Symlink", func() error { return i.Symlink("a", "b") }},
+		{"Concat", func() error {
+			return i.Concat(archiver.Reader(bytes.NewReader(b.Bytes())), nil)
+		}},
+	} {
+		if err := tt.write(); err != ErrClosed {
+			t.Errorf("%s after Close: got %v, want ErrClosed", tt.name, err)
+		}
+	}
+	if n := bytes.Count(b.Bytes(), []byte(cpio.Trailer)); n != 1 {
+		t.Errorf("got %d trailers, want 1", n)
+	}
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Errorf("got %d records, want etc and etc/motd", len(recs))
+	}
+
+	// A Close that fails fails again, the same way.
+	b.Reset()
+	if i, err = NewInitramfsRecords(archiver.Writer(&b), nil); err != nil {
+		t.Fatal(err)
+	}
+	i.Policy = DedupError
+	for _, s := range []string{"a", "b"} {
+		i.SetSource(Source{Name: s})
+		if err := i.WriteRecord(file("etc/motd", s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = i.Close()
+	if err == nil {
+		t.Fatal("Close with conflicts: got nil, want an error")
+	}
+	if err2 := i.Close(); err2 != err {
+		t.Errorf("Close twice: got %v, want %v", err2, err)
+	}
+	if err := i.WriteRecord(file("etc/hosts", "")); err != ErrClosed {
+		t.Errorf("WriteRecord after a failed Close: got %v, want ErrClosed", err)
+	}
+}
+
+// BenchmarkWriteFileLarge writes a file of 64 MiB, twice, as a layer and a
+// duplicate of it would. The contents are read from the file as they are
+// written, and compared by reading it again, so the bytes allocated an
+// operation, -benchmem's B/op, do not grow with the size of the file.
+func BenchmarkWriteFileLarge(b *testing.B) {
+	f, err := ioutil.TempFile("", "ramfs-blob")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	const size = 64 << 20
+	chunk := bytes.Repeat([]byte("firmware"), 4096)
+	for n := 0; n < size; n += len(chunk) {
+		if _, err := f.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i, err := NewInitramfsRecords(archiver.Writer(ioutil.Discard), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, s := range []string{"a", "b"} {
+			i.SetSource(Source{Name: s})
+			if err := i.WriteFile(f.Name(), "lib/firmware/blob"); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if n, _ := i.Deduplicated(); n != 1 {
+			b.Fatalf("Deduplicated: got %d records, want 1", n)
+		}
+		if err := i.WriteTrailer(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/u-root/u-root/pkg/compress"
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// Reader reads an initramfs as the kernel does: as archives one after the
+// other, each compressed or not, with zeros between them, as firmware
+// vendors ship a microcode archive ahead of a compressed one.
+//
+// Compressed archives are decompressed into temporary files, which Close
+// removes. A gzip stream ends where gzip says it does; the other
+// compressors are given all that is left. After an archive in a format
+// whose reader is not a cpio.OffsetReader, such as tar, nothing more is
+// read.
+type Reader struct {
+	archiver cpio.Archiver
+	// sources are where the archives are read from, the one being
+	// read last: the initramfs, then what is decompressed of it.
+	sources []*source
+	rr      cpio.RecordReader
+	files   []*os.File
+	// archives is how many archives have been started.
+	archives int
+}
+
+// source is an initramfs, or what is decompressed of one, and where in it
+// the next archive starts.
+type source struct {
+	r   io.ReaderAt
+	pos int64
+}
+
+// NewReader returns a Reader of the records of the initramfs r, whose
+// archives are in the format of a.
+func NewReader(a cpio.Archiver, r io.ReaderAt) *Reader {
+	return &Reader{archiver: a, sources: []*source{{r: r}}}
+}
+
+// ReadRecord returns the next record, or io.EOF after the trailer of the
+// last archive.
+func (r *Reader) ReadRecord() (cpio.Record, error) {
+	for {
+		if r.rr == nil {
+			if err := r.next(); err != nil {
+				return cpio.Record{}, err
+			}
+		}
+		rec, err := r.rr.ReadRecord()
+		if err != nil {
+			return cpio.Record{}, err
+		}
+		if rec.Name != cpio.Trailer {
+			return rec, nil
+		}
+		s := r.sources[len(r.sources)-1]
+		if o, ok := r.rr.(cpio.OffsetReader); ok {
+			s.pos += o.Offset()
+		} else {
+			r.sources = r.sources[:len(r.sources)-1]
+		}
+		r.rr = nil
+	}
+}
+
+// Archive returns which archive, counting from 0, the record ReadRecord
+// last returned is from. Inode numbers are only unique within an archive,
+// so only the links to a file in the same archive are links to it.
+func (r *Reader) Archive() int {
+	return r.archives - 1
+}
+
+// ReadRecords returns the records of all the archives.
+func (r *Reader) ReadRecords() ([]cpio.Record, error) {
+	var recs []cpio.Record
+	for {
+		rec, err := r.ReadRecord()
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// Close closes and removes the temporary files. The contents of the
+// records read can not be read after it.
+func (r *Reader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	r.files = nil
+	return err
+}
+
+// next sets r.rr to read the next archive, decompressing it first if it is
+// compressed, or returns io.EOF if there is none.
+func (r *Reader) next() error {
+	for len(r.sources) > 0 {
+		s := r.sources[len(r.sources)-1]
+		if err := s.skipZeros(); err == io.EOF {
+			r.sources = r.sources[:len(r.sources)-1]
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		rest := io.NewSectionReader(s.r, s.pos, math.MaxInt64-s.pos)
+		name, _, err := compress.Detect(io.NewSectionReader(rest, 0, rest.Size()))
+		if err != nil {
+			return err
+		}
+		if name == "none" {
+			r.rr = r.archiver.RecordFormat.Reader(rest)
+			r.archives++
+			return nil
+		}
+		f, n, err := r.decompress(name, rest)
+		if err != nil {
+			return fmt.Errorf("%s compressed archive at %d: %v", name, s.pos, err)
+		}
+		if n < 0 {
+			r.sources = r.sources[:len(r.sources)-1]
+		} else {
+			s.pos += n
+		}
+		r.sources = append(r.sources, &source{r: f})
+	}
+	return io.EOF
+}
+
+// skipZeros moves s.pos past the zeros there, or returns io.EOF if there
+// is nothing else.
+func (s *source) skipZeros() error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.r.ReadAt(buf, s.pos)
+		for i, b := range buf[:n] {
+			if b != 0 {
+				s.pos += int64(i)
+				return nil
+			}
+		}
+		s.pos += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// countReader counts the bytes read through it, one at a time or not,
+// which is how far into its input a gzip.Reader, which reads a ByteReader
+// no further than it needs, has got.
+type countReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// decompress decompresses what the compressor called name compressed at the
+// start of in into an unlinked temporary file, and returns it and how much
+// of in it took, or -1 if it took all of it.
+func (r *Reader) decompress(name string, in *io.SectionReader) (*os.File, int64, error) {
+	c := &countReader{r: bufio.NewReader(in)}
+	var zr io.ReadCloser
+	if name == "gzip" {
+		z, err := gzip.NewReader(c)
+		if err != nil {
+			return nil, 0, err
+		}
+		// What follows the gzip stream is another archive, not
+		// another gzip stream.
+		z.Multistream(false)
+		zr = z
+	} else {
+		comp, err := compress.Get(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := comp.Available(); err != nil {
+			return nil, 0, err
+		}
+		if zr, err = comp.Reader(c); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	f, err := ioutil.TempFile("", "u-root-initramfs")
+	if err != nil {
+		zr.Close()
+		return nil, 0, err
+	}
+	r.files = append(r.files, f)
+	// Unlinked, the file is there only until it is closed.
+	err = os.Remove(f.Name())
+	if err == nil {
+		_, err = io.Copy(f, zr)
+	}
+	if cerr := zr.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if name != "gzip" {
+		return f, -1, nil
+	}
+	return f, c.n, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/compress"
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// readAll returns the records of the initramfs b as lines of name and
+// contents.
+func readAll(t *testing.T, b []byte) ([]string, error) {
+	a, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(a, bytes.NewReader(b))
+	defer r.Close()
+	recs, err := r.ReadRecords()
+	if err != nil {
+		return nil, err
+	}
+	var l []string
+	for _, rec := range recs {
+		c, err := ioutil.ReadAll(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l = append(l, fmt.Sprintf("%s %q", rec.Name, c))
+	}
+	return l, nil
+}
+
+// testdata/microcode.cpio is an uncompressed archive with the microcode
+// the kernel loads early, padded to 512 bytes, followed by a gzipped one,
+// as distributions lay out their initramfs. Both were made by bsdcpio.
+func TestReaderMicrocode(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/microcode.cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readAll(t, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`kernel ""`,
+		`kernel/x86 ""`,
+		`kernel/x86/microcode ""`,
+		`kernel/x86/microcode/GenuineIntel.bin "microcode\n"`,
+		`etc ""`,
+		`etc/motd "hello\n"`,
+		`init "#!/bin/sh\n"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	a, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(a, bytes.NewReader(b))
+	defer r.Close()
+	var archives []int
+	for range want {
+		if _, err := r.ReadRecord(); err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, r.Archive())
+	}
+	if want := []int{0, 0, 0, 0, 1, 1, 1}; !reflect.DeepEqual(archives, want) {
+		t.Errorf("Archive: got %v, want %v", archives, want)
+	}
+}
+
+func TestReaderSegments(t *testing.T) {
+	segment := func(comp string, names ...string) []byte {
+		a, err := cpio.Format("newc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := compress.Get(comp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		cw, err := c.Writer(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := a.Writer(cw)
+		for _, n := range names {
+			if err := w.WriteRecord(cpio.NewRecordFromBytes([]byte(n), cpio.Info{Name: n, Mode: syscall.S_IFREG | 0644})); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	zeros := make([]byte, 100)
+	cat := func(segs ...[]byte) []byte {
+		return bytes.Join(segs, nil)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		b       []byte
+		want    []string
+		needsXZ bool
+	}{
+		{"one", segment("none", "a"), []string{"a"}, false},
+		{"padded", cat(segment("none", "a"), zeros), []string{"a"}, false},
+		{"two", cat(segment("none", "a"), segment("none", "b")), []string{"a", "b"}, false},
+		{"gzip then gzip", cat(segment("gzip", "a"), segment("gzip", "b", "c")), []string{"a", "b", "c"}, false},
+		{"gzip then padding", cat(segment("gzip", "a"), zeros, segment("none", "b"), zeros), []string{"a", "b"}, false},
+		{"xz last", cat(segment("none", "a"), zeros, segment("gzip", "b"), segment("xz", "c")), []string{"a", "b", "c"}, true},
+	} {
+		if tt.needsXZ {
+			if c, _ := compress.Get("xz"); c.Available() != nil {
+				t.Logf("Skipping %s: xz is not installed", tt.name)
+				continue
+			}
+		}
+		got, err := readAll(t, tt.b)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var want []string
+		for _, n := range tt.want {
+			want = append(want, fmt.Sprintf("%s %q", n, n))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, want)
+		}
+	}
+
+	// What follows an archive must be another one.
+	if _, err := readAll(t, cat(segment("none", "a"), bytes.Repeat([]byte("junk"), 100))); err == nil || !strings.Contains(err.Error(), "magic") {
+		t.Errorf("junk after the archive: got %v, want a magic error", err)
+	}
+	if _, err := readAll(t, cat(segment("gzip", "a"), []byte{0x1f, 0x8b, 0})); err == nil || !strings.Contains(err.Error(), "gzip compressed archive") {
+		t.Errorf("broken gzip stream: got %v, want a gzip error", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// Group is a group WriteDefaultSkeleton puts in /etc/group.
+type Group struct {
+	Name string
+	GID  uint32
+}
+
+// SkeletonOpts says what WriteDefaultSkeleton writes.
+type SkeletonOpts struct {
+	// Groups are the groups in /etc/group besides root, which is always
+	// there.
+	Groups []Group
+	// Shell is root's shell in /etc/passwd, /bin/sh if it is empty.
+	Shell string
+	// NoConsole leaves out /dev/console, for an init that mounts
+	// devtmpfs.
+	NoConsole bool
+	// NoEtc leaves out /etc and the files in it.
+	NoEtc bool
+}
+
+// WriteDefaultSkeleton writes to i what every image needs and nothing else
+// may have put there: /dev, /dev/console, /proc, /sys, /tmp, and /etc with
+// passwd, group and hosts. Each is only written if no record of its name
+// was, so that it fills in around a base archive rather than conflicting
+// with it.
+func WriteDefaultSkeleton(i *Initramfs, opts SkeletonOpts) error {
+	shell := opts.Shell
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	groups := append([]Group(nil), opts.Groups...)
+	sort.SliceStable(groups, func(a, b int) bool { return groups[a].GID < groups[b].GID })
+	group := []string{"root:x:0:\n"}
+	for _, g := range groups {
+		if g.Name == "" || strings.ContainsAny(g.Name, ":\n") {
+			return fmt.Errorf("skeleton: group %q is not a group name", g.Name)
+		}
+		group = append(group, fmt.Sprintf("%s:x:%d:\n", g.Name, g.GID))
+	}
+	if strings.ContainsAny(shell, ":\n") {
+		return fmt.Errorf("skeleton: shell %q can not be in /etc/passwd", shell)
+	}
+
+	dir := func(name string, perm uint64) cpio.Record {
+		return cpio.Record{Info: cpio.Info{Name: name, Mode: syscall.S_IFDIR | perm}}
+	}
+	file := func(name, contents string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(contents), cpio.Info{Name: name, Mode: syscall.S_IFREG | 0644})
+	}
+	recs := []cpio.Record{dir("dev", 0755)}
+	if !opts.NoConsole {
+		recs = append(recs, cpio.CharDev("dev/console", 0600, 5, 1))
+	}
+	recs = append(recs, dir("proc", 0555), dir("sys", 0555), dir("tmp", 0777|syscall.S_ISVTX))
+	if !opts.NoEtc {
+		recs = append(recs,
+			dir("etc", 0755),
+			file("etc/passwd", "root:x:0:0:root:/:"+shell+"\n"),
+			file("etc/group", strings.Join(group, "")),
+			file("etc/hosts", "127.0.0.1\tlocalhost\n::1\tlocalhost\n"),
+		)
+	}
+	for _, r := range recs {
+		if i.Has(r.Name) {
+			continue
+		}
+		if err := i.WriteRecord(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
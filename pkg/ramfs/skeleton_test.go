@@ -0,0 +1,144 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestWriteDefaultSkeleton(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		opts SkeletonOpts
+		want []string
+	}{
+		{"default", SkeletonOpts{}, []string{
+			"drwxr-xr-x 0 0 0 1970-01-01 etc",
+			"-rw-r--r-- 0 0 5 1970-01-01 etc/passwd base",
+			"drwxr-xr-x 0 0 0 1970-01-01 dev",
+			"crw------- 0 0 5,1 1970-01-01 dev/console",
+			"dr-xr-xr-x 0 0 0 1970-01-01 proc",
+			"dr-xr-xr-x 0 0 0 1970-01-01 sys",
+			"drwxrwxrwt 0 0 0 1970-01-01 tmp",
+			"-rw-r--r-- 0 0 10 1970-01-01 etc/group root:x:0:\n",
+			"-rw-r--r-- 0 0 34 1970-01-01 etc/hosts 127.0.0.1\tlocalhost\n::1\tlocalhost\n",
+		}},
+		{"groups", SkeletonOpts{Groups: []Group{{"wheel", 10}, {"tty", 5}}, NoConsole: true}, []string{
+			"drwxr-xr-x 0 0 0 1970-01-01 etc",
+			"-rw-r--r-- 0 0 5 1970-01-01 etc/passwd base",
+			"drwxr-xr-x 0 0 0 1970-01-01 dev",
+			"dr-xr-xr-x 0 0 0 1970-01-01 proc",
+			"dr-xr-xr-x 0 0 0 1970-01-01 sys",
+			"drwxrwxrwt 0 0 0 1970-01-01 tmp",
+			"-rw-r--r-- 0 0 31 1970-01-01 etc/group root:x:0:\ntty:x:5:\nwheel:x:10:\n",
+			"-rw-r--r-- 0 0 34 1970-01-01 etc/hosts 127.0.0.1\tlocalhost\n::1\tlocalhost\n",
+		}},
+		{"no etc", SkeletonOpts{NoEtc: true}, []string{
+			"drwxr-xr-x 0 0 0 1970-01-01 etc",
+			"-rw-r--r-- 0 0 5 1970-01-01 etc/passwd base",
+			"drwxr-xr-x 0 0 0 1970-01-01 dev",
+			"crw------- 0 0 5,1 1970-01-01 dev/console",
+			"dr-xr-xr-x 0 0 0 1970-01-01 proc",
+			"dr-xr-xr-x 0 0 0 1970-01-01 sys",
+			"drwxrwxrwt 0 0 0 1970-01-01 tmp",
+		}},
+	} {
+		var b bytes.Buffer
+		i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// What is there already is left alone, and makes no
+		// conflict, etc being made for etc/passwd.
+		i.Policy = DedupError
+		i.SetSource(Source{Name: "base"})
+		if err := i.WriteRecord(cpio.NewRecordFromBytes([]byte("base\n"), cpio.Info{Name: "etc/passwd", Mode: syscall.S_IFREG | 0644})); err != nil {
+			t.Fatal(err)
+		}
+		i.SetSource(Source{Name: "skeleton"})
+		if err := WriteDefaultSkeleton(i, tt.opts); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := i.WriteTrailer(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range recs {
+			s := cpio.FormatLong(r)
+			if r.Mode&syscall.S_IFMT == syscall.S_IFREG {
+				c, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s += " " + strings.TrimSuffix(string(c), "\n")
+				if r.Name != "etc/passwd" {
+					s += "\n"
+				}
+			}
+			got = append(got, s)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSkeletonPasswd(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	i, err := NewInitramfsRecords(archiver.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDefaultSkeleton(i, SkeletonOpts{Shell: "/bin/x:y"}); err == nil {
+		t.Errorf("shell with a colon: got nil, want an error")
+	}
+	if err := WriteDefaultSkeleton(i, SkeletonOpts{Groups: []Group{{"", 3}}}); err == nil {
+		t.Errorf("group with no name: got nil, want an error")
+	}
+	if err := WriteDefaultSkeleton(i, SkeletonOpts{Shell: "/bbin/elvish"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range recs {
+		if r.Name != "etc/passwd" {
+			continue
+		}
+		c, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "root:x:0:0:root:/:/bbin/elvish\n"; string(c) != want {
+			t.Errorf("etc/passwd is %q, want %q", c, want)
+		}
+		return
+	}
+	t.Errorf("no etc/passwd")
+}
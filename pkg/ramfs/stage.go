@@ -0,0 +1,129 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// StageMemory is the size up to which the contents of the records a staged
+// Initramfs holds are kept in memory. Larger contents are spooled to a
+// file.
+var StageMemory = 64 << 10
+
+// stage holds the records of a staged Initramfs, the last of each name,
+// until they are written in order with the trailer.
+type stage struct {
+	// dir is where the spool is made, or the default temporary
+	// directory if it is "".
+	dir   string
+	recs  map[string]cpio.Record
+	spool *os.File
+	size  int64
+}
+
+func newStage(dir string) *stage {
+	return &stage{dir: dir, recs: make(map[string]cpio.Record)}
+}
+
+// put holds r, and reads its contents, into memory or the spool, in place
+// of any record of the same name held before.
+func (s *stage) put(r cpio.Record) error {
+	name := strings.TrimLeft(filepath.Clean(r.Name), "/")
+	if r.ReadCloser == nil {
+		s.recs[name] = r
+		return nil
+	}
+	defer r.Close()
+	if r.FileSize <= uint64(StageMemory) {
+		b, err := ioutil.ReadAll(io.LimitReader(r, int64(r.FileSize)))
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if uint64(len(b)) != r.FileSize {
+			return fmt.Errorf("%s: read %d bytes of %d", name, len(b), r.FileSize)
+		}
+		r.ReadCloser = cpio.NewBytesReadCloser(b)
+		s.recs[name] = r
+		return nil
+	}
+	if s.spool == nil {
+		f, err := ioutil.TempFile(s.dir, "ramfs-spool")
+		if err != nil {
+			return err
+		}
+		// Unlinked, it goes away when it is closed, or the process
+		// exits, whatever happens.
+		if err := os.Remove(f.Name()); err != nil {
+			f.Close()
+			return err
+		}
+		s.spool = f
+	}
+	off := s.size
+	n, err := io.Copy(s.spool, io.LimitReader(r, int64(r.FileSize)))
+	// What was spooled of contents that could not be read is left there,
+	// unused.
+	s.size += n
+	if err != nil {
+		return fmt.Errorf("%s: spooling: %v", name, err)
+	}
+	if uint64(n) != r.FileSize {
+		return fmt.Errorf("%s: read %d bytes of %d", name, n, r.FileSize)
+	}
+	r.ReadCloser = cpio.NewReadCloser(io.NewSectionReader(s.spool, off, n))
+	s.recs[name] = r
+	return nil
+}
+
+// flush writes the records held with write, sorted by name, as path
+// elements, so that a directory comes before what is in it.
+func (s *stage) flush(write func(cpio.Record) error) error {
+	names := make([]string, 0, len(s.recs))
+	for n := range s.recs {
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool { return pathLess(names[i], names[j]) })
+	for _, n := range names {
+		if err := write(s.recs[n]); err != nil {
+			return err
+		}
+		delete(s.recs, n)
+	}
+	return nil
+}
+
+// pathLess reports whether the path a sorts before b, element by element.
+func pathLess(a, b string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		if a[i] == '/' || b[i] == '/' {
+			return a[i] == '/'
+		}
+		return a[i] < b[i]
+	}
+	return len(a) < len(b)
+}
+
+// close removes the spool, if there is one.
+func (s *stage) close() error {
+	s.recs = nil
+	if s.spool == nil {
+		return nil
+	}
+	err := s.spool.Close()
+	s.spool = nil
+	return err
+}
@@ -0,0 +1,234 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestStaged(t *testing.T) {
+	defer func(m int) { StageMemory = m }(StageMemory)
+	StageMemory = 16
+
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool := filepath.Join(dir, "spool")
+	for _, d := range []string{"spool", "src/lib"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for f, contents := range map[string]string{
+		"src/lib/small": "small",
+		"src/lib/large": strings.Repeat("large", 100),
+		"motd":          "hello",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var concat bytes.Buffer
+	w := archiver.Writer(&concat)
+	if err := w.WriteRecords([]cpio.Record{
+		{Info: cpio.Info{Name: "usr", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes(bytes.Repeat([]byte("binary"), 10), cpio.Info{Name: "usr/bin", Mode: syscall.S_IFREG | 0755}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	build := func(o Options) []byte {
+		var b bytes.Buffer
+		i, err := NewInitramfsOptions(archiver.Writer(&b), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := i.Symlink("usr/bin", "bin"); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.WriteFile(filepath.Join(dir, "motd"), "etc/motd"); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.WriteFiles(filepath.Join(dir, "src"), "", []string{"lib"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.Concat(archiver.Reader(bytes.NewReader(concat.Bytes())), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.CharDev("dev/null", 0666, 1, 3); err != nil {
+			t.Fatal(err)
+		}
+		if o.Staged {
+			// The spool is unlinked as soon as it is made.
+			if f, err := ioutil.ReadDir(spool); err != nil || len(f) != 0 {
+				t.Errorf("spool directory: got %v, %v, want it empty", f, err)
+			}
+		}
+		if err := i.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	// The contents of records can be read only once.
+	records := func() []cpio.Record {
+		return []cpio.Record{
+			{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}},
+			cpio.CharDev("dev/console", 0600, 5, 1),
+			cpio.NewRecordFromBytes([]byte(nameserver), cpio.Info{Name: "etc/resolv.conf", Mode: syscall.S_IFREG | 0644}),
+		}
+	}
+	streamed := build(Options{Records: records()})
+	staged := build(Options{Records: records(), Staged: true, SpoolDir: spool})
+
+	d, err := cpio.Diff(archiver.Reader(bytes.NewReader(streamed)), archiver.Reader(bytes.NewReader(staged)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Empty() {
+		var r bytes.Buffer
+		d.Report(&r)
+		t.Errorf("staged and streamed archives differ:\n%s", r.String())
+	}
+
+	recs, err := archiver.Reader(bytes.NewReader(staged)).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range recs {
+		names = append(names, r.Name)
+	}
+	if !sort.SliceIsSorted(names, func(i, j int) bool { return pathLess(names[i], names[j]) }) {
+		t.Errorf("staged records are not sorted: %q", names)
+	}
+}
+
+func TestStagedOverwrite(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	i, err := NewInitramfsOptions(archiver.Writer(&b), Options{Policy: DedupLast, Staged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without parents made, the directory comes after what is in it.
+	i.NoParents = true
+	for _, r := range []cpio.Record{
+		cpio.NewRecordFromBytes([]byte("a"), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644}),
+		{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("b"), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0600}),
+		cpio.NewRecordFromBytes([]byte("hosts"), cpio.Info{Name: "etc-hosts", Mode: syscall.S_IFREG | 0644}),
+	} {
+		i.SetSource(Source{Name: r.Name})
+		if err := i.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := i.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteRecord(cpio.Symlink("bin", "usr/bin")); err == nil {
+		t.Errorf("WriteRecord after the trailer: got nil, want an error")
+	}
+
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range recs {
+		got = append(got, cpio.FormatLong(r))
+	}
+	// Only the last etc/motd is written.
+	want := []string{
+		"drwxr-xr-x 0 0 0 1970-01-01 etc",
+		"-rw------- 0 0 1 1970-01-01 etc/motd",
+		"-rw-r--r-- 0 0 5 1970-01-01 etc-hosts",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestStagedClose(t *testing.T) {
+	defer func(m int) { StageMemory = m }(StageMemory)
+	StageMemory = 0
+
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	i, err := NewInitramfsOptions(archiver.Writer(&b), Options{Staged: true, SpoolDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.WriteRecord(cpio.NewRecordFromBytes([]byte("spooled"), cpio.Info{Name: "a", Mode: syscall.S_IFREG | 0644})); err != nil {
+		t.Fatal(err)
+	}
+	if i.stage.spool == nil {
+		t.Fatal("no spool was made")
+	}
+	spool := i.stage.spool
+	if b.Len() != 0 {
+		t.Errorf("%d bytes written before Close, want none", b.Len())
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closed, the spool is gone, and what it held written.
+	if _, err := spool.Stat(); err == nil {
+		t.Errorf("the spool is still open after Close")
+	}
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Name != "a" {
+		t.Errorf("got %v, want a", recs)
+	}
+	if err := i.Close(); err != nil {
+		t.Errorf("Close twice: got %v, want nil", err)
+	}
+	if err := i.WriteRecord(cpio.Symlink("b", "a")); err != ErrClosed {
+		t.Errorf("WriteRecord after Close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestPathLess(t *testing.T) {
+	want := []string{"a", "a/b", "a/b/c", "a-b", "a.b", "ab", "b"}
+	got := []string{"b", "a.b", "a/b/c", "ab", "a-b", "a/b", "a"}
+	sort.Slice(got, func(i, j int) bool { return pathLess(got[i], got[j]) })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// sign makes and checks detached signatures of files such as an initramfs.
+//
+// A signature is over the SHA256 of the file. With an ed25519 key it is the
+// ed25519 signature of the digest, as vboot checks; with an RSA key it is a
+// PKCS #1 v1.5 signature. Keys are PEM encoded: private keys as PKCS #8 or,
+// for RSA, PKCS #1, and public keys as PKIX or, for RSA, PKCS #1.
+package sign
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrVerify is returned by Verify when the signature does not match.
+var ErrVerify = errors.New("signature does not match")
+
+func decode(b []byte) (*pem.Block, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	return block, nil
+}
+
+// ParsePrivateKey parses a PEM encoded ed25519 or RSA private key.
+func ParsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, err := decode(b)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := k.(type) {
+		case ed25519.PrivateKey:
+			return k, nil
+		case *rsa.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("%T keys are not supported", k)
+	}
+	return nil, fmt.Errorf("PEM type %q is not a private key", block.Type)
+}
+
+// ParsePublicKey parses a PEM encoded ed25519 or RSA public key.
+func ParsePublicKey(b []byte) (crypto.PublicKey, error) {
+	block, err := decode(b)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := k.(type) {
+		case ed25519.PublicKey:
+			return k, nil
+		case *rsa.PublicKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("%T keys are not supported", k)
+	}
+	return nil, fmt.Errorf("PEM type %q is not a public key", block.Type)
+}
+
+func digest(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Sign returns the signature of what is read from r.
+func Sign(key crypto.Signer, r io.Reader) ([]byte, error) {
+	d, err := digest(r)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case ed25519.PrivateKey:
+		// crypto.Hash(0) signs the digest itself, rather than asking
+		// for ed25519ph.
+		return key.Sign(rand.Reader, d, crypto.Hash(0))
+	case *rsa.PrivateKey:
+		return key.Sign(rand.Reader, d, crypto.SHA256)
+	}
+	return nil, fmt.Errorf("%T keys are not supported", key)
+}
+
+// Verify checks that sig is the signature of what is read from r. It
+// returns ErrVerify if it is not.
+func Verify(key crypto.PublicKey, r io.Reader, sig []byte) error {
+	d, err := digest(r)
+	if err != nil {
+		return err
+	}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, d, sig) {
+			return ErrVerify
+		}
+		return nil
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, d, sig) != nil {
+			return ErrVerify
+		}
+		return nil
+	}
+	return fmt.Errorf("%T keys are not supported", key)
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func pemKeys(t *testing.T, priv, pub interface{}) (privPEM, pubPEM []byte) {
+	p, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: p}), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: q})
+}
+
+func TestSignVerify(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPrivPEM, edPubPEM := pemKeys(t, edPriv, edPub)
+	rsaPrivPEM, rsaPubPEM := pemKeys(t, rsaPriv, &rsaPriv.PublicKey)
+	rsa1PrivPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaPriv)})
+	rsa1PubPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaPriv.PublicKey)})
+
+	archive := []byte("070701 an initramfs")
+	for _, tt := range []struct {
+		name      string
+		priv, pub []byte
+	}{
+		{"ed25519", edPrivPEM, edPubPEM},
+		{"rsa", rsaPrivPEM, rsaPubPEM},
+		{"rsa pkcs1", rsa1PrivPEM, rsa1PubPEM},
+	} {
+		priv, err := ParsePrivateKey(tt.priv)
+		if err != nil {
+			t.Fatalf("%s: ParsePrivateKey: %v", tt.name, err)
+		}
+		pub, err := ParsePublicKey(tt.pub)
+		if err != nil {
+			t.Fatalf("%s: ParsePublicKey: %v", tt.name, err)
+		}
+		sig, err := Sign(priv, bytes.NewReader(archive))
+		if err != nil {
+			t.Fatalf("%s: Sign: %v", tt.name, err)
+		}
+		if err := Verify(pub, bytes.NewReader(archive), sig); err != nil {
+			t.Errorf("%s: Verify: %v", tt.name, err)
+		}
+		if err := Verify(pub, bytes.NewReader(append(archive, 0)), sig); err != ErrVerify {
+			t.Errorf("%s: Verify of changed contents: got %v, want %v", tt.name, err, ErrVerify)
+		}
+	}
+
+	// An ed25519 signature is of the digest, as vboot checks it.
+	priv, err := ParsePrivateKey(edPrivPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Sign(priv, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := sha256.Sum256(archive)
+	if !ed25519.Verify(edPub, d[:], sig) {
+		t.Errorf("ed25519 signature is not of the SHA256 digest")
+	}
+}
+
+func TestBadKeys(t *testing.T) {
+	for _, b := range []string{"", "not PEM", "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"} {
+		if _, err := ParsePrivateKey([]byte(b)); err == nil {
+			t.Errorf("ParsePrivateKey(%q): got nil, want an error", b)
+		}
+		if _, err := ParsePublicKey([]byte(b)); err == nil {
+			t.Errorf("ParsePublicKey(%q): got nil, want an error", b)
+		}
+	}
+}
@@ -5,18 +5,48 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"go/build"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/u-root/u-root/pkg/bb"
+	"github.com/u-root/u-root/pkg/compress"
 	"github.com/u-root/u-root/pkg/cpio"
+	_ "github.com/u-root/u-root/pkg/cpio/bin"
+	"github.com/u-root/u-root/pkg/cpio/newc"
+	_ "github.com/u-root/u-root/pkg/cpio/odc"
+	_ "github.com/u-root/u-root/pkg/cpio/tar"
+	"github.com/u-root/u-root/pkg/kmodule"
+	"github.com/u-root/u-root/pkg/ldd"
 	"github.com/u-root/u-root/pkg/ramfs"
+	"github.com/u-root/u-root/pkg/sign"
+	"golang.org/x/tools/go/packages"
 )
 
 var (
@@ -24,15 +54,80 @@ var (
 		Goroot          string
 		Arch            string
 		Goos            string
+		Goarm           string
 		Gopath          string
 		TempDir         string
+		Keep            bool
+		DryRun          bool
+		Sizes           string
+		Jobs            int
+		CacheDir        string
+		NoCache         bool
+		LDFlags         string
+		GCFlags         string
+		ASMFlags        string
+		Tags            string
+		Trimpath        bool
+		Strip           bool
+		Owner           string
+		MTime           string
+		Preserve        []string
+		Modules         string
+		UnpackModules   bool
+		Firmware        string
+		FirmwareExtra   []string
 		Go              string
-		InitialCpio     string
+		GoVersion       string
+		InitialCpio     []string
+		CpioExclude     []string
 		UseExistingInit bool
+		ExistingInit    string
+		Uinit           string
+		UinitArgs       string
+		Output          string
+		Force           bool
+		Verify          bool
+		Manifest        string
+		Sign            string
+		VerifyKey       string
+		ManifestAt      string
+		Extract         string
+		Kernel          string
+		Cmdline         string
+		EFIStub         string
+		Bundle          string
+		Format          string
+		Size            string
+		SquashfsComp    string
+		InFormat        string
+		CRCCheck        bool
+		Compress        string
+		Build           string
+		NoToolchain     bool
+		NoSrc           bool
+		Files           []string
+		NoLibs          bool
+		Symlinks        []string
+		DevNodes        []string
+		NoDevNodes      bool
+		Etc             []string
+		NoEtc           bool
+		NoSkeleton      bool
+		Dedup           string
+		Excludes        []string
+		Overrides       string
+		Verbose         verbosity
+		Strict          bool
+		GoList          bool
+		Packages        []string
 	}
 
-	// be VERY CAREFUL with these. If you have an empty line here it will
-	// result in cpio copying the whole tree.
+	configFile = flag.String("config", "", "JSON file with settings; its keys are the fields of the config struct, and flags override them")
+	dumpConfig = flag.Bool("dumpconfig", false, "Print the effective configuration as JSON and exit")
+	listTmpl   = flag.Bool("list-templates", false, "Print the templates, which can be given as arguments in place of globs, with their commands, and exit")
+
+	// be VERY CAREFUL with these. An empty line here would be the whole
+	// tree, which WriteFiles refuses to copy.
 	goList         = []string{"pkg/include"}
 	urootList      []string
 	pkgList        []string
@@ -40,291 +135,4140 @@ var (
 	gorootFiles    map[string]bool
 	urootFiles     map[string]bool
 	standardgotool = true
-)
 
-func init() {
-	flag.BoolVar(&config.UseExistingInit, "useinit", false, "If there is an existing init, don't replace it")
-	flag.StringVar(&config.InitialCpio, "cpio", "", "An initial cpio image to build on")
-	flag.StringVar(&config.TempDir, "tmpdir", "", "tmpdir to use instead of ioutil.TempDir")
-}
+	// kmods are the -modules and the ones they need, for kernel kversion.
+	kmods    []*kmodule.Module
+	kversion string
+	// libs are the shared libraries the -files need, and fw is the
+	// firmware the kernel modules need.
+	libs []extraFile
+	fw   []extraFile
+	// etcHost maps names in etcSkeleton to the -etc files replacing them.
+	etcHost map[string]string
+	// dedup is the -dedup policy.
+	dedup ramfs.DedupPolicy
+	// skipped are the packages left out without -strict, because go
+	// list failed on them.
+	skipped []string
 
-func buildPkg(pkg string, wd string, output string, opts []string) error {
-	args := []string{
-		"build", "-x", "-a",
-		"-o", output,
-		"-installsuffix", "cgo",
-		"-ldflags", "-s -w",
-	}
-	if opts != nil {
-		args = append(args, opts...)
-	}
-	if pkg != "" {
-		args = append(args, pkg)
+	// module is the module u-root is in, if the go command is in module
+	// mode. Its Path is empty in GOPATH mode.
+	module struct {
+		Path string
+		Dir  string
 	}
+	// moduleFiles maps archive paths to host paths of the non-standard
+	// sources needed in module mode, which can be spread over the
+	// module and the module cache.
+	moduleFiles map[string]string
 
-	cmd := exec.Command("go", args...)
-	if wd != "" {
-		cmd.Dir = wd
+	// goTmpDir is the GOTMPDIR of the go commands, if not empty.
+	goTmpDir string
+
+	// needsToolchain are the commands left out of bb and binaries
+	// builds, since they need the Go toolchain to do anything useful.
+	needsToolchain = map[string]bool{
+		"builtin":        true,
+		"installcommand": true,
+		"script":         true,
 	}
-	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
-	if o, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("building statically linked go tool info %v: %v, %v", pkg, string(o), err)
+
+	// cmdsList is where the archive lists the commands from outside
+	// u-root's cmds, as uroot.CmdsList.
+	cmdsList = "etc/u-root/cmds"
+
+	// templates are named sets of commands, which can be given as
+	// arguments in place of globs. Their members are globs in cmds. A
+	// fork can add its own in an init function of a file of its own.
+	templates = map[string][]string{
+		"minimal": {"cat", "echo", "kill", "ls", "mkdir", "mount", "ps", "rush", "shutdown", "umount"},
+		"core": {
+			"cat", "chmod", "cmp", "cp", "date", "dd", "dirname", "dmesg", "echo", "false",
+			"grep", "hostname", "id", "kill", "ln", "ls", "mkdir", "mknod", "mount", "mv",
+			"printenv", "ps", "pwd", "readlink", "rm", "rush", "seq", "shutdown", "sleep", "sort",
+			"stty", "sync", "tee", "true", "truncate", "umount", "uname", "uniq", "wc", "which",
+		},
+		"boot": {
+			"dhclient", "gpt", "insmod", "ip", "kexec", "lsmod", "mount", "rmmod", "rush",
+			"switch_root", "umount", "vboot", "wget",
+		},
+		"all": {"[a-zA-Z]*"},
 	}
+)
+
+// stringList is a flag.Value collecting every use of a repeatable flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
 	return nil
 }
 
-// buildToolChain builds the four binaries needed for the go toolchain:
-// go, compile, link, and asm. We do this to ensure we get smaller binaries.
-// Smaller, in this, meaning 25M instead of 33M. What a world!
-func buildToolChain() error {
-	log.Printf("Building go tools...")
+// sizesFlag is the -sizes flag, which can be used as a bool for the text
+// report.
+type sizesFlag string
 
-	goBin := filepath.Join(config.TempDir, "go/bin/go")
-	goDir := filepath.Join(config.Goroot, "src/cmd/go")
-	if err := buildPkg("", goDir, goBin, []string{"-tags", "cmd_go_bootstrap"}); err != nil {
-		return err
+func (s *sizesFlag) String() string {
+	return string(*s)
+}
+
+func (s *sizesFlag) Set(v string) error {
+	switch v {
+	case "true", "text":
+		*s = "text"
+	case "false", "":
+		*s = ""
+	case "json":
+		*s = "json"
+	default:
+		return fmt.Errorf("%q is not one of text or json", v)
 	}
+	return nil
+}
 
-	toolDir := filepath.Join(config.TempDir, fmt.Sprintf("go/pkg/tool/%v_%v", config.Goos, config.Arch))
-	for _, pkg := range []string{"compile", "link", "asm"} {
-		c := filepath.Join(toolDir, pkg)
-		if err := buildPkg(fmt.Sprintf("cmd/%s", pkg), "", c, nil); err != nil {
-			return err
+func (s *sizesFlag) IsBoolFlag() bool {
+	return true
+}
+
+// verbosity is the -v level: 0 for warnings and errors only, 1, the
+// default, for a line per phase, 2 for every package listed and record
+// written as well, and 3 for the go commands' -x output too. -v alone is 2.
+type verbosity int
+
+func (v *verbosity) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+func (v *verbosity) Set(s string) error {
+	switch s {
+	case "true":
+		*v = 2
+	case "false":
+		*v = 1
+	default:
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > 3 {
+			return fmt.Errorf("%q is not a level from 0 to 3", s)
 		}
+		*v = verbosity(n)
 	}
 	return nil
 }
 
-func guessgoarch() {
-	if arch := os.Getenv("GOARCH"); arch != "" {
-		config.Arch = filepath.Clean(arch)
-	} else {
-		config.Arch = runtime.GOARCH
-	}
+func (v *verbosity) IsBoolFlag() bool {
+	return true
 }
 
-func guessgoroot() {
-	if root := os.Getenv("GOROOT"); root != "" {
-		config.Goroot = filepath.Clean(root)
-	} else {
-		config.Goroot = runtime.GOROOT()
+// UnmarshalJSON takes the levels, and true and false from when -v was a
+// bool, in -config files.
+func (v *verbosity) UnmarshalJSON(b []byte) error {
+	return v.Set(string(b))
+}
+
+// logf logs if -v is at least level.
+func logf(level verbosity, format string, v ...interface{}) {
+	if config.Verbose >= level {
+		log.Printf(format, v...)
 	}
-	log.Printf("Using %q as GOROOT", config.Goroot)
 }
 
-func guessgopath() {
-	gopath := os.Getenv("GOPATH")
-	if gopath != "" {
-		config.Gopath = gopath
-		return
+// progressInterval is how often progress logs that a long phase is still
+// going.
+var progressInterval = 30 * time.Second
+
+// progress logs what and the count every progressInterval, from the -v=1
+// level, until the returned function is called.
+func progress(what string, count func() int64) (stop func()) {
+	start := time.Now()
+	done := make(chan struct{})
+	t := time.NewTicker(progressInterval)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				logf(1, "%s: %d so far, after %v", what, count(), time.Since(start).Round(time.Second))
+			}
+		}
+	}()
+	return func() {
+		t.Stop()
+		close(done)
 	}
-	log.Fatalf("You have to set GOPATH, which is typically ~/go")
 }
 
-type goPackage struct {
-	Dir        string
-	Deps       []string
-	GoFiles    []string
-	SFiles     []string
-	HFiles     []string
-	Goroot     bool
-	ImportPath string
+func init() {
+	flag.StringVar(&config.Goos, "goos", "", "Target GOOS (default $GOOS, or linux)")
+	flag.StringVar(&config.Arch, "goarch", "", "Target GOARCH (default $GOARCH, or the host's)")
+	flag.StringVar(&config.Goarm, "goarm", "", "Target GOARM when GOARCH is arm (default $GOARM, or 5, which runs on any board)")
+	flag.BoolVar(&config.UseExistingInit, "useinit", false, "If there is an existing init, don't replace it; the same as -existing-init=keep")
+	flag.StringVar(&config.ExistingInit, "existing-init", "", "What to do with the init of the -cpio archives: rename it to inito, discard it, or keep it instead of building one (default rename)")
+	flag.StringVar(&config.Uinit, "uinit", "", "Go package, as an import path or directory, or prebuilt binary for init to run once it has set things up; it goes to /bin/uinit")
+	flag.StringVar(&config.UinitArgs, "uinitargs", "", "Arguments for the -uinit program, written to /etc/uinit.args; a word in single quotes may have spaces")
+	flag.Var((*stringList)(&config.InitialCpio), "cpio", "An initial cpio image to build on, or - for stdin; its archives, such as a microcode one ahead of the main one, may each be gzip, xz or zstd compressed; may be repeated to layer images, later ones replacing what earlier ones have under the same name")
+	flag.Var((*stringList)(&config.CpioExclude), "cpio-exclude", "Glob of the paths, such as lib/modules, to leave out of the -cpio images, with everything below what it matches; may be repeated")
+	flag.StringVar(&config.TempDir, "tmpdir", "", "tmpdir to use instead of ioutil.TempDir; it is only removed afterwards if it did not exist")
+	flag.IntVar(&config.Jobs, "j", runtime.NumCPU(), "Number of packages to build at once")
+	flag.StringVar(&config.CacheDir, "cachedir", "", "Where to cache built binaries (default u-root in the user cache directory)")
+	flag.BoolVar(&config.NoCache, "nocache", false, "Build everything from scratch, without the cache")
+	flag.StringVar(&config.LDFlags, "ldflags", "", "Flags added to the -ldflags of every go build, which are \"-s -w -buildid=\", or \"-buildid=\" with -strip=false; start with ! to replace them instead")
+	flag.StringVar(&config.GCFlags, "gcflags", "", "Flags added to the -gcflags of every go build; start with ! to replace them instead")
+	flag.StringVar(&config.ASMFlags, "asmflags", "", "Flags added to the -asmflags of every go build; start with ! to replace them instead")
+	flag.BoolVar(&config.Trimpath, "trimpath", true, "Build with -trimpath, so that no host paths, such as GOPATH or -tmpdir, end up in the binaries")
+	flag.BoolVar(&config.Strip, "strip", true, "Strip the symbol table and debug information from the binaries; -strip=false keeps them, for debugging")
+	flag.StringVar(&config.Tags, "tags", "", "Comma separated build tags for every go build, and for go list when finding the files they need")
+	flag.StringVar(&config.Owner, "owner", "0:0", "uid:gid to give every file in the archive; empty to keep the owners they have")
+	flag.StringVar(&config.MTime, "mtime", "", "mtime, in seconds since the epoch, to give every file in the archive (default $SOURCE_DATE_EPOCH, or 0)")
+	flag.Var((*stringList)(&config.Preserve), "preserve", "Archive path whose owner and mtime, and those of everything below it, -owner and -mtime, or its default of $SOURCE_DATE_EPOCH, leave alone; may be repeated")
+	flag.StringVar(&config.Modules, "modules", "", "Kernel modules to include with what they need, as dir:name,name,... where dir is /lib/modules/<version> or a kernel build directory")
+	flag.BoolVar(&config.UnpackModules, "unpackmodules", true, "Decompress .ko.xz, .ko.zst and .ko.gz modules, which init can not load without the xz and zstd programs; -unpackmodules=false copies them as they are")
+	flag.StringVar(&config.Firmware, "firmware", "", "Directory, usually /lib/firmware, to take the firmware the -modules ask for from")
+	flag.Var((*stringList)(&config.FirmwareExtra), "firmware-extra", "Firmware file, relative to -firmware, to add even though no module asks for it; may be repeated")
+	flag.BoolVar(&config.Keep, "keep", false, "Keep the tmpdir when done")
+	flag.Var((*sizesFlag)(&config.Sizes), "sizes", "Report sizes by top-level directory and Go package after writing; -sizes=json for JSON")
+	flag.BoolVar(&config.DryRun, "dryrun", false, "List what would go into the archive, without building or writing anything")
+	flag.StringVar(&config.Output, "o", "", "Output file, or - for stdout, which, if the build fails, has as much of the archive as was written (default /tmp/initramfs.GOOS_GOARCH.cpio, or .tar, .squashfs or .ext4 after -format)")
+	flag.StringVar(&config.Output, "output", "", "Same as -o")
+	flag.StringVar(&config.Extract, "extract", "", "Make what would go into the archive in this directory, which must be empty, instead of writing an archive")
+	flag.StringVar(&config.Kernel, "kernel", "", "Kernel to bundle with the archive, for netbooting, in -bundle")
+	flag.StringVar(&config.Cmdline, "cmdline", "", "Kernel command line to put in the -kernel bundle")
+	flag.StringVar(&config.EFIStub, "efistub", "", "EFI stub, such as systemd's linuxx64.efi.stub, to also make a unified kernel image in the -kernel bundle with")
+	flag.StringVar(&config.Bundle, "bundle", "", "Directory, or file if it ends in .tar, to put the -kernel bundle in (default the output with .bundle added)")
+	flag.BoolVar(&config.Verify, "verify", true, "Read the archive back after writing it, and remove it if it is not all there")
+	flag.StringVar(&config.Manifest, "manifest", "", "File to write the path, SHA256, size, mode, uid and gid, or symlink target, of every record written to, as lines of JSON")
+	flag.StringVar(&config.ManifestAt, "manifest-at", "", "Path in the archive to put the -manifest at as well, e.g. etc/manifest.json; it does not list itself")
+	flag.StringVar(&config.Sign, "sign", "", "PEM ed25519 or RSA private key to sign the output with, into the output with .sig added")
+	flag.StringVar(&config.VerifyKey, "verify-key", "", "PEM public key to check the -sign signature with as soon as it is made")
+	flag.BoolVar(&config.Force, "force", false, "Write the archive to stdout even if it is a terminal, and replace an existing -sign signature")
+	flag.StringVar(&config.Format, "format", "newc", "Format of the output: newc, crc (newc with checksums), odc or tar, or a squashfs or ext4 filesystem image")
+	flag.StringVar(&config.Size, "size", "", "Size of the -format ext4 image, as mkfs.ext4 takes it, e.g. 64M (default twice what is in it, plus 16M)")
+	flag.StringVar(&config.SquashfsComp, "squashfs-comp", "xz", "Compressor of the -format squashfs image, as mksquashfs -comp takes it")
+	flag.StringVar(&config.InFormat, "informat", "newc", "Archive format of the -cpio archive: newc, crc, odc, bin (the old binary format) or tar")
+	flag.BoolVar(&config.CRCCheck, "crc-check", true, "Check the contents of -informat crc archives against their checksums; -crc-check=false reads what there is of a damaged one")
+	flag.StringVar(&config.Build, "build", "source", "How to build commands: source (compile on first use in the image), bb (one busybox-style binary) or binaries (one binary per command)")
+	flag.StringVar(&config.GoVersion, "go-version", "", "Go release, such as 1.22.3, to build with instead of the host's go; it is downloaded into the cache directory if it is not there")
+	flag.BoolVar(&config.NoToolchain, "notoolchain", false, "With -build=source, leave the Go toolchain and GOROOT sources out, for when a -cpio archive has them")
+	flag.BoolVar(&config.NoSrc, "nosrc", false, "With -build=source, leave the u-root sources out as well as the toolchain, for little more than init on top of the -cpio archives")
+	flag.Var((*stringList)(&config.Files), "files", "Extra file or directory to add, as hostpath or hostpath:archivepath; may be repeated")
+	flag.BoolVar(&config.NoLibs, "nolibs", false, "Don't add the dynamic loader and shared libraries that dynamically linked -files need")
+	flag.Var((*stringList)(&config.Symlinks), "symlinks", "Symlink to add after everything else, replacing what is there, as linkpath:target; may be repeated")
+	flag.Var((*stringList)(&config.DevNodes), "devnodes", "Device node to add, as path:c|b:major:minor[:mode] with an octal mode (default 0600); may be repeated")
+	flag.BoolVar(&config.NoDevNodes, "nodevnodes", false, "Leave out the default device nodes, such as /dev/console, for an init that mounts devtmpfs")
+	flag.Var((*stringList)(&config.Etc), "etc", "Host file to use instead of one of the generated /etc files, as name:hostpath, e.g. passwd:/path/to/passwd; may be repeated")
+	flag.BoolVar(&config.NoEtc, "noetc", false, "Don't generate /etc/passwd, group, nsswitch.conf, hosts and resolv.conf")
+	flag.BoolVar(&config.NoSkeleton, "noskeleton", false, "Don't add /dev, /proc, /sys, /tmp and the rest of the skeleton every image needs where nothing else put them")
+	flag.StringVar(&config.Dedup, "dedup", "error", "What to do with two records of the same name from different sources, unless they are identical: error (after listing them all), refuse (at the first), warn (and keep the first), first (keep the first) or last (write both, so the last wins)")
+	flag.Var((*stringList)(&config.Excludes), "exclude", "Glob of packages to leave out, matched against the import path or, without a /, its last element; may be repeated")
+	flag.StringVar(&config.Overrides, "overrides", "", "Manifest of per-path mode, uid, gid and rename overrides, as lines of \"path mode uid gid [rename]\" or JSON")
+	flag.BoolVar(&config.Strict, "strict", true, "Stop if go list fails on a package; -strict=false leaves the package out instead")
+	flag.BoolVar(&config.GoList, "golist", false, "Find the Go files by reading go list's JSON output, as before go/packages did it; kept for one release, to bisect regressions")
+	config.Verbose = 1
+	flag.Var(&config.Verbose, "v", "Verbosity, as -v=level: 0 for warnings only, 1 for a line per phase, 2 (or -v alone) for every package and file, 3 for the go commands' -x output")
+	flag.StringVar(&config.Compress, "compress", "none", "Compress the output: one of "+strings.Join(compress.Names(), ", "))
 }
 
-// goListPkg takes one package name, and computes all the files it needs to
-// build, separating them into Go tree files and uroot files. For now we just
-// 'go list' but hopefully later we can do this programmatically.
-func goListPkg(name string) (*goPackage, error) {
-	cmd := exec.Command("go", "list", "-json", name)
-	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
-	j, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, err
+// goFlag returns the value of a go build flag such as -ldflags, given its
+// default and what was set with the flag of the same name: set is added to
+// def or, if it starts with !, replaces it. The value is a single argument
+// to go build, which does its own splitting, so quotes in set are left for
+// it to interpret.
+func goFlag(def, set string) string {
+	switch {
+	case strings.HasPrefix(set, "!"):
+		return set[1:]
+	case set == "":
+		return def
+	case def == "":
+		return set
 	}
+	// go build takes pattern=flags to give flags to only some
+	// packages. It uses one value per package, so the defaults go in
+	// with the rest.
+	if i := strings.Index(set, "="); i > 0 && !strings.HasPrefix(set, "-") {
+		return set[:i+1] + def + " " + set[i+1:]
+	}
+	return def + " " + set
+}
 
-	var p goPackage
-	if err := json.Unmarshal([]byte(j), &p); err != nil {
-		return nil, err
+// tagFlags returns the -tags flag for go build and go list, with the tags
+// given with -tags and extra, or nothing if there are none. Listing with
+// the same tags as building is what makes the files listed the ones that
+// are compiled.
+func tagFlags(extra ...string) []string {
+	tags := strings.FieldsFunc(config.Tags, func(r rune) bool { return r == ',' || r == ' ' })
+	tags = append(tags, extra...)
+	if len(tags) == 0 {
+		return nil
 	}
+	return []string{"-tags", strings.Join(tags, ",")}
+}
 
-	for _, v := range append(append(p.GoFiles, p.SFiles...), p.HFiles...) {
-		if p.Goroot {
-			gorootFiles[filepath.Join(p.ImportPath, v)] = true
-		} else {
-			urootFiles[filepath.Join(p.ImportPath, v)] = true
+// goBuildFlags returns the flags every go build gets, whether of the
+// toolchain, init or the commands, with tags added to those of -tags.
+func goBuildFlags(tags ...string) []string {
+	flags := []string{
+		"-a",
+		"-installsuffix", "cgo",
+	}
+	// -trimpath and the empty build ID keep host paths and other
+	// accidents of the build out of the binary, so it is reproducible.
+	if config.Trimpath {
+		flags = append(flags, "-trimpath")
+	}
+	ldflags := "-buildid="
+	if config.Strip {
+		ldflags = "-s -w " + ldflags
+	}
+	for _, f := range []struct{ name, def, set string }{
+		{"-ldflags", ldflags, config.LDFlags},
+		{"-gcflags", "", config.GCFlags},
+		{"-asmflags", "", config.ASMFlags},
+	} {
+		if v := goFlag(f.def, f.set); v != "" {
+			flags = append(flags, f.name, v)
 		}
 	}
-	return &p, nil
+	return append(flags, tagFlags(tags...)...)
 }
 
-// addGoFiles Computes the set of Go files to be added to the initramfs.
-func addGoFiles() error {
-	// For each directory in pkgList, add its files and all its
-	// dependencies.  It would be nice to run go list -json with
-	// lots of package names but it produces invalid JSON.  It
-	// produces a stream thatis {}{}{} at the top level and the
-	// decoders don't like that.
-	for _, v := range pkgList {
-		p, err := goListPkg(v)
-		if err != nil {
-			log.Printf("Can't do go list in %v, ignoring\n", v)
-			continue
-		}
-		for _, v := range p.Deps {
-			deps[v] = true
+func buildPkg(pkg string, wd string, output string, tags []string, env []string) error {
+	flags := goBuildFlags(tags...)
+
+	var key string
+	if !config.NoCache {
+		var err error
+		if key, err = cacheKey(pkg, wd, flags, env); err != nil {
+			log.Printf("Not caching %v: %v", output, err)
+		} else if err := cacheGet(key, output); err == nil {
+			return nil
+		} else if !os.IsNotExist(err) {
+			log.Printf("Rebuilding %v: %v", output, err)
 		}
 	}
 
-	for v := range deps {
-		if _, err := goListPkg(v); err != nil {
-			log.Fatalf("%v", err)
-		}
+	args := append([]string{"build", "-o", output}, flags...)
+	// -x makes no difference to what is built, so it is not in the key.
+	if config.Verbose >= 3 {
+		args = append(args, "-x")
 	}
-	for v := range gorootFiles {
-		goList = append(goList, filepath.Join("src", v))
+	if pkg != "" {
+		args = append(args, pkg)
 	}
-	for v := range urootFiles {
-		urootList = append(urootList, filepath.Join("src", v))
+	cmd := command("go", args...)
+	if wd != "" {
+		cmd.Dir = wd
+	}
+	cmd.Env = append(goEnv(), env...)
+	if config.Verbose >= 3 {
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("building statically linked go tool info %v: %v", pkg, err)
+		}
+	} else if o, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("building statically linked go tool info %v: %v, %v", pkg, string(o), err)
+	}
+
+	if key != "" {
+		if err := cachePut(key, output); err != nil {
+			log.Printf("Caching %v: %v", output, err)
+		}
 	}
 	return nil
 }
 
-func globlist(s ...string) []string {
-	// For each arg, use it as a Glob pattern and add any matches to the
-	// package list. If there are no arguments, use [a-zA-Z]* as the glob pattern.
-	var pat []string
-	for _, v := range s {
-		pat = append(pat, filepath.Join(config.Gopath, v))
-	}
-	if len(s) == 0 {
-		pat = []string{filepath.Join(config.Gopath, "src/github.com/u-root/u-root/cmds", "[a-zA-Z]*")}
+var (
+	goVersionOnce sync.Once
+	goVersion     string
+	goVersionErr  error
+
+	// listed has the packages listDeps has listed, by listContext and
+	// then by import path.
+	listedMu sync.Mutex
+	listed   = make(map[string]map[string]*goPackage)
+)
+
+// listContext returns what a go list of the packages built in wd with flags
+// and env depends on, besides the packages, and the -tags of flags, which
+// it lists with for the same files.
+func listContext(wd string, flags, env []string) (string, []string) {
+	var tags []string
+	for i := range flags {
+		if flags[i] == "-tags" && i+1 < len(flags) {
+			tags = append(tags, flags[i:i+2]...)
+		}
 	}
-	return pat
+	return fmt.Sprintf("%s\n%s/%s/%s\n%s\n%q\n%q", wd, config.Goos, config.Arch, config.Goarm, config.Gopath, tags, env), tags
 }
 
-func main() {
-	flag.Parse()
+// listDeps runs one go list -deps of targets, built in wd with flags and
+// env, for cacheKey to make their keys from, and returns the package of the
+// last target, which go list gives last. Listing all of the commands of a
+// build at once is much quicker than listing each.
+func listDeps(wd string, flags, env []string, targets ...string) (*goPackage, error) {
+	lc, tags := listContext(wd, flags, env)
+	args := append(append([]string{"list", "-e", "-json", "-deps"}, tags...), targets...)
+	cmd := command("go", args...)
+	if wd != "" {
+		cmd.Dir = wd
+	}
+	cmd.Env = append(goEnv(), env...)
+	o, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list -deps %v: %v", strings.Join(targets, " "), err)
+	}
+	var pkgs []*goPackage
+	d := json.NewDecoder(bytes.NewReader(o))
+	for {
+		var p goPackage
+		if err := d.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		pkgs = append(pkgs, &p)
+	}
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("go list -deps %v: no packages", strings.Join(targets, " "))
+	}
 
-	deps = make(map[string]bool)
-	gorootFiles = make(map[string]bool)
-	urootFiles = make(map[string]bool)
+	listedMu.Lock()
+	defer listedMu.Unlock()
+	m := listed[lc]
+	if m == nil {
+		m = make(map[string]*goPackage)
+		listed[lc] = m
+	}
+	for _, p := range pkgs {
+		m[p.ImportPath] = p
+	}
+	return pkgs[len(pkgs)-1], nil
+}
 
-	guessgoarch()
-	config.Go = ""
-	config.Goos = "linux"
-	guessgoroot()
-	guessgopath()
+// cacheKey returns the key under which the binary built from pkg in wd
+// with flags and env is cached. It covers the go command's version, the
+// target, the flags and the contents of every source file that does not
+// come with Go, and, unless the build is -trimpath, the directories they
+// are in, which the binary has, so a change to any of them means a
+// rebuild. The packages are those listDeps listed for pkg, or lists now.
+func cacheKey(pkg, wd string, flags, env []string) (string, error) {
+	goVersionOnce.Do(func() {
+		var o []byte
+		o, goVersionErr = command("go", "version").Output()
+		goVersion = strings.TrimSpace(string(o))
+	})
+	if goVersionErr != nil {
+		return "", goVersionErr
+	}
 
-	pat := globlist(flag.Args()...)
+	lc, _ := listContext(wd, flags, env)
+	listedMu.Lock()
+	p := listed[lc][pkg]
+	listedMu.Unlock()
+	if p == nil {
+		target := pkg
+		if target == "" {
+			target = "."
+		}
+		var err error
+		if p, err = listDeps(wd, flags, env, target); err != nil {
+			return "", err
+		}
+	}
+	if p.Error != nil {
+		return "", fmt.Errorf("go list %v: %v", p.ImportPath, p.Error.Err)
+	}
+	if len(p.DepsErrors) > 0 {
+		return "", fmt.Errorf("go list -deps %v: %v", p.ImportPath, p.DepsErrors[0].Err)
+	}
 
-	for _, v := range pat {
-		g, err := filepath.Glob(v)
-		if err != nil {
-			log.Fatalf("Glob error: %v", err)
+	// go list gives Deps sorted, so the key does not depend on the order
+	// packages were listed in.
+	var deps []*goPackage
+	listedMu.Lock()
+	for _, d := range append(append([]string(nil), p.Deps...), p.ImportPath) {
+		deps = append(deps, listed[lc][d])
+	}
+	listedMu.Unlock()
+
+	trimpath := false
+	for _, f := range flags {
+		trimpath = trimpath || f == "-trimpath"
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s/%s/%s\n%q\n%q\n", goVersion, config.Goroot, config.Goos, config.Arch, config.Goarm, flags, env)
+	for i, d := range deps {
+		if d == nil {
+			return "", fmt.Errorf("go list -deps %v: %v is not listed", p.ImportPath, p.Deps[i])
+		}
+		fmt.Fprintf(h, "%s\n", d.ImportPath)
+		if d.Standard {
+			continue
+		}
+		if !trimpath {
+			fmt.Fprintf(h, "%s\n", d.Dir)
 		}
-		// We have a set of absolute paths in g.  We can not
-		// use absolute paths in go list, however, so we have
-		// to adjust them.
-		for i := range g {
-			r, err := filepath.Rel(filepath.Join(config.Gopath, "src"), g[i])
+		for _, n := range d.srcFiles() {
+			f, err := os.Open(filepath.Join(d.Dir, n))
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%s\n", n)
+			_, err = io.Copy(h, f)
+			f.Close()
 			if err != nil {
-				log.Fatalf("Can't get rel path for %v: %v", g, err)
+				return "", err
 			}
-			g[i] = r
 		}
-		pkgList = append(pkgList, g...)
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheSum is stored next to each binary in the cache to catch corruption.
+type cacheSum struct {
+	Size   int64
+	SHA256 string
+}
 
-	if err := addGoFiles(); err != nil {
-		log.Fatalf("%v", err)
+// cacheGet copies the binary cached under key to output. It returns an
+// error satisfying os.IsNotExist if there is none, and removes the entry
+// if it does not match its sum.
+func cacheGet(key, output string) error {
+	name := filepath.Join(config.CacheDir, key)
+	j, err := ioutil.ReadFile(name + ".sum")
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
 	}
+	var sum cacheSum
+	h := sha256.Sum256(b)
+	if err := json.Unmarshal(j, &sum); err != nil || sum.Size != int64(len(b)) || sum.SHA256 != hex.EncodeToString(h[:]) {
+		os.Remove(name + ".sum")
+		os.Remove(name)
+		return fmt.Errorf("cache entry %v is corrupt", key)
+	}
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output, b, 0755)
+}
 
-	if config.TempDir == "" {
-		var err error
-		config.TempDir, err = ioutil.TempDir("", "u-root")
+// cachePut stores the binary output in the cache under key. The sum is
+// written last, so that an entry is only used once it is complete.
+func cachePut(key, output string) error {
+	b, err := ioutil.ReadFile(output)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.CacheDir, 0755); err != nil {
+		return err
+	}
+	h := sha256.Sum256(b)
+	j, err := json.Marshal(cacheSum{int64(len(b)), hex.EncodeToString(h[:])})
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(config.CacheDir, key)
+	for _, f := range []struct {
+		name string
+		b    []byte
+	}{{name, b}, {name + ".sum", j}} {
+		t, err := ioutil.TempFile(config.CacheDir, key)
+		if err != nil {
+			return err
+		}
+		_, err = t.Write(f.b)
+		if cerr := t.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(t.Name(), f.name)
+		}
 		if err != nil {
-			log.Fatalf("%v", err)
+			os.Remove(t.Name())
+			return err
 		}
 	}
+	return nil
+}
 
-	defer func() {
-		log.Printf("Removing %v", config.TempDir)
-		if err := os.RemoveAll(config.TempDir); err != nil {
-			log.Fatalf("%v", err)
-		}
-	}()
+// job is one build step.
+type job struct {
+	name string
+	run  func() error
+}
 
-	if err := buildToolChain(); err != nil {
-		log.Fatalf("%v", err)
+// runJobs runs jobs on config.Jobs workers. Rather than stopping at the
+// first failure, all of them are reported together, each with the name of
+// its job.
+func runJobs(jobs []job) error {
+	start := time.Now()
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	var built int64
+	stop := progress(fmt.Sprintf("Building %d packages", len(jobs)), func() int64 { return atomic.LoadInt64(&built) })
+	defer stop()
+	todo := make(chan job)
+	for i := 0; i < config.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range todo {
+				t := time.Now()
+				err := j.run()
+				atomic.AddInt64(&built, 1)
+				logf(2, "Built %s in %v", j.name, time.Since(t))
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Sprintf("%s: %v", j.name, err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, j := range jobs {
+		todo <- j
 	}
+	close(todo)
+	wg.Wait()
+	logf(1, "Built %d packages in %v with %d workers", len(jobs), time.Since(start), config.Jobs)
 
-	if !config.UseExistingInit {
-		init := filepath.Join(config.TempDir, "init")
-		dir := filepath.Join(config.Gopath, "src/github.com/u-root/u-root/cmds/init")
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%d of %d builds failed:\n%s", len(errs), len(jobs), strings.Join(errs, "\n"))
+	}
+	return nil
+}
 
-		if err := buildPkg(".", dir, init, nil); err != nil {
-			log.Fatalf("%v", err)
-		}
+// toolChainJobs builds the four binaries needed for the go toolchain:
+// go, compile, link, and asm. We do this to ensure we get smaller binaries.
+// Smaller, in this, meaning 25M instead of 33M. What a world!
+// They are all built by the host's go, so they can be built at once.
+func toolChainJobs() []job {
+	jobs := []job{{"cmd/go", func() error {
+		goBin := filepath.Join(config.TempDir, "go/bin/go")
+		goDir := filepath.Join(config.Goroot, "src/cmd/go")
+		return buildPkg("", goDir, goBin, []string{"cmd_go_bootstrap"}, nil)
+	}}}
+	for _, pkg := range []string{"compile", "link", "asm"} {
+		pkg := "cmd/" + pkg
+		c := filepath.Join(config.TempDir, toolDir(), path.Base(pkg))
+		jobs = append(jobs, job{pkg, func() error {
+			return buildPkg(pkg, "", c, nil, nil)
+		}})
 	}
+	return jobs
+}
 
-	oname := fmt.Sprintf("/tmp/initramfs.%v_%v.cpio", config.Goos, config.Arch)
-	f, err := os.Create(oname)
+// buildBB compiles the commands in pkgList, and init, into a single
+// busybox-style binary at bbin/bb in the TempDir. Each command gets a
+// symlink to it in bbin, and init is a symlink to bbin/init.
+func buildBB() error {
+	if module.Path != "" {
+		return fmt.Errorf("-build=bb only works in GOPATH mode")
+	}
+	src, err := ioutil.TempDir("", "u-root-bb")
 	if err != nil {
-		log.Fatalf("%v", err)
+		return err
 	}
-	defer f.Close()
+	removeAtExit(src)
+	defer os.RemoveAll(src)
 
-	archiver, err := cpio.Format("newc")
+	// Vendored packages only resolve from inside the u-root tree, so
+	// the generated package goes into a mirror of its top level.
+	uroot := filepath.Join(config.Gopath, "src/github.com/u-root/u-root")
+	mirror := filepath.Join(src, "src/github.com/u-root/u-root")
+	if err := os.MkdirAll(mirror, 0755); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(uroot)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return err
+	}
+	for _, e := range entries {
+		if err := os.Symlink(filepath.Join(uroot, e.Name()), filepath.Join(mirror, e.Name())); err != nil {
+			return err
+		}
 	}
 
-	init, err := ramfs.NewInitramfs(archiver.Writer(f))
-	if err != nil {
-		log.Fatalf("%v", err)
+	cmds := bbCommands()
+	ctx := build.Default
+	ctx.GOOS = config.Goos
+	ctx.GOARCH = config.Arch
+	ctx.CgoEnabled = false
+	if t := tagFlags(); t != nil {
+		ctx.BuildTags = strings.Split(t[1], ",")
+	}
+	if err := bb.Generate(&ctx, src, "github.com/u-root/u-root/bbsh", cmds); err != nil {
+		return err
 	}
 
-	// Start with the initial CPIO.
-	if config.InitialCpio != "" {
-		initial, err := os.Open(config.InitialCpio)
-		if err != nil {
-			log.Fatalf("%v", err)
+	bbin := filepath.Join(config.TempDir, "bbin")
+	if err := os.MkdirAll(bbin, 0755); err != nil {
+		return err
+	}
+	env := []string{"GOPATH=" + src + string(filepath.ListSeparator) + os.Getenv("GOPATH")}
+	if err := buildPkg("github.com/u-root/u-root/bbsh", "", filepath.Join(bbin, "bb"), nil, env); err != nil {
+		return err
+	}
+	for _, c := range cmds {
+		if err := os.Symlink("bb", filepath.Join(bbin, c.Name)); err != nil {
+			return err
 		}
+	}
+	if !config.UseExistingInit {
+		return os.Symlink("bbin/init", filepath.Join(config.TempDir, "init"))
+	}
+	return nil
+}
 
-		transform := cpio.MakeReproducible
-		if !config.UseExistingInit {
-			transform = func(r cpio.Record) cpio.Record {
-				// Rename init to inito.
-				if r.Name == "init" {
-					r.Name = "inito"
-				}
-				return cpio.MakeReproducible(r)
-			}
+// bbCommands returns the commands that go into the busybox binary.
+func bbCommands() []bb.Command {
+	pkgs := pkgList
+	if !config.UseExistingInit {
+		pkgs = append(pkgs, "github.com/u-root/u-root/cmds/init")
+	}
+	var cmds []bb.Command
+	seen := make(map[string]bool)
+	for _, p := range pkgs {
+		name := path.Base(p)
+		if seen[name] {
+			continue
 		}
+		seen[name] = true
+		if needsToolchain[name] {
+			logf(1, "Skipping %v, which needs the Go toolchain", p)
+			continue
+		}
+		cmds = append(cmds, bb.Command{Name: name, Dir: filepath.Join(config.Gopath, "src", p)})
+	}
+	return cmds
+}
 
-		if err := init.Concat(archiver.Reader(initial), transform); err != nil {
-			log.Fatalf("%v", err)
+// binaryPkgs returns the commands that get a binary of their own in bin.
+func binaryPkgs() []string {
+	var pkgs []string
+	for _, p := range pkgList {
+		// init goes to /init.
+		if name := path.Base(p); name == "init" || needsToolchain[name] {
+			continue
 		}
+		pkgs = append(pkgs, p)
 	}
+	return pkgs
+}
 
-	// Write all Go toolchain files to the archive.
-	if err := init.WriteFiles(config.Goroot, "go", goList); err != nil {
-		log.Fatalf("%v", err)
+// binaryJobs statically compiles each command in pkgList into bin in the
+// TempDir.
+func binaryJobs() ([]job, error) {
+	bin := filepath.Join(config.TempDir, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		return nil, err
+	}
+	pkgs := binaryPkgs()
+	if !config.NoCache && len(pkgs) > 0 {
+		// The cache keys of all of them come from one listing, in
+		// which any that go list fails on have the error that keeps
+		// them out of the cache.
+		if _, err := listDeps("", goBuildFlags(), nil, pkgs...); err != nil {
+			logf(2, "Not listing the commands for the cache at once: %v", err)
+		}
+	}
+	var jobs []job
+	for _, p := range pkgs {
+		p := p
+		jobs = append(jobs, job{p, func() error {
+			return buildPkg(p, "", filepath.Join(bin, path.Base(p)), nil, nil)
+		}})
+	}
+	return jobs, nil
+}
+
+// goEnv returns the environment for running the go command for the target.
+// GOOS and GOARCH are always set, so a stale value exported in the shell
+// cannot leak into the build.
+func goEnv() []string {
+	env := append(os.Environ(), "CGO_ENABLED=0", "GOOS="+config.Goos, "GOARCH="+config.Arch)
+	if config.Gopath != "" {
+		env = append(env, "GOPATH="+config.Gopath)
+	}
+	if config.Arch == "arm" {
+		env = append(env, "GOARM="+config.Goarm)
+	}
+	if goTmpDir != "" {
+		env = append(env, "GOTMPDIR="+goTmpDir)
 	}
+	return env
+}
 
-	// Write u-root src files to the archive.
-	if err := init.WriteFiles(config.Gopath, "", urootList); err != nil {
-		log.Fatalf("%v", err)
+// toolDir returns where the toolchain for the target lives in the archive.
+func toolDir() string {
+	return filepath.Join("go/pkg/tool", config.Goos+"_"+config.Arch)
+}
+
+// guessplatform fills in whichever of GOOS, GOARCH and, for arm, GOARM was
+// not set by a flag or -config from the environment, or failing that the
+// defaults. It warns when the environment disagrees with an explicit setting.
+func guessplatform() {
+	guess := func(name string, val *string, def string) {
+		env := os.Getenv(name)
+		switch {
+		case *val != "":
+			if env != "" && env != *val {
+				log.Printf("Warning: building for %s=%s, but %s=%s is set in the environment", name, *val, name, env)
+			}
+		case env != "":
+			*val = env
+		default:
+			*val = def
+		}
+	}
+	guess("GOOS", &config.Goos, "linux")
+	guess("GOARCH", &config.Arch, runtime.GOARCH)
+	if config.Arch == "arm" {
+		guess("GOARM", &config.Goarm, "5")
+	} else {
+		config.Goarm = ""
 	}
+}
 
-	// Write all files from the TempDir.
-	if err := init.WriteFile(config.TempDir, ""); err != nil {
-		log.Fatalf("%v", err)
+// checkplatform returns an error if the go command does not support the
+// GOOS/GOARCH pair in config.
+func checkplatform() error {
+	o, err := command("go", "tool", "dist", "list").Output()
+	if err != nil {
+		return fmt.Errorf("listing supported platforms: %v", err)
+	}
+	if config.Goarm != "" && config.Goarm != "5" && config.Goarm != "6" && config.Goarm != "7" {
+		return fmt.Errorf("GOARM=%s is not one of 5, 6 or 7", config.Goarm)
 	}
+	p := config.Goos + "/" + config.Arch
+	for _, l := range strings.Fields(string(o)) {
+		if l == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a platform supported by go; see go tool dist list", p)
+}
+
+// buildInit compiles cmds/init to init in the TempDir.
+func buildInit() error {
+	dir := filepath.Join(urootDir(), "cmds/init")
+	return buildPkg(".", dir, filepath.Join(config.TempDir, "init"), nil, nil)
+}
 
-	if err := init.WriteTrailer(); err != nil {
-		log.Fatalf("%v", err)
+// buildUinit puts the -uinit program at bin/uinit in the TempDir, building
+// it if it is a Go package rather than a binary, with the -uinitargs in
+// etc/uinit.args.
+func buildUinit() error {
+	if config.UinitArgs != "" {
+		etc := filepath.Join(config.TempDir, "etc")
+		if err := os.MkdirAll(etc, 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(etc, "uinit.args"), []byte(config.UinitArgs+"\n"), 0644); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("Output file is %s", oname)
+	dst := filepath.Join(config.TempDir, "bin/uinit")
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	fi, err := os.Stat(config.Uinit)
+	switch {
+	case err == nil && fi.Mode().IsRegular():
+		b, err := ioutil.ReadFile(config.Uinit)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dst, b, 0755)
+	case err == nil && fi.IsDir():
+		return buildPkg(".", config.Uinit, dst, nil, nil)
+	default:
+		return buildPkg(config.Uinit, "", dst, nil, nil)
+	}
+}
+
+// checkUinit checks -uinit and -uinitargs against the init they are for,
+// warning if that is an existing init, which may be too old to run
+// /bin/uinit.
+func checkUinit() error {
+	if config.Uinit == "" && config.UinitArgs != "" {
+		return fmt.Errorf("-uinitargs needs -uinit")
+	}
+	if config.Uinit != "" && config.UseExistingInit {
+		// Only an init from here is known to run /bin/uinit.
+		log.Printf("Warning: -uinit: the existing init is kept, and may not run /bin/uinit")
+	}
+	return nil
+}
+
+func guessgoroot() {
+	switch root := os.Getenv("GOROOT"); {
+	case config.Goroot != "":
+		// Already set by -config.
+	case root != "":
+		config.Goroot = filepath.Clean(root)
+	default:
+		config.Goroot = runtime.GOROOT()
+	}
+	logf(1, "Using %q as GOROOT", config.Goroot)
+}
+
+// goDownloadURL is where -go-version gets Go releases, and their .sha256
+// files, from.
+var goDownloadURL = "https://dl.google.com/go/"
+
+// useGoVersion makes the go command the release given with -go-version,
+// unless that is the host's already. The release is downloaded into the
+// cache directory the first time, and from then on used from there. It
+// goes first in PATH, and is GOROOT, for every go command run from here
+// on, go/packages' included.
+func useGoVersion() error {
+	v := "go" + strings.TrimPrefix(config.GoVersion, "go")
+	if o, err := command("go", "env", "GOVERSION").Output(); err == nil && strings.TrimSpace(string(o)) == v {
+		logf(2, "-go-version: %s is the host's go", v)
+		return nil
+	}
+	if config.Goroot != "" {
+		return fmt.Errorf("-go-version: GOROOT is set to %q by -config; set one or the other", config.Goroot)
+	}
+
+	dir := config.CacheDir
+	if dir == "" {
+		d, err := os.UserCacheDir()
+		if err != nil {
+			return fmt.Errorf("-go-version: %v", err)
+		}
+		dir = filepath.Join(d, "u-root")
+	}
+	root, err := fetchGo(v, filepath.Join(dir, "go"))
+	if err != nil {
+		return fmt.Errorf("-go-version: %v", err)
+	}
+	logf(1, "Using %s from %q", v, root)
+	os.Setenv("PATH", filepath.Join(root, "bin")+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	os.Setenv("GOROOT", root)
+	// Newer go commands would otherwise switch to whatever toolchain a
+	// go.mod asks for.
+	os.Setenv("GOTOOLCHAIN", "local")
+	return nil
+}
+
+// fetchGo returns the GOROOT of the Go release v, for the host, in dir,
+// downloading it there first if it is not yet. The download is checked
+// against the release's published SHA256 before anything is unpacked.
+func fetchGo(v, dir string) (string, error) {
+	root := filepath.Join(dir, v, "go")
+	if _, err := os.Stat(filepath.Join(root, "bin", "go")); err == nil {
+		return root, nil
+	}
+
+	name := fmt.Sprintf("%s.%s-%s.tar.gz", v, runtime.GOOS, runtime.GOARCH)
+	fail := func(err error) (string, error) {
+		return "", fmt.Errorf("%s is not in %s, and downloading %s failed: %v", v, dir, goDownloadURL+name, err)
+	}
+	sum, err := download(goDownloadURL + name + ".sha256")
+	if err != nil {
+		return fail(err)
+	}
+	fields := strings.Fields(string(sum))
+	if len(fields) == 0 {
+		return fail(fmt.Errorf("%s.sha256 is empty", name))
+	}
+	tgz, err := download(goDownloadURL + name)
+	if err != nil {
+		return fail(err)
+	}
+	h := sha256.Sum256(tgz)
+	if got := hex.EncodeToString(h[:]); got != strings.ToLower(fields[0]) {
+		return "", fmt.Errorf("%s: SHA256 is %s, but %s.sha256 says %s", name, got, name, fields[0])
+	}
+
+	// It is unpacked beside where it goes, and only moved into place
+	// when complete, so that an interrupted unpacking is not used.
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(dir, v+".")
+	if err != nil {
+		return "", err
+	}
+	removeAtExit(tmp)
+	defer os.RemoveAll(tmp)
+	if err := untar(bytes.NewReader(tgz), tmp); err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "go", "bin", "go")); err != nil {
+		return "", fmt.Errorf("%s has no go/bin/go", name)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, v)); err != nil {
+		return "", err
+	}
+	return root, nil
+}
+
+// download returns what is at url.
+func download(url string) ([]byte, error) {
+	logf(1, "Downloading %s", url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// untar unpacks the gzipped tar archive in r into dir. Only directories,
+// regular files and symlinks are unpacked, and none of them may end up
+// outside dir.
+func untar(r io.Reader, dir string) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("%s is outside the archive", hdr.Name)
+		}
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, os.FileMode(hdr.Mode&0777)|0700)
+		case tar.TypeReg:
+			var f *os.File
+			if f, err = os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(hdr.Mode&0777)); err != nil {
+				return err
+			}
+			if _, err = io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			err = f.Close()
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) {
+				return fmt.Errorf("%s links to %s, outside the archive", hdr.Name, hdr.Linkname)
+			}
+			t := filepath.Clean(filepath.Join(filepath.Dir(name), hdr.Linkname))
+			if t == ".." || strings.HasPrefix(t, "../") {
+				return fmt.Errorf("%s links to %s, outside the archive", hdr.Name, hdr.Linkname)
+			}
+			err = os.Symlink(hdr.Linkname, p)
+		default:
+			logf(2, "Not unpacking %s, of tar type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func guesscachedir() {
+	if config.CacheDir != "" || config.NoCache {
+		return
+	}
+	d, err := os.UserCacheDir()
+	if err != nil {
+		log.Printf("Not caching builds: %v", err)
+		config.NoCache = true
+		return
+	}
+	config.CacheDir = filepath.Join(d, "u-root")
+}
+
+func guessgopath() {
+	if config.Gopath != "" {
+		return
+	}
+	gopath := os.Getenv("GOPATH")
+	if gopath != "" {
+		config.Gopath = gopath
+		return
+	}
+	if module.Path != "" {
+		// Not needed in module mode.
+		return
+	}
+	fatalf("You have to set GOPATH, which is typically ~/go")
+}
+
+// guessmodule finds the module the current directory is in, if the go
+// command is in module mode.
+func guessmodule() error {
+	cmd := command("go", "env", "GOMOD")
+	cmd.Env = goEnv()
+	o, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("go env GOMOD: %v", err)
+	}
+	// GOMOD is os.DevNull in module mode outside of a module.
+	if gomod := strings.TrimSpace(string(o)); gomod == "" || gomod == os.DevNull {
+		return nil
+	}
+
+	cmd = command("go", "list", "-m", "-json")
+	cmd.Env = goEnv()
+	if o, err = cmd.Output(); err != nil {
+		return fmt.Errorf("go list -m: %v", err)
+	}
+	return json.Unmarshal(o, &module)
+}
+
+// urootDir returns the directory of the u-root source tree.
+func urootDir() string {
+	if module.Path != "" {
+		return module.Dir
+	}
+	return filepath.Join(config.Gopath, "src/github.com/u-root/u-root")
+}
+
+// importPath returns the import path of the package in dir.
+func importPath(dir string) (string, error) {
+	if module.Path == "" {
+		return filepath.Rel(filepath.Join(config.Gopath, "src"), dir)
+	}
+	r, err := filepath.Rel(module.Dir, dir)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(module.Path, filepath.ToSlash(r)), nil
+}
+
+type goPackage struct {
+	Dir        string
+	Deps       []string
+	GoFiles    []string
+	SFiles     []string
+	HFiles     []string
+	EmbedFiles []string
+	Goroot     bool
+	Standard   bool
+	ImportPath string
+	Error      *goListError
+	DepsErrors []*goListError
+}
+
+// goListError is an error go list -e reports for a package.
+type goListError struct {
+	Err string
+}
+
+// goListPkgs runs one go list for all the packages in names and, with
+// deps, everything they import, and returns them in the order go list gives
+// them. With -e, a package that can not be loaded comes back with its Error
+// set rather than failing the whole call; the caller decides what that
+// means. It is what -golist uses in place of loadPkgs.
+func goListPkgs(deps bool, names ...string) ([]*goPackage, error) {
+	args := append([]string{"list", "-e", "-json"}, tagFlags()...)
+	if deps {
+		args = append(args, "-deps")
+	}
+	args = append(args, names...)
+	logf(2, "Listing %s", strings.Join(names, " "))
+	cmd := command("go", args...)
+	cmd.Env = goEnv()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	j, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	// The output is a stream of JSON objects, one per package, which
+	// json.Unmarshal rejects but a Decoder reads one at a time.
+	var pkgs []*goPackage
+	d := json.NewDecoder(bytes.NewReader(j))
+	for {
+		var p goPackage
+		if err := d.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("go %s: %v", strings.Join(args, " "), err)
+		}
+		pkgs = append(pkgs, &p)
+	}
+	return pkgs, nil
+}
+
+// loadPkgs is goListPkgs done with go/packages, which hands back the
+// packages as structured data instead of JSON to be picked out of go list's
+// output. The packages are turned into goPackages, so that the rest of
+// addGoFiles does not care which of the two found them.
+func loadPkgs(deps bool, names ...string) ([]*goPackage, error) {
+	logf(2, "Loading %s", strings.Join(names, " "))
+	cfg := &packages.Config{
+		Mode:       packages.NeedName | packages.NeedFiles | packages.NeedEmbedFiles | packages.NeedImports | packages.NeedDeps,
+		Context:    ctx,
+		Env:        goEnv(),
+		BuildFlags: tagFlags(),
+	}
+	roots, err := packages.Load(cfg, names...)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %v", strings.Join(names, " "), err)
+	}
+
+	var pkgs []*goPackage
+	converted := make(map[*packages.Package]*goPackage)
+	var convert func(p *packages.Package) *goPackage
+	convert = func(p *packages.Package) *goPackage {
+		if g, ok := converted[p]; ok {
+			return g
+		}
+		g := &goPackage{Dir: p.Dir, ImportPath: p.PkgPath, GoFiles: basenames(p.GoFiles)}
+		converted[p] = g
+		if g.ImportPath == "" {
+			g.ImportPath = p.ID
+		}
+		// Embedded files may be in subdirectories, and go list gives
+		// them relative to the package.
+		for _, f := range p.EmbedFiles {
+			if rel, err := filepath.Rel(p.Dir, f); err == nil {
+				g.EmbedFiles = append(g.EmbedFiles, rel)
+			}
+		}
+		for _, f := range basenames(p.OtherFiles) {
+			switch filepath.Ext(f) {
+			case ".s", ".S":
+				g.SFiles = append(g.SFiles, f)
+			case ".h", ".hh", ".hpp", ".hxx":
+				g.HFiles = append(g.HFiles, f)
+			}
+		}
+		if rel, err := filepath.Rel(filepath.Join(config.Goroot, "src"), p.Dir); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			g.Goroot, g.Standard = true, true
+		}
+		if len(p.Errors) > 0 {
+			g.Error = &goListError{p.Errors[0].Msg}
+		}
+
+		// Deps and DepsErrors are of everything p imports, however
+		// far down, as go list gives them.
+		seen := make(map[string]bool)
+		for _, i := range p.Imports {
+			d := convert(i)
+			for _, n := range append([]string{d.ImportPath}, d.Deps...) {
+				seen[n] = true
+			}
+			if d.Error != nil {
+				g.DepsErrors = append(g.DepsErrors, d.Error)
+			}
+			g.DepsErrors = append(g.DepsErrors, d.DepsErrors...)
+		}
+		for n := range seen {
+			g.Deps = append(g.Deps, n)
+		}
+		sort.Strings(g.Deps)
+		if deps {
+			pkgs = append(pkgs, g)
+		}
+		return g
+	}
+	for _, p := range roots {
+		g := convert(p)
+		if !deps {
+			pkgs = append(pkgs, g)
+		}
+	}
+	return pkgs, nil
+}
+
+// basenames returns the last elements of the paths in files.
+func basenames(files []string) []string {
+	var b []string
+	for _, f := range files {
+		b = append(b, filepath.Base(f))
+	}
+	return b
+}
+
+// err returns the error that keeps p from being built, from p itself or
+// from one of its dependencies, or nil.
+func (p *goPackage) err() error {
+	if p.Error != nil {
+		return fmt.Errorf("go list %s: %s", p.ImportPath, p.Error.Err)
+	}
+	if len(p.DepsErrors) > 0 {
+		return fmt.Errorf("go list %s: %s", p.ImportPath, p.DepsErrors[0].Err)
+	}
+	return nil
+}
+
+// srcFiles returns the names, relative to its directory, of the files p
+// needs to build, embedded ones included.
+func (p *goPackage) srcFiles() []string {
+	return append(append(append(append([]string(nil), p.GoFiles...), p.SFiles...), p.HFiles...), p.EmbedFiles...)
+}
+
+// addPkgFiles adds the files p needs to build, separating them into Go
+// tree files and uroot files, or, in module mode, module files.
+func addPkgFiles(p *goPackage) {
+	// Nothing from an excluded package may end up in the archive.
+	if excluded(p.ImportPath) {
+		return
+	}
+
+	// Non-standard packages in module mode can be anywhere in the
+	// module cache, and go to src/<import path>, so that the go tool in
+	// the image finds them in GOPATH mode.
+	if module.Path != "" && !p.Goroot {
+		for _, v := range p.srcFiles() {
+			moduleFiles[filepath.Join("src", p.ImportPath, v)] = filepath.Join(p.Dir, v)
+		}
+		return
+	}
+
+	// The files go where they are relative to src, rather than where
+	// the import path says, so that vendored packages stay in their
+	// vendor directory and resolve in the image as they did here.
+	root, files := config.Gopath, urootFiles
+	if p.Goroot {
+		root, files = config.Goroot, gorootFiles
+	}
+	dir, err := filepath.Rel(filepath.Join(root, "src"), p.Dir)
+	if err != nil || dir == ".." || strings.HasPrefix(dir, "../") {
+		dir = p.ImportPath
+	}
+	for _, v := range p.srcFiles() {
+		files[filepath.Join(dir, v)] = true
+	}
+}
+
+// dropShadowed removes the files of packages in GOPATH that a vendored copy
+// takes the place of, since the vendored one is what gets compiled.
+func dropShadowed(files map[string]bool) {
+	vendored := make(map[string]bool)
+	for f := range files {
+		dir := filepath.Dir(f)
+		if i := strings.LastIndex(dir, "/vendor/"); i != -1 {
+			vendored[dir[i+len("/vendor/"):]] = true
+		}
+	}
+	for f := range files {
+		if vendored[filepath.Dir(f)] {
+			delete(files, f)
+		}
+	}
+}
+
+// addGoFiles Computes the set of Go files to be added to the initramfs, in
+// GOPATH and module mode alike.
+func addGoFiles() error {
+	if len(pkgList) == 0 {
+		return nil
+	}
+	// One listing of the roots finds the ones that can not be built,
+	// and which root each dependency comes from, for the errors.
+	// roots has, for each dependency, the package that pulled it in.
+	list := loadPkgs
+	if config.GoList {
+		list = goListPkgs
+	}
+	ps, err := list(false, pkgList...)
+	if err != nil {
+		return err
+	}
+	roots := make(map[string]string)
+	var errs, good []string
+	for _, p := range ps {
+		if err := p.err(); err != nil {
+			if config.Strict {
+				errs = append(errs, err.Error())
+			} else {
+				log.Printf("Warning: leaving out %v: %v", p.ImportPath, err)
+				skipped = append(skipped, p.ImportPath)
+			}
+			continue
+		}
+		// Nothing pulled in only by an excluded package may end
+		// up in the archive either.
+		if excluded(p.ImportPath) {
+			continue
+		}
+		good = append(good, p.ImportPath)
+		for _, d := range p.Deps {
+			deps[d] = true
+			if _, ok := roots[d]; !ok {
+				roots[d] = p.ImportPath
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d packages failed; -strict=false to leave them out:\n%s", len(errs), len(pkgList), strings.Join(errs, "\n"))
+	}
+	if len(good) == 0 {
+		return nil
+	}
+
+	// A second lists the roots and everything they need.
+	ps, err = list(true, good...)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		if p.Error != nil {
+			return fmt.Errorf("%v, needed by %v: %v", p.ImportPath, roots[p.ImportPath], p.Error.Err)
+		}
+		addPkgFiles(p)
+	}
+	dropShadowed(urootFiles)
+	for v := range gorootFiles {
+		goList = append(goList, filepath.Join("src", v))
+	}
+	for v := range urootFiles {
+		urootList = append(urootList, filepath.Join("src", v))
+	}
+	// The same files in the same order make the same archive.
+	sort.Strings(goList)
+	sort.Strings(urootList)
+	return nil
+}
+
+// excluded returns true if the package pkg matches one of the -exclude
+// patterns.
+func excluded(pkg string) bool {
+	for _, e := range config.Excludes {
+		name := pkg
+		if !strings.Contains(e, "/") {
+			name = path.Base(pkg)
+		}
+		if m, _ := path.Match(e, name); m {
+			return true
+		}
+	}
+	return false
+}
+
+func globlist(s ...string) ([]string, error) {
+	// For each arg, use it as a Glob pattern and add any matches to the
+	// package list. If there are no arguments, use [a-zA-Z]* as the glob pattern.
+	// Patterns are absolute, or relative to GOPATH, or in module mode to
+	// the module. An arg without a / is the name of a template instead,
+	// and never a glob, so that a misspelt one is an error rather than no
+	// commands.
+	base := config.Gopath
+	if module.Path != "" {
+		base = module.Dir
+	}
+	var pat []string
+	for _, v := range s {
+		if filepath.IsAbs(v) {
+			pat = append(pat, v)
+			continue
+		}
+		if strings.Contains(v, "/") {
+			pat = append(pat, filepath.Join(base, v))
+			continue
+		}
+		cmds, ok := templates[v]
+		if !ok {
+			return nil, fmt.Errorf("%q is not a template, which are %s; globs of packages have a /", v, strings.Join(templateNames(), ", "))
+		}
+		for _, c := range cmds {
+			pat = append(pat, filepath.Join(urootDir(), "cmds", c))
+		}
+	}
+	if len(s) == 0 {
+		pat = []string{filepath.Join(urootDir(), "cmds", "[a-zA-Z]*")}
+	}
+	return pat, nil
+}
+
+// selectPkgs returns the import paths of the packages args select, in
+// order. Each arg is a template or glob adding to the packages selected
+// so far, or, with a leading - or ^, a glob subtracting from them, e.g.
+// "all -cmds/tcz -cmds/wifi". Subtractions are matched against the end of
+// the import paths. Without any adding arg, all of cmds is selected.
+// An arg that is not a glob matching anything is taken as an import path,
+// e.g. github.com/corp/tools/cmd/agent, or in module mode a pattern of
+// packages in the build list. Two commands must not have the same name.
+func selectPkgs(args ...string) ([]string, error) {
+	var add []string
+	for _, a := range args {
+		if _, ok := subtraction(a); !ok {
+			add = append(add, a)
+		}
+	}
+	if len(add) == 0 {
+		args = append([]string{"all"}, args...)
+	}
+
+	var pkgs []string
+	// Templates and globs can well name the same commands.
+	listed := make(map[string]bool)
+	for _, a := range args {
+		if e, ok := subtraction(a); ok {
+			var kept []string
+			for _, p := range pkgs {
+				if subtracted(p, e) {
+					delete(listed, p)
+					continue
+				}
+				kept = append(kept, p)
+			}
+			if len(kept) == len(pkgs) {
+				log.Printf("Warning: %s: %s is not among the packages selected before it", a, e)
+			}
+			pkgs = kept
+			continue
+		}
+		pat, err := globlist(a)
+		if err != nil {
+			return nil, err
+		}
+		var found []string
+		for _, v := range pat {
+			g, err := filepath.Glob(v)
+			if err != nil {
+				return nil, fmt.Errorf("glob %s: %v", v, err)
+			}
+			// We have a set of absolute paths in g.  We can not
+			// use absolute paths in go list, however, so we have
+			// to adjust them. Those outside GOPATH/src or the
+			// module are left to go list.
+			for i := range g {
+				r, err := importPath(g[i])
+				if err != nil || r == ".." || strings.HasPrefix(r, "../") || strings.Contains(r, "/../") {
+					if r, err = goListImportPaths(g[i]); err != nil {
+						return nil, err
+					}
+				}
+				found = append(found, strings.Fields(r)...)
+			}
+		}
+		if len(found) == 0 {
+			if strings.ContainsAny(a, "*?[") {
+				log.Printf("Warning: %s matches nothing", a)
+				continue
+			}
+			r, err := goListImportPaths(a)
+			if err != nil {
+				return nil, fmt.Errorf("%s is neither a directory nor a package: %v", a, err)
+			}
+			found = strings.Fields(r)
+		}
+		for _, r := range found {
+			if excluded(r) || listed[r] {
+				continue
+			}
+			listed[r] = true
+			pkgs = append(pkgs, r)
+		}
+	}
+
+	named := make(map[string]string)
+	for _, p := range pkgs {
+		n := path.Base(p)
+		if o, ok := named[n]; ok {
+			return nil, fmt.Errorf("%s and %s are both commands named %s; -exclude or subtract one of them", o, p, n)
+		}
+		named[n] = p
+	}
+	return pkgs, nil
+}
+
+// goListImportPaths returns the import paths of the packages go list finds
+// for args, directories or import paths, separated by newlines. A
+// directory outside GOPATH/src and the module has no usable import path.
+func goListImportPaths(args ...string) (string, error) {
+	cmd := command("go", append(append([]string{"list", "-f", "{{.ImportPath}}"}, tagFlags()...), args...)...)
+	cmd.Env = goEnv()
+	o, err := cmd.Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && len(e.Stderr) > 0 {
+			err = fmt.Errorf("go list: %s", bytes.TrimSpace(e.Stderr))
+		}
+		return "", err
+	}
+	for _, r := range strings.Fields(string(o)) {
+		if strings.HasPrefix(r, "_/") {
+			return "", fmt.Errorf("%s is outside %s and the module, so it has no import path", r[1:], filepath.Join(config.Gopath, "src"))
+		}
+	}
+	return string(o), nil
+}
+
+// subtraction returns the glob of the arg a, and true, if a subtracts
+// packages, with a leading - or ^. flag takes an arg with a leading - that
+// comes before any other as a flag, so a first arg that subtracts needs a
+// -- before it, as in "-- -cmds/tcz", or a ^, as in "^cmds/tcz".
+func subtraction(a string) (string, bool) {
+	if strings.HasPrefix(a, "-") || strings.HasPrefix(a, "^") {
+		return a[1:], true
+	}
+	return "", false
+}
+
+// subtracted reports whether the glob e, as given after a - or ^, matches
+// the import path pkg, or its last elements.
+func subtracted(pkg, e string) bool {
+	n := strings.Count(e, "/") + 1
+	el := strings.Split(pkg, "/")
+	if len(el) < n {
+		return false
+	}
+	m, _ := path.Match(e, strings.Join(el[len(el)-n:], "/"))
+	return m
+}
+
+// templateNames returns the names of the templates, sorted.
+func templateNames() []string {
+	var names []string
+	for n := range templates {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// printTemplates writes a line to w for each template, with the commands
+// its globs match.
+func printTemplates(w io.Writer) error {
+	for _, n := range templateNames() {
+		var cmds []string
+		for _, c := range templates[n] {
+			g, err := filepath.Glob(filepath.Join(urootDir(), "cmds", c))
+			if err != nil {
+				return err
+			}
+			for _, m := range g {
+				cmds = append(cmds, filepath.Base(m))
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s\n", n, strings.Join(cmds, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extraFile is a host file or directory added to the archive with -files.
+type extraFile struct {
+	src string
+	dst string
+}
+
+// extraFiles parses the -files arguments. Without an explicit archive path,
+// a file goes to the same path in the archive as on the host.
+func extraFiles() ([]extraFile, error) {
+	var files []extraFile
+	for _, v := range config.Files {
+		f := extraFile{src: v, dst: v}
+		if i := strings.LastIndex(v, ":"); i != -1 {
+			f.src, f.dst = v[:i], v[i+1:]
+		}
+		// The whole host, or the whole archive, is never meant.
+		if f.src == "" || filepath.Clean(f.src) == "/" {
+			return nil, fmt.Errorf("-files: %q: the host path is empty or /", v)
+		}
+		if _, err := os.Lstat(f.src); err != nil {
+			return nil, fmt.Errorf("-files: %v", err)
+		}
+		f.dst = strings.TrimLeft(filepath.Clean(f.dst), "/")
+		if !ramfs.Below(f.dst) {
+			return nil, fmt.Errorf("-files: %q: the archive path is not below its root", v)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// symlink is a link added with -symlinks.
+type symlink struct {
+	path   string
+	target string
+}
+
+// parseSymlinks parses the -symlinks arguments. The target is kept as it
+// is, so it can be relative or absolute.
+func parseSymlinks() ([]symlink, error) {
+	var links []symlink
+	for _, v := range config.Symlinks {
+		i := strings.Index(v, ":")
+		if i == -1 || i == 0 || i == len(v)-1 {
+			return nil, fmt.Errorf("-symlinks: %q is not linkpath:target", v)
+		}
+		l := symlink{path: strings.TrimLeft(path.Clean(v[:i]), "/"), target: v[i+1:]}
+		if !ramfs.Below(l.path) {
+			return nil, fmt.Errorf("-symlinks: %q: the link path is not below the archive's root", v)
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// etcSkeleton is the /etc that commands, ours or not, expect to find.
+var etcSkeleton = map[string]string{
+	"passwd":        "root:x:0:0:root:/:/bin/sh\n",
+	"group":         "root:x:0:\n",
+	"nsswitch.conf": "passwd: files\ngroup: files\nshadow: files\nhosts: files dns\n",
+	"hosts":         "127.0.0.1\tlocalhost\n::1\tlocalhost\n",
+	"resolv.conf":   "",
+}
+
+// etcFiles parses the -etc arguments into a map of etcSkeleton names to
+// host files.
+func etcFiles() (map[string]string, error) {
+	files := make(map[string]string)
+	for _, v := range config.Etc {
+		i := strings.Index(v, ":")
+		if i == -1 {
+			return nil, fmt.Errorf("-etc: %q is not name:hostpath", v)
+		}
+		name, src := v[:i], v[i+1:]
+		if _, ok := etcSkeleton[name]; !ok {
+			return nil, fmt.Errorf("-etc: %q is not one of the generated files", name)
+		}
+		if _, err := os.Stat(src); err != nil {
+			return nil, fmt.Errorf("-etc: %v", err)
+		}
+		files[name] = src
+	}
+	return files, nil
+}
+
+// writeEtc writes the etcSkeleton, with the -etc files instead of the
+// generated ones they replace.
+func writeEtc(init *ramfs.Initramfs, origin func(kind, src, dst string)) error {
+	var names []string
+	for n := range etcSkeleton {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		dst := path.Join("etc", n)
+		if src, ok := etcHost[n]; ok {
+			origin("etc", src, dst)
+			if err := init.WriteFile(src, dst); err != nil {
+				return err
+			}
+			continue
+		}
+		origin("etc", "", "")
+		if err := init.WriteRecord(cpio.NewRecordFromBytes([]byte(etcSkeleton[n]), cpio.Info{
+			Name: dst,
+			Mode: syscall.S_IFREG | 0644,
+		})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSkeleton writes the ramfs skeleton, unless -noskeleton, around what
+// is in the archive already. It has no device nodes with -nodevnodes and no
+// /etc with -noetc.
+func writeSkeleton(init *ramfs.Initramfs, origin func(kind, src, dst string)) error {
+	if config.NoSkeleton {
+		return nil
+	}
+	origin("skeleton", "", "")
+	init.SetSource(ramfs.Source{Name: "skeleton", Default: true})
+	return ramfs.WriteDefaultSkeleton(init, ramfs.SkeletonOpts{NoConsole: config.NoDevNodes, NoEtc: config.NoEtc})
+}
+
+// devNodes returns the -devnodes.
+func devNodes() ([]cpio.Record, error) {
+	var recs []cpio.Record
+	for _, v := range config.DevNodes {
+		f := strings.Split(v, ":")
+		if len(f) != 4 && len(f) != 5 {
+			return nil, fmt.Errorf("-devnodes: %q is not path:c|b:major:minor[:mode]", v)
+		}
+		var mode uint64
+		switch f[1] {
+		case "c":
+			mode = syscall.S_IFCHR
+		case "b":
+			mode = syscall.S_IFBLK
+		default:
+			return nil, fmt.Errorf("-devnodes: %q: type %q is not c or b", v, f[1])
+		}
+		major, err := strconv.ParseUint(f[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("-devnodes: %q: %v", v, err)
+		}
+		minor, err := strconv.ParseUint(f[3], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("-devnodes: %q: %v", v, err)
+		}
+		perm := uint64(0600)
+		if len(f) == 5 {
+			if perm, err = strconv.ParseUint(f[4], 8, 12); err != nil {
+				return nil, fmt.Errorf("-devnodes: %q: %v", v, err)
+			}
+		}
+		name := strings.TrimLeft(path.Clean(f[0]), "/")
+		recs = append(recs, cpio.Record{Info: cpio.Info{Name: name, Mode: mode | perm, Rmajor: major, Rminor: minor}})
+	}
+	return recs, nil
+}
+
+// initRecords returns the records the archive starts with: ramfs.DevCPIO,
+// without its device nodes if -nodevnodes, without its resolv.conf, without
+// what the -devnodes devs replace, and without
+// dev/console, which writeDevNodes makes. Since the archive keeps the
+// first record of a name, these are there even if a -cpio archive has
+// something else under the same name.
+func initRecords(devs []cpio.Record) []cpio.Record {
+	replaced := make(map[string]bool)
+	for _, r := range devs {
+		replaced[r.Name] = true
+	}
+	var recs []cpio.Record
+	for _, r := range ramfs.DevCPIO {
+		if t := r.Mode & syscall.S_IFMT; config.NoDevNodes && (t == syscall.S_IFCHR || t == syscall.S_IFBLK) {
+			continue
+		}
+		// The /etc skeleton has its own resolv.conf, which is
+		// written after the -cpio archive so it does not replace
+		// the archive's, and -noetc means none at all.
+		if r.Name == "etc/resolv.conf" || r.Name == "dev/console" || replaced[r.Name] {
+			continue
+		}
+		// ramfs.DevCPIO is shared, so each archive reads the
+		// contents through its own reader.
+		if ra, ok := r.ReadCloser.(io.ReaderAt); ok {
+			r.ReadCloser = cpio.NewReadCloser(io.NewSectionReader(ra, 0, int64(r.FileSize)))
+		}
+		recs = append(recs, r)
+	}
+	return recs
+}
+
+// writeDevNodes writes the -devnodes devs, and the directories they are
+// in, then dev/console, unless -nodevnodes or a -devnodes is. Like the
+// records init starts with, they override the records of the same name
+// written after them.
+func writeDevNodes(init *ramfs.Initramfs, devs []cpio.Record, origin func(kind, src, dst string)) error {
+	origin("devnodes", "", "")
+	init.SetSource(ramfs.Source{Name: "-devnodes", Override: true})
+	for _, r := range devs {
+		if err := init.WriteRecord(r); err != nil {
+			return err
+		}
+	}
+	if !config.NoDevNodes {
+		origin("ramfs", "", "")
+		init.SetSource(ramfs.Source{Name: "ramfs", Override: true})
+		if err := init.CharDev("dev/console", 0600, 5, 1); err != nil {
+			return err
+		}
+	}
+	init.SetSource(ramfs.Source{})
+	return nil
+}
+
+// libraries returns the dynamic loaders and shared libraries that the ELF
+// files among files, or in their directories, need. They go to the same
+// paths in the archive as on the host, so the loader finds them where it
+// was told to look.
+func libraries(files []extraFile) ([]extraFile, error) {
+	var names []string
+	for _, f := range files {
+		if err := filepath.Walk(f.src, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() {
+				names = append(names, p)
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	needed, err := ldd.Needed(names)
+	if err != nil {
+		return nil, err
+	}
+	var libs []extraFile
+	for _, n := range needed {
+		libs = append(libs, extraFile{src: n.FullName, dst: strings.TrimLeft(n.FullName, "/")})
+	}
+	return libs, nil
+}
+
+// loadConfig reads settings from the JSON file name, whose keys are the
+// fields of config. Unknown keys are an error, to catch typos. The command
+// line is then parsed again so that it takes precedence over the file.
+func loadConfig(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The packages from the command line share os.Args, which decoding
+	// the file's into them would overwrite; they are parsed again below.
+	config.Packages = nil
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&config); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	// A repeatable flag given on the command line replaces the list
+	// from the file rather than adding to it.
+	flag.Visit(func(f *flag.Flag) {
+		if l, ok := f.Value.(*stringList); ok {
+			*l = nil
+		}
+	})
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	if flag.NArg() > 0 {
+		config.Packages = flag.Args()
+	}
+	return nil
+}
+
+// outputExts are the extensions of the default output of each -format.
+var outputExts = map[string]string{
+	"newc":     "cpio",
+	"crc":      "cpio",
+	"odc":      "cpio",
+	"bin":      "cpio",
+	"tar":      "tar",
+	"squashfs": "squashfs",
+	"ext4":     "ext4",
+}
+
+// outputPath returns the absolute path the archive will be written to,
+// creating any missing parent directories, or - for stdout. With -extract,
+// it is the directory to extract to, which is created and has to be
+// empty. The output may not live inside
+// config.TempDir, since all of that goes into the archive.
+func outputPath(suffix string) (string, error) {
+	o := config.Output
+	switch {
+	case o == "-":
+		return o, nil
+	case config.Extract != "":
+		o = config.Extract
+	case o == "":
+		ext, ok := outputExts[config.Format]
+		if !ok {
+			ext = config.Format
+		}
+		o = fmt.Sprintf("/tmp/initramfs.%v_%v.%s%s", config.Goos, config.Arch, ext, suffix)
+	}
+	o, err := filepath.Abs(o)
+	if err != nil {
+		return "", err
+	}
+
+	t, err := filepath.Abs(config.TempDir)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(t, o); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("output %q is inside tmpdir %q, which is archived", o, t)
+	}
+
+	if config.Extract != "" {
+		if err := os.MkdirAll(o, 0755); err != nil {
+			return "", err
+		}
+		d, err := os.Open(o)
+		if err != nil {
+			return "", err
+		}
+		defer d.Close()
+		if n, err := d.Readdirnames(1); err != io.EOF {
+			if err == nil {
+				err = fmt.Errorf("%s is not empty: it has %s", o, n[0])
+			}
+			return "", err
+		}
+		return o, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(o), 0755); err != nil {
+		return "", err
+	}
+	return o, nil
+}
+
+// artifacts returns the names of what the build puts in the TempDir.
+func artifacts() []string {
+	var a []string
+	switch config.Build {
+	case "source":
+		if config.NoToolchain {
+			break
+		}
+		a = append(a, "go/bin/go")
+		for _, t := range []string{"compile", "link", "asm"} {
+			a = append(a, filepath.Join(toolDir(), t))
+		}
+	case "bb":
+		a = append(a, "bbin/bb")
+		for _, c := range bbCommands() {
+			a = append(a, filepath.Join("bbin", c.Name))
+		}
+		if !config.UseExistingInit {
+			a = append(a, "init")
+		}
+	case "binaries":
+		for _, p := range binaryPkgs() {
+			a = append(a, filepath.Join("bin", path.Base(p)))
+		}
+	}
+	if !config.UseExistingInit && config.Build != "bb" {
+		a = append(a, "init")
+	}
+	if config.Uinit != "" {
+		a = append(a, "bin/uinit")
+		if config.UinitArgs != "" {
+			a = append(a, "etc/uinit.args")
+		}
+	}
+	return a
+}
+
+// kernelModules resolves the -modules.
+func kernelModules() error {
+	i := strings.LastIndex(config.Modules, ":")
+	if i == -1 {
+		return fmt.Errorf("-modules: %q is not dir:name,...", config.Modules)
+	}
+	t, err := kmodule.OpenTree(config.Modules[:i])
+	if err != nil {
+		return fmt.Errorf("-modules: %v", err)
+	}
+	if kmods, err = t.Closure(strings.Split(config.Modules[i+1:], ",")); err != nil {
+		return fmt.Errorf("-modules: %v", err)
+	}
+	kversion = t.Version
+	var packed []string
+	for _, m := range kmods {
+		switch ext := filepath.Ext(m.Path); ext {
+		case ".xz", ".zst", ".gz":
+			if config.UnpackModules {
+				m.Path = strings.TrimSuffix(m.Path, ext)
+			} else if ext != ".gz" {
+				packed = append(packed, m.Name)
+			}
+		}
+	}
+	// Init decompresses gzip itself, but has to run xz and zstd, which
+	// an image seldom has.
+	if len(packed) > 0 && !config.UseExistingInit {
+		log.Printf("Warning: -unpackmodules=false: init can not load %s without xz or zstd in the image", strings.Join(packed, ", "))
+	}
+	return nil
+}
+
+// readModule returns the contents of the module src, decompressed if need
+// be. Decompressing is left to the tools that did the compressing.
+func readModule(src string) ([]byte, error) {
+	var tool string
+	switch filepath.Ext(src) {
+	case ".xz":
+		tool = "xz"
+	case ".zst":
+		tool = "zstd"
+	case ".gz":
+		tool = "gzip"
+	default:
+		return ioutil.ReadFile(src)
+	}
+	b, err := command(tool, "-dc", src).Output()
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s: %v", src, err)
+	}
+	return b, nil
+}
+
+// moduleRecord returns a record of info with the contents of the module
+// src, decompressed if need be. Only a compressed module is read into
+// memory.
+func moduleRecord(src string, info cpio.Info) (cpio.Record, error) {
+	switch filepath.Ext(src) {
+	case ".xz", ".zst", ".gz":
+		b, err := readModule(src)
+		if err != nil {
+			return cpio.Record{}, err
+		}
+		return cpio.NewRecordFromBytes(b, info), nil
+	}
+	return cpio.NewRecordFromFile(src, info)
+}
+
+// firmware finds the firmware the kernel modules ask for, and the
+// -firmware-extra files, in the -firmware directory. Modules often list
+// firmware for more hardware revisions than anyone has, so only a missing
+// extra file is an error.
+func firmware() ([]extraFile, error) {
+	var names []string
+	for _, m := range kmods {
+		b, err := readModule(m.Src)
+		if err != nil {
+			return nil, err
+		}
+		info, err := kmodule.Modinfo(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", m.Src, err)
+		}
+		for _, kv := range info {
+			if strings.HasPrefix(kv, "firmware=") {
+				names = append(names, strings.TrimPrefix(kv, "firmware="))
+			}
+		}
+	}
+
+	var (
+		fw      []extraFile
+		missing []string
+		seen    = make(map[string]bool)
+	)
+	// Firmware may be compressed, and is often a symlink to another
+	// file, which is written under the name asked for.
+	find := func(name string) bool {
+		for _, ext := range []string{"", ".xz", ".zst"} {
+			src, err := filepath.EvalSymlinks(filepath.Join(config.Firmware, name+ext))
+			if err != nil {
+				continue
+			}
+			if dst := filepath.Join("lib/firmware", name+ext); !seen[dst] {
+				seen[dst] = true
+				fw = append(fw, extraFile{src: src, dst: dst})
+			}
+			return true
+		}
+		return false
+	}
+	for _, n := range names {
+		if !find(n) {
+			missing = append(missing, n)
+		}
+	}
+	if len(missing) > 0 {
+		log.Printf("Warning: firmware not found in %s: %s", config.Firmware, strings.Join(missing, ", "))
+	}
+	missing = nil
+	for _, n := range config.FirmwareExtra {
+		if !find(n) {
+			missing = append(missing, n)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("-firmware-extra: not found in %s: %s", config.Firmware, strings.Join(missing, ", "))
+	}
+	return fw, nil
+}
+
+// writeModules writes the kernel modules, and a modules.dep, modules.alias
+// and modules.order that only cover them.
+func writeModules(init *ramfs.Initramfs, origin func(kind, src, dst string)) error {
+	dir := filepath.Join("lib/modules", kversion)
+	for _, m := range kmods {
+		dst := filepath.Join(dir, m.Path)
+		origin("modules", m.Src, dst)
+		if filepath.Base(m.Path) == filepath.Base(m.Src) {
+			if err := init.WriteFile(m.Src, dst); err != nil {
+				return err
+			}
+			continue
+		}
+
+		r, err := moduleRecord(m.Src, cpio.Info{Name: dst, Mode: syscall.S_IFREG | 0644})
+		if err != nil {
+			return err
+		}
+		if err := init.WriteRecord(r); err != nil {
+			return err
+		}
+	}
+
+	origin("modules", "", dir)
+	for _, f := range []struct {
+		name  string
+		write func(io.Writer, []*kmodule.Module) error
+	}{
+		{"modules.dep", kmodule.WriteDep},
+		{"modules.alias", kmodule.WriteAlias},
+		{"modules.order", kmodule.WriteOrder},
+	} {
+		var b bytes.Buffer
+		if err := f.write(&b, kmods); err != nil {
+			return err
+		}
+		if err := init.WriteRecord(cpio.NewRecordFromBytes(b.Bytes(), cpio.Info{Name: filepath.Join(dir, f.name), Mode: syscall.S_IFREG | 0644})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeInitialCpios writes the -cpio archives as layers, each replacing
+// what the ones before it have under the same names, after leaving out the
+// -cpio-exclude paths and applying the -existing-init policy to their
+// inits.
+func writeInitialCpios(init *ramfs.Initramfs, inArchiver cpio.Archiver, origin func(kind, src, dst string)) error {
+	exclude, err := cpio.ByGlob(config.CpioExclude...)
+	if err != nil {
+		return fmt.Errorf("-cpio-exclude: %v", err)
+	}
+	// Inode numbers are only unique within one archive, and there may be
+	// more than one in a layer. Each archive's are given new ones, as
+	// Concat gives them, so that its hard links are not taken for links
+	// to the files of another, and written without their contents.
+	type inode struct {
+		layer, archive    int
+		ino, major, minor uint64
+	}
+	inodes := make(map[inode]uint64)
+	layers := make([][]cpio.Record, len(config.InitialCpio))
+	for i, name := range config.InitialCpio {
+		f, err := openCpio(name)
+		if err != nil {
+			return fmt.Errorf("-cpio: %s: %v", name, err)
+		}
+		defer f.Close()
+		// The records' contents are only read as they are written. All
+		// the archives of the initramfs are read, such as a microcode
+		// one ahead of the compressed main one.
+		r := ramfs.NewReader(inArchiver, f)
+		defer r.Close()
+		rr := cpio.FilterReader(r, cpio.Not(exclude))
+		for {
+			rec, err := rr.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			k := inode{layer: i, archive: r.Archive(), ino: rec.Ino, major: rec.Major, minor: rec.Minor}
+			ino, ok := inodes[k]
+			if !ok {
+				ino = cpio.NewInode()
+				inodes[k] = ino
+			}
+			rec.Ino = ino
+			layers[i] = append(layers[i], rec)
+		}
+	}
+
+	for i, recs := range layerRecords(existingInits(layers)) {
+		origin("cpio", config.InitialCpio[i], "")
+		if err := init.WriteRecords(recs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openCpio opens the -cpio initramfs name, or stdin if it is -, to be read
+// at. One that can not be read at, as a pipe can not, is copied into a
+// temporary file first. Compressed archives in it are decompressed as they
+// are read.
+func openCpio(name string) (*os.File, error) {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+	}
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+		return f, nil
+	}
+	defer f.Close()
+
+	logf(1, "-cpio %s: reading it into a temporary file", name)
+	tmp, err := ioutil.TempFile("", "u-root-cpio")
+	if err != nil {
+		return nil, err
+	}
+	// Unlinked, the file is there only until it is closed.
+	err = os.Remove(tmp.Name())
+	if err == nil {
+		_, err = io.Copy(tmp, f)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// existingInits applies the -existing-init policy to the inits in layers.
+// With rename, the init of every layer that has one becomes inito, so that,
+// as with the rest of the layers, that of the last is the one in the
+// archive; with discard, every init is dropped so that the archive only has
+// the one built here; with keep, they are left alone, and that of the last
+// layer is the init.
+func existingInits(layers [][]cpio.Record) [][]cpio.Record {
+	for i, recs := range layers {
+		var kept []cpio.Record
+		for _, r := range recs {
+			if r.Name != "init" {
+				kept = append(kept, r)
+				continue
+			}
+			switch config.ExistingInit {
+			case "rename":
+				r.Name = "inito"
+			case "discard":
+				if r.ReadCloser != nil {
+					r.Close()
+				}
+				continue
+			}
+			kept = append(kept, r)
+		}
+		layers[i] = kept
+	}
+	return layers
+}
+
+// checkExistingInit settles -existing-init and -useinit, which is the
+// same as -existing-init=keep.
+func checkExistingInit() error {
+	switch config.ExistingInit {
+	case "":
+		config.ExistingInit = "rename"
+		if config.UseExistingInit {
+			config.ExistingInit = "keep"
+		}
+	case "rename", "discard", "keep":
+		if config.UseExistingInit && config.ExistingInit != "keep" {
+			return fmt.Errorf("-useinit keeps the existing init, but -existing-init is %s", config.ExistingInit)
+		}
+	default:
+		return fmt.Errorf("-existing-init: %q is not one of [rename discard keep]", config.ExistingInit)
+	}
+	config.UseExistingInit = config.ExistingInit == "keep"
+	return nil
+}
+
+// layerRecords returns the records of each of layers that are not
+// replaced by a later layer, either by a record of the same name or by a
+// record that is not a directory in place of a directory they are in.
+func layerRecords(layers [][]cpio.Record) [][]cpio.Record {
+	last := make(map[string]int)
+	notDir := make(map[string]int)
+	for i, recs := range layers {
+		for _, r := range recs {
+			last[r.Name] = i
+			if r.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+				notDir[r.Name] = i
+			}
+		}
+	}
+
+	kept := make([][]cpio.Record, len(layers))
+	for i, recs := range layers {
+		for _, r := range recs {
+			keep := last[r.Name] == i
+			for d := path.Dir(r.Name); keep && d != "." && d != "/"; d = path.Dir(d) {
+				if j, ok := notDir[d]; ok && j > i {
+					keep = false
+				}
+			}
+			if keep {
+				kept[i] = append(kept[i], r)
+			} else if r.ReadCloser != nil {
+				r.Close()
+			}
+		}
+	}
+	return kept
+}
+
+// writeSources writes everything but the TempDir to init, in the order that
+// decides which of two records with the same name is kept. origin is told
+// where each batch of records comes from, for -dryrun.
+//
+// After the device nodes init starts with, the archive has, in order: the
+// -files, the libraries they need, kernel modules and firmware, the -cpio
+// archives, the /etc skeleton, the Go toolchain, the u-root sources, the
+// list of commands from elsewhere and the module sources, then the
+// TempDir, the ramfs skeleton around it all and the -symlinks. Within
+// each, files are sorted by name, with directories before what is in them,
+// so the same inputs make the same archive; -cpio archives keep their own
+// order.
+func writeSources(init *ramfs.Initramfs, files []extraFile, inArchiver cpio.Archiver, origin func(kind, src, dst string)) error {
+	// Each batch is a source for init too. Records of the same name
+	// from two sources are a conflict, except that the -files and the
+	// libraries they need override the others, and the /etc skeleton
+	// gives way to them.
+	o := origin
+	origin = func(kind, src, dst string) {
+		o(kind, src, dst)
+		init.SetSource(ramfs.Source{
+			Name:     strings.TrimSpace(kind + " " + src),
+			Override: kind == "files" || kind == "libs",
+			Default:  kind == "etc",
+		})
+	}
+
+	// The archive keeps the first record written under a name, so the
+	// extra files go first to take precedence over everything else.
+	for _, f := range files {
+		origin("files", f.src, f.dst)
+		if err := init.WriteFile(f.src, f.dst); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range libs {
+		origin("libs", f.src, f.dst)
+		if err := init.WriteFile(f.src, f.dst); err != nil {
+			return err
+		}
+	}
+
+	if len(kmods) > 0 {
+		if err := writeModules(init, origin); err != nil {
+			return err
+		}
+	}
+	for _, f := range fw {
+		origin("firmware", f.src, f.dst)
+		if err := init.WriteFile(f.src, f.dst); err != nil {
+			return err
+		}
+	}
+
+	// Start with the initial CPIOs.
+	if len(config.InitialCpio) > 0 {
+		if err := writeInitialCpios(init, inArchiver, origin); err != nil {
+			return err
+		}
+	}
+
+	// The /etc skeleton comes after the initial CPIO, which may well
+	// have its own.
+	if !config.NoEtc {
+		if err := writeEtc(init, origin); err != nil {
+			return err
+		}
+	}
+
+	if config.Build != "source" {
+		return nil
+	}
+
+	// Write all Go toolchain files to the archive.
+	if !config.NoToolchain {
+		origin("goroot", config.Goroot, "go")
+		// The toolchain's files are under go/, as GOROOT is in the
+		// image. Some distributions' GOROOT is symlinks into where
+		// the files really are, which the image does not have.
+		init.FollowSymlinks = true
+		err := init.WriteFilesFunc(config.Goroot, goList, func(rel string) (string, bool) {
+			return filepath.Join("go", rel), false
+		})
+		init.FollowSymlinks = false
+		if err != nil {
+			return fmt.Errorf("the Go toolchain files: %v", err)
+		}
+	}
+	if config.NoSrc {
+		return nil
+	}
+
+	// Write u-root src files to the archive.
+	origin("uroot", config.Gopath, "")
+	// They are where they are in GOPATH, under src/.
+	if err := init.WriteFilesFunc(config.Gopath, urootList, func(rel string) (string, bool) {
+		return rel, false
+	}); err != nil {
+		return fmt.Errorf("the u-root source files: %v", err)
+	}
+
+	// Commands from elsewhere are compiled in the image too, which
+	// needs to know where their sources are.
+	var ext []string
+	for _, p := range pkgList {
+		if path.Dir(p) != "github.com/u-root/u-root/cmds" {
+			ext = append(ext, p+"\n")
+		}
+	}
+	if len(ext) > 0 {
+		origin("cmds", "", "")
+		if err := init.WriteRecord(cpio.NewRecordFromBytes([]byte(strings.Join(ext, "")), cpio.Info{
+			Name: cmdsList,
+			Mode: syscall.S_IFREG | 0644,
+		})); err != nil {
+			return err
+		}
+	}
+
+	// In module mode, the non-standard sources come from all over.
+	var dsts []string
+	for dst := range moduleFiles {
+		dsts = append(dsts, dst)
+	}
+	sort.Strings(dsts)
+	for _, dst := range dsts {
+		origin("module", moduleFiles[dst], dst)
+		if err := init.WriteFile(moduleFiles[dst], dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lister is a RecordFormat for -dryrun that prints records instead of
+// archiving them.
+type lister struct {
+	cpio.RecordFormat
+	kind, src, dst string
+	// synthesized says which directories were made for the records in
+	// them, rather than written.
+	synthesized func(name string) bool
+
+	n, size int64
+}
+
+func (l *lister) Writer(io.Writer) cpio.RecordWriter {
+	return l
+}
+
+func (l *lister) origin(kind, src, dst string) {
+	l.kind, l.src, l.dst = kind, src, dst
+}
+
+func (l *lister) WriteRecord(r cpio.Record) error {
+	src := l.src
+	switch rel, err := filepath.Rel(l.dst, r.Name); {
+	case l.src == "":
+		src = "-"
+	case l.kind == "cpio":
+		src += ":" + r.Name
+	case err == nil:
+		src = filepath.Join(l.src, rel)
+	}
+	if r.Mode&syscall.S_IFMT == syscall.S_IFDIR && l.synthesized != nil && l.synthesized(r.Name) {
+		src = "(parent)"
+	}
+	fmt.Printf("%-7s %s <- %s\n", l.kind, cpio.FormatLong(r), src)
+	l.n++
+	l.size += int64(r.FileSize)
+	// The contents are read as they would be for the archive, so that
+	// identical records are found the same way.
+	if r.ReadCloser == nil {
+		return nil
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	return r.Close()
+}
+
+// dryRun prints what would go into the archive. What the build makes can
+// only be listed by name.
+func dryRun(files []extraFile, devs []cpio.Record, links []symlink, inArchiver cpio.Archiver, transform cpio.RecordFunc) error {
+	// NewInitramfsRecords writes the device nodes and such.
+	l := &lister{kind: "ramfs"}
+	sl := newSymlinks(l, links)
+	archiver := cpio.Archiver{RecordFormat: sl}
+	init, err := ramfs.NewInitramfsOptions(archiver.Writer(nil), ramfs.Options{Records: initRecords(devs), Policy: dedup, Transform: transform, NoEpoch: true})
+	if err != nil {
+		return err
+	}
+	l.synthesized = init.Synthesized
+	if err := writeDevNodes(init, devs, l.origin); err != nil {
+		return err
+	}
+	if err := writeSources(init, files, inArchiver, l.origin); err != nil {
+		return err
+	}
+	if err := init.Conflicts(); err != nil {
+		return err
+	}
+
+	a := artifacts()
+	for _, n := range a {
+		fmt.Printf("%-7s %s <- %s\n", "tempdir", n, "(built)")
+		for ; n != "."; n = path.Dir(n) {
+			sl.names[n] = true
+		}
+	}
+	if err := writeSkeleton(init, l.origin); err != nil {
+		return err
+	}
+	l.origin("symlink", "", "")
+	if err := sl.write(init); err != nil {
+		return err
+	}
+	fmt.Printf("%d records, %d bytes, plus %d built files of unknown size\n", l.n, l.size, len(a))
+	if n, size := init.Deduplicated(); n > 0 {
+		fmt.Printf("%d records identical to ones already written skipped, saving %d bytes\n", n, size)
+	}
+	return nil
+}
+
+// tempDirJunk returns whether the file path in the TempDir is something
+// that was left there rather than built: a .git directory, or the work
+// directories and temporary files of go build.
+func tempDirJunk(path string, info os.FileInfo) bool {
+	name := filepath.Base(path)
+	if info.IsDir() {
+		return name == ".git" || strings.HasPrefix(name, "go-build")
+	}
+	return strings.HasSuffix(name, "-go-tmp-umask")
+}
+
+// makeTempDir sets up config.TempDir, creating it if need be, and returns
+// a function to clean it up when done. Only a directory made here is
+// removed, and not even that with -keep.
+func makeTempDir() (func(), error) {
+	created := false
+	switch _, err := os.Stat(config.TempDir); {
+	case config.TempDir == "":
+		config.TempDir, err = ioutil.TempDir("", "u-root")
+		if err != nil {
+			return nil, err
+		}
+		created = true
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(config.TempDir, 0755); err != nil {
+			return nil, err
+		}
+		created = true
+	case err != nil:
+		return nil, err
+	}
+
+	return func() {
+		if config.Keep || !created {
+			logf(1, "Keeping %v", config.TempDir)
+			return
+		}
+		logf(1, "Removing %v", config.TempDir)
+		if err := os.RemoveAll(config.TempDir); err != nil {
+			log.Printf("%v", err)
+		}
+	}, nil
+}
+
+var (
+	// ctx is canceled by SIGINT or SIGTERM, which stops the commands
+	// run with it.
+	ctx, cancel = context.WithCancel(context.Background())
+
+	exitMu  sync.Mutex
+	atExits []func()
+	// signalled is the exit status for the signal that stopped the
+	// build, or 0.
+	signalled int32
+)
+
+// stopGrace is how long the build has to stop by itself after a signal
+// before it is stopped anyway.
+const stopGrace = 10 * time.Second
+
+// command is exec.Command, but the command is interrupted, as by Ctrl-C,
+// when ctx is canceled, and killed if it has not exited soon after. It
+// gets a process group of its own, and the interrupt goes to the whole
+// group: go build, for one, leaves stopping to its compilers, as they get
+// Ctrl-C too, and only then cleans up.
+func command(name string, arg ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+	}
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
+
+// atExit has exit run f, before whatever was given to atExit earlier.
+func atExit(f func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	atExits = append(atExits, f)
+}
+
+// removeAtExit has exit remove name, if it is still there.
+func removeAtExit(name string) {
+	atExit(func() { os.RemoveAll(name) })
+}
+
+// exit runs what atExit was given, latest first, and exits with code or,
+// if a signal stopped the build, the status a shell gives a command killed
+// by it. Only the first call does this; any others wait for it.
+func exit(code int) {
+	// It is never unlocked, as the process is gone by then.
+	exitMu.Lock()
+	if s := atomic.LoadInt32(&signalled); s != 0 {
+		code = int(s)
+	}
+	for i := len(atExits) - 1; i >= 0; i-- {
+		atExits[i]()
+	}
+	os.Exit(code)
+}
+
+// fatalf is log.Fatalf, but it runs what atExit was given first.
+func fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	exit(1)
+}
+
+// handleSignals stops the build on SIGINT or SIGTERM. The commands
+// running are interrupted, which is usually enough for the build to fail
+// and exit by itself; if it has not within stopGrace, or there is a second
+// signal, it is made to.
+func handleSignals() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-c
+		log.Printf("%v: stopping", s)
+		atomic.StoreInt32(&signalled, 128+int32(s.(syscall.Signal)))
+		cancel()
+		select {
+		case <-c:
+		case <-time.After(stopGrace):
+		}
+		exit(1)
+	}()
+}
+
+// partial has exit remove name, which is being written, unless the
+// returned function has been called to say it is complete.
+func partial(name string) (complete func()) {
+	var done int32
+	atExit(func() {
+		if atomic.LoadInt32(&done) == 0 {
+			logf(1, "Removing the partly written %v", name)
+			os.RemoveAll(name)
+		}
+	})
+	return func() { atomic.StoreInt32(&done, 1) }
+}
+
+// symlinks is a RecordFormat for the -symlinks. Its writer leaves out the
+// records the links replace and notes the names of the others, and write
+// then adds the links after everything else.
+type symlinks struct {
+	cpio.RecordFormat
+	links    []symlink
+	replaced map[string]bool
+	names    map[string]bool
+	w        cpio.RecordWriter
+	// writing is whether the links are being written, which are let
+	// through.
+	writing bool
+}
+
+func newSymlinks(f cpio.RecordFormat, links []symlink) *symlinks {
+	s := &symlinks{
+		RecordFormat: f,
+		links:        links,
+		replaced:     make(map[string]bool),
+		names:        make(map[string]bool),
+	}
+	for _, l := range links {
+		s.replaced[l.path] = true
+	}
+	return s
+}
+
+func (s *symlinks) Writer(w io.Writer) cpio.RecordWriter {
+	s.w = s.RecordFormat.Writer(w)
+	return symlinkWriter{s}
+}
+
+type symlinkWriter struct {
+	s *symlinks
+}
+
+func (s symlinkWriter) WriteRecord(r cpio.Record) error {
+	if s.s.replaced[r.Name] && !s.s.writing {
+		if r.ReadCloser != nil {
+			r.Close()
+		}
+		return nil
+	}
+	s.s.names[r.Name] = true
+	return s.s.w.WriteRecord(r)
+}
+
+// write writes the links to init, which makes any directories they are in
+// that are not in the archive, and writes them in place of the records
+// left out. Links pointing at nothing in the archive are only warned
+// about, since that is sometimes intended.
+func (s *symlinks) write(init *ramfs.Initramfs) error {
+	var dangling []string
+	for _, l := range s.links {
+		target := l.target
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(l.path), target)
+		}
+		if t := strings.TrimLeft(path.Clean(target), "/"); !s.names[t] && !s.replaced[t] {
+			dangling = append(dangling, l.path+" -> "+l.target)
+		}
+	}
+	if len(dangling) > 0 {
+		log.Printf("Warning: -symlinks pointing at nothing in the archive: %s", strings.Join(dangling, ", "))
+	}
+
+	s.writing = true
+	init.SetSource(ramfs.Source{Name: "-symlinks", Replace: true})
+	for _, l := range s.links {
+		if err := init.WriteRecord(cpio.Symlink(l.path, l.target)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizer returns the transform for -owner and -mtime, which leaves
+// records under the -preserve paths alone. Without -mtime, it sets the
+// mtime to $SOURCE_DATE_EPOCH, or 0, as cpio.MakeReproducible does, which
+// the Initramfs leaves to it so that -preserve keeps the mtime too.
+func normalizer() (cpio.RecordFunc, error) {
+	var n cpio.Normalizer
+	if config.Owner != "" {
+		f := strings.Split(config.Owner, ":")
+		if len(f) != 2 {
+			return nil, fmt.Errorf("-owner: %q is not uid:gid", config.Owner)
+		}
+		uid, err := strconv.ParseUint(f[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("-owner: %v", err)
+		}
+		gid, err := strconv.ParseUint(f[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("-owner: %v", err)
+		}
+		u, g := int64(uid), int64(gid)
+		n.UID, n.GID = &u, &g
+	}
+	e := int64(cpio.SourceDateEpoch())
+	if config.MTime != "" {
+		mtime, err := strconv.ParseUint(config.MTime, 10, 63)
+		if err != nil {
+			return nil, fmt.Errorf("-mtime: %v", err)
+		}
+		e = int64(mtime)
+	}
+	n.Epoch = &e
+
+	var preserve []string
+	for _, p := range config.Preserve {
+		preserve = append(preserve, strings.Trim(filepath.Clean(p), "/"))
+	}
+	n.Except = func(r cpio.Record) bool {
+		for _, p := range preserve {
+			if r.Name == p || strings.HasPrefix(r.Name, p+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	return n.Transform(), nil
+}
+
+// sizes adds up the sizes of the records written, by top-level directory
+// and by the Go package they come from.
+type sizes struct {
+	cpio.RecordFormat
+	dirs map[string]int64
+	pkgs map[string]int64
+}
+
+func (s *sizes) Writer(w io.Writer) cpio.RecordWriter {
+	return sizeWriter{s.RecordFormat.Writer(w), s}
+}
+
+type sizeWriter struct {
+	cpio.RecordWriter
+	s *sizes
+}
+
+func (s sizeWriter) WriteRecord(r cpio.Record) error {
+	if r.FileSize > 0 {
+		n := int64(r.FileSize)
+		s.s.dirs[strings.SplitN(r.Name, "/", 2)[0]] += n
+		if p := recordPackage(r.Name); p != "" {
+			s.s.pkgs[p] += n
+		}
+	}
+	return s.RecordWriter.WriteRecord(r)
+}
+
+// recordPackage returns the Go package an archive path comes from: the
+// package of a source file, or the command a binary is built from.
+func recordPackage(name string) string {
+	for _, prefix := range []string{"go/src/", "src/"} {
+		if strings.HasPrefix(name, prefix) {
+			return path.Dir(strings.TrimPrefix(name, prefix))
+		}
+	}
+	switch dir, base := path.Split(name); {
+	case name == "init":
+		return "github.com/u-root/u-root/cmds/init"
+	case name == "bbin/bb":
+		return "(busybox)"
+	case dir == "bin/":
+		for _, p := range pkgList {
+			if path.Base(p) == base {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+type sizeEntry struct {
+	Name string
+	Size int64
+}
+
+// sortSizes returns m as a list, biggest first.
+func sortSizes(m map[string]int64) []sizeEntry {
+	var l []sizeEntry
+	for n, s := range m {
+		l = append(l, sizeEntry{n, s})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Size != l[j].Size {
+			return l[i].Size > l[j].Size
+		}
+		return l[i].Name < l[j].Name
+	})
+	return l
+}
+
+// report prints to w the sizes in the -sizes format, with the size of the
+// archive and, if it is compressed, of the output file.
+func (s *sizes) report(w io.Writer, archive, compressed int64) error {
+	rep := struct {
+		Dirs       []sizeEntry
+		Packages   []sizeEntry
+		Archive    int64
+		Compressed int64 `json:",omitempty"`
+	}{sortSizes(s.dirs), sortSizes(s.pkgs), archive, compressed}
+
+	if config.Sizes == "json" {
+		b, err := json.MarshalIndent(rep, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+
+	fmt.Fprintf(w, "By directory:\n")
+	for _, e := range rep.Dirs {
+		fmt.Fprintf(w, "%12d %s\n", e.Size, e.Name)
+	}
+	fmt.Fprintf(w, "By package:\n")
+	for _, e := range rep.Packages {
+		fmt.Fprintf(w, "%12d %s\n", e.Size, e.Name)
+	}
+	fmt.Fprintf(w, "Archive: %d bytes\n", rep.Archive)
+	if compressed > 0 {
+		fmt.Fprintf(w, "Compressed: %d bytes\n", rep.Compressed)
+	}
+	return nil
+}
+
+// loadOverrides reads the -overrides manifest.
+func loadOverrides(name string) (*ramfs.Manifest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ramfs.ParseManifest(f)
+}
+
+// extractor is a RecordFormat whose writer creates the records in dir
+// instead of archiving them, so that -extract makes exactly what the
+// archive would have. What it can not do, making device nodes without
+// being root and giving files away, goes in a manifest of lines
+//
+//	path mode uid gid [c|b major minor]
+//
+// instead, with mode in octal.
+type extractor struct {
+	cpio.RecordFormat
+	dir      string
+	root     bool
+	manifest []cpio.Info
+	// n is the number of records made.
+	n int
+	x *cpio.Extractor
+}
+
+func (e *extractor) Writer(io.Writer) cpio.RecordWriter {
+	return e
+}
+
+// extractor returns the cpio.Extractor making the records, which puts what
+// it can not make in the manifest.
+func (e *extractor) extractor() *cpio.Extractor {
+	if e.x == nil {
+		e.x = &cpio.Extractor{Root: e.dir, MakeDevices: e.root, Deferred: func(i cpio.Info) {
+			e.manifest = append(e.manifest, i)
+		}}
+	}
+	return e.x
+}
+
+func (e *extractor) WriteRecord(r cpio.Record) error {
+	if r.Name == cpio.Trailer {
+		return e.finish()
+	}
+	e.n++
+	return e.extractor().WriteRecord(r)
+}
+
+// finish sets the modes of the directories and writes the manifest, if
+// there is anything in it, next to the directory.
+func (e *extractor) finish() error {
+	if err := e.extractor().Finish(); err != nil {
+		return err
+	}
+	if len(e.manifest) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	b.WriteString("# path mode uid gid [c|b major minor]\n")
+	for _, i := range e.manifest {
+		fmt.Fprintf(&b, "%s %o %d %d", i.Name, i.Mode&07777, i.UID, i.GID)
+		if kind := devKind(i.Mode); kind != "" {
+			fmt.Fprintf(&b, " %s %d %d", kind, i.Rmajor, i.Rminor)
+		}
+		b.WriteString("\n")
+	}
+	return ioutil.WriteFile(e.dir+".manifest", b.Bytes(), 0644)
+}
+
+// devKind returns c or b for a character or block device mode, and
+// nothing for any other.
+func devKind(mode uint64) string {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		return "c"
+	case syscall.S_IFBLK:
+		return "b"
+	}
+	return ""
+}
+
+// image is a RecordFormat whose writer makes a filesystem image, for
+// -format squashfs and ext4. The records are extracted to a staging
+// directory, as for -extract, and the image is made from that by mksquashfs
+// or mkfs.ext4. The ownership and device nodes the extraction leaves to its
+// manifest are applied by the tools, through a mksquashfs pseudo file or
+// debugfs, so none of it needs root. There is no reader.
+type image struct {
+	cpio.RecordFormat
+	fs string
+}
+
+// available checks that the tools for the image are in $PATH.
+func (i image) available() error {
+	tools := []string{"mksquashfs"}
+	if i.fs == "ext4" {
+		tools = []string{"mkfs.ext4", "debugfs"}
+	}
+	for _, t := range tools {
+		if _, err := exec.LookPath(t); err != nil {
+			return fmt.Errorf("%s is not available: %v", t, err)
+		}
+	}
+	return nil
+}
+
+func (i image) Writer(w io.Writer) cpio.RecordWriter {
+	return &imageWriter{fs: i.fs, w: w}
+}
+
+type imageWriter struct {
+	fs string
+	w  io.Writer
+	e  *extractor
+}
+
+// WriteRecord stages r, and at the trailer makes the image and copies it
+// to the output.
+func (i *imageWriter) WriteRecord(r cpio.Record) error {
+	if i.e == nil {
+		tmp, err := ioutil.TempDir("", "u-root-image")
+		if err != nil {
+			return err
+		}
+		removeAtExit(tmp)
+		i.e = &extractor{dir: filepath.Join(tmp, "root")}
+		if err := os.Mkdir(i.e.dir, 0755); err != nil {
+			return err
+		}
+	}
+	if r.Name != cpio.Trailer {
+		return i.e.WriteRecord(r)
+	}
+
+	tmp := filepath.Dir(i.e.dir)
+	defer func() {
+		// Read-only directories can not be emptied. Walk calls its
+		// function on a directory before reading it.
+		filepath.Walk(tmp, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.IsDir() {
+				os.Chmod(p, 0755)
+			}
+			return nil
+		})
+		os.RemoveAll(tmp)
+	}()
+	if err := i.e.extractor().Finish(); err != nil {
+		return err
+	}
+	img := filepath.Join(tmp, "image")
+	var err error
+	if i.fs == "squashfs" {
+		err = i.squashfs(img)
+	} else {
+		err = i.ext4(img)
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(img)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(i.w, f)
+	return err
+}
+
+// imagePath returns name as an absolute path in the image.
+func imagePath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (i *imageWriter) squashfs(img string) error {
+	args := []string{i.e.dir, img, "-noappend", "-no-xattrs", "-comp", config.SquashfsComp, "-root-uid", "0", "-root-gid", "0"}
+	if len(i.e.manifest) > 0 {
+		// Pseudo file lines are "name c|b mode uid gid major minor" to
+		// make a device node, and "name m mode uid gid" to change what
+		// is already there.
+		var b bytes.Buffer
+		for _, m := range i.e.manifest {
+			if kind := devKind(m.Mode); kind != "" {
+				fmt.Fprintf(&b, "%s %s %o %d %d %d %d\n", imagePath(m.Name), kind, m.Mode&07777, m.UID, m.GID, m.Rmajor, m.Rminor)
+			} else {
+				fmt.Fprintf(&b, "%s m %o %d %d\n", imagePath(m.Name), m.Mode&07777, m.UID, m.GID)
+			}
+		}
+		pf := filepath.Join(filepath.Dir(img), "pseudo")
+		if err := ioutil.WriteFile(pf, b.Bytes(), 0644); err != nil {
+			return err
+		}
+		args = append(args, "-pf", pf)
+	}
+	if out, err := command("mksquashfs", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("mksquashfs: %v: %s", err, out)
+	}
+	return nil
+}
+
+func (i *imageWriter) ext4(img string) error {
+	size := config.Size
+	if size == "" {
+		// Twice what is in it, in blocks, plus room for the
+		// filesystem's own structures.
+		var used int64
+		if err := filepath.Walk(i.e.dir, func(_ string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			used += (fi.Size()+4095)&^4095 + 4096
+			return nil
+		}); err != nil {
+			return err
+		}
+		size = fmt.Sprintf("%dk", (2*used+16<<20)/1024)
+	}
+	if out, err := command("mkfs.ext4", "-q", "-F", "-d", i.e.dir, "-E", "root_owner=0:0", img, size).CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.ext4: %v: %s", err, out)
+	}
+	if len(i.e.manifest) == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	for _, m := range i.e.manifest {
+		p := strconv.Quote(imagePath(m.Name))
+		if kind := devKind(m.Mode); kind != "" {
+			// mknod makes its name in the current directory.
+			dir, name := path.Split(imagePath(m.Name))
+			fmt.Fprintf(&b, "cd %s\nmknod %s %s %d %d\n", strconv.Quote(dir), strconv.Quote(name), kind, m.Rmajor, m.Rminor)
+			fmt.Fprintf(&b, "sif %s mode 0%o\n", p, m.Mode)
+		}
+		fmt.Fprintf(&b, "sif %s uid %d\nsif %s gid %d\n", p, m.UID, p, m.GID)
+	}
+	script := filepath.Join(filepath.Dir(img), "debugfs")
+	if err := ioutil.WriteFile(script, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	// debugfs exits 0 whatever happens to the commands; anything on
+	// stderr past its banner is an error.
+	var stderr bytes.Buffer
+	cmd := command("debugfs", "-w", "-f", script, img)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("debugfs: %v: %s", err, stderr.Bytes())
+	}
+	lines := strings.SplitN(strings.TrimSpace(stderr.String()), "\n", 2)
+	if len(lines) > 1 {
+		return fmt.Errorf("debugfs: %s", lines[1])
+	}
+	return nil
+}
+
+// checkBundle checks the -kernel flags against each other and the output.
+func checkBundle() error {
+	if config.Kernel == "" {
+		if config.Cmdline != "" || config.EFIStub != "" || config.Bundle != "" {
+			return fmt.Errorf("-cmdline, -efistub and -bundle need -kernel")
+		}
+		return nil
+	}
+	if config.Format != "newc" || config.Extract != "" || config.Output == "-" {
+		return fmt.Errorf("-kernel: needs a -format newc archive written to a file")
+	}
+	files := []string{config.Kernel}
+	if config.EFIStub != "" {
+		if _, err := exec.LookPath("objcopy"); err != nil {
+			return fmt.Errorf("-efistub: objcopy is not available: %v", err)
+		}
+		files = append(files, config.EFIStub)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleInfo is the bundle.json of a -kernel bundle.
+type bundleInfo struct {
+	Kernel          string
+	KernelSHA256    string
+	Initramfs       string
+	InitramfsSHA256 string
+	Cmdline         string
+	// UKI is the unified kernel image made with -efistub.
+	UKI string `json:",omitempty"`
+}
+
+// makeBundle puts the -kernel, the archive at initramfs and a bundle.json
+// describing them, with the -cmdline, together in the -bundle, and returns
+// where that is. With -efistub, it has a unified kernel image, linux.efi,
+// as well.
+func makeBundle(initramfs string) (string, error) {
+	dst := config.Bundle
+	if dst == "" {
+		dst = initramfs + ".bundle"
+	}
+	dir := dst
+	asTar := strings.HasSuffix(dst, ".tar")
+	if asTar {
+		tmp, err := ioutil.TempDir("", "u-root-bundle")
+		if err != nil {
+			return "", err
+		}
+		removeAtExit(tmp)
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	info := bundleInfo{
+		Kernel:    filepath.Base(config.Kernel),
+		Initramfs: filepath.Base(initramfs),
+		Cmdline:   config.Cmdline,
+	}
+	var err error
+	if info.KernelSHA256, err = copySum(config.Kernel, filepath.Join(dir, info.Kernel)); err != nil {
+		return "", err
+	}
+	if info.InitramfsSHA256, err = copySum(initramfs, filepath.Join(dir, info.Initramfs)); err != nil {
+		return "", err
+	}
+	names := []string{info.Kernel, info.Initramfs}
+
+	if config.EFIStub != "" {
+		// These are the section addresses systemd's ukify used
+		// before it worked them out from the stub.
+		cmdline := filepath.Join(dir, "cmdline")
+		if err := ioutil.WriteFile(cmdline, []byte(config.Cmdline), 0644); err != nil {
+			return "", err
+		}
+		info.UKI = "linux.efi"
+		out, err := command("objcopy",
+			"--add-section", ".cmdline="+cmdline, "--change-section-vma", ".cmdline=0x30000",
+			"--add-section", ".linux="+filepath.Join(dir, info.Kernel), "--change-section-vma", ".linux=0x2000000",
+			"--add-section", ".initrd="+filepath.Join(dir, info.Initramfs), "--change-section-vma", ".initrd=0x3000000",
+			config.EFIStub, filepath.Join(dir, info.UKI)).CombinedOutput()
+		os.Remove(cmdline)
+		if err != nil {
+			return "", fmt.Errorf("objcopy: %v: %s", err, out)
+		}
+		names = append(names, info.UKI)
+	}
+
+	b, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bundle.json"), append(b, '\n'), 0644); err != nil {
+		return "", err
+	}
+	names = append(names, "bundle.json")
+	if !asTar {
+		return dst, nil
+	}
+
+	archiver, err := cpio.Format("tar")
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	w := archiver.Writer(f)
+	for _, n := range names {
+		r, err := cpio.NewRecordFromPath(filepath.Join(dir, n), n)
+		if err != nil {
+			return "", err
+		}
+		r.UID, r.GID = 0, 0
+		if err := w.WriteRecord(cpio.MakeReproducible(r)); err != nil {
+			return "", err
+		}
+	}
+	if err := w.WriteTrailer(); err != nil {
+		return "", err
+	}
+	return dst, f.Close()
+}
+
+// copySum copies the file src to dst and returns its SHA256.
+func copySum(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// counter counts the records written, other than the trailer, for
+// progress and -verify, and logs each at -v=2.
+type counter struct {
+	cpio.RecordFormat
+	n int64
+}
+
+func (c *counter) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+func (c *counter) Writer(w io.Writer) cpio.RecordWriter {
+	return counterWriter{c.RecordFormat.Writer(w), c}
+}
+
+type counterWriter struct {
+	cpio.RecordWriter
+	c *counter
+}
+
+func (c counterWriter) WriteRecord(r cpio.Record) error {
+	if r.Name != cpio.Trailer {
+		atomic.AddInt64(&c.c.n, 1)
+		logf(2, "Writing %s", r.Name)
+	}
+	return c.RecordWriter.WriteRecord(r)
+}
+
+// verify reads the archive in the file name back, through the compressor,
+// and checks that it has n records, among them init or inito, that no name
+// is in it twice unless dups is set, and that every record has as much
+// contents as its header says.
+func verify(name string, archiver cpio.Archiver, compressor compress.Compressor, n int64, dups bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := compressor.Reader(f)
+	if err != nil {
+		return err
+	}
+	// The reader wants an io.ReaderAt, which only the file itself is.
+	var ra io.ReaderAt = f
+	if config.Compress != "none" {
+		tmp, err := ioutil.TempFile("", "u-root-verify")
+		if err != nil {
+			return err
+		}
+		removeAtExit(tmp.Name())
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		_, err = io.Copy(tmp, r)
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		ra = tmp
+	}
+
+	seen := make(map[string]bool)
+	// The record reader, unlike a cpio.Reader, tells the trailer from
+	// the end of the file.
+	rr := archiver.RecordFormat.Reader(ra)
+	for i := int64(0); ; i++ {
+		rec, err := rr.ReadRecord()
+		if err == io.EOF {
+			return fmt.Errorf("it ends after %d records, without a trailer", i)
+		}
+		if fe, ok := err.(*cpio.FormatError); ok {
+			switch fe.Err {
+			case cpio.ErrTruncated:
+				return fmt.Errorf("record %d: %v; it was not written in full", i, err)
+			case cpio.ErrBadMagic:
+				return fmt.Errorf("record %d: %v; what was written before it is not what was read back", i, err)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %v", i, err)
+		}
+		if rec.Name == cpio.Trailer {
+			if i != n {
+				return fmt.Errorf("it has %d records, want %d", i, n)
+			}
+			if sr, ok := rr.(cpio.SegmentReader); ok && sr.More() {
+				return fmt.Errorf("something other than padding follows the trailer, at %d", sr.Offset())
+			}
+			break
+		}
+		if seen[rec.Name] && !dups {
+			return fmt.Errorf("%s is in it twice", rec.Name)
+		}
+		seen[rec.Name] = true
+		if rec.ReadCloser == nil {
+			continue
+		}
+		m, err := io.Copy(ioutil.Discard, rec)
+		if err != nil {
+			return fmt.Errorf("%s: %v", rec.Name, err)
+		}
+		if uint64(m) != rec.FileSize {
+			return fmt.Errorf("%s: has %d bytes, want %d", rec.Name, m, rec.FileSize)
+		}
+	}
+	if !seen["init"] && !seen["inito"] {
+		return fmt.Errorf("it has no init or inito")
+	}
+	return nil
+}
+
+// recordHasher is a RecordFormat whose writer hashes the contents of the
+// records as they are written, for -manifest and -manifest-at.
+type recordHasher struct {
+	cpio.RecordFormat
+	entries []manifestEntry
+}
+
+// manifestEntry is a line of the -manifest. Only regular files have a
+// SHA256, and only symlinks a Target.
+type manifestEntry struct {
+	Path   string
+	SHA256 string `json:",omitempty"`
+	Size   int64
+	Mode   uint64
+	UID    uint64
+	GID    uint64
+	Target string `json:",omitempty"`
+}
+
+func (h *recordHasher) Writer(w io.Writer) cpio.RecordWriter {
+	return hashWriter{h.RecordFormat.Writer(w), h}
+}
+
+// marshal returns the manifest, one JSON object per line.
+func (h *recordHasher) marshal() []byte {
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	for _, m := range h.entries {
+		// Encoding a struct of strings and numbers can not fail.
+		e.Encode(m)
+	}
+	return b.Bytes()
+}
+
+// record returns the manifest of what has been written so far as a record
+// named name, for -manifest-at.
+func (h *recordHasher) record(name string) cpio.Record {
+	return cpio.NewRecordFromBytes(h.marshal(), cpio.Info{
+		Name:  strings.TrimLeft(name, "/"),
+		Mode:  syscall.S_IFREG | 0644,
+		MTime: cpio.SourceDateEpoch(),
+	})
+}
+
+type hashWriter struct {
+	cpio.RecordWriter
+	h *recordHasher
+}
+
+// hashReader hashes and counts what is read through it.
+type hashReader struct {
+	io.ReadCloser
+	h hash.Hash
+	n int64
+}
+
+func (h *hashReader) Read(b []byte) (int, error) {
+	n, err := h.ReadCloser.Read(b)
+	h.h.Write(b[:n])
+	h.n += int64(n)
+	return n, err
+}
+
+func (h hashWriter) WriteRecord(r cpio.Record) error {
+	if r.Name == cpio.Trailer {
+		return h.RecordWriter.WriteRecord(r)
+	}
+
+	e := manifestEntry{Path: r.Name, Mode: r.Mode, UID: r.UID, GID: r.GID}
+	var hr *hashReader
+	switch r.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		hr = &hashReader{ReadCloser: ioutil.NopCloser(bytes.NewReader(nil)), h: sha256.New()}
+		if r.ReadCloser != nil {
+			hr.ReadCloser = r.ReadCloser
+			r.ReadCloser = hr
+		}
+	case syscall.S_IFLNK:
+		target, err := r.Linkname()
+		if r.ReadCloser != nil {
+			r.Close()
+		}
+		if err != nil {
+			return err
+		}
+		e.Target, e.Size = target, int64(len(target))
+		r.ReadCloser = cpio.NewBytesReadCloser([]byte(target))
+	}
+	if err := h.RecordWriter.WriteRecord(r); err != nil {
+		return err
+	}
+	if hr != nil {
+		e.SHA256, e.Size = hex.EncodeToString(hr.h.Sum(nil)), hr.n
+	}
+	h.h.entries = append(h.h.entries, e)
+	return nil
+}
+
+// writeManifest writes the manifest of what has been written to init so far
+// to -manifest-at, if it is set, as the last record before the trailer. It
+// goes through init like any other record, so it gets the directories it is
+// in, which it does not list, the -owner and -mtime of the rest, and an error
+// if a record is already at its path.
+func writeManifest(init *ramfs.Initramfs, hasher *recordHasher) error {
+	if config.ManifestAt == "" {
+		return nil
+	}
+	init.SetSource(ramfs.Source{Name: "manifest"})
+	if err := init.WriteRecord(hasher.record(config.ManifestAt)); err != nil {
+		return fmt.Errorf("-manifest-at: %v", err)
+	}
+	return nil
+}
+
+// signKeys reads the -sign private key and the -verify-key public key.
+func signKeys() (crypto.Signer, crypto.PublicKey, error) {
+	if config.Sign == "" {
+		if config.VerifyKey != "" {
+			return nil, nil, fmt.Errorf("-verify-key needs -sign")
+		}
+		return nil, nil, nil
+	}
+	if config.Output == "-" || config.Extract != "" {
+		return nil, nil, fmt.Errorf("-sign: needs the output in a file")
+	}
+	b, err := ioutil.ReadFile(config.Sign)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := sign.ParsePrivateKey(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-sign: %v", err)
+	}
+	if config.VerifyKey == "" {
+		return signer, nil, nil
+	}
+	if b, err = ioutil.ReadFile(config.VerifyKey); err != nil {
+		return nil, nil, err
+	}
+	verifier, err := sign.ParsePublicKey(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-verify-key: %v", err)
+	}
+	return signer, verifier, nil
+}
+
+// signOutput signs the file name into name.sig, and checks the signature
+// with verifier, if there is one.
+func signOutput(name string, signer crypto.Signer, verifier crypto.PublicKey) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sig, err := sign.Sign(signer, f)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(name+".sig", sig, 0644); err != nil {
+		return err
+	}
+	if verifier == nil {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := sign.Verify(verifier, f, sig); err != nil {
+		return fmt.Errorf("-verify-key: %v", err)
+	}
+	return nil
+}
+
+// isTerminal returns whether f is a terminal, or at least a character
+// device other than /dev/null.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(fi, null)
+}
+
+// checkStdout refuses -o - when stdout, which is passed in for testing, is
+// a terminal, unless there is -force.
+func checkStdout(stdout *os.File) error {
+	if config.Output == "-" && !config.Force && isTerminal(stdout) {
+		return fmt.Errorf("-o -: not writing an archive to a terminal without -force")
+	}
+	return nil
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func main() {
+	flag.Parse()
+	handleSignals()
+	// Whatever else the build leaves is cleaned up on the way out,
+	// whether it fails, is stopped by a signal or succeeds.
+	defer exit(0)
+	config.Packages = flag.Args()
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			fatalf("-config: %v", err)
+		}
+	}
+
+	// Check the formats before doing anything that takes a while.
+	var archiver cpio.Archiver
+	isImage := config.Format == "squashfs" || config.Format == "ext4"
+	if isImage {
+		img := image{fs: config.Format}
+		if err := img.available(); err != nil {
+			fatalf("-format: %v", err)
+		}
+		archiver.RecordFormat = img
+	} else {
+		a, err := cpio.Format(config.Format)
+		if err != nil {
+			fatalf("-format: %v", err)
+		}
+		archiver = a
+	}
+	if config.Size != "" && config.Format != "ext4" {
+		fatalf("-size: only goes with -format ext4")
+	}
+	if err := checkBundle(); err != nil {
+		fatalf("%v", err)
+	}
+	signer, verifier, err := signKeys()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	// Extracting goes through everything archiving does, up to the
+	// very last step.
+	var ex *extractor
+	if config.Extract != "" {
+		if config.Output != "" || config.Compress != "none" || isImage {
+			fatalf("-extract: does not go with -o, -compress or a filesystem image -format")
+		}
+		ex = &extractor{RecordFormat: archiver.RecordFormat, root: os.Geteuid() == 0}
+		archiver.RecordFormat = ex
+	}
+	// The records are counted closest to the archive, as they are
+	// really written, for -verify.
+	count := &counter{RecordFormat: archiver.RecordFormat}
+	archiver.RecordFormat = count
+	verifying := config.Verify && ex == nil && !isImage && config.Output != "-"
+	// The manifest is hashed outside the counter, so that the record it
+	// adds with -manifest-at is counted.
+	var hasher *recordHasher
+	if config.Manifest != "" || config.ManifestAt != "" {
+		hasher = &recordHasher{RecordFormat: archiver.RecordFormat}
+		archiver.RecordFormat = hasher
+	}
+	inArchiver, err := cpio.Format(config.InFormat)
+	if err != nil {
+		fatalf("-informat: %v", err)
+	}
+	inArchiver.RecordFormat = newc.WithReaderOptions(inArchiver.RecordFormat, newc.ReaderOptions{NoVerify: !config.CRCCheck})
+	files, err := extraFiles()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	links, err := parseSymlinks()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	devs, err := devNodes()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if etcHost, err = etcFiles(); err != nil {
+		fatalf("%v", err)
+	}
+	if !config.NoLibs {
+		if libs, err = libraries(files); err != nil {
+			fatalf("-files: %v", err)
+		}
+	}
+	if config.Modules != "" {
+		if err := kernelModules(); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if config.Firmware != "" {
+		if fw, err = firmware(); err != nil {
+			fatalf("%v", err)
+		}
+	} else if len(config.FirmwareExtra) > 0 {
+		fatalf("-firmware-extra needs -firmware")
+	}
+	if e := os.Getenv("SOURCE_DATE_EPOCH"); e != "" {
+		if _, err := strconv.ParseUint(e, 10, 64); err != nil {
+			fatalf("SOURCE_DATE_EPOCH: %v", err)
+		}
+	}
+	if err := checkExistingInit(); err != nil {
+		fatalf("%v", err)
+	}
+	if len(config.CpioExclude) > 0 && len(config.InitialCpio) == 0 {
+		fatalf("-cpio-exclude needs -cpio")
+	}
+	if _, err := cpio.ByGlob(config.CpioExclude...); err != nil {
+		fatalf("-cpio-exclude: %v", err)
+	}
+	if err := checkStdout(os.Stdout); err != nil {
+		fatalf("%v", err)
+	}
+	if err := checkUinit(); err != nil {
+		fatalf("%v", err)
+	}
+	switch config.Dedup {
+	case "error":
+		dedup = ramfs.DedupError
+	case "refuse":
+		dedup = ramfs.DedupRefuse
+	case "warn":
+		dedup = ramfs.DedupWarn
+	case "first":
+		dedup = ramfs.DedupFirst
+	case "last":
+		dedup = ramfs.DedupLast
+	default:
+		fatalf("-dedup: %q is not one of [error refuse warn first last]", config.Dedup)
+	}
+	ramfs.Debug = func(format string, v ...interface{}) { logf(2, format, v...) }
+	ramfs.Warn = func(format string, v ...interface{}) { log.Printf("Warning: "+format, v...) }
+	if config.Jobs < 1 {
+		fatalf("-j: %d is less than 1", config.Jobs)
+	}
+	switch config.Build {
+	case "source", "bb", "binaries":
+	default:
+		fatalf("-build: %q is not one of [source bb binaries]", config.Build)
+	}
+	// Without the sources, there is nothing for the toolchain to build.
+	if config.NoSrc {
+		config.NoToolchain = true
+	}
+	if config.NoToolchain && config.Build == "source" {
+		f := "-notoolchain"
+		if config.NoSrc {
+			f = "-nosrc"
+		}
+		log.Printf("Warning: %s: the commands are compiled in the image when first run, which fails unless a -cpio archive has the Go toolchain and their sources", f)
+	}
+	compressor, err := compress.Get(config.Compress)
+	if err != nil {
+		fatalf("-compress: %v", err)
+	}
+	if err := compressor.Available(); err != nil {
+		fatalf("-compress: %v", err)
+	}
+	// Sizes are taken from what is written, after any overrides.
+	var sz *sizes
+	if config.Sizes != "" {
+		sz = &sizes{archiver.RecordFormat, make(map[string]int64), make(map[string]int64)}
+		archiver.RecordFormat = sz
+	}
+	// The -overrides manifest is applied after -owner and -mtime, so
+	// that it has the last word.
+	transform, err := normalizer()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var overrides *ramfs.Manifest
+	if config.Overrides != "" {
+		if overrides, err = loadOverrides(config.Overrides); err != nil {
+			fatalf("-overrides: %v", err)
+		}
+		transform = cpio.Chain(transform, overrides.Transform)
+	}
+	// The links replace records as they are named after any overrides,
+	// which the Initramfs applies to every record written to it.
+	sl := newSymlinks(archiver.RecordFormat, links)
+	archiver.RecordFormat = sl
+
+	deps = make(map[string]bool)
+	gorootFiles = make(map[string]bool)
+	urootFiles = make(map[string]bool)
+	moduleFiles = make(map[string]string)
+
+	// Everything from here on that runs go runs the one asked for.
+	if config.GoVersion != "" {
+		if err := useGoVersion(); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	guessplatform()
+	if err := checkplatform(); err != nil {
+		fatalf("%v", err)
+	}
+	if err := guessmodule(); err != nil {
+		fatalf("%v", err)
+	}
+	config.Go = ""
+	guessgoroot()
+	guessgopath()
+	guesscachedir()
+
+	if *listTmpl {
+		if err := printTemplates(os.Stdout); err != nil {
+			fatalf("%v", err)
+		}
+		return
+	}
+	if *dumpConfig {
+		b, err := json.MarshalIndent(config, "", "\t")
+		if err != nil {
+			fatalf("%v", err)
+		}
+		fmt.Printf("%s\n", b)
+		return
+	}
+
+	pkgList, err = selectPkgs(config.Packages...)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	logf(1, "Commands: %v", pkgList)
+
+	// Only in source mode is anything compiled in the image, so the Go
+	// sources are not needed otherwise.
+	if config.Build == "source" && !config.NoSrc {
+		start := time.Now()
+		if err := addGoFiles(); err != nil {
+			fatalf("%v", err)
+		}
+		logf(1, "Listed %d Go files in %v", len(goList)+len(urootList), time.Since(start))
+	}
+
+	if config.DryRun {
+		if err := dryRun(files, devs, links, inArchiver, transform); err != nil {
+			fatalf("%v", err)
+		}
+		return
+	}
+
+	cleanup, err := makeTempDir()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	atExit(cleanup)
+	// go build's work directories go in here, so that they are removed
+	// even when go is stopped before it removes them itself.
+	if goTmpDir, err = ioutil.TempDir("", "u-root-go"); err != nil {
+		fatalf("%v", err)
+	}
+	removeAtExit(goTmpDir)
+
+	oname, err := outputPath(compressor.Suffix())
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if signer != nil && !config.Force {
+		if _, err := os.Stat(oname + ".sig"); err == nil {
+			fatalf("-sign: %s.sig exists; -force to replace it", oname)
+		}
+	}
+
+	var jobs []job
+	switch config.Build {
+	case "source":
+		if !config.NoToolchain {
+			jobs = toolChainJobs()
+		}
+
+	case "bb":
+		jobs = []job{{"bb", buildBB}}
+
+	case "binaries":
+		if jobs, err = binaryJobs(); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	// In bb mode, init is part of the busybox binary.
+	if !config.UseExistingInit && config.Build != "bb" {
+		jobs = append(jobs, job{"github.com/u-root/u-root/cmds/init", buildInit})
+	}
+	if config.Uinit != "" {
+		jobs = append(jobs, job{"uinit", buildUinit})
+	}
+	if err := runJobs(jobs); err != nil {
+		fatalf("%v", err)
+	}
+
+	var out io.Writer = os.Stdout
+	complete := func() {}
+	switch {
+	case ex != nil:
+		ex.dir = oname
+		out = ioutil.Discard
+		complete = partial(oname)
+	case oname != "-":
+		f, err := os.Create(oname)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer f.Close()
+		out = f
+		complete = partial(oname)
+	}
+
+	// The output is only ever written to, never seeked, so it can be a
+	// pipe; that is also why its size is counted rather than looked up.
+	fw := &countWriter{w: out}
+	w, err := compressor.Writer(fw)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	cw := &countWriter{w: w}
+
+	writeStart := time.Now()
+	stopProgress := progress("Writing records", count.count)
+	init, err := ramfs.NewInitramfsOptions(archiver.Writer(cw), ramfs.Options{Records: initRecords(devs), Policy: dedup, Transform: transform, NoEpoch: true})
+	if err != nil {
+		fatalf("%v", err)
+	}
+	// A file fatalf leaves is removed, but stdout can not be. Given the
+	// trailer, what was written to it is an archive, if not all of one.
+	// After a signal, the records may be being written still, and what
+	// was written is left as it is.
+	atExit(func() {
+		if atomic.LoadInt32(&signalled) == 0 {
+			init.Close()
+			w.Close()
+		}
+	})
+	if err := writeDevNodes(init, devs, func(kind, src, dst string) {}); err != nil {
+		fatalf("%v", err)
+	}
+
+	if err := writeSources(init, files, inArchiver, func(kind, src, dst string) {}); err != nil {
+		fatalf("%v", err)
+	}
+
+	// Write all files from the TempDir.
+	init.SetSource(ramfs.Source{Name: "tempdir"})
+	if err := init.WriteDir(config.TempDir, "", tempDirJunk); err != nil {
+		fatalf("%v", err)
+	}
+	if err := writeSkeleton(init, func(kind, src, dst string) {}); err != nil {
+		fatalf("%v", err)
+	}
+	if err := sl.write(init); err != nil {
+		fatalf("%v", err)
+	}
+	if err := writeManifest(init, hasher); err != nil {
+		fatalf("%v", err)
+	}
+
+	if err := init.Close(); err != nil {
+		fatalf("%v", err)
+	}
+	if overrides != nil {
+		if u := overrides.Unused(); len(u) > 0 {
+			fatalf("-overrides: no such paths in the archive: %v", strings.Join(u, ", "))
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		fatalf("%v", err)
+	}
+	stopProgress()
+	took := time.Since(writeStart)
+	var compressed int64
+	switch {
+	case ex != nil:
+		logf(1, "Extracted %d records in %v", ex.n, took)
+	case config.Compress != "none":
+		compressed = fw.n
+		logf(1, "Archive is %d bytes, %d bytes compressed, %d records written in %v", cw.n, compressed, count.n, took)
+	default:
+		logf(1, "Archive is %d bytes, %d records written in %v", cw.n, count.n, took)
+	}
+	if n, size := init.Deduplicated(); n > 0 {
+		logf(1, "Skipped %d records identical to ones already written, saving %d bytes", n, size)
+	}
+	if verifying {
+		// What was written is checked, whatever -crc-check says,
+		// since it is only of the -informat readers.
+		start := time.Now()
+		if err := verify(oname, cpio.Archiver{RecordFormat: count.RecordFormat}, compressor, count.n, config.Dedup == "last"); err != nil {
+			os.Remove(oname)
+			fatalf("-verify: %s: %v; removed it", oname, err)
+		}
+		logf(1, "Verified %d records in %v", count.n, time.Since(start))
+	}
+	if config.Manifest != "" {
+		if err := ioutil.WriteFile(config.Manifest, hasher.marshal(), 0644); err != nil {
+			fatalf("-manifest: %v", err)
+		}
+		logf(1, "Manifest of %d records is in %s", len(hasher.entries), config.Manifest)
+	}
+	// Everything has been written by now, compressor and all.
+	if signer != nil {
+		if err := signOutput(oname, signer, verifier); err != nil {
+			fatalf("-sign: %v", err)
+		}
+		logf(1, "Signature is in %s.sig", oname)
+	}
+	complete()
+	if sz != nil {
+		// The report goes with the logs if the archive is on stdout.
+		out := os.Stdout
+		if oname == "-" {
+			out = os.Stderr
+		}
+		if err := sz.report(out, cw.n, compressed); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	switch {
+	case ex != nil:
+		logf(1, "Output directory is %s", oname)
+		if len(ex.manifest) > 0 {
+			logf(1, "Owners and device nodes that could not be made are in %s.manifest", oname)
+		}
+	case oname == "-":
+		logf(1, "Output is stdout")
+	default:
+		logf(1, "Output file is %s", oname)
+	}
+	if config.Kernel != "" {
+		b, err := makeBundle(oname)
+		if err != nil {
+			fatalf("-kernel: %v", err)
+		}
+		logf(1, "Bundle is %s", b)
+	}
+	if len(skipped) > 0 {
+		log.Printf("Warning: go list failed on, and so the archive leaves out: %s", strings.Join(skipped, ", "))
+	}
 }
@@ -0,0 +1,3488 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/compress"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/ramfs"
+)
+
+func TestCrossBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("cross-compiling takes a while")
+	}
+	gopath := os.Getenv("GOPATH")
+	if gopath == "" {
+		t.Skip("GOPATH is not set")
+	}
+
+	for _, tt := range []struct {
+		arch    string
+		machine elf.Machine
+	}{
+		{"arm64", elf.EM_AARCH64},
+		{"riscv64", elf.EM_RISCV},
+		{"arm", elf.EM_ARM},
+	} {
+		t.Run(tt.arch, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "ramfs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			config.Goos = "linux"
+			config.Arch = tt.arch
+			config.Goarm = ""
+			config.Gopath = gopath
+			config.TempDir = tmpDir
+			config.NoCache = true
+			guessplatform()
+			if err := checkplatform(); err != nil {
+				t.Fatal(err)
+			}
+			pkgList = []string{"github.com/u-root/u-root/cmds/echo"}
+
+			config.Jobs = 2
+			jobs, err := binaryJobs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := runJobs(append(jobs, job{"init", buildInit})); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, n := range []string{"bin/echo", "init"} {
+				f, err := elf.Open(filepath.Join(tmpDir, n))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if f.Machine != tt.machine {
+					t.Errorf("%s: machine is %v, want %v", n, f.Machine, tt.machine)
+				}
+				f.Close()
+			}
+
+			if got, want := toolDir(), "go/pkg/tool/linux_"+tt.arch; got != want {
+				t.Errorf("toolDir() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCheckPlatform(t *testing.T) {
+	defer func(goos, arch, arm string) {
+		config.Goos, config.Arch, config.Goarm = goos, arch, arm
+	}(config.Goos, config.Arch, config.Goarm)
+	for _, tt := range []struct {
+		goos, arch, arm string
+		err             string
+	}{
+		{"linux", "amd64", "", ""},
+		{"linux", "arm", "7", ""},
+		// Each is known to go, but not the two together.
+		{"plan9", "riscv64", "", "plan9/riscv64 is not a platform supported by go"},
+		{"linux", "wasm", "", "linux/wasm is not a platform supported by go"},
+		{"linux", "sparc", "", "linux/sparc is not a platform supported by go"},
+		{"linux", "arm", "8", "GOARM=8 is not one of 5, 6 or 7"},
+	} {
+		config.Goos, config.Arch, config.Goarm = tt.goos, tt.arch, tt.arm
+		err := checkplatform()
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s/%s: got %v, want nil", tt.goos, tt.arch, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s/%s GOARM=%s: got %v, want an error saying %q", tt.goos, tt.arch, tt.arm, err, tt.err)
+		}
+	}
+}
+
+func TestUinit(t *testing.T) {
+	defer func(u, a string, e bool, b, d string) {
+		config.Uinit, config.UinitArgs, config.UseExistingInit, config.Build, config.TempDir = u, a, e, b, d
+	}(config.Uinit, config.UinitArgs, config.UseExistingInit, config.Build, config.TempDir)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range []struct {
+		uinit, args string
+		useInit     bool
+		err, warn   bool
+	}{
+		{"", "", false, false, false},
+		{"github.com/u-root/u-root/cmds/echo", "hi", false, false, false},
+		{"", "hi", false, true, false},
+		// The existing init may be too old to run /bin/uinit.
+		{"github.com/u-root/u-root/cmds/echo", "", true, false, true},
+		{"", "", true, false, false},
+	} {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		config.Uinit, config.UinitArgs, config.UseExistingInit = tt.uinit, tt.args, tt.useInit
+		err := checkUinit()
+		if (err != nil) != tt.err {
+			t.Errorf("-uinit=%q -uinitargs=%q -useinit=%v: got %v, want error %v", tt.uinit, tt.args, tt.useInit, err, tt.err)
+		}
+		if warned := strings.Contains(logs.String(), "Warning: -uinit:"); warned != tt.warn {
+			t.Errorf("-uinit=%q -uinitargs=%q -useinit=%v: logged %q, want a warning %v", tt.uinit, tt.args, tt.useInit, logs.String(), tt.warn)
+		}
+	}
+	log.SetOutput(os.Stderr)
+
+	if testing.Short() {
+		t.Skip("building takes a while")
+	}
+	gopath := os.Getenv("GOPATH")
+	if gopath == "" {
+		t.Skip("GOPATH is not set")
+	}
+	defer func(o, a, g string, n bool) {
+		config.Goos, config.Arch, config.Gopath, config.NoCache = o, a, g, n
+	}(config.Goos, config.Arch, config.Gopath, config.NoCache)
+	config.Goos, config.Arch, config.Gopath, config.NoCache = runtime.GOOS, runtime.GOARCH, gopath, true
+	config.UseExistingInit = false
+	guessplatform()
+
+	dir, err := ioutil.TempDir("", "uinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prebuilt := filepath.Join(dir, "prebuilt")
+	if err := ioutil.WriteFile(prebuilt, []byte("#!/bin/sh\necho hi\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, build := range []string{"source", "binaries"} {
+		for _, tt := range []struct {
+			name, uinit, args string
+		}{
+			{"package", "github.com/u-root/u-root/cmds/echo", "-n hi there"},
+			{"directory", filepath.Join(urootDir(), "cmds/echo"), ""},
+			{"binary", prebuilt, "-x"},
+		} {
+			t.Run(build+"/"+tt.name, func(t *testing.T) {
+				config.Build, config.Uinit, config.UinitArgs = build, tt.uinit, tt.args
+				config.TempDir = filepath.Join(dir, build+"-"+tt.name)
+				if err := os.Mkdir(config.TempDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := buildUinit(); err != nil {
+					t.Fatal(err)
+				}
+
+				uinit := filepath.Join(config.TempDir, "bin/uinit")
+				fi, err := os.Stat(uinit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Mode()&0111 == 0 {
+					t.Errorf("bin/uinit has mode %v, want it executable", fi.Mode())
+				}
+				if tt.uinit == prebuilt {
+					b, err := ioutil.ReadFile(uinit)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(b) != "#!/bin/sh\necho hi\n" {
+						t.Errorf("bin/uinit is %q, want a copy of %s", b, prebuilt)
+					}
+				} else {
+					f, err := elf.Open(uinit)
+					if err != nil {
+						t.Fatalf("bin/uinit: %v", err)
+					}
+					f.Close()
+				}
+
+				want := []string{"bin/uinit"}
+				args, err := ioutil.ReadFile(filepath.Join(config.TempDir, "etc/uinit.args"))
+				switch {
+				case tt.args == "" && !os.IsNotExist(err):
+					t.Errorf("etc/uinit.args without -uinitargs: got %q, %v, want none", args, err)
+				case tt.args != "" && (err != nil || string(args) != tt.args+"\n"):
+					t.Errorf("etc/uinit.args: got %q, %v, want %q", args, err, tt.args+"\n")
+				case tt.args != "":
+					want = append(want, "etc/uinit.args")
+				}
+
+				// And they go in the archive.
+				a := artifacts()
+				for _, w := range want {
+					found := false
+					for _, n := range a {
+						found = found || n == w
+					}
+					if !found {
+						t.Errorf("artifacts() = %v, want %s in it", a, w)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestVendoredFiles(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+
+	// x uses the vendored lib directly, and the GOPATH one through
+	// other, which is outside app and so does not see app/vendor.
+	for n, c := range map[string]string{
+		"example.com/app/cmds/x/x.go": `package main
+
+import (
+	"example.com/lib"
+	"example.com/other"
+)
+
+func main() { lib.F(); other.F() }
+`,
+		"example.com/app/vendor/example.com/lib/lib.go": "package lib\n\nfunc F() {}\n",
+		"example.com/lib/lib.go":                        "package lib\n\nfunc F() {}\n",
+		"example.com/other/other.go":                    "package other\n\nimport \"example.com/lib\"\n\nfunc F() { lib.F() }\n",
+	} {
+		n = filepath.Join(gopath, "src", n)
+		if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(n, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config.Goos, config.Arch, config.Goarm = "", "", ""
+	config.Gopath = gopath
+	config.Goroot = runtime.GOROOT()
+	guessplatform()
+	deps = make(map[string]bool)
+	gorootFiles = make(map[string]bool)
+	urootFiles = make(map[string]bool)
+	goList, urootList = nil, nil
+	pkgList = []string{"example.com/app/cmds/x"}
+	if err := addGoFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	init, err := ramfs.NewInitramfs(archiver.Writer(&b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := init.WriteFiles(gopath, "", urootList); err != nil {
+		t.Fatal(err)
+	}
+	if err := init.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, r := range recs {
+		names[r.Name] = true
+	}
+
+	for n, want := range map[string]bool{
+		"src/example.com/app/cmds/x/x.go":                   true,
+		"src/example.com/app/vendor/example.com/lib/lib.go": true,
+		"src/example.com/other/other.go":                    true,
+		"src/example.com/lib/lib.go":                        false,
+	} {
+		if names[n] != want {
+			t.Errorf("%s in archive: got %v, want %v", n, names[n], want)
+		}
+	}
+}
+
+func TestMakeTempDir(t *testing.T) {
+	parent, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	existing := filepath.Join(parent, "existing")
+	if err := os.Mkdir(existing, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(existing, "precious"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		dir     string
+		keep    bool
+		removed bool
+	}{
+		{"existing", existing, false, false},
+		{"existing with -keep", existing, true, false},
+		{"new", filepath.Join(parent, "new"), false, true},
+		{"new with -keep", filepath.Join(parent, "kept"), true, false},
+		{"default", "", false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config.TempDir = tt.dir
+			config.Keep = tt.keep
+			cleanup, err := makeTempDir()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi, err := os.Stat(config.TempDir); err != nil || !fi.IsDir() {
+				t.Fatalf("tmpdir %q was not created: %v", config.TempDir, err)
+			}
+			cleanup()
+
+			_, err = os.Stat(config.TempDir)
+			if removed := os.IsNotExist(err); removed != tt.removed {
+				t.Errorf("%q removed: got %v, want %v", config.TempDir, removed, tt.removed)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(existing, "precious")); err != nil {
+		t.Errorf("contents of an existing tmpdir were removed: %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	config.CacheDir = filepath.Join(tmpDir, "cache")
+
+	bin := filepath.Join(tmpDir, "bin")
+	if err := ioutil.WriteFile(bin, []byte("a binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(tmpDir, "out/bin")
+	if err := cacheGet("key", out); !os.IsNotExist(err) {
+		t.Fatalf("cacheGet of a missing entry: got %v, want a not exist error", err)
+	}
+	if err := cachePut("key", bin); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacheGet("key", out); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(out); err != nil || string(b) != "a binary" {
+		t.Fatalf("cached binary: got %q, %v, want %q", b, err, "a binary")
+	}
+
+	// A corrupt entry is an error, and is thrown away.
+	if err := ioutil.WriteFile(filepath.Join(config.CacheDir, "key"), []byte("b binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacheGet("key", out); err == nil || os.IsNotExist(err) {
+		t.Fatalf("cacheGet of a corrupt entry: got %v, want a corruption error", err)
+	}
+	if err := cacheGet("key", out); !os.IsNotExist(err) {
+		t.Fatalf("cacheGet after corruption: got %v, want a not exist error", err)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command")
+	}
+	tmpDir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	defer func(g, o, a string) {
+		config.Gopath, config.Goos, config.Arch = g, o, a
+		listed = make(map[string]map[string]*goPackage)
+	}(config.Gopath, config.Goos, config.Arch)
+	config.Goos, config.Arch = runtime.GOOS, runtime.GOARCH
+
+	// The same packages in two GOPATHs.
+	gopaths := []string{filepath.Join(tmpDir, "gopath1"), filepath.Join(tmpDir, "gopath2")}
+	for _, gp := range gopaths {
+		for n, c := range map[string]string{
+			"example.com/lib/lib.go":      "package lib\n\nconst Hi = \"hi\"\n",
+			"example.com/hello/main.go":   "package main\n\nimport \"example.com/lib\"\n\nfunc main() { println(lib.Hi) }\n",
+			"example.com/goodbye/main.go": "package main\n\nimport \"os\"\n\nfunc main() { os.Exit(0) }\n",
+		} {
+			f := filepath.Join(gp, "src", n)
+			if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(f, []byte(c), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	key := func(gopath, pkg string, flags []string) string {
+		t.Helper()
+		config.Gopath = gopath
+		k, err := cacheKey(pkg, "", flags, []string{"GO111MODULE=off"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	// Without -trimpath, the binary has the source paths, and so does
+	// the key.
+	trimpath := []string{"-trimpath"}
+	if key(gopaths[0], "example.com/hello", trimpath) != key(gopaths[1], "example.com/hello", trimpath) {
+		t.Errorf("-trimpath: the same package in two GOPATHs has two keys")
+	}
+	if key(gopaths[0], "example.com/hello", nil) == key(gopaths[1], "example.com/hello", nil) {
+		t.Errorf("without -trimpath: the same package in two GOPATHs has one key")
+	}
+	// A change to what it imports is a change to it.
+	before := key(gopaths[1], "example.com/hello", trimpath)
+	if err := ioutil.WriteFile(filepath.Join(gopaths[1], "src/example.com/lib/lib.go"), []byte("package lib\n\nconst Hi = \"hello\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if key(gopaths[1], "example.com/hello", trimpath) == before {
+		t.Errorf("a change to an imported package does not change the key")
+	}
+	if key(gopaths[1], "example.com/goodbye", nil) == key(gopaths[1], "example.com/goodbye", []string{"-tags", "netgo"}) {
+		t.Errorf("the tags are not in the key")
+	}
+
+	// One listing is enough for the keys of everything listed, which
+	// are the same as those listed one at a time.
+	listed = make(map[string]map[string]*goPackage)
+	want := key(gopaths[0], "example.com/goodbye", trimpath)
+	listed = make(map[string]map[string]*goPackage)
+	config.Gopath = gopaths[0]
+	if _, err := listDeps("", trimpath, []string{"GO111MODULE=off"}, "example.com/hello", "example.com/goodbye", "example.com/nosuch"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
+	if got := key(gopaths[0], "example.com/goodbye", trimpath); got != want {
+		t.Errorf("key from one listing: got %s, want %s", got, want)
+	}
+	if _, err := cacheKey("example.com/nosuch", "", trimpath, []string{"GO111MODULE=off"}); err == nil {
+		t.Errorf("cacheKey of a package that is not there: got nil, want an error")
+	}
+}
+
+func TestGoFlag(t *testing.T) {
+	for _, tt := range []struct {
+		def, set, want string
+	}{
+		{"-s -w", "", "-s -w"},
+		{"-s -w", "-X main.version=1", "-s -w -X main.version=1"},
+		{"-s -w", "!-X main.version=1", "-X main.version=1"},
+		{"-s -w", "!", ""},
+		{"", "all=-N -l", "all=-N -l"},
+		{"-s -w", "main=-X 'main.version=a b'", "main=-s -w -X 'main.version=a b'"},
+	} {
+		if got := goFlag(tt.def, tt.set); got != tt.want {
+			t.Errorf("goFlag(%q, %q) = %q, want %q", tt.def, tt.set, got, tt.want)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(gopath, "src", "github.com", "u-root"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(gopath, "src", "github.com", "u-root", "u-root")); err != nil {
+		t.Fatal(err)
+	}
+	defer func(g string) { config.Gopath = g }(config.Gopath)
+	config.Gopath = gopath
+
+	for n, cmds := range templates {
+		for _, c := range cmds {
+			if m, _ := filepath.Glob(filepath.Join(root, "cmds", c)); len(m) == 0 {
+				t.Errorf("template %s: %s matches no command", n, c)
+			}
+		}
+	}
+
+	pat, err := globlist("minimal", "src/github.com/u-root/u-root/cmds/gpt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := len(templates["minimal"]) + 1; len(pat) != want {
+		t.Errorf("globlist(minimal, a glob): got %d patterns, want %d", len(pat), want)
+	}
+	if got, want := pat[len(pat)-1], filepath.Join(gopath, "src/github.com/u-root/u-root/cmds/gpt"); got != want {
+		t.Errorf("globlist(minimal, a glob): got %q last, want %q", got, want)
+	}
+	if _, err := globlist("minimla"); err == nil || !strings.Contains(err.Error(), "minimal") {
+		t.Errorf("globlist(minimla): got %v, want an error listing the templates", err)
+	}
+
+	pkgs, err := selectPkgs("minimal", "src/github.com/u-root/u-root/cmds/gpt", "-cmds/ls", "-c*/ps", "-cmds/wifi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cat", "echo", "kill", "mkdir", "mount", "rush", "shutdown", "umount", "gpt"}
+	for i := range want {
+		want[i] = "github.com/u-root/u-root/cmds/" + want[i]
+	}
+	if !reflect.DeepEqual(pkgs, want) {
+		t.Errorf("selectPkgs(minimal, a glob, subtractions): got %v, want %v", pkgs, want)
+	}
+	all, err := selectPkgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err = selectPkgs("-cmds/tcz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != len(all)-1 {
+		t.Errorf("selectPkgs(-cmds/tcz): got %d packages, want %d", len(pkgs), len(all)-1)
+	}
+
+	// On the command line, a - that comes first is taken for a flag,
+	// unless there is a -- before it; a ^ is not.
+	fs := flag.NewFlagSet("ramfs", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	for _, tt := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-cmds/tcz"}, false},
+		{[]string{"--", "-cmds/tcz"}, true},
+		{[]string{"^cmds/tcz"}, true},
+		{[]string{"all", "-cmds/tcz"}, true},
+		{[]string{"all", "^cmds/tcz"}, true},
+	} {
+		if err := fs.Parse(tt.args); err != nil {
+			if tt.ok {
+				t.Errorf("Parse(%q): got %v, want nil", tt.args, err)
+			}
+			continue
+		}
+		if !tt.ok {
+			t.Errorf("Parse(%q): got nil, want an error", tt.args)
+			continue
+		}
+		pkgs, err := selectPkgs(fs.Args()...)
+		if err != nil {
+			t.Errorf("selectPkgs(%q): %v", fs.Args(), err)
+			continue
+		}
+		if len(pkgs) != len(all)-1 {
+			t.Errorf("selectPkgs(%q): got %d packages, want %d", fs.Args(), len(pkgs), len(all)-1)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := printTemplates(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "\nminimal: cat echo kill ls") {
+		t.Errorf("printTemplates: got %q, want the minimal template with its commands", b.String())
+	}
+}
+
+func TestExternalPkgs(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(gopath, "src", "github.com", "u-root"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(gopath, "src", "github.com", "u-root", "u-root")); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(gopath, "outside", "agent")
+	for _, d := range []string{"src/example.com/corp/tools/cmd/agent", "src/example.com/other/agent", "outside/agent"} {
+		if err := os.MkdirAll(filepath.Join(gopath, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(gopath, d, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(g string) { config.Gopath = g }(config.Gopath)
+	config.Gopath = gopath
+
+	agent := "example.com/corp/tools/cmd/agent"
+	for _, args := range [][]string{
+		{"src/github.com/u-root/u-root/cmds/ls", agent},
+		{"src/github.com/u-root/u-root/cmds/ls", filepath.Join(gopath, "src", agent)},
+		{"src/github.com/u-root/u-root/cmds/ls", "example.com/corp/..."},
+	} {
+		pkgs, err := selectPkgs(args...)
+		if err != nil {
+			t.Errorf("selectPkgs(%q): %v", args, err)
+			continue
+		}
+		if want := []string{"github.com/u-root/u-root/cmds/ls", agent}; !reflect.DeepEqual(pkgs, want) {
+			t.Errorf("selectPkgs(%q): got %v, want %v", args, pkgs, want)
+		}
+	}
+	if _, err := selectPkgs(agent, "example.com/other/agent"); err == nil || !strings.Contains(err.Error(), "named agent") {
+		t.Errorf("selectPkgs of two agents: got %v, want a conflict", err)
+	}
+	if _, err := selectPkgs(agent, "example.com/other/agent", "-other/agent"); err != nil {
+		t.Errorf("selectPkgs of two agents, one subtracted: %v", err)
+	}
+	if _, err := selectPkgs(outside); err == nil {
+		t.Errorf("selectPkgs(%s): got nil, want an error, as it is outside GOPATH", outside)
+	}
+	if _, err := selectPkgs("example.com/nope/agent"); err == nil {
+		t.Errorf("selectPkgs(example.com/nope/agent): got nil, want an error")
+	}
+}
+
+func TestBuildFlagQuoting(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a program")
+	}
+	defer func() { config.LDFlags, config.GCFlags, config.NoCache = "", "", false }()
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for n, c := range map[string]string{
+		"go.mod":  "module example.com/version\n",
+		"main.go": "package main\n\nimport \"fmt\"\n\nvar version, tag string\n\nfunc main() { fmt.Printf(\"%s|%s\", version, tag) }\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, n), []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.Goos, config.Arch, config.Goarm = "", "", ""
+	config.Gopath = ""
+	guessplatform()
+	config.NoCache = true
+
+	// The spaces and quotes have to get to go build as they are, in one
+	// argument, for it to split.
+	config.LDFlags = `-X 'main.version=1.0 beta' -X "main.tag=it's here"`
+	config.GCFlags = "all=-N -l"
+	bin := filepath.Join(dir, "version")
+	if err := buildPkg(".", dir, bin, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	o, err := exec.Command(bin).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(o), "1.0 beta|it's here"; got != want {
+		t.Errorf("built with -ldflags %q: got %q, want %q", config.LDFlags, got, want)
+	}
+}
+
+func TestTags(t *testing.T) {
+	defer func() { config.Tags, config.GoList = "", false }()
+	gopath, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+	for n, c := range map[string]string{
+		"main.go":  "package main\n\nfunc main() { say() }\n",
+		"fancy.go": "//go:build !tiny\n\npackage main\n\nimport \"fmt\"\n\nfunc say() { fmt.Println(\"fancy\") }\n",
+		"tiny.go":  "//go:build tiny\n\npackage main\n\nfunc say() { println(\"tiny\") }\n",
+	} {
+		n = filepath.Join(gopath, "src/example.com/say", n)
+		if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(n, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.Goos, config.Arch, config.Goarm = "", "", ""
+	config.Gopath = gopath
+	config.Goroot = runtime.GOROOT()
+	guessplatform()
+
+	for _, tt := range []struct {
+		tags string
+		want []string
+	}{
+		{"", []string{"src/example.com/say/fancy.go", "src/example.com/say/main.go"}},
+		{"tiny", []string{"src/example.com/say/main.go", "src/example.com/say/tiny.go"}},
+		{"other, tiny", []string{"src/example.com/say/main.go", "src/example.com/say/tiny.go"}},
+	} {
+		for _, golist := range []bool{false, true} {
+			config.Tags, config.GoList = tt.tags, golist
+			deps = make(map[string]bool)
+			gorootFiles = make(map[string]bool)
+			urootFiles = make(map[string]bool)
+			goList, urootList = nil, nil
+			pkgList = []string{"example.com/say"}
+			if err := addGoFiles(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(urootList, tt.want) {
+				t.Errorf("-tags %q, -golist=%v: listed %q, want %q", tt.tags, golist, urootList, tt.want)
+			}
+		}
+	}
+
+	// The toolchain's own tag goes with the others rather than
+	// replacing them.
+	config.Tags = "tiny"
+	flags := goBuildFlags("cmd_go_bootstrap")
+	if got, want := flags[len(flags)-2:], []string{"-tags", "tiny,cmd_go_bootstrap"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("goBuildFlags(cmd_go_bootstrap) ends %q, want %q", got, want)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building takes a while")
+	}
+	if os.Getenv("GOPATH") == "" {
+		t.Skip("GOPATH is not set")
+	}
+	tmpDir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ramfs := filepath.Join(tmpDir, "ramfs")
+	if o, err := exec.Command("go", "build", "-o", ramfs, "ramfs.go").CombinedOutput(); err != nil {
+		t.Fatalf("building ramfs: %v, %s", err, o)
+	}
+
+	// Enough files that directory order is unlikely to be sorted.
+	extra := filepath.Join(tmpDir, "extra")
+	if err := os.Mkdir(extra, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"m", "b", "z", "a", "q", "c", "y"} {
+		if err := ioutil.WriteFile(filepath.Join(extra, n), []byte(n), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sums [2][sha256.Size]byte
+	for i := range sums {
+		out := filepath.Join(tmpDir, fmt.Sprintf("out%d.cpio", i))
+		cmd := exec.Command(ramfs,
+			"-build=binaries", "-nocache",
+			"-tmpdir", filepath.Join(tmpDir, fmt.Sprintf("build%d", i)),
+			"-files", extra+":extra",
+			"-o", out,
+			"src/github.com/u-root/u-root/cmds/echo")
+		cmd.Env = append(os.Environ(), "SOURCE_DATE_EPOCH=1500000000")
+		if o, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("ramfs: %v, %s", err, o)
+		}
+		b, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums[i] = sha256.Sum256(b)
+	}
+	if sums[0] != sums[1] {
+		t.Errorf("two builds differ: sha256 %x and %x", sums[0], sums[1])
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(o, d, f, goos, arch string) {
+		config.Output, config.TempDir, config.Format, config.Goos, config.Arch = o, d, f, goos, arch
+	}(config.Output, config.TempDir, config.Format, config.Goos, config.Arch)
+	config.TempDir, config.Format = filepath.Join(dir, "tmp"), "newc"
+	config.Goos, config.Arch = "linux", "amd64"
+
+	for _, tt := range []struct {
+		name, output, suffix string
+		want                 string
+		err                  string
+	}{
+		{"stdout", "-", "", "-", ""},
+		{"default", "", ".xz", "/tmp/initramfs.linux_amd64.cpio.xz", ""},
+		{"missing parents", filepath.Join(dir, "a/b/out.cpio"), "", filepath.Join(dir, "a/b/out.cpio"), ""},
+		{"relative", filepath.Join(dir, "a/../c/out.cpio"), "", filepath.Join(dir, "c/out.cpio"), ""},
+		{"in the TempDir", filepath.Join(dir, "tmp/out.cpio"), "", "", "which is archived"},
+		{"the TempDir", filepath.Join(dir, "tmp"), "", "", "which is archived"},
+		{"deep in the TempDir", filepath.Join(dir, "tmp/a/b/out.cpio"), "", "", "which is archived"},
+		// Only what is inside it is refused, not what starts
+		// with its name.
+		{"beside the TempDir", filepath.Join(dir, "tmpfile.cpio"), "", filepath.Join(dir, "tmpfile.cpio"), ""},
+	} {
+		config.Output = tt.output
+		got, err := outputPath(tt.suffix)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got %q, %v, want an error saying %q", tt.name, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+			continue
+		}
+		if got == "-" {
+			continue
+		}
+		if fi, err := os.Stat(filepath.Dir(got)); err != nil || !fi.IsDir() {
+			t.Errorf("%s: parent of %s: got %v, want a directory", tt.name, got, err)
+		}
+	}
+	// Nothing is made for an output that is refused.
+	if _, err := os.Stat(filepath.Join(dir, "tmp")); !os.IsNotExist(err) {
+		t.Errorf("refused outputs: got %v for the TempDir, want it not to exist", err)
+	}
+
+	// The default is named after the -format.
+	config.Output = ""
+	for format, want := range map[string]string{
+		"newc":     "/tmp/initramfs.linux_amd64.cpio",
+		"crc":      "/tmp/initramfs.linux_amd64.cpio",
+		"odc":      "/tmp/initramfs.linux_amd64.cpio",
+		"bin":      "/tmp/initramfs.linux_amd64.cpio",
+		"tar":      "/tmp/initramfs.linux_amd64.tar",
+		"squashfs": "/tmp/initramfs.linux_amd64.squashfs",
+		"ext4":     "/tmp/initramfs.linux_amd64.ext4",
+	} {
+		config.Format = format
+		if got, err := outputPath(""); err != nil || got != want {
+			t.Errorf("-format %s: got %q, %v, want %q", format, got, err, want)
+		}
+	}
+}
+
+func TestStdout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(o string, f bool) { config.Output, config.Force = o, f }(config.Output, config.Force)
+
+	file, err := os.Create(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	// A character device that is not /dev/null is taken for a
+	// terminal, and is one to test with where there is no tty.
+	tty, err := os.OpenFile("/dev/zero", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+
+	for _, tt := range []struct {
+		output string
+		force  bool
+		stdout *os.File
+		err    bool
+	}{
+		{"-", false, file, false},
+		{"-", false, null, false},
+		{"-", false, tty, true},
+		{"-", true, tty, false},
+		{"", false, tty, false},
+		{filepath.Join(dir, "out.cpio"), false, tty, false},
+	} {
+		config.Output, config.Force = tt.output, tt.force
+		if err := checkStdout(tt.stdout); (err != nil) != tt.err {
+			t.Errorf("-o %q -force=%v to %s: got %v, want error %v", tt.output, tt.force, tt.stdout.Name(), err, tt.err)
+		}
+	}
+
+	if testing.Short() {
+		t.Skip("building takes a while")
+	}
+	if os.Getenv("GOPATH") == "" {
+		t.Skip("GOPATH is not set")
+	}
+	ramfs := filepath.Join(dir, "ramfs")
+	if o, err := exec.Command("go", "build", "-o", ramfs, "ramfs.go").CombinedOutput(); err != nil {
+		t.Fatalf("building ramfs: %v, %s", err, o)
+	}
+	args := []string{
+		"-build=binaries", "-nocache", "-v=2",
+		"-tmpdir", filepath.Join(dir, "build"),
+		"-compress", "gzip",
+		"-o", "-",
+		"src/github.com/u-root/u-root/cmds/echo",
+	}
+
+	// All of stdout is the compressed archive; the logs are on stderr.
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(ramfs, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("ramfs -o -: %v, %s", err, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "Output is stdout") {
+		t.Errorf("ramfs -o -: stderr has no %q:\n%s", "Output is stdout", stderr.String())
+	}
+	z, err := gzip.NewReader(&stdout)
+	if err != nil {
+		t.Fatalf("ramfs -o -: stdout is not gzip: %v", err)
+	}
+	// Anything on stdout after the archive is taken for another gzip
+	// stream, and is an error.
+	b, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatalf("ramfs -o -: stdout is not just gzip: %v", err)
+	}
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := newc.Reader(bytes.NewReader(b)).ReadRecords()
+	if err != nil {
+		t.Fatalf("ramfs -o -: %v", err)
+	}
+	found := false
+	for _, r := range recs {
+		found = found || r.Name == "bin/echo"
+	}
+	if !found {
+		t.Errorf("ramfs -o -: no bin/echo in the archive")
+	}
+
+	// Nor does it write to a terminal, unless forced to.
+	cmd = exec.Command(ramfs, args...)
+	cmd.Stdout, cmd.Stderr = tty, &stderr
+	if err := cmd.Run(); err == nil || !strings.Contains(stderr.String(), "without -force") {
+		t.Errorf("ramfs -o - to a terminal: got %v, %s, want it refused", err, stderr.String())
+	}
+	stderr.Reset()
+	cmd = exec.Command(ramfs, append([]string{"-force"}, args...)...)
+	cmd.Stdout, cmd.Stderr = tty, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Errorf("ramfs -force -o - to a terminal: %v, %s", err, stderr.String())
+	}
+}
+
+func TestTrimpath(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building takes a while")
+	}
+	gopath := os.Getenv("GOPATH")
+	if gopath == "" {
+		t.Skip("GOPATH is not set")
+	}
+	defer func() { config.Trimpath, config.Strip, config.NoCache = true, true, false }()
+	tmpDir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	config.Goos, config.Arch, config.Goarm = "", "", ""
+	config.Gopath = gopath
+	config.Goroot = runtime.GOROOT()
+	config.TempDir = tmpDir
+	config.NoCache = true
+	guessplatform()
+
+	// Even with the debug information kept, trimmed paths leave neither
+	// GOPATH nor the temporary directory in init. Without trimming,
+	// GOPATH is there, which shows the check finds it.
+	for _, trim := range []bool{true, false} {
+		config.Trimpath, config.Strip = trim, false
+		if err := buildInit(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(tmpDir, "init"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{gopath, tmpDir} {
+			if got := bytes.Contains(b, []byte(p)); got != (!trim && p == gopath) {
+				t.Errorf("-trimpath=%v: init contains %q: got %v", trim, p, got)
+			}
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := newSymlinks(archiver.RecordFormat, []symlink{
+		{"bin/sh", "../bbin/rush"},
+		{"init", "/bbin/init"},
+		{"usr/local/bin/x", "/nowhere"},
+	})
+	archiver.RecordFormat = sl
+
+	var b bytes.Buffer
+	init, err := ramfs.NewInitramfsRecords(archiver.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []cpio.Record{
+		cpio.Record{Info: cpio.Info{Name: "bin", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("old init"), cpio.Info{Name: "init", Mode: syscall.S_IFREG | 0755}),
+		{Info: cpio.Info{Name: "bbin", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("rush"), cpio.Info{Name: "bbin/rush", Mode: syscall.S_IFREG | 0755}),
+	} {
+		if err := init.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sl.write(init); err != nil {
+		t.Fatal(err)
+	}
+	if err := init.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range recs {
+		s := fmt.Sprintf("%s %o", r.Name, r.Mode)
+		if r.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+			target, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s += " " + string(target)
+		}
+		got = append(got, s)
+	}
+	want := []string{
+		"bin 40755",
+		"bbin 40755",
+		"bbin/rush 100755",
+		"bin/sh 120777 ../bbin/rush",
+		"init 120777 /bbin/init",
+		"usr 40755",
+		"usr/local 40755",
+		"usr/local/bin 40755",
+		"usr/local/bin/x 120777 /nowhere",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestWholeTree(t *testing.T) {
+	defer func(f, s []string) { config.Files, config.Symlinks = f, s }(config.Files, config.Symlinks)
+	for _, v := range []string{"", ":x", "/", "/:x", ".:/", "ramfs.go:.", "ramfs.go:../x"} {
+		config.Files = []string{v}
+		if _, err := extraFiles(); err == nil {
+			t.Errorf("-files %q: got nil, want an error", v)
+		}
+	}
+	config.Files = []string{"ramfs.go:x", "ramfs.go:/bin/x"}
+	if _, err := extraFiles(); err != nil {
+		t.Errorf("-files %q: %v", config.Files, err)
+	}
+	for _, v := range []string{"/:x", ".:x", "../x:y", "a/../..:y"} {
+		config.Symlinks = []string{v}
+		if _, err := parseSymlinks(); err == nil {
+			t.Errorf("-symlinks %q: got nil, want an error", v)
+		}
+	}
+
+	defer func(g []string) { urootList = g }(urootList)
+	urootList = []string{"src/example.com/x/x.go", ""}
+	config.Build, config.NoToolchain = "source", true
+	defer func() { config.Build, config.NoToolchain = "", false }()
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	init, err := ramfs.NewInitramfsRecords(archiver.Writer(ioutil.Discard), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSources(init, nil, archiver, func(kind, src, dst string) {}); err == nil || !strings.Contains(err.Error(), "u-root source files") {
+		t.Errorf("writeSources with an empty file: got %v, want an error naming the list", err)
+	}
+}
+
+func TestSkeleton(t *testing.T) {
+	defer func() { config.NoSkeleton, config.NoDevNodes = false, false }()
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		noSkeleton, noDevNodes bool
+		want                   []string
+	}{
+		{false, false, []string{"dev", "dev/console", "proc", "sys", "tmp", "etc", "etc/passwd", "etc/group", "etc/hosts"}},
+		{false, true, []string{"dev", "proc", "sys", "tmp", "etc", "etc/passwd", "etc/group", "etc/hosts"}},
+		{true, false, nil},
+	} {
+		config.NoSkeleton, config.NoDevNodes = tt.noSkeleton, tt.noDevNodes
+		var b bytes.Buffer
+		init, err := ramfs.NewInitramfsRecords(archiver.Writer(&b), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeSkeleton(init, func(kind, src, dst string) {}); err != nil {
+			t.Fatal(err)
+		}
+		if err := init.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+		recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range recs {
+			got = append(got, r.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-noskeleton=%v -nodevnodes=%v: got %q, want %q", tt.noSkeleton, tt.noDevNodes, got, tt.want)
+		}
+	}
+
+	// What the user puts in /etc, with -files or -cpio, is kept in place
+	// of the skeleton's.
+	dir, err := ioutil.TempDir("", "skeleton")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var base bytes.Buffer
+	w := archiver.Writer(&base)
+	if err := w.WriteRecords([]cpio.Record{
+		{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("root:x:0:0:cpio:/:/bin/sh\n"), cpio.Info{Name: "etc/passwd", Mode: syscall.S_IFREG | 0644}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	hosts := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("10.0.0.1 files\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	initial := filepath.Join(dir, "base.cpio")
+	if err := ioutil.WriteFile(initial, base.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(c []string, b string) { config.InitialCpio, config.Build = c, b }(config.InitialCpio, config.Build)
+	config.InitialCpio, config.Build = []string{initial}, "binaries"
+
+	var b bytes.Buffer
+	init, err := ramfs.NewInitramfsOptions(archiver.Writer(&b), ramfs.Options{Policy: dedup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := func(kind, src, dst string) {}
+	if err := writeSources(init, []extraFile{{src: hosts, dst: "etc/hosts"}}, archiver, origin); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSkeleton(init, origin); err != nil {
+		t.Fatal(err)
+	}
+	if err := init.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := readContents(t, b.Bytes())
+	for name, want := range map[string]string{
+		"etc/passwd": "root:x:0:0:cpio:/:/bin/sh\n",
+		"etc/hosts":  "10.0.0.1 files\n",
+	} {
+		if got[name] != want {
+			t.Errorf("%s: got %q, want %q, not the skeleton's", name, got[name], want)
+		}
+	}
+	// Only the skeleton has an etc/group.
+	if _, ok := got["etc/group"]; !ok {
+		t.Errorf("no etc/group from the skeleton in %v", got)
+	}
+}
+
+func TestNoEtc(t *testing.T) {
+	defer func(b string) { config.Build, config.NoEtc = b, false }(config.Build)
+	config.Build = "binaries"
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, noEtc := range []bool{false, true} {
+		config.NoEtc = noEtc
+		var b bytes.Buffer
+		init, err := ramfs.NewInitramfsOptions(archiver.Writer(&b), ramfs.Options{Records: initRecords(nil), Policy: dedup})
+		if err != nil {
+			t.Fatal(err)
+		}
+		origin := func(kind, src, dst string) {}
+		if err := writeSources(init, nil, archiver, origin); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeSkeleton(init, origin); err != nil {
+			t.Fatal(err)
+		}
+		if err := init.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got := readContents(t, b.Bytes())
+		// ramfs.DevCPIO's resolv.conf, naming a nameserver, is in
+		// neither; only the skeleton's, which names none, is.
+		for name, want := range map[string]string{"etc/resolv.conf": "", "etc/passwd": etcSkeleton["passwd"]} {
+			c, ok := got[name]
+			if noEtc && ok {
+				t.Errorf("-noetc: got %s with %q, want none", name, c)
+			}
+			if !noEtc && (!ok || c != want) {
+				t.Errorf("%s: got %q (%v), want %q", name, c, ok, want)
+			}
+		}
+		// What is not in the skeleton is still there.
+		if _, ok := got["etc/localtime"]; !ok {
+			t.Errorf("-noetc=%v: no etc/localtime", noEtc)
+		}
+	}
+}
+
+// kindCounter is a RecordFormat that counts the records written by the
+// kind of source an origin function last named.
+type kindCounter struct {
+	cpio.RecordFormat
+	kind string
+	n    map[string]int
+}
+
+func (k *kindCounter) origin(kind, src, dst string) {
+	k.kind = kind
+}
+
+func (k *kindCounter) Writer(w io.Writer) cpio.RecordWriter {
+	return kindWriter{k: k, RecordWriter: k.RecordFormat.Writer(w)}
+}
+
+type kindWriter struct {
+	k *kindCounter
+	cpio.RecordWriter
+}
+
+func (w kindWriter) WriteRecord(r cpio.Record) error {
+	if r.Name != cpio.Trailer {
+		w.k.n[w.k.kind]++
+	}
+	return w.RecordWriter.WriteRecord(r)
+}
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dryrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The -cpio archive has an /etc/passwd, for the skeleton's to give
+	// way to, and a directory the -files go in.
+	var base bytes.Buffer
+	w := newc.Writer(&base)
+	if err := w.WriteRecords([]cpio.Record{
+		{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("root:x:0:0::/:/bin/sh\n"), cpio.Info{Name: "etc/passwd", Mode: syscall.S_IFREG | 0644}),
+		cpio.NewRecordFromBytes([]byte("old"), cpio.Info{Name: "lib/old.so", Mode: syscall.S_IFREG | 0755}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	for n, c := range map[string][]byte{
+		"base.cpio":   base.Bytes(),
+		"motd":        []byte("hello\n"),
+		"tree/a":      []byte("a"),
+		"tree/sub/b":  []byte("bb"),
+		"tree/sub/c1": []byte("ccc"),
+	} {
+		p := filepath.Join(dir, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, c, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(b string, u bool, c []string, p []string) {
+		config.Build, config.UseExistingInit, config.InitialCpio, pkgList = b, u, c, p
+	}(config.Build, config.UseExistingInit, config.InitialCpio, pkgList)
+	// Nothing is built, so all of the archive can be listed.
+	config.Build, config.UseExistingInit, config.InitialCpio, pkgList = "binaries", true, []string{filepath.Join(dir, "base.cpio")}, nil
+	files := []extraFile{
+		{src: filepath.Join(dir, "motd"), dst: "etc/motd"},
+		{src: filepath.Join(dir, "tree"), dst: "usr/share/tree"},
+	}
+	devs := []cpio.Record{cpio.CharDev("dev/ttyS0", 0660, 4, 64)}
+	links := []symlink{{"bin/sh", "/bbin/rush"}, {"lib/new.so", "old.so"}}
+
+	// The dry run, as main does it.
+	stdout := os.Stdout
+	out, err := ioutil.TempFile(dir, "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = out
+	err = dryRun(files, devs, links, newc, nil)
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The real thing, as main does it, but for the built files.
+	k := &kindCounter{RecordFormat: newc.RecordFormat, kind: "ramfs", n: make(map[string]int)}
+	sl := newSymlinks(k, links)
+	var b bytes.Buffer
+	init, err := ramfs.NewInitramfsOptions(cpio.Archiver{RecordFormat: sl}.Writer(&b), ramfs.Options{Records: initRecords(devs), Policy: dedup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeDevNodes(init, devs, k.origin); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSources(init, files, newc, k.origin); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSkeleton(init, k.origin); err != nil {
+		t.Fatal(err)
+	}
+	k.origin("symlink", "", "")
+	if err := sl.write(init); err != nil {
+		t.Fatal(err)
+	}
+	if err := init.Close(); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := newc.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		names []string
+		size  int64
+	)
+	for _, r := range recs {
+		names = append(names, r.Name)
+		size += int64(r.FileSize)
+	}
+
+	var (
+		listed []string
+		kinds  = make(map[string]int)
+		n, sz  int64
+		built  int
+	)
+	for _, l := range strings.Split(strings.TrimSpace(string(listing)), "\n") {
+		if _, err := fmt.Sscanf(l, "%d records, %d bytes, plus %d built files of unknown size", &n, &sz, &built); err == nil {
+			continue
+		}
+		i := strings.Index(l, " <- ")
+		f := strings.Fields(l[:i])
+		if len(f) < 7 {
+			t.Fatalf("listed %q, want kind, mode, uid, gid, size, date and name", l)
+		}
+		listed = append(listed, f[6])
+		kinds[f[0]]++
+	}
+	if !reflect.DeepEqual(listed, names) {
+		t.Errorf("listed:\n%s\nwritten:\n%s", strings.Join(listed, "\n"), strings.Join(names, "\n"))
+	}
+	if !reflect.DeepEqual(kinds, k.n) {
+		t.Errorf("listed by kind %v, written %v", kinds, k.n)
+	}
+	for _, kind := range []string{"ramfs", "devnodes", "files", "cpio", "etc", "skeleton", "symlink"} {
+		if kinds[kind] == 0 {
+			t.Errorf("nothing listed from %s", kind)
+		}
+	}
+	if n != int64(len(recs)) || sz != size || built != 0 {
+		t.Errorf("summary: %d records, %d bytes, %d built, want %d, %d, 0", n, sz, built, len(recs), size)
+	}
+}
+
+func TestTempDirJunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "junk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"bbin", ".git", "go-build123", "etc/.git"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"bbin/bb", "bbin/bb-go-tmp-umask", "init", ".gitignore", "go-build.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		path string
+		junk bool
+	}{
+		{"bbin", false},
+		{"bbin/bb", false},
+		{"bbin/bb-go-tmp-umask", true},
+		{"init", false},
+		{".git", true},
+		{"etc/.git", true},
+		{".gitignore", false},
+		{"go-build123", true},
+		{"go-build.txt", false},
+	} {
+		fi, err := os.Lstat(filepath.Join(dir, tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tempDirJunk(tt.path, fi); got != tt.junk {
+			t.Errorf("tempDirJunk(%q): got %v, want %v", tt.path, got, tt.junk)
+		}
+	}
+}
+
+func TestDevNodes(t *testing.T) {
+	defer func() { config.DevNodes, config.NoDevNodes = nil, false }()
+	config.DevNodes = []string{"/dev/ttyS0:c:4:64:0660", "dev/mapper/root:b:253:0", "dev/console:c:5:1:0622"}
+	devs, err := devNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	init, err := ramfs.NewInitramfsRecords(archiver.Writer(&b), initRecords(devs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeDevNodes(init, devs, func(kind, src, dst string) {}); err != nil {
+		t.Fatal(err)
+	}
+	// The -devnodes override what comes later.
+	if err := init.WriteRecord(cpio.CharDev("dev/ttyS0", 0600, 4, 65)); err != nil {
+		t.Fatal(err)
+	}
+	if err := init.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]cpio.Info)
+	for _, r := range recs {
+		if _, ok := got[r.Name]; ok {
+			t.Errorf("%s is there twice", r.Name)
+		}
+		r.Info.Ino, r.Info.NLink = 0, 0
+		got[r.Name] = r.Info
+	}
+	for _, want := range []cpio.Info{
+		{Name: "dev", Mode: syscall.S_IFDIR | 0755},
+		{Name: "dev/ttyS0", Mode: syscall.S_IFCHR | 0660, Rmajor: 4, Rminor: 64},
+		{Name: "dev/mapper", Mode: syscall.S_IFDIR | 0755},
+		{Name: "dev/mapper/root", Mode: syscall.S_IFBLK | 0600, Rmajor: 253},
+		{Name: "dev/console", Mode: syscall.S_IFCHR | 0622, Rmajor: 5, Rminor: 1},
+		{Name: "dev/null", Mode: syscall.S_IFCHR | 0666, Rmajor: 1, Rminor: 3},
+	} {
+		want.MTime = cpio.SourceDateEpoch()
+		if got[want.Name] != want {
+			t.Errorf("%s: got %v, want %v", want.Name, got[want.Name], want)
+		}
+	}
+
+	config.NoDevNodes = true
+	for _, r := range initRecords(devs) {
+		if typ := r.Mode & syscall.S_IFMT; typ == syscall.S_IFCHR || typ == syscall.S_IFBLK {
+			t.Errorf("-nodevnodes: %s is there", r.Name)
+		}
+	}
+
+	for _, v := range []string{"dev/x", "dev/x:p:1:1", "dev/x:c:a:1", "dev/x:c:1:1:0999"} {
+		config.DevNodes = []string{v}
+		if _, err := devNodes(); err == nil {
+			t.Errorf("-devnodes %q: got nil, want an error", v)
+		}
+	}
+}
+
+func TestLayerRecords(t *testing.T) {
+	dir := func(name string) cpio.Record {
+		return cpio.Record{Info: cpio.Info{Name: name, Mode: syscall.S_IFDIR | 0755}}
+	}
+	file := func(name string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(name), cpio.Info{Name: name, Mode: syscall.S_IFREG | 0644})
+	}
+	layers := [][]cpio.Record{
+		{dir("etc"), file("etc/motd"), file("lib"), dir("opt"), file("opt/a"), dir("opt/b"), file("opt/b/c")},
+		// lib goes from a file to a directory, and opt from a
+		// directory to a file, taking what was in it along.
+		{dir("etc"), dir("lib"), file("lib/x.so"), file("opt")},
+		{file("etc/motd")},
+	}
+	var got [][]string
+	for _, recs := range layerRecords(layers) {
+		var names []string
+		for _, r := range recs {
+			names = append(names, r.Name)
+		}
+		got = append(got, names)
+	}
+	want := [][]string{
+		nil,
+		{"etc", "lib", "lib/x.so", "opt"},
+		{"etc/motd"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("layerRecords: got %q, want %q", got, want)
+	}
+}
+
+func TestExistingInit(t *testing.T) {
+	defer func() { config.ExistingInit, config.UseExistingInit = "", false }()
+	for _, tt := range []struct {
+		existingInit string
+		useInit      bool
+		want         string
+	}{
+		{"", false, "rename"},
+		{"", true, "keep"},
+		{"discard", false, "discard"},
+		{"keep", false, "keep"},
+		{"keep", true, "keep"},
+		{"rename", true, ""},
+		{"discard", true, ""},
+		{"replace", false, ""},
+	} {
+		config.ExistingInit, config.UseExistingInit = tt.existingInit, tt.useInit
+		err := checkExistingInit()
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("-existing-init=%q -useinit=%v: got nil, want an error", tt.existingInit, tt.useInit)
+			}
+			continue
+		}
+		if err != nil || config.ExistingInit != tt.want || config.UseExistingInit != (tt.want == "keep") {
+			t.Errorf("-existing-init=%q -useinit=%v: got %q, -useinit=%v, %v, want %q", tt.existingInit, tt.useInit, config.ExistingInit, config.UseExistingInit, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		existingInit string
+		want         [][]string
+	}{
+		{"rename", [][]string{{"etc"}, {"inito", "bin"}, {"inito"}}},
+		{"discard", [][]string{{"etc"}, {"bin"}, nil}},
+		{"keep", [][]string{{"etc"}, {"init", "bin"}, {"init"}}},
+	} {
+		config.ExistingInit = tt.existingInit
+		layers := [][]cpio.Record{
+			{{Info: cpio.Info{Name: "etc"}}},
+			{{Info: cpio.Info{Name: "init"}}, {Info: cpio.Info{Name: "bin"}}},
+			{{Info: cpio.Info{Name: "init"}}},
+		}
+		var got [][]string
+		for _, recs := range existingInits(layers) {
+			var names []string
+			for _, r := range recs {
+				names = append(names, r.Name)
+			}
+			got = append(got, names)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-existing-init=%s: got %q, want %q", tt.existingInit, got, tt.want)
+		}
+	}
+}
+
+func TestOpenCpio(t *testing.T) {
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	w := newc.Writer(&archive)
+	if err := w.WriteRecords([]cpio.Record{cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644})}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "opencpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+
+	read := func(name string) {
+		f, err := openCpio(name)
+		if err != nil {
+			t.Fatalf("openCpio(%s): %v", name, err)
+		}
+		defer f.Close()
+		r := ramfs.NewReader(newc, f)
+		defer r.Close()
+		recs, err := r.ReadRecords()
+		if err != nil || len(recs) != 1 {
+			t.Fatalf("openCpio(%s): got %d records, %v, want 1", name, len(recs), err)
+		}
+		if b, err := ioutil.ReadAll(recs[0]); err != nil || string(b) != "hello\n" {
+			t.Errorf("openCpio(%s): %s has %q, %v, want %q", name, recs[0].Name, b, err, "hello\n")
+		}
+	}
+	for _, name := range compress.Names() {
+		c, err := compress.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Available(); err != nil {
+			t.Logf("Skipping %s: %v", name, err)
+			continue
+		}
+		var b bytes.Buffer
+		cw, err := c.Writer(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cw.Write(archive.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(dir, "initramfs.cpio"+c.Suffix())
+		if err := ioutil.WriteFile(p, b.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		read(p)
+
+		// Stdin, as a pipe, can not be read at.
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			pw.Write(b.Bytes())
+			pw.Close()
+		}()
+		os.Stdin = pr
+		read("-")
+	}
+}
+
+func TestCpioExclude(t *testing.T) {
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	w := newc.Writer(&archive)
+	if err := w.WriteRecords([]cpio.Record{
+		{Info: cpio.Info{Name: "lib", Mode: syscall.S_IFDIR | 0755}},
+		{Info: cpio.Info{Name: "lib/modules", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("old"), cpio.Info{Name: "lib/modules/e1000.ko", Mode: syscall.S_IFREG | 0644}),
+		cpio.NewRecordFromBytes([]byte("libc"), cpio.Info{Name: "lib/libc.so", Mode: syscall.S_IFREG | 0755}),
+		cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0644}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "cpioexclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "base.cpio")
+	if err := ioutil.WriteFile(p, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { config.InitialCpio, config.CpioExclude, config.ExistingInit = nil, nil, "" }()
+	config.InitialCpio, config.CpioExclude, config.ExistingInit = []string{p}, []string{"lib/modules", "etc/*"}, "keep"
+	var b bytes.Buffer
+	init, err := ramfs.NewInitramfsRecords(newc.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeInitialCpios(init, newc, func(kind, src, dst string) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := init.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := cpio.ReadArchive(newc.RecordFormat.Reader(bytes.NewReader(b.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With etc/motd left out, there is nothing to make etc for.
+	if got, want := a.Names(), []string{"lib", "lib/libc.so"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("-cpio-exclude: got %q, want %q", got, want)
+	}
+
+	config.CpioExclude = []string{"lib/[modules"}
+	if err := writeInitialCpios(init, newc, func(kind, src, dst string) {}); err == nil {
+		t.Errorf("-cpio-exclude=lib/[modules: got nil, want an error")
+	}
+}
+
+// gnuLinks returns an archive of the hard links names, to a file of
+// contents, as GNU cpio writes them: all with inode 7 and only the last
+// with the contents.
+func gnuLinks(t *testing.T, contents string, names ...string) []byte {
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	// The RecordWriter writes the records as they are, as cpio.Writer
+	// would not.
+	w := newc.RecordFormat.Writer(&b)
+	for i, n := range names {
+		info := cpio.Info{Name: n, Ino: 7, Mode: syscall.S_IFREG | 0644, NLink: uint64(len(names)), Major: 8, Minor: 1}
+		rec := cpio.Record{Info: info}
+		if i == len(names)-1 {
+			rec = cpio.NewRecordFromBytes([]byte(contents), info)
+		}
+		if err := w.WriteRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteRecord(cpio.TrailerRecord); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// readContents returns the contents of the regular files of the archive b
+// by name.
+func readContents(t *testing.T, b []byte) map[string]string {
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := newc.Reader(bytes.NewReader(b)).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(map[string]string)
+	for _, r := range recs {
+		if r.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			continue
+		}
+		d, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c[r.Name] = string(d)
+	}
+	return c
+}
+
+func TestCpioHardLinks(t *testing.T) {
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "cpiolinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Both layers use inode 7, for different files.
+	var layers []string
+	for i, l := range []struct {
+		contents string
+		names    []string
+	}{
+		{"first", []string{"a1", "a2"}},
+		{"second", []string{"b1", "b2"}},
+	} {
+		p := filepath.Join(dir, fmt.Sprintf("layer%d.cpio", i))
+		if err := ioutil.WriteFile(p, gnuLinks(t, l.contents, l.names...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, p)
+	}
+
+	defer func() { config.InitialCpio, config.ExistingInit = nil, "" }()
+	config.InitialCpio, config.ExistingInit = layers, "keep"
+	var b bytes.Buffer
+	init, err := ramfs.NewInitramfsRecords(newc.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeInitialCpios(init, newc, func(kind, src, dst string) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := init.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a1": "first", "a2": "first", "b1": "second", "b2": "second"}
+	if got := readContents(t, b.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCpioLayersHardLinks(t *testing.T) {
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "cpiolayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The first layer is two archives, one after the other, and every
+	// archive has its links at inode 7. The second replaces a2, the link
+	// of the first archive that has the contents.
+	base := append(gnuLinks(t, "first", "a1", "a2"), gnuLinks(t, "third", "c1", "c2")...)
+	over := gnuLinks(t, "second", "b1", "a2")
+	var layers []string
+	for i, l := range [][]byte{base, over} {
+		p := filepath.Join(dir, fmt.Sprintf("layer%d.cpio", i))
+		if err := ioutil.WriteFile(p, l, 0644); err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, p)
+	}
+
+	defer func() { config.InitialCpio, config.ExistingInit = nil, "" }()
+	config.InitialCpio, config.ExistingInit = layers, "keep"
+	var b bytes.Buffer
+	init, err := ramfs.NewInitramfsRecords(newc.Writer(&b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeInitialCpios(init, newc, func(kind, src, dst string) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := init.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a1": "first", "c1": "third", "c2": "third", "b1": "second", "a2": "second"}
+	if got := readContents(t, b.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCpioLayersInit(t *testing.T) {
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "cpiolayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Both layers have an init, and the overlay's replaces the base's.
+	var layers []string
+	for i, l := range [][]byte{
+		append(gnuLinks(t, "base init", "init"), gnuLinks(t, "base", "base")...),
+		gnuLinks(t, "overlay init", "init"),
+	} {
+		p := filepath.Join(dir, fmt.Sprintf("layer%d.cpio", i))
+		if err := ioutil.WriteFile(p, l, 0644); err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, p)
+	}
+
+	defer func() { config.InitialCpio, config.ExistingInit, config.CpioExclude = nil, "", nil }()
+	for _, tt := range []struct {
+		existingInit string
+		exclude      []string
+		want         map[string]string
+	}{
+		{"rename", nil, map[string]string{"base": "base", "inito": "overlay init", "init": "built"}},
+		{"discard", nil, map[string]string{"base": "base", "init": "built"}},
+		// Nothing is built, and the last layer's init is the init.
+		{"keep", nil, map[string]string{"base": "base", "init": "overlay init"}},
+		// What -cpio-exclude leaves out is not there to rename.
+		{"rename", []string{"/init"}, map[string]string{"base": "base", "init": "built"}},
+		{"keep", []string{"init"}, map[string]string{"base": "base"}},
+	} {
+		config.InitialCpio, config.ExistingInit, config.CpioExclude = layers, tt.existingInit, tt.exclude
+		var b bytes.Buffer
+		init, err := ramfs.NewInitramfsOptions(newc.Writer(&b), ramfs.Options{Policy: ramfs.DedupError})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeInitialCpios(init, newc, func(kind, src, dst string) {}); err != nil {
+			t.Fatal(err)
+		}
+		// As the init built in the TempDir is.
+		if tt.existingInit != "keep" {
+			init.SetSource(ramfs.Source{Name: "tempdir"})
+			if err := init.WriteRecord(cpio.NewRecordFromBytes([]byte("built"), cpio.Info{Name: "init", Mode: syscall.S_IFREG | 0755})); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := init.Conflicts(); err != nil {
+			t.Errorf("-existing-init=%s -cpio-exclude=%q: %v", tt.existingInit, tt.exclude, err)
+		}
+		if err := init.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := readContents(t, b.Bytes()); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-existing-init=%s -cpio-exclude=%q: got %q, want %q", tt.existingInit, tt.exclude, got, tt.want)
+		}
+	}
+}
+
+func TestKernelModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dep := "kernel/a.ko.xz: kernel/b.ko.gz kernel/c.ko.zst\nkernel/b.ko.gz: kernel/c.ko.zst\nkernel/c.ko.zst:\nkernel/d.ko:\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "modules.dep"), []byte(dep), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { config.Modules, config.UnpackModules, config.UseExistingInit, kmods = "", false, false, nil }()
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range []struct {
+		unpack, useInit bool
+		paths           []string
+		warning         string
+	}{
+		{true, false, []string{"kernel/c.ko", "kernel/b.ko", "kernel/a.ko", "kernel/d.ko"}, ""},
+		// Init can load gzipped modules, but needs xz and zstd for
+		// the rest.
+		{false, false, []string{"kernel/c.ko.zst", "kernel/b.ko.gz", "kernel/a.ko.xz", "kernel/d.ko"}, "init can not load c, a without xz or zstd"},
+		// An existing init is on its own.
+		{false, true, []string{"kernel/c.ko.zst", "kernel/b.ko.gz", "kernel/a.ko.xz", "kernel/d.ko"}, ""},
+	} {
+		config.Modules, config.UnpackModules, config.UseExistingInit = dir+":a,d", tt.unpack, tt.useInit
+		var b bytes.Buffer
+		log.SetOutput(&b)
+		if err := kernelModules(); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, m := range kmods {
+			paths = append(paths, m.Path)
+		}
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("-unpackmodules=%v: got %q, want %q", tt.unpack, paths, tt.paths)
+		}
+		if got := b.String(); tt.warning == "" && got != "" || !strings.Contains(got, tt.warning) {
+			t.Errorf("-unpackmodules=%v -useinit=%v: logged %q, want %q", tt.unpack, tt.useInit, got, tt.warning)
+		}
+	}
+}
+
+func TestFirmware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "firmware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for n, c := range map[string]string{
+		"intel/ibt.sfi":    "ibt",
+		"brcm/real.bin":    "brcm",
+		"rtl/fw.bin.xz":    "xz",
+		"intel/unused.sfi": "unused",
+	} {
+		n = filepath.Join(dir, n)
+		if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(n, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("real.bin", filepath.Join(dir, "brcm/link.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(b string) { config.Build, config.Firmware, config.FirmwareExtra, fw = b, "", nil, nil }(config.Build)
+	config.Build, config.Firmware = "binaries", dir
+	config.FirmwareExtra = []string{"intel/ibt.sfi", "brcm/link.bin", "rtl/fw.bin"}
+	if fw, err = firmware(); err != nil {
+		t.Fatal(err)
+	}
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	init, err := ramfs.NewInitramfsOptions(archiver.Writer(&b), ramfs.Options{Policy: dedup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSources(init, nil, archiver, func(kind, src, dst string) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := init.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := readContents(t, b.Bytes())
+	// A link is archived as the file it is of, under its own name, and
+	// compressed firmware under the name with its extension.
+	for name, want := range map[string]string{
+		"lib/firmware/intel/ibt.sfi": "ibt",
+		"lib/firmware/brcm/link.bin": "brcm",
+		"lib/firmware/rtl/fw.bin.xz": "xz",
+	} {
+		if c, ok := got[name]; !ok || c != want {
+			t.Errorf("%s: got %q (%v), want %q", name, c, ok, want)
+		}
+	}
+	for _, name := range []string{"lib/firmware/brcm/real.bin", "lib/firmware/intel/unused.sfi"} {
+		if _, ok := got[name]; ok {
+			t.Errorf("%s is in the archive, but nothing asked for it", name)
+		}
+	}
+
+	config.FirmwareExtra = []string{"intel/ibt.sfi", "intel/missing.sfi"}
+	if _, err := firmware(); err == nil || !strings.Contains(err.Error(), "intel/missing.sfi") {
+		t.Errorf("-firmware-extra intel/missing.sfi: got %v, want an error naming it", err)
+	}
+}
+
+// goRelease returns a gzipped tar archive laid out like a Go release, with
+// files named in extra too.
+func goRelease(t *testing.T, extra ...string) []byte {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(zw)
+	for _, f := range append([]string{"go/bin/go", "go/VERSION"}, extra...) {
+		c := "#!/bin/sh\necho go version go1.99.0\n"
+		if err := tw.WriteHeader(&tar.Header{Name: f, Mode: 0755, Size: int64(len(c)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestFetchGo(t *testing.T) {
+	defer func(u string) { goDownloadURL = u }(goDownloadURL)
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The server has go1.99.0, one with a wrong checksum and one that
+	// writes outside where it is unpacked.
+	files := make(map[string][]byte)
+	add := func(v string, tgz []byte, sum string) {
+		name := fmt.Sprintf("/%s.%s-%s.tar.gz", v, runtime.GOOS, runtime.GOARCH)
+		if sum == "" {
+			h := sha256.Sum256(tgz)
+			sum = fmt.Sprintf("%x", h)
+		}
+		files[name], files[name+".sha256"] = tgz, []byte(sum+"\n")
+	}
+	add("go1.99.0", goRelease(t), "")
+	add("go1.99.1", goRelease(t), strings.Repeat("0", 64))
+	add("go1.99.2", goRelease(t, "go/../../escaped"), "")
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b, ok := files[r.URL.Path]; ok {
+			w.Write(b)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	goDownloadURL = s.URL + "/"
+
+	root, err := fetchGo("go1.99.0", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != filepath.Join(dir, "go1.99.0/go") {
+		t.Errorf("fetchGo(go1.99.0) = %q, want it in %s", root, dir)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "bin/go")); err != nil || fi.Mode()&0111 == 0 {
+		t.Errorf("go1.99.0/go/bin/go: got %v, %v, want an executable", fi, err)
+	}
+	for _, tt := range []struct {
+		v, want string
+	}{
+		{"go1.99.1", "SHA256 is"},
+		{"go1.99.2", "outside the archive"},
+		{"go1.99.3", "404"},
+	} {
+		if _, err := fetchGo(tt.v, dir); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("fetchGo(%s): got %v, want an error with %q", tt.v, err, tt.want)
+		}
+		if _, err := os.Stat(filepath.Join(dir, tt.v)); !os.IsNotExist(err) {
+			t.Errorf("fetchGo(%s) left %s behind", tt.v, tt.v)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("go1.99.2 wrote outside %s", dir)
+	}
+
+	// Offline, what is cached is still there, and what is not is an
+	// error rather than the host's go.
+	s.Close()
+	if r, err := fetchGo("go1.99.0", dir); err != nil || r != root {
+		t.Errorf("fetchGo(go1.99.0) offline: got %q, %v, want %q", r, err, root)
+	}
+	if _, err := fetchGo("go1.99.3", dir); err == nil || !strings.Contains(err.Error(), "go1.99.3 is not in") {
+		t.Errorf("fetchGo(go1.99.3) offline: got %v, want an error saying it is not in %s", err, dir)
+	}
+}
+
+func TestNoToolchain(t *testing.T) {
+	defer func() {
+		config.Build, config.NoToolchain, config.NoSrc, config.NoEtc = "source", false, false, false
+		goList, urootList = []string{"pkg/include"}, nil
+	}()
+	tmpDir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	config.Goroot = filepath.Join(tmpDir, "goroot")
+	config.Gopath = filepath.Join(tmpDir, "gopath")
+	for _, n := range []string{"goroot/src/os/file.go", "gopath/src/example.com/x/x.go"} {
+		n = filepath.Join(tmpDir, n)
+		if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(n, []byte("package x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	goList, urootList = []string{"src/os/file.go"}, []string{"src/example.com/x/x.go"}
+	config.Build, config.NoEtc = "source", true
+	config.Goos, config.Arch, config.Goarm = "linux", "amd64", ""
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		noToolchain, noSrc bool
+		files, artifacts   []string
+	}{
+		{false, false, []string{"go/src/os/file.go", "src/example.com/x/x.go", "etc/u-root/cmds"}, []string{"go/bin/go", "go/pkg/tool/linux_amd64/compile", "go/pkg/tool/linux_amd64/link", "go/pkg/tool/linux_amd64/asm", "init"}},
+		{true, false, []string{"src/example.com/x/x.go", "etc/u-root/cmds"}, []string{"init"}},
+		{true, true, nil, []string{"init"}},
+	} {
+		config.NoToolchain, config.NoSrc = tt.noToolchain, tt.noSrc
+		var b bytes.Buffer
+		init, err := ramfs.NewInitramfsRecords(archiver.Writer(&b), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeSources(init, nil, archiver, func(kind, src, dst string) {}); err != nil {
+			t.Fatal(err)
+		}
+		if err := init.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+		recs, err := archiver.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, r := range recs {
+			if r.Mode&syscall.S_IFMT == syscall.S_IFREG {
+				files = append(files, r.Name)
+			}
+		}
+		if !reflect.DeepEqual(files, tt.files) {
+			t.Errorf("-notoolchain=%v -nosrc=%v: wrote %q, want %q", tt.noToolchain, tt.noSrc, files, tt.files)
+		}
+		if got := artifacts(); !reflect.DeepEqual(got, tt.artifacts) {
+			t.Errorf("-notoolchain=%v -nosrc=%v: built %q, want %q", tt.noToolchain, tt.noSrc, got, tt.artifacts)
+		}
+	}
+}
+
+// interrupted is what TestInterrupt runs in a child: a build, as far as
+// what it leaves goes, stuck in a long command.
+func interrupted() {
+	dir := os.Getenv("RAMFS_INTERRUPTED")
+	config.TempDir = filepath.Join(dir, "tmp")
+	cleanup, err := makeTempDir()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	atExit(cleanup)
+	if err := ioutil.WriteFile(filepath.Join(config.TempDir, "init"), []byte("built"), 0755); err != nil {
+		fatalf("%v", err)
+	}
+	out := filepath.Join(dir, "out.cpio")
+	if err := ioutil.WriteFile(out, []byte("070701"), 0644); err != nil {
+		fatalf("%v", err)
+	}
+	partial(out)
+	handleSignals()
+
+	cmd := command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		fatalf("%v", err)
+	}
+	fmt.Printf("%d\n", cmd.Process.Pid)
+	if err := cmd.Wait(); err != nil {
+		fatalf("sleep: %v", err)
+	}
+	exit(0)
+}
+
+func TestInterrupt(t *testing.T) {
+	if os.Getenv("RAMFS_INTERRUPTED") != "" {
+		interrupted()
+		return
+	}
+	for _, tt := range []struct {
+		sig    syscall.Signal
+		status int
+	}{
+		{syscall.SIGINT, 130},
+		{syscall.SIGTERM, 143},
+	} {
+		dir, err := ioutil.TempDir("", "ramfs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestInterrupt$")
+		cmd.Env = append(os.Environ(), "RAMFS_INTERRUPTED="+dir)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		// It prints the pid of sleep once it is running.
+		var pid int
+		if _, err := fmt.Fscan(bufio.NewReader(stdout), &pid); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			t.Fatalf("%v: reading the pid of sleep: %v, %s", tt.sig, err, stderr.Bytes())
+		}
+		if err := cmd.Process.Signal(tt.sig); err != nil {
+			t.Fatal(err)
+		}
+		err = cmd.Wait()
+		if got := cmd.ProcessState.ExitCode(); got != tt.status {
+			t.Errorf("%v: exit status %d (%v), want %d: %s", tt.sig, got, err, tt.status, stderr.Bytes())
+		}
+		for _, n := range []string{"tmp", "out.cpio"} {
+			if _, err := os.Stat(filepath.Join(dir, n)); !os.IsNotExist(err) {
+				t.Errorf("%v: %s was left behind", tt.sig, n)
+			}
+		}
+		// Once the child is gone, sleep is reparented and reaped.
+		gone := false
+		for i := 0; i < 50 && !gone; i++ {
+			gone = syscall.Kill(pid, 0) == syscall.ESRCH
+			time.Sleep(20 * time.Millisecond)
+		}
+		if !gone {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Errorf("%v: sleep, pid %d, was left running", tt.sig, pid)
+		}
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if dir := os.Getenv("RAMFS_FORMAT"); dir != "" {
+		os.Args = []string{"ramfs", "-format", "zip", "-tmpdir", filepath.Join(dir, "tmp"), "-o", filepath.Join(dir, "out.cpio")}
+		main()
+		return
+	}
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Without a PATH, whatever runs go fails some other way.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestUnknownFormat$")
+	cmd.Env = append(os.Environ(), "RAMFS_FORMAT="+dir, "PATH=")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if got := cmd.ProcessState.ExitCode(); got != 1 {
+		t.Errorf("exit status %d (%v), want 1: %s", got, err, stderr.Bytes())
+	}
+	if !strings.Contains(stderr.String(), "-format: Format zip is not one of") {
+		t.Errorf("got %q, want a -format error", stderr.String())
+	}
+	for _, n := range []string{"tmp", "out.cpio"} {
+		if _, err := os.Stat(filepath.Join(dir, n)); !os.IsNotExist(err) {
+			t.Errorf("%s was made before -format was checked", n)
+		}
+	}
+}
+
+func TestNormalizer(t *testing.T) {
+	defer func(o, m string, p []string) {
+		config.Owner, config.MTime, config.Preserve = o, m, p
+	}(config.Owner, config.MTime, config.Preserve)
+
+	info := func(name string, mode uint64) cpio.Info {
+		return cpio.Info{Name: name, Mode: mode, UID: 1000, GID: 100, MTime: 1234, Major: 8, Minor: 1}
+	}
+	recs := []cpio.Record{
+		cpio.NewRecordFromBytes([]byte("hi"), info("etc/motd", syscall.S_IFREG|0644)),
+		{Info: info("home/user", syscall.S_IFDIR|0755)},
+		cpio.NewRecordFromBytes([]byte("x"), info("home/user/.profile", syscall.S_IFREG|0644)),
+		cpio.NewRecordFromBytes([]byte("/bbin/rush"), info("home/user/sh", syscall.S_IFLNK|0777)),
+		// Not under /home/user, although it starts the same.
+		{Info: info("home/username", syscall.S_IFDIR|0755)},
+	}
+
+	type fields struct {
+		uid, gid, mtime uint64
+	}
+	epoch := cpio.SourceDateEpoch()
+	for _, tt := range []struct {
+		owner, mtime string
+		preserve     []string
+		want         []fields
+	}{
+		// Without -mtime, it is $SOURCE_DATE_EPOCH, or 0.
+		{
+			owner: "", mtime: "",
+			want: []fields{{1000, 100, epoch}, {1000, 100, epoch}, {1000, 100, epoch}, {1000, 100, epoch}, {1000, 100, epoch}},
+		},
+		{
+			owner: "0:0", mtime: "",
+			want: []fields{{0, 0, epoch}, {0, 0, epoch}, {0, 0, epoch}, {0, 0, epoch}, {0, 0, epoch}},
+		},
+		{
+			owner: "0:0", mtime: "", preserve: []string{"etc/motd"},
+			want: []fields{{1000, 100, 1234}, {0, 0, epoch}, {0, 0, epoch}, {0, 0, epoch}, {0, 0, epoch}},
+		},
+		{
+			owner: "", mtime: "42",
+			want: []fields{{1000, 100, 42}, {1000, 100, 42}, {1000, 100, 42}, {1000, 100, 42}, {1000, 100, 42}},
+		},
+		{
+			owner: "5:6", mtime: "42",
+			want: []fields{{5, 6, 42}, {5, 6, 42}, {5, 6, 42}, {5, 6, 42}, {5, 6, 42}},
+		},
+		{
+			owner: "0:0", mtime: "42", preserve: []string{"/home/user/"},
+			want: []fields{{0, 0, 42}, {1000, 100, 1234}, {1000, 100, 1234}, {1000, 100, 1234}, {0, 0, 42}},
+		},
+		{
+			owner: "0:0", mtime: "42", preserve: []string{"home/user/sh", "etc/motd"},
+			want: []fields{{1000, 100, 1234}, {0, 0, 42}, {0, 0, 42}, {1000, 100, 1234}, {0, 0, 42}},
+		},
+	} {
+		config.Owner, config.MTime, config.Preserve = tt.owner, tt.mtime, tt.preserve
+		f, err := normalizer()
+		if err != nil {
+			t.Errorf("-owner=%q -mtime=%q: %v", tt.owner, tt.mtime, err)
+			continue
+		}
+		for i, r := range recs {
+			got := f(r)
+			if g := (fields{got.UID, got.GID, got.MTime}); g != tt.want[i] {
+				t.Errorf("-owner=%q -mtime=%q -preserve=%q: %s has uid, gid, mtime %v, want %v", tt.owner, tt.mtime, tt.preserve, r.Name, g, tt.want[i])
+			}
+			// The device of the file the record came from is never
+			// archived.
+			if got.Major != 0 || got.Minor != 0 {
+				t.Errorf("-owner=%q -mtime=%q -preserve=%q: %s has device %d:%d, want 0:0", tt.owner, tt.mtime, tt.preserve, r.Name, got.Major, got.Minor)
+			}
+			if got.Name != r.Name || got.Mode != r.Mode || got.FileSize != r.FileSize {
+				t.Errorf("-owner=%q -mtime=%q -preserve=%q: %s became %v", tt.owner, tt.mtime, tt.preserve, r.Name, got.Info)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		owner, mtime string
+		err          string
+	}{
+		{owner: "0", err: `-owner: "0" is not uid:gid`},
+		{owner: "0:0:0", err: `-owner: "0:0:0" is not uid:gid`},
+		{owner: "root:0", err: "-owner: "},
+		{owner: "0:wheel", err: "-owner: "},
+		{owner: "-1:0", err: "-owner: "},
+		{owner: "4294967296:0", err: "-owner: "},
+		{owner: ":", err: "-owner: "},
+		{mtime: "yesterday", err: "-mtime: "},
+		{mtime: "-1", err: "-mtime: "},
+	} {
+		config.Owner, config.MTime, config.Preserve = tt.owner, tt.mtime, nil
+		if _, err := normalizer(); err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("-owner=%q -mtime=%q: got %v, want an error starting %q", tt.owner, tt.mtime, err, tt.err)
+		}
+	}
+}
+
+func TestPreserve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(o, m string, p, c []string, b string) {
+		config.Owner, config.MTime, config.Preserve, config.InitialCpio, config.Build = o, m, p, c, b
+	}(config.Owner, config.MTime, config.Preserve, config.InitialCpio, config.Build)
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A -cpio archive and a -files file, each with one record under
+	// -preserve and one not.
+	var base bytes.Buffer
+	w := newc.Writer(&base)
+	info := func(name string) cpio.Info {
+		return cpio.Info{Name: name, Mode: syscall.S_IFREG | 0644, UID: 1000, GID: 100, MTime: 1234567}
+	}
+	if err := w.WriteRecords([]cpio.Record{
+		{Info: cpio.Info{Name: "home", Mode: syscall.S_IFDIR | 0755, UID: 1000, GID: 100, MTime: 1234567}},
+		{Info: cpio.Info{Name: "home/user", Mode: syscall.S_IFDIR | 0755, UID: 1000, GID: 100, MTime: 1234567}},
+		cpio.NewRecordFromBytes([]byte("kept"), info("home/user/.profile")),
+		cpio.NewRecordFromBytes([]byte("normalized"), info("etc/profile")),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	initial := filepath.Join(dir, "base.cpio")
+	if err := ioutil.WriteFile(initial, base.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var files []extraFile
+	for _, n := range []string{"kept", "normalized"} {
+		f := filepath.Join(dir, n)
+		if err := ioutil.WriteFile(f, []byte(n), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Unix(7654321, 0)
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files = []extraFile{
+		{src: filepath.Join(dir, "kept"), dst: "opt/kept"},
+		{src: filepath.Join(dir, "normalized"), dst: "usr/normalized"},
+	}
+
+	config.Owner, config.MTime, config.Preserve = "0:0", "", []string{"/home/user", "opt/kept"}
+	config.InitialCpio, config.Build = []string{initial}, "binaries"
+	transform, err := normalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	init, err := ramfs.NewInitramfsOptions(newc.Writer(&b), ramfs.Options{Policy: dedup, Transform: transform, NoEpoch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSources(init, files, newc, func(kind, src, dst string) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := init.Close(); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := newc.Reader(bytes.NewReader(b.Bytes())).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	epoch := cpio.SourceDateEpoch()
+	own := uint64(os.Getuid())
+	want := map[string][3]uint64{
+		"home/user":          {1000, 100, 1234567},
+		"home/user/.profile": {1000, 100, 1234567},
+		"opt/kept":           {own, uint64(os.Getgid()), 7654321},
+		"home":               {0, 0, epoch},
+		"etc/profile":        {0, 0, epoch},
+		"usr/normalized":     {0, 0, epoch},
+	}
+	for _, r := range recs {
+		w, ok := want[r.Name]
+		if !ok {
+			continue
+		}
+		delete(want, r.Name)
+		if got := [3]uint64{r.UID, r.GID, r.MTime}; got != w {
+			t.Errorf("%s: uid, gid, mtime %v, want %v", r.Name, got, w)
+		}
+	}
+	for n := range want {
+		t.Errorf("%s is not in the archive", n)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(l []string, s string) { pkgList, config.Sizes = l, s }(pkgList, config.Sizes)
+	pkgList = []string{"github.com/u-root/u-root/cmds/ls"}
+
+	sz := &sizes{newc.RecordFormat, make(map[string]int64), make(map[string]int64)}
+	var b bytes.Buffer
+	w := sz.Writer(&b)
+	for _, r := range []cpio.Record{
+		cpio.Record{Info: cpio.Info{Name: "bin", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes(make([]byte, 30), cpio.Info{Name: "bin/ls", Mode: syscall.S_IFREG | 0755}),
+		cpio.NewRecordFromBytes(make([]byte, 5), cpio.Info{Name: "bin/other", Mode: syscall.S_IFREG | 0755}),
+		cpio.NewRecordFromBytes(make([]byte, 100), cpio.Info{Name: "bbin/bb", Mode: syscall.S_IFREG | 0755}),
+		cpio.NewRecordFromBytes(make([]byte, 40), cpio.Info{Name: "init", Mode: syscall.S_IFREG | 0755}),
+		cpio.NewRecordFromBytes(make([]byte, 7), cpio.Info{Name: "go/src/github.com/u-root/u-root/pkg/a/a.go", Mode: syscall.S_IFREG | 0644}),
+		cpio.NewRecordFromBytes(make([]byte, 8), cpio.Info{Name: "go/src/github.com/u-root/u-root/pkg/a/b.go", Mode: syscall.S_IFREG | 0644}),
+		cpio.NewRecordFromBytes(make([]byte, 15), cpio.Info{Name: "src/example.com/b/b.go", Mode: syscall.S_IFREG | 0644}),
+		cpio.Symlink("bin/sh", "/bbin/rush"),
+	} {
+		if err := w.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A symlink's size is that of its target.
+	wantDirs := []sizeEntry{{"bbin", 100}, {"bin", 45}, {"init", 40}, {"go", 15}, {"src", 15}}
+	wantPkgs := []sizeEntry{
+		{"(busybox)", 100},
+		{"github.com/u-root/u-root/cmds/init", 40},
+		{"github.com/u-root/u-root/cmds/ls", 30},
+		{"example.com/b", 15},
+		{"github.com/u-root/u-root/pkg/a", 15},
+	}
+	if got := sortSizes(sz.dirs); !reflect.DeepEqual(got, wantDirs) {
+		t.Errorf("by directory: got %v, want %v", got, wantDirs)
+	}
+	if got := sortSizes(sz.pkgs); !reflect.DeepEqual(got, wantPkgs) {
+		t.Errorf("by package: got %v, want %v", got, wantPkgs)
+	}
+
+	var text bytes.Buffer
+	config.Sizes = "text"
+	if err := sz.report(&text, 1024, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := `By directory:
+         100 bbin
+          45 bin
+          40 init
+          15 go
+          15 src
+By package:
+         100 (busybox)
+          40 github.com/u-root/u-root/cmds/init
+          30 github.com/u-root/u-root/cmds/ls
+          15 example.com/b
+          15 github.com/u-root/u-root/pkg/a
+Archive: 1024 bytes
+`
+	if text.String() != want {
+		t.Errorf("-sizes: got\n%s\nwant\n%s", text.String(), want)
+	}
+
+	for _, tt := range []struct {
+		compressed int64
+		fields     []string
+	}{
+		{0, []string{"Archive", "Dirs", "Packages"}},
+		{512, []string{"Archive", "Compressed", "Dirs", "Packages"}},
+	} {
+		var j bytes.Buffer
+		config.Sizes = "json"
+		if err := sz.report(&j, 1024, tt.compressed); err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(j.Bytes(), &m); err != nil {
+			t.Fatalf("-sizes=json: %v in %s", err, j.String())
+		}
+		var fields []string
+		for f := range m {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("-sizes=json with %d compressed: got fields %v, want %v", tt.compressed, fields, tt.fields)
+		}
+		var rep struct {
+			Dirs, Packages      []sizeEntry
+			Archive, Compressed int64
+		}
+		if err := json.Unmarshal(j.Bytes(), &rep); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rep.Dirs, wantDirs) || !reflect.DeepEqual(rep.Packages, wantPkgs) || rep.Archive != 1024 || rep.Compressed != tt.compressed {
+			t.Errorf("-sizes=json: got %+v", rep)
+		}
+		// The entries are objects with a Name and a Size.
+		var dirs []map[string]interface{}
+		if err := json.Unmarshal(m["Dirs"], &dirs); err != nil {
+			t.Fatal(err)
+		}
+		if d := dirs[0]; len(d) != 2 || d["Name"] != "bbin" || d["Size"] != float64(100) {
+			t.Errorf("-sizes=json: got first directory %v, want {Name: bbin, Size: 100}", d)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "root")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	file := func(name, content string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte(content), cpio.Info{Name: name, Mode: syscall.S_IFREG | 0644})
+	}
+	link := cpio.Symlink
+	// None of these may be made outside of dir.
+	e := &extractor{dir: dir}
+	for _, r := range []cpio.Record{
+		{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0555}},
+		file("../../passwd", "a"),
+		link("up", "../.."),
+		file("up/shadow", "b"),
+		link("etc/abs", "/etc"),
+		file("etc/abs/group", "c"),
+		file("etc/motd", "old"),
+		file("etc/motd", "new"),
+		{Info: cpio.Info{Name: "dev/console", Mode: syscall.S_IFCHR | 0600, Rmajor: 5, Rminor: 1}},
+		cpio.NewRecordFromBytes([]byte("d"), cpio.Info{Name: "hosts", Mode: syscall.S_IFREG | 0644, Ino: 9, NLink: 2}),
+		{Info: cpio.Info{Name: "hosts.link", Mode: syscall.S_IFREG | 0644, Ino: 9, NLink: 2}},
+		{Info: cpio.Info{Name: cpio.Trailer}},
+	} {
+		if err := e.WriteRecord(r); err != nil {
+			t.Fatalf("WriteRecord(%q): %v", r.Name, err)
+		}
+	}
+	defer os.Chmod(filepath.Join(dir, "etc"), 0755)
+
+	for name, want := range map[string]string{
+		"passwd":     "a",
+		"shadow":     "b",
+		"etc/group":  "c",
+		"etc/motd":   "new",
+		"hosts.link": "d",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(b) != want {
+			t.Errorf("%s: got %q, %v, want %q", name, b, err, want)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "etc")); err != nil || fi.Mode().Perm() != 0555 {
+		t.Errorf("etc: got %v, %v, want mode 0555", fi, err)
+	}
+	a, aerr := os.Stat(filepath.Join(dir, "hosts"))
+	b, berr := os.Stat(filepath.Join(dir, "hosts.link"))
+	if aerr != nil || berr != nil || !os.SameFile(a, b) {
+		t.Errorf("hosts.link is not a hard link to hosts: %v, %v", aerr, berr)
+	}
+	if e.n != 11 {
+		t.Errorf("got %d records, want 11", e.n)
+	}
+
+	m, err := ioutil.ReadFile(dir + ".manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(m), "\ndev/console 600 0 0 c 5 1\n") {
+		t.Errorf("manifest has no dev/console node:\n%s", m)
+	}
+}
+
+func TestExt4Image(t *testing.T) {
+	img := image{fs: "ext4"}
+	if err := img.available(); err != nil {
+		t.Skip(err)
+	}
+	var b bytes.Buffer
+	w := img.Writer(&b)
+	for _, r := range []cpio.Record{
+		{Info: cpio.Info{Name: "etc", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "etc/motd", Mode: syscall.S_IFREG | 0640, UID: 12, GID: 34}),
+		cpio.NewRecordFromBytes([]byte("motd"), cpio.Info{Name: "etc/greeting", Mode: syscall.S_IFLNK | 0777}),
+		{Info: cpio.Info{Name: "dev", Mode: syscall.S_IFDIR | 0755}},
+		{Info: cpio.Info{Name: "dev/console", Mode: syscall.S_IFCHR | 0600, Rmajor: 5, Rminor: 1}},
+		cpio.TrailerRecord,
+	} {
+		if err := w.WriteRecord(r); err != nil {
+			t.Fatalf("WriteRecord(%q): %v", r.Name, err)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	for _, tt := range []struct {
+		path string
+		want []string
+	}{
+		{"/etc/motd", []string{"Type: regular", "Mode:  0640", "User:    12", "Group:    34", "Size: 6"}},
+		{"/etc/greeting", []string{"Type: symlink", "Fast link dest: \"motd\""}},
+		{"/dev/console", []string{"Type: character special", "Mode:  0600", "User:     0", "Device major/minor number: 05:01"}},
+	} {
+		out, err := exec.Command("debugfs", "-R", "stat "+tt.path, f.Name()).Output()
+		if err != nil {
+			t.Fatalf("debugfs stat %s: %v", tt.path, err)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(string(out), w) {
+				t.Errorf("debugfs stat %s: no %q in\n%s", tt.path, w, out)
+			}
+		}
+	}
+}
+
+func TestBundle(t *testing.T) {
+	defer func() { config.Kernel, config.Cmdline, config.Bundle = "", "", "" }()
+	tmp, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	initramfs := filepath.Join(tmp, "initramfs.cpio")
+	config.Kernel = filepath.Join(tmp, "bzImage")
+	for n, c := range map[string]string{initramfs: "cpio", config.Kernel: "kernel"} {
+		if err := ioutil.WriteFile(n, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.Cmdline = "console=ttyS0"
+	want := fmt.Sprintf(`{
+	"Kernel": "bzImage",
+	"KernelSHA256": "%x",
+	"Initramfs": "initramfs.cpio",
+	"InitramfsSHA256": "%x",
+	"Cmdline": "console=ttyS0"
+}
+`, sha256.Sum256([]byte("kernel")), sha256.Sum256([]byte("cpio")))
+
+	config.Bundle = ""
+	dir, err := makeBundle(initramfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != initramfs+".bundle" {
+		t.Errorf("bundle is %s, want %s.bundle", dir, initramfs)
+	}
+	for n, c := range map[string]string{"bzImage": "kernel", "initramfs.cpio": "cpio", "bundle.json": want} {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, n)); err != nil || string(b) != c {
+			t.Errorf("%s: got %q, %v, want %q", n, b, err, c)
+		}
+	}
+
+	config.Bundle = filepath.Join(tmp, "netboot.tar")
+	if _, err := makeBundle(initramfs); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(config.Bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	archiver, err := cpio.Format("tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := archiver.Reader(f).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range recs {
+		got = append(got, r.Name)
+	}
+	if names := []string{"bzImage", "initramfs.cpio", "bundle.json"}; !reflect.DeepEqual(got, names) {
+		t.Errorf("tar bundle has %q, want %q", got, names)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	defer func() { config.Compress = "none" }()
+	tmp, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := func(name string) cpio.Record {
+		return cpio.NewRecordFromBytes([]byte("contents of "+name), cpio.Info{Name: name, Mode: syscall.S_IFREG | 0755})
+	}
+	// write writes recs with the compressor to a file and returns its
+	// name and how many records the counter saw.
+	write := func(compressor string, recs ...cpio.Record) (string, int64) {
+		config.Compress = compressor
+		c, err := compress.Get(compressor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := ioutil.TempFile(tmp, "archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		z, err := c.Writer(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := &counter{RecordFormat: newc.RecordFormat}
+		w := cpio.Archiver{RecordFormat: count}.Writer(z)
+		for _, r := range recs {
+			if err := w.WriteDuplicate(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name(), count.n
+	}
+
+	for _, tt := range []struct {
+		name       string
+		compressor string
+		recs       []cpio.Record
+		dups       bool
+		truncate   int64
+		err        string
+	}{
+		{name: "good", compressor: "none", recs: []cpio.Record{file("init"), file("bin/ls")}},
+		{name: "gzip", compressor: "gzip", recs: []cpio.Record{file("inito"), file("bin/ls")}},
+		{name: "no init", compressor: "none", recs: []cpio.Record{file("bin/ls")}, err: "no init"},
+		{name: "twice", compressor: "none", recs: []cpio.Record{file("init"), file("init")}, err: "twice"},
+		{name: "twice allowed", compressor: "none", recs: []cpio.Record{file("init"), file("init")}, dups: true},
+		{name: "short contents", compressor: "none", recs: []cpio.Record{file("bin/ls"), file("init")}, truncate: 132, err: "init: size 16 is more than is left"},
+		{name: "no trailer", compressor: "none", recs: []cpio.Record{file("init"), file("bin/ls")}, truncate: 124, err: "without a trailer"},
+		{name: "cut trailer", compressor: "none", recs: []cpio.Record{file("init"), file("bin/ls")}, truncate: 120, err: "want 110 bytes"},
+	} {
+		name, n := write(tt.compressor, tt.recs...)
+		if tt.truncate > 0 {
+			fi, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(name, fi.Size()-tt.truncate); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c, err := compress.Get(tt.compressor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = verify(name, newc, c, n, tt.dups)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	defer func() { config.ManifestAt, config.Owner, config.MTime = "", "", "" }()
+	config.ManifestAt, config.Owner, config.MTime = "/etc/manifest.jsonl", "7:8", "99"
+	transform, err := normalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newc, err := cpio.Format("newc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(recs ...cpio.Record) (*recordHasher, []byte, error) {
+		h := &recordHasher{RecordFormat: newc.RecordFormat}
+		var b bytes.Buffer
+		init, err := ramfs.NewInitramfsOptions(cpio.Archiver{RecordFormat: h}.Writer(&b), ramfs.Options{Policy: ramfs.DedupError, Transform: transform, NoEpoch: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range recs {
+			if err := init.WriteRecord(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writeManifest(init, h); err != nil {
+			return nil, nil, err
+		}
+		return h, b.Bytes(), init.Close()
+	}
+
+	h, b, err := write(
+		cpio.Record{Info: cpio.Info{Name: "bin", Mode: syscall.S_IFDIR | 0755}},
+		cpio.NewRecordFromBytes([]byte("hello\n"), cpio.Info{Name: "bin/motd", Mode: syscall.S_IFREG | 0640, UID: 12, GID: 34}),
+		cpio.NewRecordFromBytes([]byte("motd"), cpio.Info{Name: "bin/greeting", Mode: syscall.S_IFLNK | 0777}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The records are listed as -owner left them, and the manifest
+	// lists neither itself nor etc, which is made for it.
+	want := fmt.Sprintf(`{"Path":"bin","Size":0,"Mode":16877,"UID":7,"GID":8}
+{"Path":"bin/motd","SHA256":"%x","Size":6,"Mode":33184,"UID":7,"GID":8}
+{"Path":"bin/greeting","Size":4,"Mode":41471,"UID":7,"GID":8,"Target":"motd"}
+`, sha256.Sum256([]byte("hello\n")))
+	recs, err := newc.Reader(bytes.NewReader(b)).ReadRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range recs {
+		names = append(names, r.Name)
+	}
+	if want := []string{"bin", "bin/motd", "bin/greeting", "etc", "etc/manifest.jsonl"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("archive has %q, want %q", names, want)
+	}
+	m := recs[4]
+	if got, err := ioutil.ReadAll(m); err != nil || string(got) != want {
+		t.Errorf("%s: got\n%s%v\nwant\n%s", m.Name, got, err, want)
+	}
+	if m.UID != 7 || m.GID != 8 || m.MTime != 99 {
+		t.Errorf("%s: got uid %d, gid %d, mtime %d, want 7, 8, 99", m.Name, m.UID, m.GID, m.MTime)
+	}
+
+	// The -manifest file, written after, has everything.
+	if got := len(h.entries); got != 5 {
+		t.Errorf("-manifest: got %d entries, want 5", got)
+	}
+
+	// A record at the path already is a clash, like any other.
+	if _, _, err := write(cpio.NewRecordFromBytes([]byte("mine\n"), cpio.Info{Name: "etc/manifest.jsonl", Mode: syscall.S_IFREG | 0644})); err == nil {
+		t.Errorf("-manifest-at over a file: got nil, want an error")
+	}
+}
+
+func TestSignOutput(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	name := filepath.Join(tmp, "initramfs.cpio")
+	if err := ioutil.WriteFile(name, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signOutput(name, priv, pub); err != nil {
+		t.Fatalf("signOutput: %v", err)
+	}
+	sig, err := ioutil.ReadFile(name + ".sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := sha256.Sum256([]byte("archive"))
+	if !ed25519.Verify(pub, d[:], sig) {
+		t.Errorf("%s.sig does not verify", name)
+	}
+	if err := signOutput(name, priv, other); err == nil {
+		t.Errorf("signOutput with the wrong -verify-key: got nil, want an error")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := config
+	defer func(a []string) { config, os.Args = saved, a }(os.Args)
+
+	for _, tt := range []struct {
+		name string
+		json string
+		args []string
+		err  string
+		// check returns what is wrong with config, if anything.
+		check func() string
+	}{
+		{
+			name: "file",
+			json: `{"Output": "/tmp/file.cpio", "Compress": "gzip", "Keep": true, "Files": ["f1:a", "f2:b"], "Packages": ["cmds/ls"]}`,
+			check: func() string {
+				if config.Output != "/tmp/file.cpio" || config.Compress != "gzip" || !config.Keep ||
+					!reflect.DeepEqual(config.Files, []string{"f1:a", "f2:b"}) || !reflect.DeepEqual(config.Packages, []string{"cmds/ls"}) {
+					return "the file's settings were not all used"
+				}
+				return ""
+			},
+		},
+		{
+			name: "flags win",
+			json: `{"Output": "/tmp/file.cpio", "Compress": "gzip", "Keep": true, "Files": ["f1:a", "f2:b"], "Symlinks": ["bin/sh:rush"], "Packages": ["cmds/ls"]}`,
+			args: []string{"-o", "/tmp/flag.cpio", "-keep=false", "-files", "f3:c", "cmds/echo"},
+			check: func() string {
+				switch {
+				case config.Output != "/tmp/flag.cpio":
+					return "-o did not win"
+				case config.Keep:
+					return "-keep=false did not win"
+				case !reflect.DeepEqual(config.Files, []string{"f3:c"}):
+					return "-files did not replace the file's Files"
+				case !reflect.DeepEqual(config.Packages, []string{"cmds/echo"}):
+					return "the packages given did not replace the file's"
+				case config.Compress != "gzip" || !reflect.DeepEqual(config.Symlinks, []string{"bin/sh:rush"}):
+					return "the settings not given as flags were lost"
+				}
+				return ""
+			},
+		},
+		{
+			name: "unknown key",
+			json: `{"Output": "/tmp/file.cpio", "Outptu": "/tmp/typo.cpio"}`,
+			err:  `unknown field "Outptu"`,
+		},
+		{
+			name: "wrong type",
+			json: `{"Keep": "yes"}`,
+			err:  "Keep",
+		},
+		{
+			name: "not JSON",
+			json: `Output = /tmp/file.cpio`,
+			err:  "invalid character",
+		},
+	} {
+		config = saved
+		name := filepath.Join(dir, "config.json")
+		if err := ioutil.WriteFile(name, []byte(tt.json), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// As main does it.
+		os.Args = append([]string{"ramfs"}, tt.args...)
+		if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+			t.Fatal(err)
+		}
+		config.Packages = flag.Args()
+		err := loadConfig(name)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error with %q", tt.name, err, tt.err)
+		case tt.check != nil:
+			if s := tt.check(); s != "" {
+				t.Errorf("%s: %s: config is %+v", tt.name, s, config)
+			}
+		}
+	}
+	if err := loadConfig(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("loadConfig of a missing file: got nil, want an error")
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want verbosity
+		err  bool
+	}{
+		{"true", 2, false},
+		{"false", 1, false},
+		{"0", 0, false},
+		{"3", 3, false},
+		{"4", 0, true},
+		{"loud", 0, true},
+	} {
+		var v verbosity
+		err := v.Set(tt.in)
+		if (err != nil) != tt.err || v != tt.want {
+			t.Errorf("Set(%q): got %d, %v, want %d, error %v", tt.in, v, err, tt.want, tt.err)
+		}
+	}
+
+	// -config files from when -v was a bool still work.
+	var c struct{ Verbose verbosity }
+	for in, want := range map[string]verbosity{`{"Verbose": true}`: 2, `{"Verbose": 3}`: 3} {
+		if err := json.Unmarshal([]byte(in), &c); err != nil || c.Verbose != want {
+			t.Errorf("Unmarshal(%s): got %d, %v, want %d", in, c.Verbose, err, want)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	defer func() { config.Strict, skipped = true, nil }()
+	gopath, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+	n := filepath.Join(gopath, "src/example.com/good/good.go")
+	if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(n, []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.Goos, config.Arch, config.Goarm = "", "", ""
+	config.Gopath = gopath
+	config.Goroot = runtime.GOROOT()
+	guessplatform()
+
+	for _, strict := range []bool{true, false} {
+		config.Strict, skipped = strict, nil
+		deps = make(map[string]bool)
+		gorootFiles = make(map[string]bool)
+		urootFiles = make(map[string]bool)
+		goList, urootList = nil, nil
+		pkgList = []string{"example.com/good", "example.com/missing"}
+		err := addGoFiles()
+		if strict {
+			if err == nil || !strings.Contains(err.Error(), "go list example.com/missing") {
+				t.Errorf("-strict: got %v, want an error about example.com/missing", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-strict=false: got %v, want nil", err)
+		}
+		if !reflect.DeepEqual(skipped, []string{"example.com/missing"}) {
+			t.Errorf("-strict=false: skipped %q, want example.com/missing", skipped)
+		}
+		if !reflect.DeepEqual(urootList, []string{"src/example.com/good/good.go"}) {
+			t.Errorf("-strict=false: got %q, want good.go", urootList)
+		}
+	}
+}
+
+func TestModuleFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// x embeds a file in a subdirectory and imports a package of the
+	// module; broken imports a package the module does not have.
+	for n, c := range map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.16\n",
+		"cmds/x/x.go": `package main
+
+import (
+	_ "embed"
+
+	"example.com/m/lib"
+)
+
+//go:embed data/motd
+var motd string
+
+func main() { lib.F(motd) }
+`,
+		"cmds/x/data/motd":      "hello\n",
+		"lib/lib.go":            "package lib\n\nfunc F(string) {}\n",
+		"cmds/broken/broken.go": "package main\n\nimport _ \"example.com/m/missing\"\n\nfunc main() {}\n",
+	} {
+		n = filepath.Join(dir, n)
+		if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(n, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"GO111MODULE": "on", "GOFLAGS": "-mod=mod", "GOPROXY": "off"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	saved := module
+	defer func() { module, config.Strict, config.GoList, skipped = saved, true, false, nil }()
+
+	config.Goos, config.Arch, config.Goarm = "", "", ""
+	config.Gopath = ""
+	config.Goroot = runtime.GOROOT()
+	guessplatform()
+	if err := guessmodule(); err != nil {
+		t.Fatal(err)
+	}
+	if module.Path != "example.com/m" {
+		t.Fatalf("guessmodule: got %q, want example.com/m", module.Path)
+	}
+
+	want := map[string]string{
+		"src/example.com/m/cmds/x/x.go":      filepath.Join(dir, "cmds/x/x.go"),
+		"src/example.com/m/cmds/x/data/motd": filepath.Join(dir, "cmds/x/data/motd"),
+		"src/example.com/m/lib/lib.go":       filepath.Join(dir, "lib/lib.go"),
+	}
+	for _, golist := range []bool{false, true} {
+		for _, strict := range []bool{true, false} {
+			config.Strict, config.GoList, skipped = strict, golist, nil
+			deps = make(map[string]bool)
+			gorootFiles = make(map[string]bool)
+			urootFiles = make(map[string]bool)
+			moduleFiles = make(map[string]string)
+			goList, urootList = nil, nil
+			pkgList = []string{"example.com/m/cmds/x", "example.com/m/cmds/broken"}
+			err := addGoFiles()
+			if strict {
+				if err == nil || !strings.Contains(err.Error(), "example.com/m/cmds/broken") {
+					t.Errorf("-golist=%v -strict: got %v, want an error about example.com/m/cmds/broken", golist, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("-golist=%v -strict=false: got %v, want nil", golist, err)
+				continue
+			}
+			if !reflect.DeepEqual(skipped, []string{"example.com/m/cmds/broken"}) {
+				t.Errorf("-golist=%v -strict=false: skipped %q, want example.com/m/cmds/broken", golist, skipped)
+			}
+			if !reflect.DeepEqual(moduleFiles, want) {
+				t.Errorf("-golist=%v -strict=false: got %q, want %q", golist, moduleFiles, want)
+			}
+			if len(urootList) != 0 {
+				t.Errorf("-golist=%v -strict=false: got uroot files %q, want none", golist, urootList)
+			}
+			if i := sort.SearchStrings(goList, "src/runtime/proc.go"); i == len(goList) || goList[i] != "src/runtime/proc.go" {
+				t.Errorf("-golist=%v -strict=false: src/runtime/proc.go not in %d GOROOT files", golist, len(goList))
+			}
+		}
+	}
+}
+
+func TestExclude(t *testing.T) {
+	defer func() { config.Excludes = nil }()
+	gopath, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+	for n, c := range map[string]string{
+		"example.com/app/app.go":     "package main\n\nimport \"example.com/lib\"\n\nfunc main() { lib.F() }\n",
+		"example.com/lib/lib.go":     "package lib\n\nfunc F() {}\n",
+		"example.com/other/other.go": "package main\n\nimport \"example.com/only\"\n\nfunc main() { only.F() }\n",
+		"example.com/only/only.go":   "package only\n\nfunc F() {}\n",
+	} {
+		n = filepath.Join(gopath, "src", n)
+		if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(n, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.Goos, config.Arch, config.Goarm = "", "", ""
+	config.Gopath = gopath
+	config.Goroot = runtime.GOROOT()
+	guessplatform()
+
+	for _, tt := range []struct {
+		excludes []string
+		want     []string
+	}{
+		{nil, []string{"app", "lib", "only", "other"}},
+		// Nothing other alone pulls in is there either.
+		{[]string{"example.com/other"}, []string{"app", "lib"}},
+		// Without a /, the last element is matched.
+		{[]string{"lib"}, []string{"app", "only", "other"}},
+		{[]string{"o*"}, []string{"app", "lib"}},
+	} {
+		config.Excludes = tt.excludes
+		deps = make(map[string]bool)
+		gorootFiles = make(map[string]bool)
+		urootFiles = make(map[string]bool)
+		goList, urootList = nil, nil
+		pkgList = []string{"example.com/app", "example.com/other"}
+		if err := addGoFiles(); err != nil {
+			t.Errorf("-exclude %q: %v", tt.excludes, err)
+			continue
+		}
+		var want []string
+		for _, p := range tt.want {
+			want = append(want, fmt.Sprintf("src/example.com/%s/%s.go", p, p))
+		}
+		if !reflect.DeepEqual(urootList, want) {
+			t.Errorf("-exclude %q: got %q, want %q", tt.excludes, urootList, want)
+		}
+	}
+}
+
+func TestLoadPkgs(t *testing.T) {
+	config.Goos, config.Arch, config.Goarm = "", "", ""
+	config.Goroot = runtime.GOROOT()
+	guessplatform()
+
+	// net/http has packages vendored in GOROOT, runtime has assembly
+	// and headers, and traceviewer embeds files in a subdirectory.
+	byPath := func(ps []*goPackage) map[string]goPackage {
+		m := make(map[string]goPackage)
+		for _, p := range ps {
+			m[p.ImportPath] = *p
+		}
+		return m
+	}
+	want, err := goListPkgs(true, "net/http", "internal/trace/traceviewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadPkgs(true, "net/http", "internal/trace/traceviewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, g := byPath(want), byPath(got)
+	if len(g) != len(w) {
+		t.Errorf("loadPkgs found %d packages, go list %d", len(g), len(w))
+	}
+	for n, wp := range w {
+		if gp := g[n]; !reflect.DeepEqual(gp, wp) {
+			t.Errorf("%s: loadPkgs got %+v, go list %+v", n, gp, wp)
+		}
+	}
+}
+
+func BenchmarkAddGoFiles(b *testing.B) {
+	gopath := os.Getenv("GOPATH")
+	if gopath == "" {
+		b.Skip("GOPATH is not set")
+	}
+	g, err := filepath.Glob(filepath.Join(gopath, "src/github.com/u-root/u-root/cmds/*"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var cmds []string
+	for _, v := range g {
+		if fi, err := os.Stat(v); err != nil || !fi.IsDir() {
+			continue
+		}
+		cmds = append(cmds, strings.TrimPrefix(v, filepath.Join(gopath, "src")+"/"))
+	}
+	config.Goos, config.Arch, config.Goarm = "", "", ""
+	config.Gopath = gopath
+	config.Goroot = runtime.GOROOT()
+	guessplatform()
+
+	for i := 0; i < b.N; i++ {
+		deps = make(map[string]bool)
+		gorootFiles = make(map[string]bool)
+		urootFiles = make(map[string]bool)
+		goList, urootList = nil, nil
+		pkgList = cmds
+		if err := addGoFiles(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package uroot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+type Mount struct {
+	Source string
+	Target string
+	FSType string
+	Flags  uintptr
+	Opts   string
+	// Required is whether the system can not do without the mount, as
+	// it can not without /proc or /dev.
+	Required bool
+}
+
+// Create mounts m, after making the directory it is mounted on, unless
+// something is mounted there already, e.g. by an earlier initramfs.
+func (m Mount) Create() error {
+	if mounted(m.Target) {
+		return nil
+	}
+	if err := os.MkdirAll(m.Target, 0755); err != nil {
+		return err
+	}
+	return syscall.Mount(m.Source, m.Target, m.FSType, m.Flags, m.Opts)
+}
+
+func (m Mount) String() string {
+	return fmt.Sprintf("mount -t %q -o %s %q %q flags %#x", m.FSType, m.Opts, m.Source, m.Target, m.Flags)
+}
+
+// Mounts are the file systems Rootfs mounts, in order.
+var Mounts = []Mount{
+	{Source: "proc", Target: "/proc", FSType: "proc", Flags: syscall.MS_MGC_VAL, Required: true},
+	{Source: "sys", Target: "/sys", FSType: "sysfs", Flags: syscall.MS_MGC_VAL},
+	{Source: "cgroup", Target: "/sys/fs/cgroup", FSType: "tmpfs", Flags: syscall.MS_MGC_VAL},
+	{Source: "none", Target: "/tmp", FSType: "tmpfs", Flags: syscall.MS_MGC_VAL},
+	// Kernel must be compiled with CONFIG_DEVTMPFS; a static /dev, e.g.
+	// from Dev.cpio, needs an Fstab without it.
+	{Source: "none", Target: "/dev", FSType: "devtmpfs", Flags: syscall.MS_MGC_VAL, Required: true},
+	{Source: "none", Target: "/dev/pts", FSType: "devpts", Flags: syscall.MS_MGC_VAL, Opts: "newinstance,ptmxmode=666,gid=5,mode=620"},
+	{Source: "cgroup", Target: "/sys/fs/cgroup/memory", FSType: "cgroup", Flags: syscall.MS_MGC_VAL, Opts: "memory"},
+	{Source: "cgroup", Target: "/sys/fs/cgroup/freezer", FSType: "cgroup", Flags: syscall.MS_MGC_VAL, Opts: "freezer"},
+	{Source: "cgroup", Target: "/sys/fs/cgroup/devices", FSType: "cgroup", Flags: syscall.MS_MGC_VAL, Opts: "devices"},
+	{Source: "cgroup", Target: "/sys/fs/cgroup/cpu,cpuacct", FSType: "cgroup", Flags: syscall.MS_MGC_VAL, Opts: "cpu,cpuacct"},
+}
+
+// mountFlags are the fstab options that are mount flags. The rest are
+// passed to the file system.
+var mountFlags = map[string]uintptr{
+	"defaults":    0,
+	"auto":        0,
+	"rw":          0,
+	"ro":          syscall.MS_RDONLY,
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"sync":        syscall.MS_SYNCHRONOUS,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+	"bind":        syscall.MS_BIND,
+	"rbind":       syscall.MS_BIND | syscall.MS_REC,
+}
+
+// ApplyFstab returns mounts, changed by the fstab(5) lines read from r.
+// Each line is
+//
+//	source target fstype [options [dump [pass]]]
+//
+// and mounts source on target in place of what mounts has there, or after
+// the rest if there is nothing. A mount of a line is Required unless it
+// has the nofail option, and one with the noauto option is left out, so
+//
+//	none /dev devtmpfs noauto
+//
+// keeps a static /dev. The dump and pass fields are ignored.
+func ApplyFstab(mounts []Mount, r io.Reader) ([]Mount, error) {
+	mounts = append([]Mount(nil), mounts...)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if len(f) < 3 || len(f) > 6 {
+			return nil, fmt.Errorf("line %d: %q is not source target fstype [options [dump [pass]]]", n, s.Text())
+		}
+		m := Mount{Source: unescape(f[0]), Target: filepath.Clean(unescape(f[1])), FSType: f[2], Flags: syscall.MS_MGC_VAL, Required: true}
+		noauto := false
+		if len(f) > 3 {
+			var opts []string
+			for _, o := range strings.Split(f[3], ",") {
+				switch flag, ok := mountFlags[o]; {
+				case ok:
+					m.Flags |= flag
+				case o == "nofail":
+					m.Required = false
+				case o == "noauto":
+					noauto = true
+				case o != "":
+					opts = append(opts, o)
+				}
+			}
+			m.Opts = strings.Join(opts, ",")
+		}
+		if noauto {
+			mounts = WithoutMounts(mounts, m.Target)
+			continue
+		}
+		i := 0
+		for ; i < len(mounts) && mounts[i].Target != m.Target; i++ {
+		}
+		if i == len(mounts) {
+			mounts = append(mounts, m)
+		} else {
+			mounts[i] = m
+		}
+	}
+	return mounts, s.Err()
+}
+
+// WithoutMounts returns mounts without those on targets.
+func WithoutMounts(mounts []Mount, targets ...string) []Mount {
+	var w []Mount
+	for _, m := range mounts {
+		keep := true
+		for _, t := range targets {
+			if filepath.Clean(t) == filepath.Clean(m.Target) {
+				keep = false
+			}
+		}
+		if keep {
+			w = append(w, m)
+		}
+	}
+	return w
+}
+
+// unescape returns s, of /proc/mounts or fstab, with the octal escapes of
+// spaces, tabs, newlines and backslashes undone.
+func unescape(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+// mounted reports whether something is mounted on target, as /proc/mounts
+// says. Without /proc, nothing is.
+func mounted(target string) bool {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return false
+	}
+	b, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return false
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if f := strings.Fields(l); len(f) > 1 && unescape(f[1]) == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package uroot
+
+import (
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestApplyFstab(t *testing.T) {
+	base := []Mount{
+		{Source: "proc", Target: "/proc", FSType: "proc", Flags: syscall.MS_MGC_VAL, Required: true},
+		{Source: "none", Target: "/tmp", FSType: "tmpfs", Flags: syscall.MS_MGC_VAL},
+		{Source: "none", Target: "/dev", FSType: "devtmpfs", Flags: syscall.MS_MGC_VAL, Required: true},
+	}
+	for _, tt := range []struct {
+		name  string
+		fstab string
+		want  []Mount
+		err   bool
+	}{
+		{name: "empty", want: base},
+		{name: "comments", fstab: "# static /dev\n\n  # none\n", want: base},
+		{
+			name:  "replace and add",
+			fstab: "none /tmp/ tmpfs size=1g,nosuid,nodev,nofail 0 0\nefivarfs /sys/firmware/efi/efivars efivarfs ro,nofail\nnone /run tmpfs mode=0755,size=64m\n",
+			want: []Mount{
+				base[0],
+				{Source: "none", Target: "/tmp", FSType: "tmpfs", Flags: syscall.MS_MGC_VAL | syscall.MS_NOSUID | syscall.MS_NODEV, Opts: "size=1g"},
+				base[2],
+				{Source: "efivarfs", Target: "/sys/firmware/efi/efivars", FSType: "efivarfs", Flags: syscall.MS_MGC_VAL | syscall.MS_RDONLY},
+				{Source: "none", Target: "/run", FSType: "tmpfs", Flags: syscall.MS_MGC_VAL, Opts: "mode=0755,size=64m", Required: true},
+			},
+		},
+		{name: "noauto", fstab: "none /dev devtmpfs noauto\n", want: base[:2]},
+		{name: "escapes", fstab: `/dev/sda1 /mnt/my\040disk ext4 defaults`, want: append(base[:3:3], Mount{Source: "/dev/sda1", Target: "/mnt/my disk", FSType: "ext4", Flags: syscall.MS_MGC_VAL, Required: true})},
+		{name: "short", fstab: "none /run\n", err: true},
+		{name: "long", fstab: "none /run tmpfs defaults 0 0 0\n", err: true},
+	} {
+		got, err := ApplyFstab(base, strings.NewReader(tt.fstab))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got %v, want an error: %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got\n%+v\nwant\n%+v", tt.name, got, tt.want)
+		}
+	}
+	if base[1].Opts != "" {
+		t.Errorf("ApplyFstab changed the mounts it was given")
+	}
+}
+
+func TestWithoutMounts(t *testing.T) {
+	got := WithoutMounts(Mounts, "/dev/", "/sys/fs/cgroup/memory", "/nothing")
+	if len(got) != len(Mounts)-2 {
+		t.Errorf("got %d mounts, want %d", len(got), len(Mounts)-2)
+	}
+	for _, m := range got {
+		if m.Target == "/dev" || m.Target == "/sys/fs/cgroup/memory" {
+			t.Errorf("%s is still there", m.Target)
+		}
+	}
+}
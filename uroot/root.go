@@ -14,16 +14,22 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 )
 
 const (
 	// Not all these paths may be populated or even exist but OTOH they might.
-	PATHHEAD = "/ubin"
+	PATHHEAD = "/ubin:/bbin"
 	PATHMID  = "/usr/sbin:/usr/bin:/sbin:/bin:/usr/local/bin:/usr/local/sbin"
 	PATHTAIL = "/buildbin"
 	CmdsPath = "github.com/u-root/u-root/cmds"
+	// CmdsList lists the import paths, one per line, of the commands in
+	// /src that are not in CmdsPath, for those not at /src/*/*/name.
+	CmdsList = "/etc/u-root/cmds"
+	// Fstab changes the Mounts init makes; see ApplyFstab.
+	Fstab = "/etc/u-root/fstab"
 )
 
 type Creator interface {
@@ -102,22 +108,6 @@ func (d Dev) String() string {
 	return fmt.Sprintf("dev :%q: mode: %#o: magic: %v", d.Name, d.Mode, d.Dev)
 }
 
-type Mount struct {
-	Source string
-	Target string
-	FSType string
-	Flags  uintptr
-	Opts   string
-}
-
-func (m Mount) Create() error {
-	return syscall.Mount(m.Source, m.Target, m.FSType, m.Flags, m.Opts)
-}
-
-func (m Mount) String() string {
-	return fmt.Sprintf("mount -t %q -o %s %q %q flags %#x", m.FSType, m.Opts, m.Source, m.Target, m.Flags)
-}
-
 var (
 	Profile string
 	Envs    []string
@@ -127,6 +117,9 @@ var (
 		"GOPATH":          "/",
 		"GOBIN":           "/ubin",
 		"CGO_ENABLED":     "0",
+		// Sources are laid out GOPATH-style under /src, even when
+		// the archive was built from a module.
+		"GO111MODULE": "off",
 	}
 
 	namespace = []Creator{
@@ -149,54 +142,36 @@ var (
 		Dev{Name: "/dev/tty", Mode: uint32(syscall.S_IFCHR) | 0666, Dev: 0x0500},
 		Dev{Name: "/dev/urandom", Mode: uint32(syscall.S_IFCHR) | 0444, Dev: 0x0109},
 		Dev{Name: "/dev/port", Mode: uint32(syscall.S_IFCHR) | 0640, Dev: 0x0104},
-		Mount{Source: "proc", Target: "/proc", FSType: "proc", Flags: syscall.MS_MGC_VAL, Opts: ""},
-		Mount{Source: "sys", Target: "/sys", FSType: "sysfs", Flags: syscall.MS_MGC_VAL, Opts: ""},
-		Mount{Source: "cgroup", Target: "/sys/fs/cgroup", FSType: "tmpfs", Flags: syscall.MS_MGC_VAL, Opts: ""},
-		Mount{Source: "none", Target: "/tmp", FSType: "tmpfs", Flags: syscall.MS_MGC_VAL, Opts: ""},
-		// Kernel must be compiled with CONFIG_DEVTMPFS, otherwise
-		// default to contents of Dev.cpio.
-		Mount{Source: "none", Target: "/dev", FSType: "devtmpfs", Flags: syscall.MS_MGC_VAL},
-		Dir{Name: "/dev/pts", Mode: os.FileMode(0777)},
-		Mount{Source: "none", Target: "/dev/pts", FSType: "devpts", Flags: syscall.MS_MGC_VAL, Opts: "newinstance,ptmxmode=666,gid=5,mode=620"},
+	}
+
+	// links are made after the Mounts, in what they mount.
+	links = []Creator{
 		Symlink{Linkpath: "/dev/pts/ptmx", Target: "/dev/ptmx"},
 		File{Name: "/etc/resolv.conf", Contents: `nameserver 8.8.8.8`, Mode: os.FileMode(0644)},
-		Dir{Name: "/sys/fs/cgroup/memory", Mode: os.FileMode(0555)},
-		Dir{Name: "/sys/fs/cgroup/freezer", Mode: os.FileMode(0555)},
-		Dir{Name: "/sys/fs/cgroup/devices", Mode: os.FileMode(0555)},
-		Dir{Name: "/sys/fs/cgroup/cpu,cpuacct", Mode: os.FileMode(0555)},
 		Symlink{Linkpath: "/sys/fs/cgroup/cpu,cpuacct", Target: "/sys/fs/cgroup/cpu"},
 		Symlink{Linkpath: "/sys/fs/cgroup/cpu,cpuacct", Target: "/sys/fs/cgroup/cpuacct"},
-		Mount{Source: "cgroup", Target: "/sys/fs/cgroup/memory", FSType: "cgroup", Flags: syscall.MS_MGC_VAL, Opts: "memory"},
-		Mount{Source: "cgroup", Target: "/sys/fs/cgroup/freezer", FSType: "cgroup", Flags: syscall.MS_MGC_VAL, Opts: "freezer"},
-		Mount{Source: "cgroup", Target: "/sys/fs/cgroup/devices", FSType: "cgroup", Flags: syscall.MS_MGC_VAL, Opts: "devices"},
-		Mount{Source: "cgroup", Target: "/sys/fs/cgroup/cpu,cpuacct", FSType: "cgroup", Flags: syscall.MS_MGC_VAL, Opts: "cpu,cpuacct"},
 	}
 )
 
 // build the root file system.
 func Rootfs() {
-	// Pick some reasonable values in the (unlikely!) even that Uname fails.
-	uname := "linux"
-	mach := "amd64"
+	if err := RootfsMounts(Mounts); err != nil {
+		log.Print(err)
+	}
+}
+
+// RootfsMounts builds the root file system, as Rootfs does, with mounts in
+// place of Mounts. A mount that fails is warned about, unless it is
+// Required, which is an error once the rest is done.
+func RootfsMounts(mounts []Mount) error {
 	// There are three possible places for go:
 	// The first is in /go/bin/$OS_$ARCH
 	// The second is in /go/bin [why they still use this path is anyone's guess]
 	// The third is in /go/pkg/tool/$OS_$ARCH
-	if u, err := Uname(); err != nil {
-		log.Printf("uroot.Utsname fails: %v, so assume %v_%v\n", err, uname, mach)
-	} else {
-		// Sadly, go and the OS disagree on many things.
-		uname = strings.ToLower(u.Sysname)
-		mach = strings.ToLower(u.Machine)
-		// Yes, we really have to do this stupid thing.
-		if mach[0:3] == "arm" {
-			mach = "arm"
-		}
-		if mach == "x86_64" {
-			mach = "amd64"
-		}
-	}
-	goPath := fmt.Sprintf("/go/bin/%s_%s:/go/bin:/go/pkg/tool/%s_%s", uname, mach, uname, mach)
+	// We were built for the same GOOS and GOARCH as the toolchain, so
+	// there is no need to guess them from uname, which gets e.g. aarch64
+	// wrong.
+	goPath := fmt.Sprintf("/go/bin/%s_%s:/go/bin:/go/pkg/tool/%s_%s", runtime.GOOS, runtime.GOARCH, runtime.GOOS, runtime.GOARCH)
 	env["PATH"] = fmt.Sprintf("%v:%v:%v:%v", goPath, PATHHEAD, PATHMID, PATHTAIL)
 
 	for k, v := range env {
@@ -218,17 +193,25 @@ func Rootfs() {
 	// tmpfs. There's no good way to do this on linux. The closest we can get for now
 	// is to mount a tmpfs of /go/pkg/%s_%s :-(
 	// Same applies to ubin. Each user should have their own.
-	Profile += fmt.Sprintf("sudo mount -t tmpfs none /go/pkg/%s_%s\n", uname, mach)
+	Profile += fmt.Sprintf("sudo mount -t tmpfs none /go/pkg/%s_%s\n", runtime.GOOS, runtime.GOARCH)
 	Profile += fmt.Sprintf("sudo mount -t tmpfs none /ubin\n")
 	Profile += fmt.Sprintf("sudo mount -t tmpfs none /pkg\n")
 
-	for _, c := range namespace {
-		if err := c.Create(); err != nil {
-			log.Printf("Error creating %s: %v", c, err)
+	create(namespace)
+	var failed []string
+	for _, m := range mounts {
+		if err := m.Create(); err != nil {
+			if m.Required {
+				log.Printf("Error creating %s: %v", m, err)
+				failed = append(failed, m.Target)
+			} else {
+				log.Printf("Warning: creating %s: %v", m, err)
+			}
 		} else {
-			log.Printf("Created %v", c)
+			log.Printf("Created %v", m)
 		}
 	}
+	create(links)
 
 	// only in case of emergency.
 	if false {
@@ -244,4 +227,18 @@ func Rootfs() {
 			log.Printf("WALK fails %v\n", err)
 		}
 	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not mount %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func create(cs []Creator) {
+	for _, c := range cs {
+		if err := c.Create(); err != nil {
+			log.Printf("Error creating %s: %v", c, err)
+		} else {
+			log.Printf("Created %v", c)
+		}
+	}
 }